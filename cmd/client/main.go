@@ -1,24 +1,38 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/net/websocket"
+	"golang.org/x/sys/unix"
 
 	"github.com/abshkbh/arrakis/out/gen/serverapi"
 	"github.com/abshkbh/arrakis/pkg/config"
 )
 
+// Ctrl-], detaches from a console as in telnet.
+const consoleEscapeByte = 0x1d
+
 var (
 	apiClient *serverapi.APIClient
+	// Base URL of the server for the endpoints the generated client can't handle, i.e. streams and
+	// asynchronous requests.
+	serverURL string
 )
 
 // parseErrorResponse attempts to parse the HTTP response body as an ErrorResponse.
@@ -71,17 +85,142 @@ func destroyVM(vmName string) error {
 	return nil
 }
 
-func destroyAllVMs() error {
-	_, httpResp, err := apiClient.DefaultAPI.V1VmsDelete(context.Background()).Execute()
+func destroyAllVMs(selector string) error {
+	req := apiClient.DefaultAPI.V1VmsDelete(context.Background())
+	if selector != "" {
+		req = req.Selector(selector)
+	}
+	resp, httpResp, err := req.Execute()
 	if err != nil {
 		return parseErrorResponse("destroy all VMs", httpResp, err)
 	}
 
-	log.Infof("destroyed all VMs")
+	log.Infof("destroyed VMs: %v", resp.GetVmNames())
 	return nil
 }
 
-func startVM(vmName string, kernel string, rootfs string, entryPoint string, snapshotId string) error {
+// parseLabels parses labels given as key=value.
+func parseLabels(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		key, value, found := strings.Cut(spec, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid label, expected key=value: %s", spec)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+func printCrash(crash *serverapi.VMCrash) {
+	if crash == nil {
+		return
+	}
+	fmt.Printf("Last Crash: %s", crash.GetCrashedAt().Format(time.RFC3339))
+	if crash.HasExitStatus() {
+		fmt.Printf(" (%s)", crash.GetExitStatus())
+	}
+	fmt.Printf(", restarted %d times\n", crash.GetRestarts())
+	if crash.GetLogTail() != "" {
+		fmt.Println("Log:")
+		fmt.Println(crash.GetLogTail())
+	}
+}
+
+func printDisk(disk serverapi.VMDisk) {
+	source := "fresh"
+	if disk.HasImage() {
+		source = "image " + disk.GetImage()
+	}
+	if disk.HasVolume() {
+		source = "volume " + disk.GetVolume()
+	}
+	mode := "rw"
+	if disk.GetReadonly() {
+		mode = "ro"
+	}
+	fmt.Printf("  %s: %d MB, %s, %s, mounted at %s\n",
+		disk.GetId(),
+		disk.GetSizeMB(),
+		source,
+		mode,
+		disk.GetMountPoint())
+}
+
+func printLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Println("Labels:")
+	for _, key := range keys {
+		fmt.Printf("  %s=%s\n", key, labels[key])
+	}
+}
+
+// vmResources holds the optional sizing of a VM passed to `startVM`. Zero values are left to the
+// server to decide.
+type vmResources struct {
+	vcpus              int32
+	memorySizeMB       int32
+	statefulDiskSizeMB int32
+}
+
+// vmVolumes holds the optional volumes passed to `startVM`.
+type vmVolumes struct {
+	// Volume used as the stateful disk of the VM.
+	root string
+	// Volumes attached as extra disks.
+	mounts []serverapi.VolumeMount
+}
+
+// parseVolumeMounts parses volumes given as name or name:ro.
+func parseVolumeMounts(specs []string) ([]serverapi.VolumeMount, error) {
+	mounts := make([]serverapi.VolumeMount, 0, len(specs))
+	for _, spec := range specs {
+		name, mode, found := strings.Cut(spec, ":")
+		if name == "" || (found && mode != "ro" && mode != "rw") {
+			return nil, fmt.Errorf("invalid volume, expected name[:ro]: %s", spec)
+		}
+		mounts = append(mounts, serverapi.VolumeMount{
+			Name:     name,
+			Readonly: serverapi.PtrBool(mode == "ro"),
+		})
+	}
+	return mounts, nil
+}
+
+// vmLifetime holds the optional limits after which the server destroys a VM. Zero values disable
+// the corresponding limit.
+type vmLifetime struct {
+	ttl         time.Duration
+	idleTimeout time.Duration
+}
+
+func startVM(
+	vmName string,
+	kernel string,
+	rootfs string,
+	entryPoint string,
+	restartPolicy string,
+	crashRestartPolicy string,
+	snapshotId string,
+	freshNetwork bool,
+	resources vmResources,
+	lifetime vmLifetime,
+	labels map[string]string,
+	volumes vmVolumes,
+	async bool,
+) error {
 	var startVMRequest *serverapi.StartVMRequest
 	if snapshotId != "" {
 		// If snapshot ID is provided, restore the VM from the snapshot
@@ -89,6 +228,9 @@ func startVM(vmName string, kernel string, rootfs string, entryPoint string, sna
 			VmName:     serverapi.PtrString(vmName),
 			SnapshotId: serverapi.PtrString(snapshotId),
 		}
+		if freshNetwork {
+			startVMRequest.SetFreshNetwork(true)
+		}
 	} else {
 		startVMRequest = &serverapi.StartVMRequest{
 			VmName:     serverapi.PtrString(vmName),
@@ -96,6 +238,39 @@ func startVM(vmName string, kernel string, rootfs string, entryPoint string, sna
 			Rootfs:     serverapi.PtrString(rootfs),
 			EntryPoint: serverapi.PtrString(entryPoint),
 		}
+		if restartPolicy != "" {
+			startVMRequest.SetEntryPointRestartPolicy(restartPolicy)
+		}
+		if resources.vcpus > 0 {
+			startVMRequest.SetVcpus(resources.vcpus)
+		}
+		if resources.memorySizeMB > 0 {
+			startVMRequest.SetMemorySizeMB(resources.memorySizeMB)
+		}
+		if resources.statefulDiskSizeMB > 0 {
+			startVMRequest.SetStatefulDiskSizeMB(resources.statefulDiskSizeMB)
+		}
+		if volumes.root != "" {
+			startVMRequest.SetRootVolume(volumes.root)
+		}
+	}
+	if len(volumes.mounts) > 0 {
+		startVMRequest.SetVolumes(volumes.mounts)
+	}
+	if crashRestartPolicy != "" {
+		startVMRequest.SetCrashRestartPolicy(crashRestartPolicy)
+	}
+	if lifetime.ttl > 0 {
+		startVMRequest.SetTtlSeconds(int32(lifetime.ttl.Seconds()))
+	}
+	if lifetime.idleTimeout > 0 {
+		startVMRequest.SetIdleTimeoutSeconds(int32(lifetime.idleTimeout.Seconds()))
+	}
+	if len(labels) > 0 {
+		startVMRequest.SetLabels(labels)
+	}
+	if async {
+		return startOperation("start VM", "/v1/vms", startVMRequest)
 	}
 
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsPost(context.Background()).StartVMRequest(*startVMRequest).Execute()
@@ -111,8 +286,146 @@ func startVM(vmName string, kernel string, rootfs string, entryPoint string, sna
 	return nil
 }
 
-func listAllVMs() error {
-	resp, httpResp, err := apiClient.DefaultAPI.V1VmsGet(context.Background()).Execute()
+// startOperation sends `body` to `path` as an asynchronous request and prints the operation tracking
+// it. The generated client only decodes the responses of synchronous requests.
+func startOperation(operation string, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpResp, err := http.Post(serverURL+path+"?async=true", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to %s: %v", operation, err)
+	}
+	if httpResp.StatusCode != http.StatusAccepted {
+		return parseErrorResponse(operation, httpResp, fmt.Errorf("bad status: %s", httpResp.Status))
+	}
+	defer httpResp.Body.Close()
+
+	var op serverapi.Operation
+	if err := json.NewDecoder(httpResp.Body).Decode(&op); err != nil {
+		return fmt.Errorf("failed to parse operation: %w", err)
+	}
+	log.Infof("started operation %s, check its progress with: operation -i %s", op.GetId(), op.GetId())
+	return nil
+}
+
+func printOperation(op serverapi.Operation) {
+	fmt.Printf("ID: %s\n", op.GetId())
+	fmt.Printf("Type: %s\n", op.GetType())
+	fmt.Printf("VM: %s\n", op.GetVmName())
+	fmt.Printf("State: %s\n", op.GetState())
+	if op.HasProgress() {
+		fmt.Printf("Progress: %s\n", op.GetProgress())
+	}
+	if op.HasError() {
+		fmt.Printf("Error: %s\n", op.GetError())
+	}
+	fmt.Printf("Created: %s\n", op.GetCreatedAt().Format(time.RFC3339))
+	if op.HasFinishedAt() {
+		fmt.Printf("Finished: %s\n", op.GetFinishedAt().Format(time.RFC3339))
+	}
+	if op.HasStartResult() {
+		startResult := op.GetStartResult()
+		fmt.Printf("IP: %s\n", startResult.GetIp())
+		fmt.Printf("Status: %s\n", startResult.GetStatus())
+	}
+	if op.HasSnapshotResult() {
+		snapshotResult := op.GetSnapshotResult()
+		fmt.Printf("Snapshot: %s\n", snapshotResult.GetSnapshotId())
+	}
+}
+
+func listOperations() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1OperationsGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("list operations", httpResp, err)
+	}
+
+	fmt.Println("Operations:")
+	fmt.Println("-------------")
+	for _, op := range resp.GetOperations() {
+		printOperation(op)
+		fmt.Println("-------------")
+	}
+	return nil
+}
+
+func queryAuditLog(vmName string, caller string, action string, since time.Duration, limit int) error {
+	req := apiClient.DefaultAPI.V1AuditGet(context.Background())
+	if vmName != "" {
+		req = req.VmName(vmName)
+	}
+	if caller != "" {
+		req = req.Caller(caller)
+	}
+	if action != "" {
+		req = req.Action(action)
+	}
+	if since > 0 {
+		req = req.Since(time.Now().Add(-since))
+	}
+	if limit > 0 {
+		req = req.Limit(int32(limit))
+	}
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("query audit log", httpResp, err)
+	}
+
+	for _, record := range resp.GetRecords() {
+		line := fmt.Sprintf(
+			"%s %s %s",
+			record.GetTime().Local().Format(time.RFC3339),
+			record.GetCaller(),
+			record.GetAction(),
+		)
+		if record.GetVmName() != "" {
+			line += " vm=" + record.GetVmName()
+		}
+		line += fmt.Sprintf(" %s (%dms)", record.GetOutcome(), record.GetDurationMs())
+		details := record.GetDetails()
+		keys := make([]string, 0, len(details))
+		for key := range details {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			line += fmt.Sprintf(" %s=%q", key, details[key])
+		}
+		if record.GetError() != "" {
+			line += fmt.Sprintf(" error=%q", record.GetError())
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func getOperation(id string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1OperationsIdGet(context.Background(), id).Execute()
+	if err != nil {
+		return parseErrorResponse("get operation", httpResp, err)
+	}
+	printOperation(*resp)
+	return nil
+}
+
+func cancelOperation(id string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1OperationsIdCancelPost(context.Background(), id).Execute()
+	if err != nil {
+		return parseErrorResponse("cancel operation", httpResp, err)
+	}
+	log.Infof("cancelling operation: %s", id)
+	return nil
+}
+
+func listAllVMs(selector string) error {
+	req := apiClient.DefaultAPI.V1VmsGet(context.Background())
+	if selector != "" {
+		req = req.Selector(selector)
+	}
+	resp, httpResp, err := req.Execute()
 	if err != nil {
 		return parseErrorResponse("list all VMs", httpResp, err)
 	}
@@ -126,6 +439,12 @@ func listAllVMs() error {
 		fmt.Printf("Status: %s\n", vm.GetStatus())
 		fmt.Printf("IP Address: %s\n", vm.GetIp())
 		fmt.Printf("Tap Device: %s\n", vm.GetTapDeviceName())
+		fmt.Printf("vCPUs: %d\n", vm.GetVcpus())
+		fmt.Printf("Memory: %d MB\n", vm.GetMemorySizeMB())
+		fmt.Printf("Stateful Disk: %d MB\n", vm.GetStatefulDiskSizeMB())
+		printLifetime(vm.Lifetime)
+		printLabels(vm.GetLabels())
+		printCrash(vm.Crash)
 
 		// Print port forwards with descriptions
 		if len(vm.GetPortForwards()) > 0 {
@@ -143,6 +462,213 @@ func listAllVMs() error {
 	return nil
 }
 
+// formatResourceUsage returns the usage as "<committed>/<limit>", the limit being "unlimited" if
+// not set.
+func formatResourceUsage(usage serverapi.ResourceUsage) string {
+	if usage.GetLimit() == 0 {
+		return fmt.Sprintf("%d/unlimited", usage.GetCommitted())
+	}
+	return fmt.Sprintf("%d/%d", usage.GetCommitted(), usage.GetLimit())
+}
+
+func getCapacity() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1CapacityGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get capacity", httpResp, err)
+	}
+
+	fmt.Printf("vCPUs: %s\n", formatResourceUsage(resp.GetVcpus()))
+	fmt.Printf("Memory: %s MB\n", formatResourceUsage(resp.GetMemoryMB()))
+	fmt.Printf("Resident Memory: %d MB\n", resp.GetResidentMemoryMB())
+	fmt.Printf("Stateful Disk: %s MB\n", formatResourceUsage(resp.GetStatefulDiskMB()))
+	fmt.Printf("Queued Requests: %d\n", resp.GetQueuedRequests())
+	if len(resp.GetTenants()) > 0 {
+		fmt.Println("Tenants:")
+		for _, tenant := range resp.GetTenants() {
+			fmt.Printf("  %s: VMs: %s, vCPUs: %s, Memory: %s MB, Stateful Disk: %s MB\n",
+				tenant.GetTenant(),
+				formatResourceUsage(tenant.GetVms()),
+				formatResourceUsage(tenant.GetVcpus()),
+				formatResourceUsage(tenant.GetMemoryMB()),
+				formatResourceUsage(tenant.GetStatefulDiskMB()))
+		}
+	}
+	return nil
+}
+
+func streamEvents(vmNames []string, eventTypes []string, selector string) error {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("selector", selector)
+	}
+	for _, vmName := range vmNames {
+		query.Add("vm", vmName)
+	}
+	for _, eventType := range eventTypes {
+		query.Add("event", eventType)
+	}
+
+	httpResp, err := http.Get(serverURL + "/v1/events?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to stream events: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("stream events", httpResp, fmt.Errorf("bad status: %s", httpResp.Status))
+	}
+	defer httpResp.Body.Close()
+
+	scanner := bufio.NewScanner(httpResp.Body)
+	for scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+
+		var event serverapi.VMEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			log.WithError(err).Warnf("failed to parse event: %s", data)
+			continue
+		}
+		fmt.Printf("%s %-16s %s", event.GetTimestamp().Format(time.RFC3339), event.GetType(), event.GetVmName())
+		for key, value := range event.GetDetails() {
+			fmt.Printf(" %s=%q", key, value)
+		}
+		fmt.Println()
+	}
+	return scanner.Err()
+}
+
+func streamVMLog(vmName string, follow bool, tail int) error {
+	query := url.Values{}
+	if follow {
+		query.Set("follow", "true")
+	}
+	if tail >= 0 {
+		query.Set("tail", strconv.Itoa(tail))
+	}
+
+	httpResp, err := http.Get(serverURL + "/v1/vms/" + url.PathEscape(vmName) + "/logs?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to get VM log: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("get VM log", httpResp, fmt.Errorf("bad status: %s", httpResp.Status))
+	}
+	defer httpResp.Body.Close()
+
+	if _, err := io.Copy(os.Stdout, httpResp.Body); err != nil {
+		return fmt.Errorf("failed to get VM log: %v", err)
+	}
+	return nil
+}
+
+// makeTerminalRaw puts the terminal `fd` into raw mode, so that keys are sent to the console as
+// typed, and returns a function restoring its previous mode.
+func makeTerminalRaw(fd int) (func(), error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	previous := *termios
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, err
+	}
+	return func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, &previous)
+	}, nil
+}
+
+func attachConsole(vmName string) error {
+	consoleURL := "ws" + strings.TrimPrefix(serverURL, "http") + "/v1/vms/" + url.PathEscape(vmName) + "/console"
+	config, err := websocket.NewConfig(consoleURL, serverURL)
+	if err != nil {
+		return fmt.Errorf("failed to attach console: %v", err)
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to attach console, is the VM running?: %v", err)
+	}
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+
+	// Input may not come from a terminal, e.g. when piped.
+	if restore, err := makeTerminalRaw(int(os.Stdin.Fd())); err == nil {
+		defer restore()
+	}
+	fmt.Fprintf(os.Stderr, "Attached to the serial console of %s, press Ctrl-] to detach\r\n", vmName)
+
+	done := make(chan error, 2)
+	go func() {
+		// Ends when the server closes the console, e.g. because the VM was shut down.
+		_, err := io.Copy(os.Stdout, ws)
+		done <- err
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			input := buf[:n]
+			detach := false
+			if i := bytes.IndexByte(input, consoleEscapeByte); i >= 0 {
+				input = input[:i]
+				detach = true
+			}
+			if len(input) > 0 {
+				if _, err := ws.Write(input); err != nil {
+					done <- err
+					return
+				}
+			}
+			if detach {
+				done <- nil
+				return
+			}
+			// Output is still shown once there's no more input.
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	err = <-done
+	fmt.Fprint(os.Stderr, "\r\nDetached from the serial console\r\n")
+	if err != nil {
+		return fmt.Errorf("console failed: %v", err)
+	}
+	return nil
+}
+
+func listWarmPools() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1WarmpoolsGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("list warm pools", httpResp, err)
+	}
+
+	fmt.Println("Warm Pools:")
+	fmt.Println("-------------")
+	for _, pool := range resp.GetPools() {
+		fmt.Printf("Name: %s\n", pool.GetName())
+		if pool.GetSnapshotId() != "" {
+			fmt.Printf("Snapshot: %s\n", pool.GetSnapshotId())
+		} else {
+			fmt.Printf("Kernel: %s\n", pool.GetKernel())
+			fmt.Printf("Initramfs: %s\n", pool.GetInitramfs())
+			fmt.Printf("Rootfs: %s\n", pool.GetRootfs())
+		}
+		fmt.Printf("Ready: %d/%d (%d booting)\n", pool.GetReady(), pool.GetSize(), pool.GetBooting())
+		fmt.Println("-------------")
+	}
+	return nil
+}
+
 func createApiClient(serverAddr string) (*serverapi.APIClient, error) {
 	host, port, err := net.SplitHostPort(serverAddr)
 	if err != nil {
@@ -173,11 +699,14 @@ func createApiClient(serverAddr string) (*serverapi.APIClient, error) {
 	return apiClient, nil
 }
 
-func snapshotVM(vmName string, snapshotId string) error {
+func snapshotVM(vmName string, snapshotId string, async bool) error {
 	req := serverapi.V1VmsNameSnapshotsPostRequest{}
 	if snapshotId != "" {
 		req.SetSnapshotId(snapshotId)
 	}
+	if async {
+		return startOperation("create snapshot", "/v1/vms/"+url.PathEscape(vmName)+"/snapshots", req)
+	}
 
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSnapshotsPost(context.Background(), vmName).V1VmsNameSnapshotsPostRequest(req).Execute()
 	if err != nil {
@@ -187,8 +716,217 @@ func snapshotVM(vmName string, snapshotId string) error {
 	return nil
 }
 
-func restoreVM(vmName string, snapshotId string) error {
-	return startVM(vmName, "", "", "", snapshotId)
+func printSnapshot(snapshot serverapi.Snapshot) {
+	if snapshot.HasCached() && !snapshot.GetCached() {
+		fmt.Printf("%s: in the snapshot store, not cached\n", snapshot.GetId())
+		return
+	}
+	fmt.Printf("%s: created %s", snapshot.GetId(), snapshot.GetCreatedAt().Format(time.RFC3339))
+	if snapshot.HasVmName() {
+		fmt.Printf(" from %s", snapshot.GetVmName())
+	}
+	fmt.Printf(", %.1f MB on disk\n", float64(snapshot.GetDiskUsageBytes())/(1024*1024))
+}
+
+func listSnapshots() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1SnapshotsGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("list snapshots", httpResp, err)
+	}
+
+	if len(resp.GetSnapshots()) == 0 {
+		fmt.Println("No snapshots")
+		return nil
+	}
+	for _, snapshot := range resp.GetSnapshots() {
+		printSnapshot(snapshot)
+	}
+	return nil
+}
+
+func inspectSnapshot(snapshotId string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1SnapshotsIdGet(context.Background(), snapshotId).Execute()
+	if err != nil {
+		return parseErrorResponse("inspect snapshot", httpResp, err)
+	}
+
+	printSnapshot(*resp)
+	fmt.Printf("vCPUs: %d\n", resp.GetVcpus())
+	fmt.Printf("Memory: %d MB\n", resp.GetMemorySizeMB())
+	fmt.Printf("Kernel: %s\n", resp.GetKernel())
+	if resp.GetInitramfs() != "" {
+		fmt.Printf("Initramfs: %s\n", resp.GetInitramfs())
+	}
+	fmt.Printf("Rootfs: %s\n", resp.GetRootfs())
+	printLabels(resp.GetLabels())
+	if len(resp.GetUsedBy()) > 0 {
+		fmt.Printf("Used by VMs: %s\n", strings.Join(resp.GetUsedBy(), ", "))
+	}
+	if len(resp.GetWarmPools()) > 0 {
+		fmt.Printf("Used by warm pools: %s\n", strings.Join(resp.GetWarmPools(), ", "))
+	}
+	return nil
+}
+
+func deleteSnapshot(snapshotId string, force bool) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1SnapshotsIdDelete(context.Background(), snapshotId).
+		Force(force).
+		Execute()
+	if err != nil {
+		return parseErrorResponse("delete snapshot", httpResp, err)
+	}
+
+	log.Infof("deleted snapshot: %s", snapshotId)
+	return nil
+}
+
+func exportSnapshot(snapshotId string, outputPath string) error {
+	if outputPath == "" {
+		outputPath = snapshotId + ".tar.gz"
+	}
+
+	httpResp, err := http.Get(serverURL + "/v1/snapshots/" + url.PathEscape(snapshotId) + "/export")
+	if err != nil {
+		return fmt.Errorf("failed to export snapshot: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("export snapshot", httpResp, fmt.Errorf("bad status: %s", httpResp.Status))
+	}
+	defer httpResp.Body.Close()
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %v", err)
+	}
+	defer file.Close()
+	size, err := io.Copy(file, httpResp.Body)
+	if err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to export snapshot: %v", err)
+	}
+
+	log.Infof("exported snapshot %s to %s (%.1f MB)", snapshotId, outputPath, float64(size)/(1024*1024))
+	return nil
+}
+
+func importSnapshot(archivePath string, snapshotId string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	query := url.Values{}
+	if snapshotId != "" {
+		query.Set("id", snapshotId)
+	}
+	httpResp, err := http.Post(serverURL+"/v1/snapshots/import?"+query.Encode(), "application/gzip", file)
+	if err != nil {
+		return fmt.Errorf("failed to import snapshot: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("import snapshot", httpResp, fmt.Errorf("bad status: %s", httpResp.Status))
+	}
+	defer httpResp.Body.Close()
+
+	var snapshot serverapi.Snapshot
+	if err := json.NewDecoder(httpResp.Body).Decode(&snapshot); err != nil {
+		return fmt.Errorf("failed to parse response: %v", err)
+	}
+	log.Infof("imported snapshot: %s", snapshot.GetId())
+	printSnapshot(snapshot)
+	return nil
+}
+
+func restoreVM(vmName string, snapshotId string, freshNetwork bool, labels map[string]string, async bool) error {
+	return startVM(vmName, "", "", "", "", "", snapshotId, freshNetwork, vmResources{}, vmLifetime{}, labels, vmVolumes{}, async)
+}
+
+func cloneVM(vmName string, cloneName string, labels map[string]string) error {
+	cloneRequest := serverapi.CloneVMRequest{VmName: cloneName}
+	if len(labels) > 0 {
+		cloneRequest.SetLabels(labels)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameClonePost(context.Background(), vmName).
+		CloneVMRequest(cloneRequest).
+		Execute()
+	if err != nil {
+		return parseErrorResponse("clone VM", httpResp, err)
+	}
+
+	resp_bytes, err := resp.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	log.Infof("cloned VM %s: %v", vmName, string(resp_bytes))
+	return nil
+}
+
+func printCheckpoints(resp *serverapi.VMCheckpoints) {
+	if resp.HasSchedule() {
+		schedule := resp.GetSchedule()
+		fmt.Printf("Checkpointed every %v, keeping the last %d, %d hourly and %d daily, next at %s\n",
+			time.Duration(schedule.IntervalSeconds)*time.Second,
+			schedule.GetKeepLast(),
+			schedule.GetKeepHourly(),
+			schedule.GetKeepDaily(),
+			resp.GetNextCheckpointAt().Format(time.RFC3339))
+	} else {
+		fmt.Println("Not checkpointed")
+	}
+
+	if len(resp.GetCheckpoints()) == 0 {
+		fmt.Println("No checkpoints")
+		return
+	}
+	fmt.Println("Checkpoints:")
+	for _, checkpoint := range resp.GetCheckpoints() {
+		fmt.Printf("  %s: created %s\n",
+			checkpoint.GetSnapshotId(),
+			checkpoint.GetCreatedAt().Format(time.RFC3339))
+	}
+}
+
+func setSnapshotSchedule(vmName string, interval time.Duration, keepLast int32, keepHourly int32, keepDaily int32) error {
+	schedule := serverapi.SnapshotSchedule{IntervalSeconds: int32(interval.Seconds())}
+	schedule.SetKeepLast(keepLast)
+	schedule.SetKeepHourly(keepHourly)
+	schedule.SetKeepDaily(keepDaily)
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSnapshotSchedulePut(context.Background(), vmName).
+		SnapshotSchedule(schedule).
+		Execute()
+	if err != nil {
+		return parseErrorResponse("set snapshot schedule", httpResp, err)
+	}
+	printCheckpoints(resp)
+	return nil
+}
+
+func listCheckpoints(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCheckpointsGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("list checkpoints", httpResp, err)
+	}
+	printCheckpoints(resp)
+	return nil
+}
+
+func rollbackVM(vmName string, snapshotId string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameRollbackPost(context.Background(), vmName).
+		RollbackVMRequest(serverapi.RollbackVMRequest{SnapshotId: snapshotId}).
+		Execute()
+	if err != nil {
+		return parseErrorResponse("roll back VM", httpResp, err)
+	}
+
+	resp_bytes, err := resp.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	log.Infof("rolled back VM %s to %s: %v", vmName, snapshotId, string(resp_bytes))
+	return nil
 }
 
 func pauseVM(vmName string) error {
@@ -213,62 +951,270 @@ func resumeVM(vmName string) error {
 	if err != nil {
 		return parseErrorResponse("resume VM", httpResp, err)
 	}
-	log.Infof("successfully resumed VM: %s", vmName)
+	log.Infof("successfully resumed VM: %s", vmName)
+	return nil
+}
+
+func uploadFiles(vmName string, fileSpecs []string) error {
+	if len(fileSpecs) == 0 || len(fileSpecs)%2 != 0 {
+		return fmt.Errorf("invalid number of file specifications: must be even")
+	}
+
+	apiFiles := make([]serverapi.VmFileUploadRequestFilesInner, len(fileSpecs)/2)
+	for i := 0; i < len(fileSpecs); i += 2 {
+		sourcePath := fileSpecs[i]
+		destPath := fileSpecs[i+1]
+
+		log.Infof("uploading file from %s to %s", sourcePath, destPath)
+
+		content, err := os.ReadFile(sourcePath)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %v", sourcePath, err)
+		}
+
+		apiFiles[i/2] = serverapi.VmFileUploadRequestFilesInner{
+			Path:    destPath,
+			Content: string(content),
+		}
+	}
+
+	req := apiClient.DefaultAPI.V1VmsNameFilesPost(context.Background(), vmName)
+	req = req.VmFileUploadRequest(serverapi.VmFileUploadRequest{
+		Files: apiFiles,
+	})
+
+	_, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("upload files", httpResp, err)
+	}
+
+	log.Infof("successfully uploaded %d files to VM: %s", len(fileSpecs)/2, vmName)
+	return nil
+}
+
+func runCommand(vmName string, cmd string) error {
+	req := serverapi.VmCommandRequest{
+		Cmd:      cmd,
+		Blocking: serverapi.PtrBool(true),
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCmdPost(context.Background(), vmName).VmCommandRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("run command", httpResp, err)
+	}
+
+	if resp.GetError() != "" {
+		return fmt.Errorf("command failed: %s\nOutput: %s", resp.GetError(), resp.GetOutput())
+	}
+	fmt.Println(resp.GetOutput())
+	return nil
+}
+
+// printLifetime prints when the VM will be destroyed automatically, if ever.
+func printLifetime(lifetime *serverapi.VMLifetime) {
+	if lifetime == nil {
+		fmt.Println("Expires: never")
+		return
+	}
+	fmt.Printf(
+		"Expires: %s (in %v)\n",
+		lifetime.GetExpiresAt().Format(time.RFC3339),
+		time.Duration(lifetime.GetRemainingSeconds())*time.Second,
+	)
+}
+
+func keepAliveVM(vmName string, ttl time.Duration) error {
+	req := apiClient.DefaultAPI.V1VmsNameKeepalivePost(context.Background(), vmName)
+	if ttl > 0 {
+		keepAliveRequest := serverapi.KeepAliveRequest{}
+		keepAliveRequest.SetTtlSeconds(int32(ttl.Seconds()))
+		req = req.KeepAliveRequest(keepAliveRequest)
+	}
+
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("keep alive VM", httpResp, err)
+	}
+
+	if !resp.HasExpiresAt() {
+		fmt.Println("Expires: never")
+		return nil
+	}
+	printLifetime(resp)
+	return nil
+}
+
+func attachDisk(vmName string, diskId string, sizeMB int32, image string, volume string, readonly bool) error {
+	attachRequest := serverapi.AttachDiskRequest{Id: diskId}
+	if sizeMB > 0 {
+		attachRequest.SetSizeMB(sizeMB)
+	}
+	if image != "" {
+		attachRequest.SetImage(image)
+	}
+	if volume != "" {
+		attachRequest.SetVolume(volume)
+	}
+	if readonly {
+		attachRequest.SetReadonly(true)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameDisksPost(context.Background(), vmName).
+		AttachDiskRequest(attachRequest).
+		Execute()
+	if err != nil {
+		return parseErrorResponse("attach disk", httpResp, err)
+	}
+
+	log.Infof("attached disk: %s", resp.GetId())
+	printDisk(*resp)
+	return nil
+}
+
+func detachDisk(vmName string, diskId string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameDisksIdDelete(context.Background(), vmName, diskId).Execute()
+	if err != nil {
+		return parseErrorResponse("detach disk", httpResp, err)
+	}
+
+	log.Infof("detached disk: %s", diskId)
+	return nil
+}
+
+func listDisks(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameDisksGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("list disks", httpResp, err)
+	}
+
+	if len(resp.GetDisks()) == 0 {
+		fmt.Println("No disks attached")
+		return nil
+	}
+	fmt.Println("Disks:")
+	for _, disk := range resp.GetDisks() {
+		printDisk(disk)
+	}
+	return nil
+}
+
+func printVolume(volume serverapi.Volume) {
+	fmt.Printf("%s: %d MB, created %s\n",
+		volume.GetName(),
+		volume.GetSizeMB(),
+		volume.GetCreatedAt().Format(time.RFC3339))
+	for _, attachment := range volume.GetAttachments() {
+		mode := "rw"
+		if attachment.GetReadonly() {
+			mode = "ro"
+		}
+		fmt.Printf("  attached to %s as %s, %s\n", attachment.GetVmName(), attachment.GetMode(), mode)
+	}
+}
+
+func createVolume(name string, sizeMB int32) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VolumesPost(context.Background()).
+		CreateVolumeRequest(serverapi.CreateVolumeRequest{Name: name, SizeMB: sizeMB}).
+		Execute()
+	if err != nil {
+		return parseErrorResponse("create volume", httpResp, err)
+	}
+
+	log.Infof("created volume: %s", resp.GetName())
+	printVolume(*resp)
+	return nil
+}
+
+func listVolumes() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VolumesGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("list volumes", httpResp, err)
+	}
+
+	if len(resp.GetVolumes()) == 0 {
+		fmt.Println("No volumes")
+		return nil
+	}
+	for _, volume := range resp.GetVolumes() {
+		printVolume(volume)
+	}
 	return nil
 }
 
-func uploadFiles(vmName string, fileSpecs []string) error {
-	if len(fileSpecs) == 0 || len(fileSpecs)%2 != 0 {
-		return fmt.Errorf("invalid number of file specifications: must be even")
+func getVolume(name string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VolumesNameGet(context.Background(), name).Execute()
+	if err != nil {
+		return parseErrorResponse("get volume", httpResp, err)
 	}
 
-	apiFiles := make([]serverapi.VmFileUploadRequestFilesInner, len(fileSpecs)/2)
-	for i := 0; i < len(fileSpecs); i += 2 {
-		sourcePath := fileSpecs[i]
-		destPath := fileSpecs[i+1]
+	printVolume(*resp)
+	return nil
+}
 
-		log.Infof("uploading file from %s to %s", sourcePath, destPath)
+func deleteVolume(name string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VolumesNameDelete(context.Background(), name).Execute()
+	if err != nil {
+		return parseErrorResponse("delete volume", httpResp, err)
+	}
 
-		content, err := os.ReadFile(sourcePath)
-		if err != nil {
-			return fmt.Errorf("failed to read file %s: %v", sourcePath, err)
-		}
+	log.Infof("deleted volume: %s", name)
+	return nil
+}
 
-		apiFiles[i/2] = serverapi.VmFileUploadRequestFilesInner{
-			Path:    destPath,
-			Content: string(content),
-		}
+func resizeVM(vmName string, vcpus int32, memorySizeMB int32, balloonTargetMB *int32) error {
+	resizeRequest := serverapi.ResizeVMRequest{}
+	if vcpus > 0 {
+		resizeRequest.SetVcpus(vcpus)
+	}
+	if memorySizeMB > 0 {
+		resizeRequest.SetMemorySizeMB(memorySizeMB)
+	}
+	if balloonTargetMB != nil {
+		resizeRequest.SetBalloonTargetMB(*balloonTargetMB)
 	}
 
-	req := apiClient.DefaultAPI.V1VmsNameFilesPost(context.Background(), vmName)
-	req = req.VmFileUploadRequest(serverapi.VmFileUploadRequest{
-		Files: apiFiles,
-	})
-
-	_, httpResp, err := req.Execute()
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameResourcesPatch(context.Background(), vmName).
+		ResizeVMRequest(resizeRequest).
+		Execute()
 	if err != nil {
-		return parseErrorResponse("upload files", httpResp, err)
+		return parseErrorResponse("resize VM", httpResp, err)
 	}
 
-	log.Infof("successfully uploaded %d files to VM: %s", len(fileSpecs)/2, vmName)
+	log.Infof("resized VM: %s", resp.GetVmName())
+	fmt.Printf("vCPUs: %d\n", resp.GetVcpus())
+	fmt.Printf("Memory: %d MB\n", resp.GetMemorySizeMB())
+	printMemory(resp.Memory)
 	return nil
 }
 
-func runCommand(vmName string, cmd string) error {
-	req := serverapi.VmCommandRequest{
-		Cmd:      cmd,
-		Blocking: serverapi.PtrBool(true),
+// printMemory prints how much of the memory of a VM is reclaimed by its balloon and actually used.
+func printMemory(memory *serverapi.VMMemory) {
+	if memory == nil {
+		return
 	}
+	if memory.HasBalloonSizeMB() {
+		fmt.Printf("Balloon: %d MB (target %d MB), %d MB available to the guest\n",
+			memory.GetBalloonSizeMB(),
+			memory.GetBalloonTargetMB(),
+			memory.GetAvailableMB())
+	}
+	if memory.HasResidentMB() {
+		fmt.Printf("Resident Memory: %d MB\n", memory.GetResidentMB())
+	}
+}
 
-	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCmdPost(context.Background(), vmName).VmCommandRequest(req).Execute()
+func getEntryPointStatus(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameEntrypointGet(context.Background(), vmName).Execute()
 	if err != nil {
-		return parseErrorResponse("run command", httpResp, err)
+		return parseErrorResponse("get entry point status", httpResp, err)
 	}
 
-	if resp.GetError() != "" {
-		return fmt.Errorf("command failed: %s\nOutput: %s", resp.GetError(), resp.GetOutput())
-	}
-	fmt.Println(resp.GetOutput())
+	fmt.Printf("Command: %s\n", resp.GetCmd())
+	fmt.Printf("Restart Policy: %s\n", resp.GetRestartPolicy())
+	fmt.Printf("State: %s\n", resp.GetState())
+	fmt.Printf("PID: %d\n", resp.GetPid())
+	fmt.Printf("Exit Code: %d\n", resp.GetExitCode())
+	fmt.Printf("Restart Count: %d\n", resp.GetRestartCount())
 	return nil
 }
 
@@ -296,6 +1242,19 @@ func listVM(vmName string) error {
 	fmt.Printf("Status: %s\n", resp.GetStatus())
 	fmt.Printf("IP Address: %s\n", resp.GetIp())
 	fmt.Printf("Tap Device: %s\n", resp.GetTapDeviceName())
+	fmt.Printf("vCPUs: %d\n", resp.GetVcpus())
+	fmt.Printf("Memory: %d MB\n", resp.GetMemorySizeMB())
+	printMemory(resp.Memory)
+	fmt.Printf("Stateful Disk: %d MB\n", resp.GetStatefulDiskSizeMB())
+	printLifetime(resp.Lifetime)
+	printLabels(resp.GetLabels())
+	printCrash(resp.Crash)
+	if len(resp.GetDisks()) > 0 {
+		fmt.Println("Disks:")
+		for _, disk := range resp.GetDisks() {
+			printDisk(disk)
+		}
+	}
 
 	// Print port forwards with descriptions
 	if len(resp.GetPortForwards()) > 0 {
@@ -337,6 +1296,7 @@ func main() {
 			if err != nil {
 				return fmt.Errorf("failed to initialize api client: %v", err)
 			}
+			serverURL = fmt.Sprintf("http://%s:%s", clientConfig.ServerHost, clientConfig.ServerPort)
 			return nil
 		},
 		Commands: []*cli.Command{
@@ -366,19 +1326,96 @@ func main() {
 						Usage:    "Entry point of the VM",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:  "restart",
+						Usage: "Restart policy of the entry point: never, on-failure or always",
+					},
+					&cli.StringFlag{
+						Name:  "on-crash",
+						Usage: "What to do when the VM crashes: never, reboot or restore from its latest snapshot",
+					},
 					&cli.StringFlag{
 						Name:    "snapshot",
 						Aliases: []string{"s"},
 						Usage:   "Path to snapshot directory to restore from",
 					},
+					&cli.BoolFlag{
+						Name:  "fresh-network",
+						Usage: "Restore the snapshot with a new IP, tap device and CID instead of the snapshotted VM's",
+					},
+					&cli.IntFlag{
+						Name:  "vcpus",
+						Usage: "Number of vCPUs of the VM",
+					},
+					&cli.IntFlag{
+						Name:    "memory",
+						Aliases: []string{"m"},
+						Usage:   "Memory size of the VM in MB",
+					},
+					&cli.IntFlag{
+						Name:    "disk",
+						Aliases: []string{"d"},
+						Usage:   "Size of the stateful disk of the VM in MB",
+					},
+					&cli.DurationFlag{
+						Name:  "ttl",
+						Usage: "Destroy the VM automatically after this long, e.g. 2h",
+					},
+					&cli.DurationFlag{
+						Name:  "idle-timeout",
+						Usage: "Destroy the VM automatically after it has been idle for this long, e.g. 15m",
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "Label of the VM as key=value, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "root-volume",
+						Usage: "Volume to use as the stateful disk of the VM instead of a fresh one",
+					},
+					&cli.StringSliceFlag{
+						Name:  "volume",
+						Usage: "Volume to mount at /mnt/disks/<name> as name or name:ro, can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:  "async",
+						Usage: "Return an operation ID right away instead of waiting for the VM to be ready",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
+					labels, err := parseLabels(ctx.StringSlice("label"))
+					if err != nil {
+						return err
+					}
+					volumeMounts, err := parseVolumeMounts(ctx.StringSlice("volume"))
+					if err != nil {
+						return err
+					}
 					return startVM(
 						ctx.String("name"),
 						ctx.String("kernel"),
 						ctx.String("rootfs"),
 						ctx.String("entry-point"),
+						ctx.String("restart"),
+						ctx.String("on-crash"),
 						ctx.String("snapshot"),
+						ctx.Bool("fresh-network"),
+						vmResources{
+							vcpus:              int32(ctx.Int("vcpus")),
+							memorySizeMB:       int32(ctx.Int("memory")),
+							statefulDiskSizeMB: int32(ctx.Int("disk")),
+						},
+						vmLifetime{
+							ttl:         ctx.Duration("ttl"),
+							idleTimeout: ctx.Duration("idle-timeout"),
+						},
+						labels,
+						vmVolumes{
+							root:   ctx.String("root-volume"),
+							mounts: volumeMounts,
+						},
+						ctx.Bool("async"),
 					)
 				},
 			},
@@ -415,15 +1452,107 @@ func main() {
 			{
 				Name:  "destroy-all",
 				Usage: "Destroy all VMs",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "selector",
+						Aliases: []string{"l"},
+						Usage:   "Only destroy VMs whose labels match, e.g. team=infra,env!=prod",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					return destroyAllVMs()
+					return destroyAllVMs(ctx.String("selector"))
 				},
 			},
 			{
 				Name:  "list-all",
 				Usage: "List all VMs",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "selector",
+						Aliases: []string{"l"},
+						Usage:   "Only list VMs whose labels match, e.g. team=infra,env!=prod",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return listAllVMs(ctx.String("selector"))
+				},
+			},
+			{
+				Name:  "events",
+				Usage: "Stream VM lifecycle events",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Only show events of these VMs",
+					},
+					&cli.StringSliceFlag{
+						Name:    "event",
+						Aliases: []string{"e"},
+						Usage:   "Only show events of these types, e.g. booted or destroyed",
+					},
+					&cli.StringFlag{
+						Name:    "selector",
+						Aliases: []string{"l"},
+						Usage:   "Only show events of VMs whose labels match, e.g. team=infra",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return streamEvents(ctx.StringSlice("name"), ctx.StringSlice("event"), ctx.String("selector"))
+				},
+			},
+			{
+				Name:  "logs",
+				Usage: "Show the log of a VM, i.e. the output of its VMM and its serial console",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "Keep showing output as it's written until the VM exits",
+					},
+					&cli.IntFlag{
+						Name:  "tail",
+						Usage: "Only show the last lines of the log. Negative shows the whole log",
+						Value: -1,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return streamVMLog(ctx.String("name"), ctx.Bool("follow"), ctx.Int("tail"))
+				},
+			},
+			{
+				Name:  "console",
+				Usage: "Attach to the serial console of a VM, Ctrl-] detaches",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return attachConsole(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "capacity",
+				Usage: "Show the resources committed to VMs and the remaining capacity of the host",
+				Action: func(ctx *cli.Context) error {
+					return getCapacity()
+				},
+			},
+			{
+				Name:  "warmpools",
+				Usage: "List the pools of VMs booted ahead of time",
 				Action: func(ctx *cli.Context) error {
-					return listAllVMs()
+					return listWarmPools()
 				},
 			},
 			{
@@ -443,13 +1572,13 @@ func main() {
 			},
 			{
 				Name:  "snapshot",
-				Usage: "Create a snapshot of a VM",
+				Usage: "Create a snapshot of a VM, or manage snapshots with a subcommand",
 				Flags: []cli.Flag{
+					// Not required as the subcommands don't take it.
 					&cli.StringFlag{
-						Name:     "name",
-						Aliases:  []string{"n"},
-						Usage:    "Name of the VM",
-						Required: true,
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Name of the VM",
 					},
 					&cli.StringFlag{
 						Name:     "id",
@@ -457,9 +1586,99 @@ func main() {
 						Usage:    "Unique identifier for the snapshot",
 						Required: false,
 					},
+					&cli.BoolFlag{
+						Name:  "async",
+						Usage: "Return an operation ID right away instead of waiting for the snapshot",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return snapshotVM(ctx.String("name"), ctx.String("id"))
+					if ctx.String("name") == "" {
+						return fmt.Errorf("Required flag \"name\" not set")
+					}
+					return snapshotVM(ctx.String("name"), ctx.String("id"), ctx.Bool("async"))
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List all snapshots",
+						Action: func(ctx *cli.Context) error {
+							return listSnapshots()
+						},
+					},
+					{
+						Name:  "inspect",
+						Usage: "Show a snapshot, what it depends on and the VMs using it",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "ID of the snapshot",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return inspectSnapshot(ctx.String("id"))
+						},
+					},
+					{
+						Name:  "rm",
+						Usage: "Delete a snapshot",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "ID of the snapshot",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Delete the snapshot even if VMs or warm pools use it",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return deleteSnapshot(ctx.String("id"), ctx.Bool("force"))
+						},
+					},
+					{
+						Name:  "export",
+						Usage: "Download a snapshot as an archive that can be imported on another host",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "ID of the snapshot",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Path of the archive, <id>.tar.gz by default",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return exportSnapshot(ctx.String("id"), ctx.String("output"))
+						},
+					},
+					{
+						Name:  "import",
+						Usage: "Register a snapshot archive created by export",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "file",
+								Aliases:  []string{"f"},
+								Usage:    "Path of the archive",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "ID to import the snapshot as, the exported one by default",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return importSnapshot(ctx.String("file"), ctx.String("id"))
+						},
+					},
 				},
 			},
 			{
@@ -478,9 +1697,135 @@ func main() {
 						Usage:    "ID of the snapshot to restore from",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "fresh-network",
+						Usage: "Restore the snapshot with a new IP, tap device and CID instead of the snapshotted VM's",
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "Label of the VM as key=value, can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:  "async",
+						Usage: "Return an operation ID right away instead of waiting for the VM to be ready",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					labels, err := parseLabels(ctx.StringSlice("label"))
+					if err != nil {
+						return err
+					}
+					return restoreVM(
+						ctx.String("name"),
+						ctx.String("id"),
+						ctx.Bool("fresh-network"),
+						labels,
+						ctx.Bool("async"),
+					)
+				},
+			},
+			{
+				Name:  "clone",
+				Usage: "Clone a running VM into a new VM with its own IP",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to clone",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Aliases:  []string{"t"},
+						Usage:    "Name of the clone",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "Label of the clone as key=value, can be repeated",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					labels, err := parseLabels(ctx.StringSlice("label"))
+					if err != nil {
+						return err
+					}
+					return cloneVM(ctx.String("name"), ctx.String("to"), labels)
+				},
+			},
+			{
+				Name:  "audit",
+				Usage: "Show the most recent records of the audit log, oldest first",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Only show actions on this VM",
+					},
+					&cli.StringFlag{
+						Name:  "caller",
+						Usage: "Only show actions of this caller",
+					},
+					&cli.StringFlag{
+						Name:  "action",
+						Usage: "Only show this action, e.g. vm.command",
+					},
+					&cli.DurationFlag{
+						Name:  "since",
+						Usage: "Only show actions taken within this long, e.g. 24h",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Most records to show, defaults to 100",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return queryAuditLog(
+						ctx.String("name"),
+						ctx.String("caller"),
+						ctx.String("action"),
+						ctx.Duration("since"),
+						ctx.Int("limit"),
+					)
+				},
+			},
+			{
+				Name:  "operations",
+				Usage: "List running and recently finished asynchronous operations",
+				Action: func(ctx *cli.Context) error {
+					return listOperations()
+				},
+			},
+			{
+				Name:  "operation",
+				Usage: "Show the progress and result of an asynchronous operation",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Aliases:  []string{"i"},
+						Usage:    "ID of the operation",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return getOperation(ctx.String("id"))
+				},
+			},
+			{
+				Name:  "cancel",
+				Usage: "Cancel an asynchronous operation and roll back what it did so far",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Aliases:  []string{"i"},
+						Usage:    "ID of the operation to cancel",
+						Required: true,
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return restoreVM(ctx.String("name"), ctx.String("id"))
+					return cancelOperation(ctx.String("id"))
 				},
 			},
 			{
@@ -555,6 +1900,303 @@ func main() {
 					return runCommand(ctx.String("name"), ctx.String("cmd"))
 				},
 			},
+			{
+				Name:  "keepalive",
+				Usage: "Reset the idle timer of a VM and extend its time-to-live",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.DurationFlag{
+						Name:  "ttl",
+						Usage: "New time-to-live counted from now. Defaults to the one the VM was started with",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return keepAliveVM(ctx.String("name"), ctx.Duration("ttl"))
+				},
+			},
+			{
+				Name:  "checkpoint",
+				Usage: "Manage the automatic checkpoints of a VM",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "schedule",
+						Usage: "Checkpoint a VM periodically and delete the checkpoints no retention rule keeps",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the VM",
+								Required: true,
+							},
+							&cli.DurationFlag{
+								Name:     "every",
+								Usage:    "Interval between checkpoints, at least 1m. 0 stops checkpointing and keeps the checkpoints",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:  "keep-last",
+								Usage: "Number of most recent checkpoints to keep",
+							},
+							&cli.IntFlag{
+								Name:  "keep-hourly",
+								Usage: "Number of hours for which to keep the latest checkpoint of the hour",
+							},
+							&cli.IntFlag{
+								Name:  "keep-daily",
+								Usage: "Number of days for which to keep the latest checkpoint of the day",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return setSnapshotSchedule(
+								ctx.String("name"),
+								ctx.Duration("every"),
+								int32(ctx.Int("keep-last")),
+								int32(ctx.Int("keep-hourly")),
+								int32(ctx.Int("keep-daily")),
+							)
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "Show the snapshot schedule and the retained checkpoints of a VM",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the VM",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return listCheckpoints(ctx.String("name"))
+						},
+					},
+					{
+						Name:  "rollback",
+						Usage: "Replace a VM by one restored from one of its checkpoints",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the VM",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "Snapshot ID of the checkpoint",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return rollbackVM(ctx.String("name"), ctx.String("id"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "disk",
+				Usage: "Manage disks hot-plugged into a running VM",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "attach",
+						Usage: "Hot-plug a fresh disk, a disk image or a volume and mount it at /mnt/disks/<id> in the guest",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the VM",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "ID of the disk",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:  "size",
+								Usage: "Size of a fresh, empty disk in MB",
+							},
+							&cli.StringFlag{
+								Name:  "image",
+								Usage: "Disk image relative to the server's disk images directory",
+							},
+							&cli.StringFlag{
+								Name:  "volume",
+								Usage: "Name of a volume",
+							},
+							&cli.BoolFlag{
+								Name:  "readonly",
+								Usage: "Attach the disk image or volume read-only",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return attachDisk(
+								ctx.String("name"),
+								ctx.String("id"),
+								int32(ctx.Int("size")),
+								ctx.String("image"),
+								ctx.String("volume"),
+								ctx.Bool("readonly"),
+							)
+						},
+					},
+					{
+						Name:  "detach",
+						Usage: "Unmount a disk in the guest and unplug it",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the VM",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "ID of the disk",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return detachDisk(ctx.String("name"), ctx.String("id"))
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List the disks hot-plugged into a VM",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the VM",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return listDisks(ctx.String("name"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "volume",
+				Usage: "Manage persistent volumes that outlive the VMs they're attached to",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "create",
+						Usage: "Create an empty volume",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the volume",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:     "size",
+								Usage:    "Size of the volume in MB",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return createVolume(ctx.String("name"), int32(ctx.Int("size")))
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List all volumes and the VMs they're attached to",
+						Action: func(ctx *cli.Context) error {
+							return listVolumes()
+						},
+					},
+					{
+						Name:  "inspect",
+						Usage: "Show a volume and the VMs it's attached to",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the volume",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return getVolume(ctx.String("name"))
+						},
+					},
+					{
+						Name:  "rm",
+						Usage: "Delete a volume that isn't attached to any VM",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the volume",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							return deleteVolume(ctx.String("name"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "resize",
+				Usage: "Hot-plug vCPUs and memory into a running VM or reclaim memory from it",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "vcpus",
+						Usage: "Desired number of vCPUs. Defaults to the current number",
+					},
+					&cli.IntFlag{
+						Name:  "memory",
+						Usage: "Desired memory size in MB, in multiples of 128 MB more than the current size",
+					},
+					&cli.IntFlag{
+						Name:  "balloon",
+						Usage: "Memory in MB to reclaim from the guest through its balloon, 0 gives it all back",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.Int("vcpus") == 0 && ctx.Int("memory") == 0 && !ctx.IsSet("balloon") {
+						return fmt.Errorf("at least one of --vcpus, --memory and --balloon is required")
+					}
+					var balloonTargetMB *int32
+					if ctx.IsSet("balloon") {
+						balloonTargetMB = serverapi.PtrInt32(int32(ctx.Int("balloon")))
+					}
+					return resizeVM(ctx.String("name"), int32(ctx.Int("vcpus")), int32(ctx.Int("memory")), balloonTargetMB)
+				},
+			},
+			{
+				Name:  "entrypoint",
+				Usage: "Get the status of the entry point of a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return getEntryPointStatus(ctx.String("name"))
+				},
+			},
 			{
 				Name:  "download",
 				Usage: "Download files from a VM",
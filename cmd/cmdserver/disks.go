@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How long to wait for a hot-plugged disk to show up in the guest.
+	diskAppearTimeout = 10 * time.Second
+	diskPollInterval  = 100 * time.Millisecond
+)
+
+// findDisk returns the block device whose virtio-blk serial is `id` or an empty string.
+func findDisk(id string) (string, error) {
+	serialPaths, err := filepath.Glob("/sys/block/*/serial")
+	if err != nil {
+		return "", err
+	}
+	for _, serialPath := range serialPaths {
+		serial, err := os.ReadFile(serialPath)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(serial)) == id {
+			return filepath.Join("/dev", filepath.Base(filepath.Dir(serialPath))), nil
+		}
+	}
+	return "", nil
+}
+
+// waitForDisk waits for the hot-plugged disk `id` to show up and returns its block device.
+func waitForDisk(id string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		device, err := findDisk(id)
+		if err != nil {
+			return "", err
+		}
+		if device != "" {
+			return device, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("disk %s didn't show up within %v", id, timeout)
+		}
+		time.Sleep(diskPollInterval)
+	}
+}
+
+// mountDiskHandler handles "/disks" POST requests.
+func mountDiskHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "mount_disk")
+
+	var req cmdserver.DiskMountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !cmdserver.IsValidDiskId(req.Id) {
+		logger.Errorf("invalid disk id: %q", req.Id)
+		http.Error(w, fmt.Sprintf("invalid disk id: %q", req.Id), http.StatusBadRequest)
+		return
+	}
+
+	device, err := waitForDisk(req.Id, diskAppearTimeout)
+	if err != nil {
+		logger.WithError(err).Error("failed to find disk")
+		http.Error(w, fmt.Sprintf("failed to find disk: %v", err), http.StatusNotFound)
+		return
+	}
+
+	mountPoint := cmdserver.DiskMountPoint(req.Id)
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		logger.WithError(err).Errorf("failed to create mount point: %s", mountPoint)
+		http.Error(w, fmt.Sprintf("failed to create mount point: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	args := []string{device, mountPoint}
+	if req.Readonly {
+		args = append([]string{"-o", "ro"}, args...)
+	}
+	if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		logger.WithError(err).Errorf("failed to mount %s at %s: %s", device, mountPoint, string(out))
+		http.Error(w, fmt.Sprintf("failed to mount disk: %v out: %s", err, string(out)), http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("mounted disk %s (%s) at %s", req.Id, device, mountPoint)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.DiskMountResponse{
+		Device:     device,
+		MountPoint: mountPoint,
+	})
+}
+
+// unmountDiskHandler handles "/disks/{id}" DELETE requests.
+func unmountDiskHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "unmount_disk")
+
+	id := mux.Vars(r)["id"]
+	if !cmdserver.IsValidDiskId(id) {
+		logger.Errorf("invalid disk id: %q", id)
+		http.Error(w, fmt.Sprintf("invalid disk id: %q", id), http.StatusBadRequest)
+		return
+	}
+
+	mountPoint := cmdserver.DiskMountPoint(id)
+	if out, err := exec.Command("mountpoint", "-q", mountPoint).CombinedOutput(); err != nil {
+		// Nothing to do if the disk isn't mounted, e.g. after the guest rebooted.
+		logger.Infof("disk %s isn't mounted: %s", id, string(out))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if out, err := exec.Command("umount", mountPoint).CombinedOutput(); err != nil {
+		logger.WithError(err).Errorf("failed to unmount %s: %s", mountPoint, string(out))
+		http.Error(w, fmt.Sprintf("failed to unmount disk: %v out: %s", err, string(out)), http.StatusConflict)
+		return
+	}
+	os.Remove(mountPoint)
+	logger.Infof("unmounted disk %s from %s", id, mountPoint)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -330,6 +330,11 @@ func main() {
 		log.Fatalf("Failed to create base directory: %v", err)
 	}
 
+	// The entry point is started once guest initialization is done, which is guaranteed by this
+	// service being ordered after it.
+	entryPointSupervisor := newSupervisor()
+	go entryPointSupervisor.run()
+
 	// Initialize Gorilla Mux router.
 	router := mux.NewRouter()
 
@@ -338,6 +343,9 @@ func main() {
 	router.HandleFunc("/files", uploadFileHandler).Methods(http.MethodPost)
 	router.HandleFunc("/files", downloadFileHandler).Methods(http.MethodGet)
 	router.HandleFunc("/cmd", runCommandHandler).Methods(http.MethodPost)
+	router.HandleFunc("/entrypoint", entryPointSupervisor.entryPointHandler).Methods(http.MethodGet)
+	router.HandleFunc("/disks", mountDiskHandler).Methods(http.MethodPost)
+	router.HandleFunc("/disks/{id}", unmountDiskHandler).Methods(http.MethodDelete)
 
 	// Optionally, add logging middleware.
 	router.Use(loggingMiddleware)
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/cmdline"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+const (
+	// Delay between restarts of the entry point. Doubled after every consecutive restart up to
+	// `maxEntryPointRestartDelay`.
+	entryPointRestartDelay    = 1 * time.Second
+	maxEntryPointRestartDelay = 30 * time.Second
+	// A run longer than this resets the restart delay.
+	entryPointStableRunDuration = 10 * time.Second
+)
+
+// supervisor runs the entry point of the sandbox passed by the host on the kernel command line and
+// restarts it as per its restart policy.
+type supervisor struct {
+	lock   sync.Mutex
+	status cmdserver.EntryPointStatus
+}
+
+// newSupervisor returns a supervisor for the entry point on the kernel command line. The returned
+// supervisor reports the entry point as not configured if there is none.
+func newSupervisor() *supervisor {
+	s := &supervisor{
+		status: cmdserver.EntryPointStatus{
+			State: cmdserver.EntryPointStateNotConfigured,
+		},
+	}
+
+	encodedCmd, err := cmdline.ParseKey(cmdserver.EntryPointCmdlineKey)
+	if err != nil || encodedCmd == "" {
+		log.Info("no entry point configured")
+		return s
+	}
+
+	cmd, err := base64.RawURLEncoding.DecodeString(encodedCmd)
+	if err != nil {
+		log.WithError(err).Error("failed to decode entry point")
+		return s
+	}
+
+	restartPolicy, err := cmdline.ParseKey(cmdserver.EntryPointRestartPolicyCmdlineKey)
+	if err != nil || !cmdserver.IsValidRestartPolicy(restartPolicy) {
+		restartPolicy = cmdserver.RestartPolicyNever
+	}
+
+	s.status.Cmd = string(cmd)
+	s.status.RestartPolicy = restartPolicy
+	return s
+}
+
+func (s *supervisor) getStatus() cmdserver.EntryPointStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status
+}
+
+// shouldRestart returns true if the entry point should be restarted after exiting with `exitCode`.
+func (s *supervisor) shouldRestart(exitCode int) bool {
+	switch s.status.RestartPolicy {
+	case cmdserver.RestartPolicyAlways:
+		return true
+	case cmdserver.RestartPolicyOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// runOnce runs the entry point until it exits and returns its exit code.
+func (s *supervisor) runOnce() int {
+	logger := log.WithField("api", "entry_point")
+
+	// Set up environment variables
+	env := os.Environ()
+	customPath := "/usr/local/bin:/usr/bin:/bin"
+	env = append(env, "PATH="+customPath)
+
+	cmd := exec.Command("bash", "-c", s.status.Cmd)
+	cmd.Env = env
+	cmd.Dir = baseDir
+	stdout := logger.WithField("stream", "stdout").Writer()
+	defer stdout.Close()
+	stderr := logger.WithField("stream", "stderr").Writer()
+	defer stderr.Close()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		logger.WithError(err).Error("failed to start entry point")
+		return -1
+	}
+
+	s.lock.Lock()
+	s.status.State = cmdserver.EntryPointStateRunning
+	s.status.Pid = cmd.Process.Pid
+	s.lock.Unlock()
+	logger.WithField("pid", cmd.Process.Pid).Info("entry point started")
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to wait for entry point")
+		return -1
+	}
+	return 0
+}
+
+// run supervises the entry point. It returns once the entry point has exited and isn't to be
+// restarted.
+func (s *supervisor) run() {
+	if s.status.State == cmdserver.EntryPointStateNotConfigured {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"api":           "entry_point",
+		"cmd":           s.status.Cmd,
+		"restartPolicy": s.status.RestartPolicy,
+	})
+	delay := entryPointRestartDelay
+	for {
+		startTime := time.Now()
+		exitCode := s.runOnce()
+		logger.WithField("exitCode", exitCode).Info("entry point exited")
+
+		s.lock.Lock()
+		s.status.Pid = 0
+		s.status.ExitCode = exitCode
+		if !s.shouldRestart(exitCode) {
+			s.status.State = cmdserver.EntryPointStateExited
+			s.lock.Unlock()
+			return
+		}
+		s.status.State = cmdserver.EntryPointStateRestarting
+		s.status.RestartCount++
+		s.lock.Unlock()
+
+		if time.Since(startTime) > entryPointStableRunDuration {
+			delay = entryPointRestartDelay
+		}
+		logger.Infof("restarting entry point in %v", delay)
+		time.Sleep(delay)
+		delay = min(delay*2, maxEntryPointRestartDelay)
+	}
+}
+
+// entryPointHandler handles "/entrypoint" GET requests.
+func (s *supervisor) entryPointHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.getStatus())
+}
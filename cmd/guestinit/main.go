@@ -5,9 +5,10 @@ import (
 	"net"
 	"os"
 	"os/exec"
-	"strings"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/cmdline"
 )
 
 const (
@@ -15,39 +16,14 @@ const (
 	ipBin  = "/usr/bin/ip"
 )
 
-// parseKeyFromCmdLine parses a key from the kernel command line. Assumes each
-// key:val is present like key="val" in /proc/cmdline.
-func parseKeyFromCmdLine(prefix string) (string, error) {
-	cmdline, err := os.ReadFile("/proc/cmdline")
-	if err != nil {
-		return "", fmt.Errorf("failed to read /proc/cmdline: %w", err)
-	}
-
-	key := prefix + "="
-	cmdlineStr := string(cmdline)
-
-	start := strings.Index(cmdlineStr, key)
-	if start == -1 {
-		return "", fmt.Errorf("key %q not found in kernel command line", key)
-	}
-
-	start += len(key)
-	value := strings.TrimPrefix(cmdlineStr[start:], "\"")
-	end := strings.IndexByte(value, '"')
-	if end == -1 {
-		return "", fmt.Errorf("unclosed quote for key %q in kernel command line", key)
-	}
-	return value[:end], nil
-}
-
 // parseNetworkingMetadata parses the networking metadata from the kernel command line.
 func parseNetworkingMetadata() (string, string, error) {
-	guestCIDR, err := parseKeyFromCmdLine("guest_ip")
+	guestCIDR, err := cmdline.ParseKey("guest_ip")
 	if err != nil {
 		return "", "", fmt.Errorf("failed to parse guest_ip: %w", err)
 	}
 
-	gatewayCIDR, err := parseKeyFromCmdLine("gateway_ip")
+	gatewayCIDR, err := cmdline.ParseKey("gateway_ip")
 	if err != nil {
 		return "", "", fmt.Errorf("failed to parse gateway_ip: %w", err)
 	}
@@ -1,26 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/abshkbh/arrakis/out/gen/serverapi"
 	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/metrics"
 	"github.com/abshkbh/arrakis/pkg/server"
 )
 
 const (
 	API_VERSION = "v1"
+	// Interval at which a comment is sent on idle event streams so that proxies don't close them.
+	eventStreamHeartbeatInterval = 15 * time.Second
+	// Largest error response whose message is recorded in the audit log.
+	maxAuditedErrorResponseSize = 4096
 )
 
 // sendErrorResponse sends a standardized error response to the client.
@@ -35,8 +51,226 @@ func sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// httpStatusFromError returns the HTTP status of a failed call to the VM server. Synchronous and
+// asynchronous variants of a call map their errors the same way.
+func httpStatusFromError(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isAsync returns whether the request asked to be run as an asynchronous operation.
+func isAsync(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("async")
+	if value == "" {
+		return false, nil
+	}
+	async, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid async parameter: %s", value)
+	}
+	return async, nil
+}
+
+// sendOperation sends an operation that was started by a request.
+func sendOperation(w http.ResponseWriter, op *serverapi.Operation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
 type restServer struct {
 	vmServer *server.Server
+	// Request header naming the caller, empty to identify callers by their address.
+	callerHeader string
+	// Addresses of the proxies trusted to set `callerHeader`.
+	trustedProxies []netip.Prefix
+	// Closed when the server shuts down to end streams, which never become idle and would hold up
+	// the shutdown otherwise.
+	shutdown chan struct{}
+}
+
+// streamContext returns a context of `r` that's also cancelled when the server shuts down. The
+// returned cancel function must be called once the stream ends.
+func (s *restServer) streamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-s.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// identifyCaller attributes requests to their caller, named by the configured header if set by a
+// trusted proxy and by their address otherwise. Callers reaching the server directly can't claim
+// to be someone else, e.g. a tenant with a quota.
+func (s *restServer) identifyCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			caller = host
+		}
+		if s.callerHeader != "" && s.isTrustedProxy(caller) {
+			if header := r.Header.Get(s.callerHeader); header != "" {
+				caller = header
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(server.WithCaller(r.Context(), caller)))
+	})
+}
+
+func (s *restServer) isTrustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses the addresses and CIDR ranges of the proxies trusted to name callers.
+// They're required along with a caller header.
+func parseTrustedProxies(auditConfig config.AuditConfig) ([]netip.Prefix, error) {
+	if auditConfig.CallerHeader != "" && len(auditConfig.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("caller_header requires trusted_proxies")
+	}
+	prefixes := make([]netip.Prefix, 0, len(auditConfig.TrustedProxies))
+	for _, proxy := range auditConfig.TrustedProxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type auditEntryKey struct{}
+
+// auditEntry is what the audit record of a request can't tell from its URL, e.g. the name of a VM
+// sent in the body.
+type auditEntry struct {
+	vmName  string
+	details map[string]string
+}
+
+// annotateAudit sets the VM of the audit record of `r` if `vmName` isn't empty and adds the
+// non-empty `details` to it.
+func annotateAudit(r *http.Request, vmName string, details map[string]string) {
+	entry, ok := r.Context().Value(auditEntryKey{}).(*auditEntry)
+	if !ok {
+		return
+	}
+	if vmName != "" {
+		entry.vmName = vmName
+	}
+	for key, value := range details {
+		if value != "" {
+			entry.details[key] = value
+		}
+	}
+}
+
+// auditResponseWriter keeps the status of a response, and the message of an error response, for
+// the audit log. Streamed and WebSocket responses work through it as before.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	errorBody bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= http.StatusBadRequest {
+		w.errorBody.Write(p[:min(len(p), max(maxAuditedErrorResponseSize-w.errorBody.Len(), 0))])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// err returns the error the response reported, nil if the request succeeded.
+func (w *auditResponseWriter) err() error {
+	if w.status < http.StatusBadRequest {
+		return nil
+	}
+	var resp serverapi.ErrorResponse
+	if err := json.Unmarshal(w.errorBody.Bytes(), &resp); err == nil && resp.Error.GetMessage() != "" {
+		return errors.New(resp.Error.GetMessage())
+	}
+	return errors.New(http.StatusText(w.status))
+}
+
+// audited records calls of `handler` as `action` in the audit log. The VM of actions on VMs is
+// taken from the route unless the handler names it with `annotateAudit`.
+func (s *restServer) audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &auditEntry{
+			details: map[string]string{
+				"method": r.Method,
+				"path":   r.URL.RequestURI(),
+			},
+		}
+		if strings.HasPrefix(action, "vm.") {
+			entry.vmName = mux.Vars(r)["name"]
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry))
+		aw := &auditResponseWriter{ResponseWriter: w}
+		// Deferred to also record aborted streams.
+		defer func() {
+			statusCode := aw.status
+			if statusCode == 0 {
+				statusCode = http.StatusOK
+			}
+			entry.details["status"] = strconv.Itoa(statusCode)
+			s.vmServer.Audit(r.Context(), action, entry.vmName, start, entry.details, aw.err())
+		}()
+		handler(aw, r)
+	}
 }
 
 // Health check endpoint for load balancer monitoring
@@ -47,18 +281,730 @@ func (s *restServer) healthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Implement handler functions
+func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "startVM")
+	startTime := time.Now()
+
+	var req serverapi.StartVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetVmName() == "" {
+		logger.Error("Empty vm name")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Empty vm name")
+		return
+	}
+
+	vmName := req.GetVmName()
+	annotateAudit(r, vmName, map[string]string{"snapshotId": req.GetSnapshotId()})
+	async, err := isAsync(r)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request")
+		sendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if async {
+		op, err := s.vmServer.StartVMAsync(r.Context(), &req)
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM asynchronously")
+			sendErrorResponse(
+				w,
+				httpStatusFromError(err),
+				fmt.Sprintf("Failed to start VM: %v", err))
+			return
+		}
+		sendOperation(w, op)
+		return
+	}
+
+	resp, err := s.vmServer.StartVM(r.Context(), &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to start VM: %v", err))
+		return
+	}
+
+	elapsedTime := time.Since(startTime)
+	logger.WithFields(log.Fields{
+		"vmName":      vmName,
+		"startupTime": elapsedTime.String(),
+	}).Info("VM started successfully")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "destroyVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	// Create request object with the VM name
+	req := serverapi.VMRequest{
+		VmName: &vmName,
+	}
+
+	resp, err := s.vmServer.DestroyVM(r.Context(), &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to destroy VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "destroyAllVMs")
+	selector, err := server.ParseLabelSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		logger.WithError(err).Error("Invalid label selector")
+		sendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp, err := s.vmServer.DestroyAllVMs(r.Context(), selector)
+	if err != nil {
+		logger.WithError(err).Error("Failed to destroy all VMs")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to destroy all VMs: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listAllVMs")
+	selector, err := server.ParseLabelSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		logger.WithError(err).Error("Invalid label selector")
+		sendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp, err := s.vmServer.ListAllVMs(r.Context(), selector)
+	if err != nil {
+		logger.WithError(err).Error("Failed to list all VMs")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list all VMs: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "streamEvents")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("Streaming not supported")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			"Streaming not supported")
+		return
+	}
+
+	query := r.URL.Query()
+	selector, err := server.ParseLabelSelector(query.Get("selector"))
+	if err != nil {
+		logger.WithError(err).Error("Invalid label selector")
+		sendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, unsubscribe := s.vmServer.SubscribeEvents(server.EventFilter{
+		VMNames:  query["vm"],
+		Types:    query["event"],
+		Selector: selector,
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.shutdown:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.WithError(err).Error("Failed to marshal event")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.GetType(), data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *restServer) streamVMLog(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "streamVMLog")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("Streaming not supported")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			"Streaming not supported")
+		return
+	}
+
+	query := r.URL.Query()
+	follow := false
+	if value := query.Get("follow"); value != "" {
+		var err error
+		follow, err = strconv.ParseBool(value)
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Invalid request")
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid follow parameter: %s", value))
+			return
+		}
+	}
+	tail := -1
+	if value := query.Get("tail"); value != "" {
+		var err error
+		tail, err = strconv.Atoi(value)
+		if err != nil || tail < 0 {
+			logger.WithField("vmName", vmName).WithError(err).Error("Invalid request")
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid tail parameter: %s", value))
+			return
+		}
+	}
+
+	vmLog, err := s.vmServer.OpenVMLog(r.Context(), vmName, tail, follow)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to open VM log")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to open VM log: %v", err))
+		return
+	}
+	defer vmLog.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	// Followed until the client goes away or the server shuts down.
+	ctx, cancel := s.streamContext(r)
+	defer cancel()
+	// The status is sent already, failures past this point abort the response.
+	if err := vmLog.Write(ctx, w, flusher.Flush); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to stream VM log")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *restServer) attachConsole(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "attachConsole")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	console, err := s.vmServer.AttachConsole(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to attach console")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to attach console: %v", err))
+		return
+	}
+	defer console.Close()
+
+	// Clients other than browsers don't send an Origin header, so it isn't checked.
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		go func() {
+			// Detaches the console once the client goes away, which ends the output below.
+			defer console.Close()
+			if _, err := io.Copy(console, ws); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.WithField("vmName", vmName).WithError(err).Warn("Failed to forward console input")
+			}
+		}()
+		for output := range console.Output() {
+			if _, err := ws.Write(output); err != nil {
+				logger.WithField("vmName", vmName).WithError(err).Warn("Failed to send console output")
+				return
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
+
+func (s *restServer) metrics(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "metrics")
+	// Written to a buffer first so that failures can still be reported.
+	var buf bytes.Buffer
+	if err := s.vmServer.WriteMetrics(r.Context(), &buf); err != nil {
+		logger.WithError(err).Error("Failed to get metrics")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to get metrics: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.Write(buf.Bytes())
+}
+
+func (s *restServer) queryAuditLog(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "queryAuditLog")
+	query := r.URL.Query()
+	filter := server.AuditFilter{
+		VmName: query.Get("vmName"),
+		Caller: query.Get("caller"),
+		Action: query.Get("action"),
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logger.WithError(err).Error("Invalid request")
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid %s parameter: %s", name, value))
+			return
+		}
+		*t = parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			logger.WithError(err).Error("Invalid request")
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid limit parameter: %s", value))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	resp, err := s.vmServer.QueryAuditLog(r.Context(), filter)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query audit log")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.FailedPrecondition {
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to query audit log: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) capacity(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "capacity")
+	resp, err := s.vmServer.Capacity(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Failed to get capacity")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to get capacity: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listWarmPools(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listWarmPools")
+	resp, err := s.vmServer.ListWarmPools(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Failed to list warm pools")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list warm pools: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listOperations(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listOperations")
+	resp, err := s.vmServer.ListOperations(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Failed to list operations")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list operations: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) getOperation(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getOperation")
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	resp, err := s.vmServer.GetOperation(r.Context(), id)
+	if err != nil {
+		logger.WithField("operationId", id).WithError(err).Error("Failed to get operation")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get operation: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) cancelOperation(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cancelOperation")
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	resp, err := s.vmServer.CancelOperation(r.Context(), id)
+	if err != nil {
+		logger.WithField("operationId", id).WithError(err).Error("Failed to cancel operation")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to cancel operation: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	resp, err := s.vmServer.ListVM(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list VM")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "snapshotVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req struct {
+		SnapshotId string `json:"snapshotId,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	async, err := isAsync(r)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request")
+		sendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if async {
+		op, err := s.vmServer.SnapshotVMAsync(r.Context(), vmName, req.SnapshotId)
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to create snapshot asynchronously")
+			sendErrorResponse(
+				w,
+				httpStatusFromError(err),
+				fmt.Sprintf("Failed to create snapshot: %v", err))
+			return
+		}
+		sendOperation(w, op)
+		return
+	}
+
+	resp, err := s.vmServer.SnapshotVM(r.Context(), vmName, req.SnapshotId)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":     vmName,
+			"snapshotId": req.SnapshotId,
+		}).WithError(err).Error("Failed to create snapshot")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to create snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "updateVMState")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.V1VmsNamePatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	status := req.GetStatus()
+	annotateAudit(r, "", map[string]string{"status": status})
+	if status != "stopped" && status != "paused" && status != "resume" {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"status": status,
+		}).Error("Invalid status value")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid status value: %s", status))
+		return
+	}
+
+	vmReq := serverapi.VMRequest{
+		VmName: &vmName,
+	}
+
+	var resp *serverapi.VMResponse
+	var err error
+	if status == "stopped" {
+		resp, err = s.vmServer.StopVM(r.Context(), &vmReq)
+	} else if status == "paused" {
+		resp, err = s.vmServer.PauseVM(r.Context(), &vmReq)
+	} else { // status == "resume"
+		resp, err = s.vmServer.ResumeVM(r.Context(), &vmReq)
+	}
+
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"status": status,
+		}).WithError(err).Error("Failed to update VM state")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to change VM state to '%s': %v", status, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmCommand")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.VmCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetCmd() == "" {
+		logger.WithField("vmName", vmName).Error("Command cannot be empty")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Command cannot be empty")
+		return
+	}
+
+	cmd := req.GetCmd()
+	// Default to blocking if not specified
+	blocking := true
+	if req.Blocking != nil {
+		blocking = *req.Blocking
+	}
+
+	resp, err := s.vmServer.VMCommand(r.Context(), vmName, cmd, blocking)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":   vmName,
+			"cmd":      cmd,
+			"blocking": blocking,
+			"success":  false,
+		}).Error("Failed to execute command")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to execute command: %v", err))
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"vmName":   vmName,
+		"cmd":      cmd,
+		"blocking": blocking,
+		"success":  true,
+	}).Info("Successfully executed command")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) keepAliveVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "keepAliveVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	// The request body is optional.
+	var req serverapi.KeepAliveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	ttl := time.Duration(req.GetTtlSeconds()) * time.Second
+	resp, err := s.vmServer.KeepAliveVM(r.Context(), vmName, ttl)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to keep VM alive")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to keep VM alive: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listDisks(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listDisks")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.ListDisks(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list disks")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to list disks: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
-// Implement handler functions
-func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "startVM")
-	startTime := time.Now()
+func (s *restServer) attachDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "attachDisk")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
 
-	var req serverapi.StartVMRequest
+	var req serverapi.AttachDiskRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logger.WithError(err).Error("Invalid request body")
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
 		sendErrorResponse(
 			w,
 			http.StatusBadRequest,
@@ -66,52 +1012,191 @@ func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.GetVmName() == "" {
-		logger.Error("Empty vm name")
+	resp, err := s.vmServer.AttachDisk(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to attach disk")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition, codes.AlreadyExists:
+			statusCode = http.StatusConflict
+		}
 		sendErrorResponse(
 			w,
-			http.StatusBadRequest,
-			"Empty vm name")
+			statusCode,
+			fmt.Sprintf("Failed to attach disk: %v", err))
 		return
 	}
 
-	vmName := req.GetVmName()
-	resp, err := s.vmServer.StartVM(r.Context(), &req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) detachDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "detachDisk")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	diskId := vars["id"]
+
+	if err := s.vmServer.DetachDisk(r.Context(), vmName, diskId); err != nil {
+		logger.WithFields(log.Fields{"vmName": vmName, "diskId": diskId}).WithError(err).Error("Failed to detach disk")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to detach disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+func (s *restServer) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listSnapshots")
+
+	resp, err := s.vmServer.ListSnapshots(r.Context())
 	if err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
+		logger.WithError(err).Error("Failed to list snapshots")
 		sendErrorResponse(
 			w,
 			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to start VM: %v", err))
+			fmt.Sprintf("Failed to list snapshots: %v", err))
 		return
 	}
 
-	elapsedTime := time.Since(startTime)
-	logger.WithFields(log.Fields{
-		"vmName":      vmName,
-		"startupTime": elapsedTime.String(),
-	}).Info("VM started successfully")
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "destroyVM")
+func (s *restServer) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getSnapshot")
 	vars := mux.Vars(r)
-	vmName := vars["name"]
+	snapshotId := vars["id"]
 
-	// Create request object with the VM name
-	req := serverapi.VMRequest{
-		VmName: &vmName,
+	resp, err := s.vmServer.GetSnapshot(r.Context(), snapshotId)
+	if err != nil {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to get snapshot")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get snapshot: %v", err))
+		return
 	}
 
-	resp, err := s.vmServer.DestroyVM(r.Context(), &req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "deleteSnapshot")
+	vars := mux.Vars(r)
+	snapshotId := vars["id"]
+
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		force, err = strconv.ParseBool(value)
+		if err != nil {
+			logger.WithField("snapshotId", snapshotId).WithError(err).Error("Invalid request")
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid force parameter: %s", value))
+			return
+		}
+	}
+
+	if err := s.vmServer.DeleteSnapshot(r.Context(), snapshotId, force); err != nil {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to delete snapshot")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to delete snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+func (s *restServer) exportSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "exportSnapshot")
+	vars := mux.Vars(r)
+	snapshotId := vars["id"]
+
+	archive, err := s.vmServer.ExportSnapshot(r.Context(), snapshotId)
 	if err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM")
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to export snapshot")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to destroy VM: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to export snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", snapshotId+".tar.gz"))
+	// The status is sent with the first bytes of the archive, failures past that abort the response.
+	if err := archive.Write(r.Context(), w); err != nil {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to write snapshot archive")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *restServer) importSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "importSnapshot")
+	snapshotId := r.URL.Query().Get("id")
+
+	resp, err := s.vmServer.ImportSnapshot(r.Context(), r.Body, snapshotId)
+	if err != nil {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to import snapshot")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition, codes.AlreadyExists:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to import snapshot: %v", err))
 		return
 	}
 
@@ -119,15 +1204,16 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "destroyAllVMs")
-	resp, err := s.vmServer.DestroyAllVMs(r.Context())
+func (s *restServer) listVolumes(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listVolumes")
+
+	resp, err := s.vmServer.ListVolumes(r.Context())
 	if err != nil {
-		logger.WithError(err).Error("Failed to destroy all VMs")
+		logger.WithError(err).Error("Failed to list volumes")
 		sendErrorResponse(
 			w,
 			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to destroy all VMs: %v", err))
+			fmt.Sprintf("Failed to list volumes: %v", err))
 		return
 	}
 
@@ -135,15 +1221,33 @@ func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "listAllVMs")
-	resp, err := s.vmServer.ListAllVMs(r.Context())
+func (s *restServer) createVolume(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "createVolume")
+
+	var req serverapi.CreateVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CreateVolume(r.Context(), &req)
 	if err != nil {
-		logger.WithError(err).Error("Failed to list all VMs")
+		logger.WithField("volume", req.GetName()).WithError(err).Error("Failed to create volume")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.AlreadyExists:
+			statusCode = http.StatusConflict
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to list all VMs: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to create volume: %v", err))
 		return
 	}
 
@@ -151,17 +1255,22 @@ func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "listVM")
+func (s *restServer) getVolume(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getVolume")
 	vars := mux.Vars(r)
-	vmName := vars["name"]
-	resp, err := s.vmServer.ListVM(r.Context(), vmName)
+	name := vars["name"]
+
+	resp, err := s.vmServer.GetVolume(r.Context(), name)
 	if err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list VM")
+		logger.WithField("volume", name).WithError(err).Error("Failed to get volume")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to list VM: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to get volume: %v", err))
 		return
 	}
 
@@ -169,14 +1278,39 @@ func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "snapshotVM")
+func (s *restServer) deleteVolume(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "deleteVolume")
 	vars := mux.Vars(r)
-	vmName := vars["name"]
+	name := vars["name"]
 
-	var req struct {
-		SnapshotId string `json:"snapshotId,omitempty"`
+	if err := s.vmServer.DeleteVolume(r.Context(), name); err != nil {
+		logger.WithField("volume", name).WithError(err).Error("Failed to delete volume")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to delete volume: %v", err))
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+func (s *restServer) cloneVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cloneVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.CloneVMRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
 		sendErrorResponse(
@@ -186,16 +1320,25 @@ func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := s.vmServer.SnapshotVM(r.Context(), vmName, req.SnapshotId)
+	annotateAudit(r, "", map[string]string{"cloneName": req.GetVmName()})
+	resp, err := s.vmServer.CloneVM(r.Context(), vmName, &req)
 	if err != nil {
-		logger.WithFields(log.Fields{
-			"vmName":     vmName,
-			"snapshotId": req.SnapshotId,
-		}).WithError(err).Error("Failed to create snapshot")
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to clone VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition, codes.AlreadyExists:
+			statusCode = http.StatusConflict
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to create snapshot: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to clone VM: %v", err))
 		return
 	}
 
@@ -203,12 +1346,12 @@ func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "updateVMState")
+func (s *restServer) setSnapshotSchedule(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "setSnapshotSchedule")
 	vars := mux.Vars(r)
 	vmName := vars["name"]
 
-	var req serverapi.V1VmsNamePatchRequest
+	var req serverapi.SnapshotSchedule
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
 		sendErrorResponse(
@@ -218,42 +1361,36 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status := req.GetStatus()
-	if status != "stopped" && status != "paused" && status != "resume" {
-		logger.WithFields(log.Fields{
-			"vmName": vmName,
-			"status": status,
-		}).Error("Invalid status value")
+	resp, err := s.vmServer.SetSnapshotSchedule(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to set snapshot schedule")
 		sendErrorResponse(
 			w,
-			http.StatusBadRequest,
-			fmt.Sprintf("Invalid status value: %s", status))
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to set snapshot schedule: %v", err))
 		return
 	}
 
-	vmReq := serverapi.VMRequest{
-		VmName: &vmName,
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	var resp *serverapi.VMResponse
-	var err error
-	if status == "stopped" {
-		resp, err = s.vmServer.StopVM(r.Context(), &vmReq)
-	} else if status == "paused" {
-		resp, err = s.vmServer.PauseVM(r.Context(), &vmReq)
-	} else { // status == "resume"
-		resp, err = s.vmServer.ResumeVM(r.Context(), &vmReq)
-	}
+func (s *restServer) listCheckpoints(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listCheckpoints")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
 
+	resp, err := s.vmServer.ListCheckpoints(r.Context(), vmName)
 	if err != nil {
-		logger.WithFields(log.Fields{
-			"vmName": vmName,
-			"status": status,
-		}).WithError(err).Error("Failed to update VM state")
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list checkpoints")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to change VM state to '%s': %v", status, err))
+			statusCode,
+			fmt.Sprintf("Failed to list checkpoints: %v", err))
 		return
 	}
 
@@ -261,12 +1398,12 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "vmCommand")
+func (s *restServer) rollbackVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "rollbackVM")
 	vars := mux.Vars(r)
 	vmName := vars["name"]
 
-	var req serverapi.VmCommandRequest
+	var req serverapi.RollbackVMRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
 		sendErrorResponse(
@@ -276,43 +1413,89 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.GetCmd() == "" {
-		logger.WithField("vmName", vmName).Error("Command cannot be empty")
+	resp, err := s.vmServer.RollbackVM(r.Context(), vmName, req.SnapshotId)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to roll back VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to roll back VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) resizeVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "resizeVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.ResizeVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
 		sendErrorResponse(
 			w,
 			http.StatusBadRequest,
-			"Command cannot be empty")
+			fmt.Sprintf("Invalid request format: %v", err))
 		return
 	}
 
-	cmd := req.GetCmd()
-	// Default to blocking if not specified
-	blocking := true
-	if req.Blocking != nil {
-		blocking = *req.Blocking
+	resp, err := s.vmServer.ResizeVM(r.Context(), vmName, req.GetVcpus(), req.GetMemorySizeMB())
+	if err == nil && req.HasBalloonTargetMB() {
+		resp, err = s.vmServer.SetBalloonTarget(r.Context(), vmName, req.GetBalloonTargetMB())
+	}
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to resize VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to resize VM: %v", err))
+		return
 	}
 
-	resp, err := s.vmServer.VMCommand(r.Context(), vmName, cmd, blocking)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmEntryPointStatus(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmEntryPointStatus")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMEntryPointStatus(r.Context(), vmName)
 	if err != nil {
-		logger.WithFields(log.Fields{
-			"vmName":   vmName,
-			"cmd":      cmd,
-			"blocking": blocking,
-			"success":  false,
-		}).Error("Failed to execute command")
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get entry point status")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to execute command: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to get entry point status: %v", err))
 		return
 	}
 
-	logger.WithFields(log.Fields{
-		"vmName":   vmName,
-		"cmd":      cmd,
-		"blocking": blocking,
-		"success":  true,
-	}).Info("Successfully executed command")
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
@@ -394,6 +1577,8 @@ func (s *restServer) vmFileDownload(w http.ResponseWriter, r *http.Request) {
 func main() {
 	var serverConfig *config.ServerConfig
 	var configFile string
+	var keepVMs bool
+	var preserveVMs bool
 
 	app := &cli.App{
 		Name:  "arrakis-restserver",
@@ -406,8 +1591,22 @@ func main() {
 				Destination: &configFile,
 				Value:       "./config.yaml",
 			},
+			&cli.BoolFlag{
+				Name:        "keep-vms",
+				Usage:       "Leave VMs running on shutdown so that the next server instance re-attaches to them",
+				Destination: &keepVMs,
+			},
+			&cli.BoolFlag{
+				Name:        "preserve-vms",
+				Usage:       "Snapshot VMs on shutdown so that the next server instance restores them",
+				Destination: &preserveVMs,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
+			if keepVMs && preserveVMs {
+				return fmt.Errorf("--keep-vms and --preserve-vms are mutually exclusive")
+			}
+
 			var err error
 			serverConfig, err = config.GetServerConfig(configFile)
 			if err != nil {
@@ -424,27 +1623,70 @@ func main() {
 	}
 
 	// At this point `serverConfig` is populated.
+	trustedProxies, err := parseTrustedProxies(serverConfig.Audit)
+	if err != nil {
+		log.Fatalf("invalid audit config: %v", err)
+	}
+
 	// Create the VM server
 	vmServer, err := server.NewServer(*serverConfig)
 	if err != nil {
 		log.Fatalf("failed to create VM server: %v", err)
 	}
+	vmServer.SetPreserveVMs(preserveVMs)
 
 	// Create REST server
-	s := &restServer{vmServer: vmServer}
+	s := &restServer{
+		vmServer:       vmServer,
+		callerHeader:   serverConfig.Audit.CallerHeader,
+		trustedProxies: trustedProxies,
+		shutdown:       make(chan struct{}),
+	}
 	r := mux.NewRouter()
+	r.Use(s.identifyCaller)
 
-	// Register routes
-	r.HandleFunc("/"+API_VERSION+"/vms", s.startVM).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.updateVMState).Methods("PATCH")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.destroyVM).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.destroyAllVMs).Methods("DELETE")
+	// Register routes. Calls changing VMs, snapshots and volumes or accessing guests are recorded in
+	// the audit log, commands and file transfers are recorded by the VM server.
+	r.HandleFunc("/"+API_VERSION+"/vms", s.audited("vm.start", s.startVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.audited("vm.update-state", s.updateVMState)).Methods("PATCH")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.audited("vm.destroy", s.destroyVM)).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/vms", s.audited("vm.destroy-all", s.destroyAllVMs)).Methods("DELETE")
 	r.HandleFunc("/"+API_VERSION+"/vms", s.listAllVMs).Methods("GET")
 	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.listVM).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/snapshots", s.snapshotVM).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/snapshots", s.audited("vm.snapshot", s.snapshotVM)).Methods("POST")
 	r.HandleFunc("/"+API_VERSION+"/vms/{name}/cmd", s.vmCommand).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/entrypoint", s.vmEntryPointStatus).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/logs", s.audited("vm.logs", s.streamVMLog)).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/console", s.audited("vm.console", s.attachConsole)).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/keepalive", s.audited("vm.keepalive", s.keepAliveVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/clone", s.audited("vm.clone", s.cloneVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/snapshot-schedule", s.audited("vm.set-snapshot-schedule", s.setSnapshotSchedule)).Methods("PUT")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/checkpoints", s.listCheckpoints).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/rollback", s.audited("vm.rollback", s.rollbackVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/resources", s.audited("vm.resize", s.resizeVM)).Methods("PATCH")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/disks", s.listDisks).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/disks", s.audited("vm.attach-disk", s.attachDisk)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/disks/{id}", s.audited("vm.detach-disk", s.detachDisk)).Methods("DELETE")
 	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileUpload).Methods("POST")
 	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileDownload).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/snapshots", s.listSnapshots).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/{id}", s.getSnapshot).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/{id}", s.audited("snapshot.delete", s.deleteSnapshot)).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/{id}/export", s.audited("snapshot.export", s.exportSnapshot)).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/import", s.audited("snapshot.import", s.importSnapshot)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/volumes", s.listVolumes).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/volumes", s.audited("volume.create", s.createVolume)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/volumes/{name}", s.getVolume).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/volumes/{name}", s.audited("volume.delete", s.deleteVolume)).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/operations", s.listOperations).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/operations/{id}", s.getOperation).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/operations/{id}/cancel", s.audited("operation.cancel", s.cancelOperation)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/warmpools", s.listWarmPools).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/capacity", s.capacity).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/audit", s.queryAuditLog).Methods("GET")
+	// Where Prometheus scrapes metrics by default, hence not versioned.
+	r.HandleFunc("/metrics", s.metrics).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/events", s.streamEvents).Methods("GET")
 	r.HandleFunc("/"+API_VERSION+"/health", s.healthCheck).Methods("GET")
 
 	// Start HTTP server
@@ -452,6 +1694,10 @@ func main() {
 		Addr:    serverConfig.Host + ":" + serverConfig.Port,
 		Handler: r,
 	}
+	// Streams are ended on shutdown, other requests are waited for.
+	srv.RegisterOnShutdown(func() {
+		close(s.shutdown)
+	})
 
 	go func() {
 		log.Printf("REST server listening on: %s:%s", serverConfig.Host, serverConfig.Port)
@@ -469,6 +1715,15 @@ func main() {
 	if err := srv.Shutdown(context.Background()); err != nil {
 		log.Fatalf("Server shutdown failed: %v", err)
 	}
-	vmServer.DestroyAllVMs(context.Background())
+	vmServer.StopWarmPools()
+	if preserveVMs {
+		if err := vmServer.PreserveVMs(context.Background()); err != nil {
+			log.WithError(err).Fatal("failed to preserve VMs, VMs that weren't preserved are left running")
+		}
+	} else if keepVMs {
+		log.Println("Leaving VMs running")
+	} else {
+		vmServer.DestroyAllVMs(context.Background(), nil)
+	}
 	log.Println("Server stopped")
 }
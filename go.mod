@@ -11,6 +11,7 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/viper v1.19.0
 	github.com/urfave/cli/v2 v2.27.3
+	golang.org/x/sys v0.28.0
 	google.golang.org/grpc v1.65.0
 )
 
@@ -44,8 +45,7 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
-	golang.org/x/net v0.32.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/net v0.32.0
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
 	gvisor.dev/gvisor v0.0.0-20241025194355-0b2cae1b4ea8
 )
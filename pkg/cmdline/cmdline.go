@@ -0,0 +1,49 @@
+package cmdline
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParseKey parses a key from the kernel command line. Assumes each key:val is present like
+// key="val" in /proc/cmdline.
+func ParseKey(prefix string) (string, error) {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/cmdline: %w", err)
+	}
+	return parseKey(strings.TrimSpace(string(cmdline)), prefix)
+}
+
+// parseKey returns the value of the key `prefix` in `cmdline`. The key must start a parameter, so
+// that e.g. "ip" doesn't match "guest_ip=". Unquoted values end at the next space.
+func parseKey(cmdline string, prefix string) (string, error) {
+	key := prefix + "="
+
+	rest := cmdline
+	for {
+		start := strings.Index(rest, key)
+		if start == -1 {
+			return "", fmt.Errorf("key %q not found in kernel command line", key)
+		}
+		startsParameter := start == 0 || rest[start-1] == ' '
+		rest = rest[start+len(key):]
+		if startsParameter {
+			break
+		}
+	}
+
+	value, quoted := strings.CutPrefix(rest, "\"")
+	if !quoted {
+		if end := strings.IndexByte(value, ' '); end != -1 {
+			value = value[:end]
+		}
+		return value, nil
+	}
+	end := strings.IndexByte(value, '"')
+	if end == -1 {
+		return "", fmt.Errorf("unclosed quote for key %q in kernel command line", key)
+	}
+	return value[:end], nil
+}
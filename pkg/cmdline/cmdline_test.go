@@ -0,0 +1,47 @@
+package cmdline
+
+import (
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	cmdline := `console=ttyS0 gateway_ip="10.20.1.1" guest_ip="10.20.1.2/24" ` +
+		`entry_point="cHl0aG9uMyAtbSBodHRwLnNlcnZlcg" entry_point_restart="on-failure"`
+	tests := []struct {
+		cmdline string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{cmdline: cmdline, key: "console", want: "ttyS0"},
+		{cmdline: cmdline, key: "gateway_ip", want: "10.20.1.1"},
+		{cmdline: cmdline, key: "guest_ip", want: "10.20.1.2/24"},
+		{cmdline: cmdline, key: "entry_point", want: "cHl0aG9uMyAtbSBodHRwLnNlcnZlcg"},
+		{cmdline: cmdline, key: "entry_point_restart", want: "on-failure"},
+		// Keys only match whole parameters.
+		{cmdline: cmdline, key: "ip", wantErr: true},
+		{cmdline: `x_ip="1" ip="2"`, key: "ip", want: "2"},
+		{cmdline: cmdline, key: "restart", wantErr: true},
+		{cmdline: `key=""`, key: "key", want: ""},
+		{cmdline: `key="a b" other="c"`, key: "key", want: "a b"},
+		{cmdline: `key=value other="c"`, key: "key", want: "value"},
+		{cmdline: `key="unclosed`, key: "key", wantErr: true},
+		{cmdline: "", key: "key", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseKey(test.cmdline, test.key)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseKey(%q, %q) = %q, want error", test.cmdline, test.key, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseKey(%q, %q) failed: %v", test.cmdline, test.key, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseKey(%q, %q) = %q, want %q", test.cmdline, test.key, got, test.want)
+		}
+	}
+}
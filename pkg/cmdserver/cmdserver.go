@@ -1,5 +1,10 @@
 package cmdserver
 
+import (
+	"path"
+	"regexp"
+)
+
 // fileData represents a single file's content and metadata.
 type FileData struct {
 	Content string `json:"content"`
@@ -27,4 +32,75 @@ type FilesPostRequest struct {
 type RunCmdResponse struct {
 	Output string `json:"output,omitempty"`
 	Error  string `json:"error,omitempty"`
-} 
\ No newline at end of file
+}
+
+// Kernel command line keys used by the host to pass the entry point of the sandbox to the guest.
+// The entry point itself is base64 (URL, unpadded) encoded so that it survives the command line.
+const (
+	EntryPointCmdlineKey              = "entry_point"
+	EntryPointRestartPolicyCmdlineKey = "entry_point_restart"
+)
+
+// Restart policies of the entry point.
+const (
+	RestartPolicyNever     = "never"
+	RestartPolicyOnFailure = "on-failure"
+	RestartPolicyAlways    = "always"
+)
+
+// States of the entry point.
+const (
+	EntryPointStateNotConfigured = "not-configured"
+	EntryPointStateRunning       = "running"
+	EntryPointStateRestarting    = "restarting"
+	EntryPointStateExited        = "exited"
+)
+
+// IsValidRestartPolicy returns true if `policy` is one of the supported restart policies.
+func IsValidRestartPolicy(policy string) bool {
+	switch policy {
+	case RestartPolicyNever, RestartPolicyOnFailure, RestartPolicyAlways:
+		return true
+	default:
+		return false
+	}
+}
+
+// EntryPointStatus describes the entry point process supervised inside the guest.
+type EntryPointStatus struct {
+	Cmd           string `json:"cmd,omitempty"`
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+	State         string `json:"state"`
+	Pid           int    `json:"pid,omitempty"`
+	ExitCode      int    `json:"exitCode"`
+	RestartCount  int    `json:"restartCount"`
+}
+
+// Hot-plugged disks are mounted at `DisksMountDir`/<id> inside the guest.
+const DisksMountDir = "/mnt/disks"
+
+// Disk IDs double as the virtio-blk serial through which the guest finds the disk, which is limited
+// to 20 bytes.
+var diskIdRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,19}$`)
+
+// IsValidDiskId returns true if `id` can identify a hot-plugged disk.
+func IsValidDiskId(id string) bool {
+	return diskIdRegexp.MatchString(id)
+}
+
+// DiskMountPoint returns where the hot-plugged disk `id` is mounted inside the guest.
+func DiskMountPoint(id string) string {
+	return path.Join(DisksMountDir, id)
+}
+
+// DiskMountRequest asks the guest to mount the hot-plugged disk with the serial `Id`.
+type DiskMountRequest struct {
+	Id       string `json:"id"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// DiskMountResponse is where a hot-plugged disk was mounted inside the guest.
+type DiskMountResponse struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mountPoint"`
+}
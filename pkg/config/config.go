@@ -17,6 +17,90 @@ type PortForwardConfig struct {
 	Description string `mapstructure:"description"`
 }
 
+// WarmPoolConfig describes a pool of VMs booted ahead of time. Empty image paths default to the
+// server's ones. If `SnapshotId` is set the VMs are restored from that snapshot instead.
+type WarmPoolConfig struct {
+	Name          string `mapstructure:"name"`
+	Size          int32  `mapstructure:"size"`
+	KernelPath    string `mapstructure:"kernel"`
+	RootfsPath    string `mapstructure:"rootfs"`
+	InitramfsPath string `mapstructure:"initramfs"`
+	SnapshotId    string `mapstructure:"snapshot_id"`
+}
+
+// TenantQuotaConfig limits the VMs a single tenant can run. Zero values are unlimited. The tenant is
+// the caller of the API as identified for the audit log, or "default" for callers without a quota.
+type TenantQuotaConfig struct {
+	Tenant            string `mapstructure:"tenant"`
+	MaxVMs            int32  `mapstructure:"max_vms"`
+	MaxVCPUs          int32  `mapstructure:"max_vcpus"`
+	MaxMemoryMB       int32  `mapstructure:"max_memory_mb"`
+	MaxStatefulDiskMB int32  `mapstructure:"max_stateful_disk_mb"`
+}
+
+// AdmissionConfig limits the resources committed to VMs on the host. Zero values are unlimited. A
+// VM that doesn't fit waits for up to `QueueTimeoutSeconds` for resources to be freed before being
+// rejected.
+type AdmissionConfig struct {
+	MaxVCPUs            int32               `mapstructure:"max_vcpus"`
+	MaxMemoryMB         int32               `mapstructure:"max_memory_mb"`
+	MaxStatefulDiskMB   int32               `mapstructure:"max_stateful_disk_mb"`
+	QueueTimeoutSeconds int32               `mapstructure:"queue_timeout_seconds"`
+	TenantQuotas        []TenantQuotaConfig `mapstructure:"tenant_quotas"`
+}
+
+// ResizeConfig sets how far VMs can be grown while running. `MaxVCPUs` defaults to the host's CPU
+// count. Up to `MemoryHotplugMB` of memory can be hot-plugged, zero disables memory hotplug.
+type ResizeConfig struct {
+	MaxVCPUs        int32 `mapstructure:"max_vcpus"`
+	MemoryHotplugMB int32 `mapstructure:"memory_hotplug_mb"`
+}
+
+// BalloonConfig sets how much memory is reclaimed automatically through the virtio-balloon device
+// of VMs. VMs that saw no activity for `IdleAfterSeconds` have `IdleReclaimPercent` of their memory
+// reclaimed until they're active again, paused VMs `PausedReclaimPercent` until they're resumed.
+// Zero values disable the respective reclaim.
+type BalloonConfig struct {
+	IdleAfterSeconds     int32 `mapstructure:"idle_after_seconds"`
+	IdleReclaimPercent   int32 `mapstructure:"idle_reclaim_percent"`
+	PausedReclaimPercent int32 `mapstructure:"paused_reclaim_percent"`
+}
+
+// AuditConfig sets where the audit log of API calls and of commands run and files transferred in
+// VMs is appended to as JSON lines. Empty `Path` disables the audit log. The log is rotated once it
+// reaches `MaxSizeMB`, 100 by default, keeping `MaxFiles`, 5 by default, rotated logs as
+// "<path>.1", "<path>.2" and so on. Callers are identified by the request header `CallerHeader` if
+// set by an authenticating proxy at one of the addresses or CIDR ranges `TrustedProxies`, and by
+// their address otherwise.
+type AuditConfig struct {
+	Path           string   `mapstructure:"path"`
+	MaxSizeMB      int32    `mapstructure:"max_size_mb"`
+	MaxFiles       int32    `mapstructure:"max_files"`
+	CallerHeader   string   `mapstructure:"caller_header"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+}
+
+// S3Config describes a bucket of an S3 compatible object store, e.g. MinIO, addressed path-style.
+// Empty credentials default to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+// variables.
+type S3Config struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	Region          string `mapstructure:"region"`
+	Bucket          string `mapstructure:"bucket"`
+	Prefix          string `mapstructure:"prefix"`
+	AccessKeyId     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+}
+
+// SnapshotStoreConfig sets where snapshots are kept. `Type` "local", the default, keeps them in
+// `Dir`, by default the "snapshots" directory of the state directory. "s3" keeps them in the bucket
+// `S3` and caches the ones in use in the state directory.
+type SnapshotStoreConfig struct {
+	Type string   `mapstructure:"type"`
+	Dir  string   `mapstructure:"dir"`
+	S3   S3Config `mapstructure:"s3"`
+}
+
 type ServerConfig struct {
 	Host               string              `mapstructure:"host"`
 	Port               string              `mapstructure:"port"`
@@ -31,6 +115,18 @@ type ServerConfig struct {
 	InitramfsPath      string              `mapstructure:"initramfs"`
 	StatefulSizeInMB   int32               `mapstructure:"stateful_size_in_mb"`
 	GuestMemPercentage int32               `mapstructure:"guest_mem_percentage"`
+	WarmPools          []WarmPoolConfig    `mapstructure:"warm_pools"`
+	Admission          AdmissionConfig     `mapstructure:"admission"`
+	Resize             ResizeConfig        `mapstructure:"resize"`
+	Balloon            BalloonConfig       `mapstructure:"balloon"`
+	// Directory holding the disk images that can be hot-plugged into VMs. Empty disables attaching
+	// existing images.
+	DiskImagesDir string              `mapstructure:"disk_images_dir"`
+	SnapshotStore SnapshotStoreConfig `mapstructure:"snapshot_store"`
+	// Directory the logs of destroyed VMs, including VMs that failed to boot, are kept in as
+	// "<vm name>.log". Empty deletes the logs along with the VMs.
+	VMLogsDir string      `mapstructure:"vm_logs_dir"`
+	Audit     AuditConfig `mapstructure:"audit"`
 }
 
 func (c ServerConfig) String() string {
@@ -47,6 +143,14 @@ PortForwards: %+v
 InitramfsPath: %s
 StatefulSizeInMB: %d
 GuestMemPercentage: %d
+WarmPools: %+v
+Admission: %+v
+Resize: %+v
+Balloon: %+v
+DiskImagesDir: %s
+SnapshotStore: {Type: %s Dir: %s S3: {Endpoint: %s Region: %s Bucket: %s Prefix: %s}}
+VMLogsDir: %s
+Audit: %+v
 }`,
 		c.Host,
 		c.Port,
@@ -60,6 +164,19 @@ GuestMemPercentage: %d
 		c.InitramfsPath,
 		c.StatefulSizeInMB,
 		c.GuestMemPercentage,
+		c.WarmPools,
+		c.Admission,
+		c.Resize,
+		c.Balloon,
+		c.DiskImagesDir,
+		c.SnapshotStore.Type,
+		c.SnapshotStore.Dir,
+		c.SnapshotStore.S3.Endpoint,
+		c.SnapshotStore.S3.Region,
+		c.SnapshotStore.S3.Bucket,
+		c.SnapshotStore.S3.Prefix,
+		c.VMLogsDir,
+		c.Audit,
 	)
 }
 
@@ -0,0 +1,170 @@
+// Package metrics writes metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+
+	// Content type of the Prometheus text exposition format.
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DurationBuckets are the upper bounds in seconds of the buckets of histograms of operations
+// taking between milliseconds and minutes.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Writer writes metrics to an `io.Writer`. The samples of a metric must be written right after the
+// metric was described with `Describe`. The first error is kept and returned by `Err`.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a writer writing metrics to `w`.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Describe writes the help and type of the metric `name`.
+func (w *Writer) Describe(name string, metricType string, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, metricType)
+}
+
+// Sample writes a sample of the metric `name` with `labels`, which may be nil.
+func (w *Writer) Sample(name string, labels map[string]string, value float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+// Err returns the first error writing metrics.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+// Histogram counts observed values in buckets. It's safe for concurrent use.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock sync.Mutex
+	// Number of values observed per bucket, the last one counting values above all bounds.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a histogram named `name` with buckets with the sorted upper bounds
+// `buckets`.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds `value` to the histogram.
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince adds the seconds elapsed since `start` to the histogram.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Write writes the histogram to `w`.
+func (h *Histogram) Write(w *Writer) {
+	h.lock.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	count := h.count
+	h.lock.Unlock()
+
+	w.Describe(h.name, TypeHistogram, h.help)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		w.Sample(h.name+"_bucket", map[string]string{"le": formatValue(bound)}, float64(cumulative))
+	}
+	w.Sample(h.name+"_bucket", map[string]string{"le": "+Inf"}, float64(count))
+	w.Sample(h.name+"_sum", nil, sum)
+	w.Sample(h.name+"_count", nil, float64(count))
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
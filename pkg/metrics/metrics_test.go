@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Describe("vms", TypeGauge, "Number of VMs.\nBy status, \\ included.")
+	w.Sample("vms", map[string]string{"status": "running", "host": "a\"b\nc\\d"}, 3)
+	w.Sample("vms", nil, 1.5)
+	if err := w.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+
+	want := "# HELP vms Number of VMs.\\nBy status, \\\\ included.\n" +
+		"# TYPE vms gauge\n" +
+		"vms{host=\"a\\\"b\\nc\\\\d\",status=\"running\"} 3\n" +
+		"vms 1.5\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("write failed")
+}
+
+func TestWriterKeepsFirstError(t *testing.T) {
+	out := &failingWriter{}
+	w := NewWriter(out)
+	w.Describe("vms", TypeGauge, "Number of VMs.")
+	w.Sample("vms", nil, 1)
+	if w.Err() == nil {
+		t.Errorf("Err() = nil after a failed write")
+	}
+	if out.writes != 1 {
+		t.Errorf("%d writes after the first failed, want none", out.writes-1)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{value: 0, want: "0"},
+		{value: 42, want: "42"},
+		{value: -1.25, want: "-1.25"},
+		{value: 0.005, want: "0.005"},
+		{value: 1e21, want: "1e+21"},
+		{value: math.Inf(1), want: "+Inf"},
+		{value: math.Inf(-1), want: "-Inf"},
+		{value: math.NaN(), want: "NaN"},
+	}
+	for _, test := range tests {
+		if got := formatValue(test.value); got != test.want {
+			t.Errorf("formatValue(%v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("op_seconds", "Duration of operations.", []float64{0.1, 1, 10})
+	for _, value := range []float64{0.05, 0.1, 0.5, 1, 20} {
+		h.Observe(value)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h.Write(w)
+	if err := w.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+
+	// Bounds are inclusive and buckets cumulative.
+	want := "# HELP op_seconds Duration of operations.\n" +
+		"# TYPE op_seconds histogram\n" +
+		"op_seconds_bucket{le=\"0.1\"} 2\n" +
+		"op_seconds_bucket{le=\"1\"} 4\n" +
+		"op_seconds_bucket{le=\"10\"} 4\n" +
+		"op_seconds_bucket{le=\"+Inf\"} 5\n" +
+		"op_seconds_sum 21.65\n" +
+		"op_seconds_count 5\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Tenant of the VMs of callers without a quota of their own, who share its quota.
+	defaultTenant = "default"
+)
+
+func (r vmResources) add(other vmResources) vmResources {
+	return vmResources{
+		vcpus:              r.vcpus + other.vcpus,
+		memorySizeMB:       r.memorySizeMB + other.memorySizeMB,
+		statefulDiskSizeMB: r.statefulDiskSizeMB + other.statefulDiskSizeMB,
+	}
+}
+
+func (r vmResources) sub(other vmResources) vmResources {
+	return vmResources{
+		vcpus:              r.vcpus - other.vcpus,
+		memorySizeMB:       r.memorySizeMB - other.memorySizeMB,
+		statefulDiskSizeMB: r.statefulDiskSizeMB - other.statefulDiskSizeMB,
+	}
+}
+
+// exceeds returns the name of the first resource in `r` above its limit in `limits` or an empty
+// string. Zero limits are unlimited.
+func (r vmResources) exceeds(limits vmResources) string {
+	if limits.vcpus > 0 && r.vcpus > limits.vcpus {
+		return "vcpus"
+	}
+	if limits.memorySizeMB > 0 && r.memorySizeMB > limits.memorySizeMB {
+		return "memory"
+	}
+	if limits.statefulDiskSizeMB > 0 && r.statefulDiskSizeMB > limits.statefulDiskSizeMB {
+		return "stateful disk"
+	}
+	return ""
+}
+
+type tenantUsage struct {
+	vms       int32
+	resources vmResources
+}
+
+type tenantQuota struct {
+	maxVMs    int32
+	resources vmResources
+}
+
+// admissionController tracks the resources committed to VMs and refuses VMs that would exceed the
+// host's limits or their tenant's quota. VMs in warm pools don't belong to a tenant until they are
+// handed out, they only count against the host's limits.
+type admissionController struct {
+	lock         sync.Mutex
+	limits       vmResources
+	committed    vmResources
+	queueTimeout time.Duration
+	queued       int32
+	quotas       map[string]tenantQuota
+	tenants      map[string]*tenantUsage
+	// Closed and replaced whenever resources are released to wake up queued requests.
+	released chan struct{}
+}
+
+func newAdmissionController(admissionConfig config.AdmissionConfig) *admissionController {
+	a := &admissionController{
+		limits: vmResources{
+			vcpus:              admissionConfig.MaxVCPUs,
+			memorySizeMB:       admissionConfig.MaxMemoryMB,
+			statefulDiskSizeMB: admissionConfig.MaxStatefulDiskMB,
+		},
+		queueTimeout: time.Duration(admissionConfig.QueueTimeoutSeconds) * time.Second,
+		quotas:       make(map[string]tenantQuota, len(admissionConfig.TenantQuotas)),
+		tenants:      make(map[string]*tenantUsage),
+		released:     make(chan struct{}),
+	}
+	for _, quota := range admissionConfig.TenantQuotas {
+		a.quotas[quota.Tenant] = tenantQuota{
+			maxVMs: quota.MaxVMs,
+			resources: vmResources{
+				vcpus:              quota.MaxVCPUs,
+				memorySizeMB:       quota.MaxMemoryMB,
+				statefulDiskSizeMB: quota.MaxStatefulDiskMB,
+			},
+		}
+	}
+	return a
+}
+
+// tenantOf returns the tenant whose quota the VMs started by `caller` count against, the caller
+// itself if it has a quota and the default tenant otherwise. Callers can't pick another tenant.
+func (a *admissionController) tenantOf(caller string) string {
+	if _, ok := a.quotas[caller]; ok {
+		return caller
+	}
+	return defaultTenant
+}
+
+// checkQuotaLocked returns an error if a VM with `resources` exceeds the quota of `tenant`. Expects
+// `a.lock` to be held.
+func (a *admissionController) checkQuotaLocked(tenant string, resources vmResources) error {
+	if tenant == "" {
+		return nil
+	}
+	quota, ok := a.quotas[tenant]
+	if !ok {
+		return nil
+	}
+
+	var usage tenantUsage
+	if u, ok := a.tenants[tenant]; ok {
+		usage = *u
+	}
+	if quota.maxVMs > 0 && usage.vms+1 > quota.maxVMs {
+		return status.Errorf(codes.ResourceExhausted, "quota of tenant %s exceeded: vms", tenant)
+	}
+	if resource := usage.resources.add(resources).exceeds(quota.resources); resource != "" {
+		return status.Errorf(codes.ResourceExhausted, "quota of tenant %s exceeded: %s", tenant, resource)
+	}
+	return nil
+}
+
+// chargeTenantLocked adds a VM with `resources` to the usage of `tenant`. Expects `a.lock` to be
+// held.
+func (a *admissionController) chargeTenantLocked(tenant string, resources vmResources) {
+	if tenant == "" {
+		return
+	}
+	usage, ok := a.tenants[tenant]
+	if !ok {
+		usage = &tenantUsage{}
+		a.tenants[tenant] = usage
+	}
+	usage.vms++
+	usage.resources = usage.resources.add(resources)
+}
+
+// unchargeTenantLocked removes a VM with `resources` from the usage of `tenant`. Expects `a.lock` to
+// be held.
+func (a *admissionController) unchargeTenantLocked(tenant string, resources vmResources) {
+	usage, ok := a.tenants[tenant]
+	if !ok {
+		return
+	}
+	usage.vms--
+	usage.resources = usage.resources.sub(resources)
+	if usage.vms <= 0 {
+		delete(a.tenants, tenant)
+	}
+}
+
+// admit commits `resources` for a new VM of `tenant`. If the host doesn't have enough capacity
+// left it waits for up to the configured queue timeout for other VMs to be destroyed. Quotas are
+// enforced right away.
+func (a *admissionController) admit(ctx context.Context, tenant string, resources vmResources) error {
+	// A VM that can't fit even on an empty host is never admitted.
+	if resource := resources.exceeds(a.limits); resource != "" {
+		return status.Errorf(codes.ResourceExhausted, "VM exceeds the host's limit: %s", resource)
+	}
+
+	deadline := time.Now().Add(a.queueTimeout)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for {
+		if err := a.checkQuotaLocked(tenant, resources); err != nil {
+			return err
+		}
+
+		resource := a.committed.add(resources).exceeds(a.limits)
+		if resource == "" {
+			a.committed = a.committed.add(resources)
+			a.chargeTenantLocked(tenant, resources)
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return status.Errorf(codes.ResourceExhausted, "not enough capacity on the host: %s", resource)
+		}
+
+		released := a.released
+		a.queued++
+		a.lock.Unlock()
+		timer := time.NewTimer(remaining)
+		select {
+		case <-released:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		a.lock.Lock()
+		a.queued--
+
+		if err := ctx.Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+}
+
+// commit records `resources` of a VM that already exists without enforcing any limit, e.g. one
+// adopted from a previous server instance.
+func (a *admissionController) commit(tenant string, resources vmResources) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.committed = a.committed.add(resources)
+	a.chargeTenantLocked(tenant, resources)
+}
+
+// chargeTenant moves a VM with `resources` that is already committed to the host, i.e. one in a
+// warm pool, to `tenant` if the tenant's quota allows it.
+func (a *admissionController) chargeTenant(tenant string, resources vmResources) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := a.checkQuotaLocked(tenant, resources); err != nil {
+		return err
+	}
+	a.chargeTenantLocked(tenant, resources)
+	return nil
+}
+
+// unchargeTenant undoes `chargeTenant`.
+func (a *admissionController) unchargeTenant(tenant string, resources vmResources) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.unchargeTenantLocked(tenant, resources)
+}
+
+// release frees the resources of a destroyed VM of `tenant`.
+func (a *admissionController) release(tenant string, resources vmResources) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.committed = a.committed.sub(resources)
+	a.unchargeTenantLocked(tenant, resources)
+
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+func newResourceUsage(limit int32, committed int32) *serverapi.ResourceUsage {
+	usage := &serverapi.ResourceUsage{
+		Limit:     serverapi.PtrInt32(limit),
+		Committed: serverapi.PtrInt32(committed),
+	}
+	if limit > 0 {
+		usage.SetAvailable(max(limit-committed, 0))
+	}
+	return usage
+}
+
+// Capacity returns the resources committed to VMs, the host's limits and the usage of every tenant
+// that has VMs or a quota.
+func (s *Server) Capacity(ctx context.Context) (*serverapi.CapacityResponse, error) {
+	residentMemoryMB := s.residentMemoryMB()
+
+	a := s.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	tenantNames := make(map[string]bool, len(a.tenants)+len(a.quotas))
+	for tenant := range a.tenants {
+		tenantNames[tenant] = true
+	}
+	for tenant := range a.quotas {
+		tenantNames[tenant] = true
+	}
+
+	tenants := make([]serverapi.TenantUsage, 0, len(tenantNames))
+	for tenant := range tenantNames {
+		var usage tenantUsage
+		if u, ok := a.tenants[tenant]; ok {
+			usage = *u
+		}
+		quota := a.quotas[tenant]
+		tenants = append(tenants, serverapi.TenantUsage{
+			Tenant:         serverapi.PtrString(tenant),
+			Vms:            newResourceUsage(quota.maxVMs, usage.vms),
+			Vcpus:          newResourceUsage(quota.resources.vcpus, usage.resources.vcpus),
+			MemoryMB:       newResourceUsage(quota.resources.memorySizeMB, usage.resources.memorySizeMB),
+			StatefulDiskMB: newResourceUsage(quota.resources.statefulDiskSizeMB, usage.resources.statefulDiskSizeMB),
+		})
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].GetTenant() < tenants[j].GetTenant()
+	})
+
+	return &serverapi.CapacityResponse{
+		Vcpus:            newResourceUsage(a.limits.vcpus, a.committed.vcpus),
+		MemoryMB:         newResourceUsage(a.limits.memorySizeMB, a.committed.memorySizeMB),
+		StatefulDiskMB:   newResourceUsage(a.limits.statefulDiskSizeMB, a.committed.statefulDiskSizeMB),
+		QueuedRequests:   serverapi.PtrInt32(a.queued),
+		ResidentMemoryMB: serverapi.PtrInt32(residentMemoryMB),
+		Tenants:          tenants,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestAdmissionController(queueTimeoutSeconds int32) *admissionController {
+	return newAdmissionController(config.AdmissionConfig{
+		MaxVCPUs:            8,
+		MaxMemoryMB:         8192,
+		QueueTimeoutSeconds: queueTimeoutSeconds,
+		TenantQuotas: []config.TenantQuotaConfig{
+			{Tenant: "alice", MaxVMs: 2, MaxVCPUs: 4},
+			{Tenant: defaultTenant, MaxMemoryMB: 2048},
+		},
+	})
+}
+
+func checkCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("got error %v, want code %v", err, want)
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	a := newTestAdmissionController(0)
+	tests := map[string]string{
+		"alice":       "alice",
+		"bob":         defaultTenant,
+		"":            defaultTenant,
+		defaultTenant: defaultTenant,
+	}
+	for caller, want := range tests {
+		if got := a.tenantOf(caller); got != want {
+			t.Errorf("tenantOf(%q) = %q, want %q", caller, got, want)
+		}
+	}
+}
+
+func TestAdmitHostLimits(t *testing.T) {
+	a := newTestAdmissionController(0)
+	ctx := context.Background()
+	vm := vmResources{vcpus: 3, memorySizeMB: 1024}
+
+	checkCode(t, a.admit(ctx, "", vmResources{vcpus: 9}), codes.ResourceExhausted)
+	for i := 0; i < 2; i++ {
+		if err := a.admit(ctx, "", vm); err != nil {
+			t.Fatalf("admit() failed: %v", err)
+		}
+	}
+	checkCode(t, a.admit(ctx, "", vm), codes.ResourceExhausted)
+	if want := (vmResources{vcpus: 6, memorySizeMB: 2048}); a.committed != want {
+		t.Errorf("committed = %+v, want %+v", a.committed, want)
+	}
+
+	a.release("", vm)
+	if err := a.admit(ctx, "", vm); err != nil {
+		t.Errorf("admit() after release failed: %v", err)
+	}
+}
+
+func TestAdmitTenantQuotas(t *testing.T) {
+	a := newTestAdmissionController(0)
+	ctx := context.Background()
+	vm := vmResources{vcpus: 2, memorySizeMB: 1024}
+
+	for i := 0; i < 2; i++ {
+		if err := a.admit(ctx, "alice", vm); err != nil {
+			t.Fatalf("admit() failed: %v", err)
+		}
+	}
+	// Over the VM count and vCPU quotas.
+	checkCode(t, a.admit(ctx, "alice", vmResources{vcpus: 1}), codes.ResourceExhausted)
+	// Callers without a quota share the default tenant's.
+	for i := 0; i < 2; i++ {
+		if err := a.admit(ctx, defaultTenant, vm); err != nil {
+			t.Fatalf("admit() failed: %v", err)
+		}
+	}
+	checkCode(t, a.admit(ctx, defaultTenant, vm), codes.ResourceExhausted)
+	// Tenants without a quota are only limited by the host.
+	if err := a.admit(ctx, "bob", vmResources{vcpus: 0, memorySizeMB: 1024}); err != nil {
+		t.Errorf("admit() of tenant without quota failed: %v", err)
+	}
+
+	a.release("alice", vm)
+	if usage := a.tenants["alice"]; usage.vms != 1 || usage.resources != vm {
+		t.Errorf("usage of alice = %+v, want 1 VM with %+v", usage, vm)
+	}
+	a.release("alice", vm)
+	if _, ok := a.tenants["alice"]; ok {
+		t.Errorf("tenant without VMs still tracked: %+v", a.tenants["alice"])
+	}
+}
+
+func TestAdmitQueues(t *testing.T) {
+	a := newTestAdmissionController(5)
+	ctx := context.Background()
+	vm := vmResources{vcpus: 8}
+	if err := a.admit(ctx, "", vm); err != nil {
+		t.Fatalf("admit() failed: %v", err)
+	}
+
+	admitted := make(chan error)
+	go func() {
+		admitted <- a.admit(ctx, "", vm)
+	}()
+	for {
+		a.lock.Lock()
+		queued := a.queued
+		a.lock.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a.release("", vm)
+	if err := <-admitted; err != nil {
+		t.Errorf("queued admit() failed: %v", err)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		admitted <- a.admit(cancelCtx, "", vm)
+	}()
+	cancel()
+	checkCode(t, <-admitted, codes.Canceled)
+	if a.queued != 0 {
+		t.Errorf("queued = %d after the request was canceled", a.queued)
+	}
+}
+
+func TestChargeTenant(t *testing.T) {
+	a := newTestAdmissionController(0)
+	vm := vmResources{vcpus: 3}
+
+	// Warm pool VMs only count against the host's limits until they are handed out.
+	a.commit("", vm)
+	a.commit("", vm)
+	if err := a.chargeTenant("alice", vm); err != nil {
+		t.Fatalf("chargeTenant() failed: %v", err)
+	}
+	checkCode(t, a.chargeTenant("alice", vm), codes.ResourceExhausted)
+	if want := (vmResources{vcpus: 6}); a.committed != want {
+		t.Errorf("committed = %+v, want %+v", a.committed, want)
+	}
+
+	a.unchargeTenant("alice", vm)
+	if _, ok := a.tenants["alice"]; ok {
+		t.Errorf("uncharged tenant still tracked: %+v", a.tenants["alice"])
+	}
+	if err := a.chargeTenant("alice", vm); err != nil {
+		t.Errorf("chargeTenant() after unchargeTenant() failed: %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	a := newTestAdmissionController(0)
+	ctx := context.Background()
+	from := vmResources{vcpus: 2, memorySizeMB: 1024}
+	if err := a.admit(ctx, "alice", from); err != nil {
+		t.Fatalf("admit() failed: %v", err)
+	}
+
+	checkCode(t, a.resize("alice", from, vmResources{vcpus: 5, memorySizeMB: 1024}), codes.ResourceExhausted)
+	to := vmResources{vcpus: 4, memorySizeMB: 4096}
+	if err := a.resize("alice", from, to); err != nil {
+		t.Fatalf("resize() failed: %v", err)
+	}
+	if a.committed != to || a.tenants["alice"].resources != to {
+		t.Errorf("committed = %+v, usage = %+v, want %+v", a.committed, a.tenants["alice"].resources, to)
+	}
+	checkCode(t, a.resize("bob", vmResources{}, vmResources{memorySizeMB: 8192}), codes.ResourceExhausted)
+
+	// Shrinking always fits.
+	if err := a.resize("alice", to, from); err != nil {
+		t.Fatalf("resize() failed: %v", err)
+	}
+	if a.committed != from {
+		t.Errorf("committed = %+v, want %+v", a.committed, from)
+	}
+
+	a.revertResize("alice", to, from)
+	if a.committed != to || a.tenants["alice"].resources != to {
+		t.Errorf("committed = %+v, usage = %+v after revert, want %+v", a.committed, a.tenants["alice"].resources, to)
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Caller of the actions the server takes on its own, e.g. destroying expired VMs.
+	serverCaller = "server"
+
+	defaultAuditMaxSizeMB = 100
+	defaultAuditMaxFiles  = 5
+	defaultAuditLimit     = 100
+	// Longest line read from the audit log, longer ones are skipped.
+	maxAuditRecordSize = 1024 * 1024
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// Actions recorded in the audit log by the server itself. The REST server records the API calls.
+const (
+	AuditActionCommand      = "vm.command"
+	AuditActionFileUpload   = "vm.files.upload"
+	AuditActionFileDownload = "vm.files.download"
+	AuditActionExpire       = "vm.expire"
+	// Followed by the operation type.
+	auditActionOperationPrefix = "operation."
+)
+
+type callerContextKey struct{}
+
+// WithCaller returns a copy of `ctx` for a request made by `caller`, which actions taken on behalf
+// of the request are attributed to in the audit log.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+func callerFromContext(ctx context.Context) string {
+	if caller, ok := ctx.Value(callerContextKey{}).(string); ok {
+		return caller
+	}
+	return serverCaller
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time       time.Time         `json:"time"`
+	Caller     string            `json:"caller"`
+	Action     string            `json:"action"`
+	VmName     string            `json:"vmName,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+	DurationMs int64             `json:"durationMs"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+func (r auditRecord) toAPI() serverapi.AuditRecord {
+	record := serverapi.AuditRecord{
+		Time:       serverapi.PtrTime(r.Time),
+		Caller:     serverapi.PtrString(r.Caller),
+		Action:     serverapi.PtrString(r.Action),
+		Outcome:    serverapi.PtrString(r.Outcome),
+		DurationMs: serverapi.PtrInt64(r.DurationMs),
+	}
+	if r.VmName != "" {
+		record.SetVmName(r.VmName)
+	}
+	if r.Error != "" {
+		record.SetError(r.Error)
+	}
+	if len(r.Details) > 0 {
+		record.SetDetails(r.Details)
+	}
+	return record
+}
+
+// AuditFilter selects records of the audit log. Empty fields match all records.
+type AuditFilter struct {
+	VmName string
+	Caller string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	// Most recent records returned at most, defaults to 100.
+	Limit int
+}
+
+func (f AuditFilter) matches(record auditRecord) bool {
+	return (f.VmName == "" || record.VmName == f.VmName) &&
+		(f.Caller == "" || record.Caller == f.Caller) &&
+		(f.Action == "" || record.Action == f.Action) &&
+		(f.Since.IsZero() || !record.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || record.Time.Before(f.Until))
+}
+
+// auditLog is an append-only log of JSON lines rotated once it grows too large.
+type auditLog struct {
+	path         string
+	maxSizeBytes int64
+	maxFiles     int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// newAuditLog opens the audit log configured by `config`, nil if it's disabled.
+func newAuditLog(config config.AuditConfig) (*auditLog, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	maxSizeMB := config.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultAuditMaxSizeMB
+	}
+	maxFiles := int(config.MaxFiles)
+	if maxFiles <= 0 {
+		maxFiles = defaultAuditMaxFiles
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	a := &auditLog{
+		path:         config.Path,
+		maxSizeBytes: int64(maxSizeMB) * mib,
+		maxFiles:     maxFiles,
+	}
+	if err := a.openLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) openLocked() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// rotateLocked moves the log to "<path>.1", shifting the rotated logs by one and dropping the
+// oldest, and starts a new log.
+func (a *auditLog) rotateLocked() error {
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotatedPath(i), a.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(a.path, a.rotatedPath(1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return a.openLocked()
+}
+
+func (a *auditLog) append(record auditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.size > 0 && a.size+int64(len(data)) > a.maxSizeBytes {
+		if err := a.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// query returns the most recent records matching `filter`, oldest first.
+func (a *auditLog) query(filter AuditFilter) ([]auditRecord, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+
+	// The logs are opened together so that a rotation doesn't make records show up twice or not at
+	// all. Reading them doesn't hold up appending.
+	a.lock.Lock()
+	var files []*os.File
+	for i := a.maxFiles; i >= 0; i-- {
+		logPath := a.path
+		if i > 0 {
+			logPath = a.rotatedPath(i)
+		}
+		file, err := os.Open(logPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			a.lock.Unlock()
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		files = append(files, file)
+	}
+	a.lock.Unlock()
+
+	var records []auditRecord
+	for _, file := range files {
+		var err error
+		records, err = readAuditRecords(file, filter, limit, records)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// readAuditRecords appends the records in `r` matching `filter` to `records`, keeping the last
+// `limit` ones.
+func readAuditRecords(r io.Reader, filter AuditFilter, limit int, records []auditRecord) ([]auditRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditRecordSize)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A line may be cut short if the server died while writing it.
+			continue
+		}
+		if !filter.matches(record) {
+			continue
+		}
+		records = append(records, record)
+		if len(records) > limit {
+			records = records[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return records, nil
+}
+
+// Audit records in the audit log that the caller of `ctx` took `action`, on the VM `vmName` if not
+// empty, starting at `start` and failing with `err` if not nil. Failing to record is logged, it
+// doesn't fail the action.
+func (s *Server) Audit(ctx context.Context, action string, vmName string, start time.Time, details map[string]string, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	record := auditRecord{
+		Time:       start.UTC(),
+		Caller:     callerFromContext(ctx),
+		Action:     action,
+		VmName:     vmName,
+		Outcome:    AuditOutcomeSuccess,
+		DurationMs: time.Since(start).Milliseconds(),
+		Details:    details,
+	}
+	if err != nil {
+		record.Outcome = AuditOutcomeFailure
+		record.Error = err.Error()
+	}
+	if err := s.auditLog.append(record); err != nil {
+		log.WithFields(log.Fields{
+			"action": action,
+			"vmName": vmName,
+		}).WithError(err).Error("failed to write audit log")
+	}
+}
+
+// QueryAuditLog returns the most recent records of the audit log matching `filter`, oldest first.
+func (s *Server) QueryAuditLog(ctx context.Context, filter AuditFilter) (*serverapi.AuditLogResponse, error) {
+	if s.auditLog == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is disabled")
+	}
+
+	records, err := s.auditLog.query(filter)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &serverapi.AuditLogResponse{Records: make([]serverapi.AuditRecord, 0, len(records))}
+	for _, record := range records {
+		resp.Records = append(resp.Records, record.toAPI())
+	}
+	return resp, nil
+}
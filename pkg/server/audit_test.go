@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuditRecords(t *testing.T, records ...auditRecord) string {
+	t.Helper()
+	var lines []string
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatalf("failed to marshal audit record: %v", err)
+		}
+		lines = append(lines, string(data))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func auditActions(records []auditRecord) []string {
+	var actions []string
+	for _, record := range records {
+		actions = append(actions, record.Action)
+	}
+	return actions
+}
+
+func TestReadAuditRecords(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	log := testAuditRecords(t,
+		auditRecord{Time: start, Caller: "alice", Action: "a0", VmName: "vm1"},
+		auditRecord{Time: start.Add(time.Minute), Caller: "bob", Action: "a1", VmName: "vm1"},
+		auditRecord{Time: start.Add(2 * time.Minute), Caller: "alice", Action: "a2", VmName: "vm2"},
+		auditRecord{Time: start.Add(3 * time.Minute), Caller: "alice", Action: "a3"},
+	)
+	// A line cut short by a crash is skipped.
+	log += `{"time":"2026-01-01T00:04:00Z","caller":"al` + "\n"
+
+	tests := []struct {
+		filter AuditFilter
+		limit  int
+		want   []string
+	}{
+		{filter: AuditFilter{}, limit: 10, want: []string{"a0", "a1", "a2", "a3"}},
+		{filter: AuditFilter{}, limit: 2, want: []string{"a2", "a3"}},
+		{filter: AuditFilter{Caller: "alice"}, limit: 10, want: []string{"a0", "a2", "a3"}},
+		{filter: AuditFilter{VmName: "vm1"}, limit: 10, want: []string{"a0", "a1"}},
+		{filter: AuditFilter{Action: "a2"}, limit: 10, want: []string{"a2"}},
+		{filter: AuditFilter{Since: start.Add(time.Minute)}, limit: 10, want: []string{"a1", "a2", "a3"}},
+		{filter: AuditFilter{Until: start.Add(time.Minute)}, limit: 10, want: []string{"a0"}},
+		{filter: AuditFilter{Caller: "carol"}, limit: 10, want: nil},
+	}
+	for _, test := range tests {
+		records, err := readAuditRecords(strings.NewReader(log), test.filter, test.limit, nil)
+		if err != nil {
+			t.Fatalf("readAuditRecords(%+v) failed: %v", test.filter, err)
+		}
+		if got := auditActions(records); !slices.Equal(got, test.want) {
+			t.Errorf("readAuditRecords(%+v, %d) = %v, want %v", test.filter, test.limit, got, test.want)
+		}
+	}
+
+	// Records of earlier logs are dropped first.
+	earlier := []auditRecord{{Action: "old0"}, {Action: "old1"}}
+	records, err := readAuditRecords(strings.NewReader(log), AuditFilter{}, 5, earlier)
+	if err != nil {
+		t.Fatalf("readAuditRecords() failed: %v", err)
+	}
+	if got, want := auditActions(records), []string{"old1", "a0", "a1", "a2", "a3"}; !slices.Equal(got, want) {
+		t.Errorf("readAuditRecords() = %v, want %v", got, want)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit", "audit.log")
+	record := auditRecord{Caller: "alice", Action: "a00", Outcome: AuditOutcomeSuccess}
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("failed to marshal audit record: %v", err)
+	}
+	recordSize := int64(len(data) + 1)
+
+	a := &auditLog{path: logPath, maxSizeBytes: 2 * recordSize, maxFiles: 2}
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		t.Fatalf("failed to create audit log directory: %v", err)
+	}
+	if err := a.openLocked(); err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer a.file.Close()
+
+	// 2 records fit in each log. The first 2 are dropped along with the oldest rotated log.
+	for i := 0; i < 7; i++ {
+		record.Action = fmt.Sprintf("a%02d", i)
+		if err := a.append(record); err != nil {
+			t.Fatalf("append() failed: %v", err)
+		}
+	}
+	for path, want := range map[string]int64{
+		logPath:          recordSize,
+		a.rotatedPath(1): 2 * recordSize,
+		a.rotatedPath(2): 2 * recordSize,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", path, err)
+		}
+		if info.Size() != want {
+			t.Errorf("size of %s = %d, want %d", path, info.Size(), want)
+		}
+	}
+	if _, err := os.Stat(a.rotatedPath(3)); !os.IsNotExist(err) {
+		t.Errorf("more than %d rotated logs kept: %v", a.maxFiles, err)
+	}
+
+	records, err := a.query(AuditFilter{})
+	if err != nil {
+		t.Fatalf("query() failed: %v", err)
+	}
+	if got, want := auditActions(records), []string{"a02", "a03", "a04", "a05", "a06"}; !slices.Equal(got, want) {
+		t.Errorf("query() = %v, want %v", got, want)
+	}
+	records, err = a.query(AuditFilter{Limit: 3})
+	if err != nil {
+		t.Fatalf("query() failed: %v", err)
+	}
+	if got, want := auditActions(records), []string{"a04", "a05", "a06"}; !slices.Equal(got, want) {
+		t.Errorf("query(limit 3) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/chvapi"
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// How often the balloons of VMs are adjusted to their activity.
+	balloonInterval = 15 * time.Second
+	// Memory the balloon leaves to the guest at the very least.
+	minBalloonGuestMemoryMB = 128
+	// How long a VM being paused is given to hand memory to its balloon.
+	balloonInflateTimeout = 5 * time.Second
+	balloonPollInterval   = 250 * time.Millisecond
+	// How long getting the memory of a VM from its VMM may take.
+	vmMemoryInfoTimeout = 2 * time.Second
+	mib                 = 1024 * 1024
+)
+
+// newBalloonConfig returns the virtio-balloon device VMs are created with. It starts deflated, gives
+// memory back to the guest when it runs out of memory and lets the guest hand free pages back to
+// the host.
+func newBalloonConfig() *chvapi.BalloonConfig {
+	return &chvapi.BalloonConfig{
+		Size:              0,
+		DeflateOnOom:      Bool(true),
+		FreePageReporting: Bool(true),
+	}
+}
+
+// desiredBalloonSizeMBLocked returns how much memory to reclaim from the VM: the target set by hand
+// or, if more, what's reclaimed automatically given whether the VM is idle or paused. Expects
+// `v.lock` to be held.
+func (s *Server) desiredBalloonSizeMBLocked(v *vm, idle bool, paused bool) int32 {
+	var reclaimPercent int32
+	if paused {
+		reclaimPercent = s.config.Balloon.PausedReclaimPercent
+	} else if idle {
+		reclaimPercent = s.config.Balloon.IdleReclaimPercent
+	}
+	reclaimPercent = min(max(reclaimPercent, 0), 100)
+
+	memorySizeMB := v.resources.memorySizeMB
+	sizeMB := max(v.balloonTargetMB, memorySizeMB*reclaimPercent/100)
+	return max(min(sizeMB, memorySizeMB-minBalloonGuestMemoryMB), 0)
+}
+
+// isIdle returns whether the VM saw no activity for long enough to reclaim memory from it.
+func (s *Server) isIdle(v *vm) bool {
+	idleAfter := time.Duration(s.config.Balloon.IdleAfterSeconds) * time.Second
+	return idleAfter > 0 && time.Since(v.lifetime.lastActiveAt()) >= idleAfter
+}
+
+// balloonInfo returns the size of the balloon of the VM in MB and the memory the guest can use
+// in MB. Fails with `codes.FailedPrecondition` if the VM has no balloon, e.g. when restored from
+// a snapshot of a VM created without one.
+func (v *vm) balloonInfo(ctx context.Context) (int32, int32, error) {
+	info, resp, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get VM info: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("failed to get VM info. bad status: %v", resp)
+	}
+	if info.Config.Balloon == nil {
+		return 0, 0, status.Errorf(codes.FailedPrecondition, "vm has no balloon device: %s", v.name)
+	}
+	return int32(info.Config.Balloon.Size / mib), int32(info.GetMemoryActualSize() / mib), nil
+}
+
+// resizeBalloonLocked asks the guest to hand `sizeMB` of memory to its balloon. Expects `v.lock` to
+// be held.
+func (v *vm) resizeBalloonLocked(ctx context.Context, sizeMB int32) error {
+	resize := chvapi.NewVmResize()
+	resize.SetDesiredBalloon(int64(sizeMB) * mib)
+	resp, err := v.apiClient.DefaultAPI.VmResizePut(ctx).VmResize(*resize).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to resize balloon: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to resize balloon. bad status: %v", resp)
+	}
+	return nil
+}
+
+// adjustBalloon resizes the balloon of the VM to what it should reclaim given its activity. Returns
+// the size of the balloon in MB before and after.
+func (s *Server) adjustBalloon(ctx context.Context, v *vm, paused bool) (int32, int32, error) {
+	idle := s.isIdle(v)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	sizeMB, _, err := v.balloonInfo(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	desiredMB := s.desiredBalloonSizeMBLocked(v, idle, paused)
+	if desiredMB == sizeMB {
+		return sizeMB, sizeMB, nil
+	}
+	if err := v.resizeBalloonLocked(ctx, desiredMB); err != nil {
+		return sizeMB, sizeMB, err
+	}
+	log.WithFields(log.Fields{
+		"vmName": v.name,
+		"idle":   idle,
+		"paused": paused,
+	}).Infof("resized balloon from %d MB to %d MB", sizeMB, desiredMB)
+	return sizeMB, desiredMB, nil
+}
+
+// runBalloonAdjuster periodically reclaims memory from idle VMs and gives it back once they're
+// active again. It never returns.
+func (s *Server) runBalloonAdjuster() {
+	ticker := time.NewTicker(balloonInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.adjustBalloons(context.Background())
+	}
+}
+
+func (s *Server) adjustBalloons(ctx context.Context) {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	for _, vm := range vms {
+		vm.lock.RLock()
+		running := vm.status == vmStatusRunning && !vm.destroying
+		vm.lock.RUnlock()
+		// Paused VMs can't hand memory to their balloon, they're shrunk before being paused.
+		if !running {
+			continue
+		}
+
+		if _, _, err := s.adjustBalloon(ctx, vm, false); err != nil && status.Code(err) != codes.FailedPrecondition {
+			log.WithField("vmName", vm.name).WithError(err).Warn("failed to adjust balloon")
+		}
+	}
+}
+
+// inflateBalloonForPause reclaims the memory of a VM about to be paused and waits a little for the
+// guest to hand it over, which it can't do once paused.
+func (s *Server) inflateBalloonForPause(ctx context.Context, v *vm) error {
+	_, availableMB, err := v.balloonInfo(ctx)
+	if err != nil {
+		return err
+	}
+	fromMB, toMB, err := s.adjustBalloon(ctx, v, true)
+	if err != nil || toMB <= fromMB {
+		return err
+	}
+
+	targetAvailableMB := availableMB - (toMB - fromMB)
+	ctx, cancel := context.WithTimeout(ctx, balloonInflateTimeout)
+	defer cancel()
+	ticker := time.NewTicker(balloonPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.WithField("vmName", v.name).Warn("guest didn't hand all memory to its balloon before being paused")
+			return nil
+		case <-ticker.C:
+		}
+		_, availableMB, err := v.balloonInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if availableMB <= targetAvailableMB {
+			return nil
+		}
+	}
+}
+
+// SetBalloonTarget sets how much memory to reclaim from a running VM through its balloon.
+func (s *Server) SetBalloonTarget(ctx context.Context, vmName string, targetMB int32) (*serverapi.ListVMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to set balloon target to %d MB", targetMB)
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.Lock()
+	if vm.status != vmStatusRunning {
+		vm.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm isn't running: %s", vmName)
+	}
+	if targetMB < 0 || targetMB > vm.resources.memorySizeMB-minBalloonGuestMemoryMB {
+		vm.lock.Unlock()
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"balloonTargetMB must be between 0 and %d",
+			max(vm.resources.memorySizeMB-minBalloonGuestMemoryMB, 0),
+		)
+	}
+	if _, _, err := vm.balloonInfo(ctx); err != nil {
+		vm.lock.Unlock()
+		return nil, err
+	}
+	vm.balloonTargetMB = targetMB
+	vm.lock.Unlock()
+
+	if _, _, err := s.adjustBalloon(ctx, vm, false); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeResized, vm, map[string]string{
+		"balloonTargetMB": fmt.Sprint(targetMB),
+	})
+	return s.ListVM(ctx, vmName)
+}
+
+// getResidentMemoryMB returns the memory of the host used by the process `pid` in MB.
+func getResidentMemoryMB(pid int) (int32, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "VmRSS:")
+		if !found {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse VmRSS: %w", err)
+		}
+		return int32(kb / 1024), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("VmRSS not found")
+}
+
+// residentMemoryMB returns the memory of the host used by the VMM of the VM in MB.
+func (v *vm) residentMemoryMB() (int32, bool) {
+	v.lock.RLock()
+	process := v.process
+	v.lock.RUnlock()
+	if process == nil {
+		return 0, false
+	}
+	residentMB, err := getResidentMemoryMB(process.Pid)
+	if err != nil {
+		return 0, false
+	}
+	return residentMB, true
+}
+
+// memoryToAPI returns the memory of the VM as reported by the API. What only the VMM knows is left
+// out if it can't be asked, e.g. because the VM crashed.
+func (s *Server) memoryToAPI(ctx context.Context, v *vm) *serverapi.VMMemory {
+	v.lock.RLock()
+	memory := &serverapi.VMMemory{
+		SizeMB:          serverapi.PtrInt32(v.resources.memorySizeMB),
+		BalloonTargetMB: serverapi.PtrInt32(v.balloonTargetMB),
+	}
+	alive := v.status != vmStatusCrashed && !v.destroying
+	v.lock.RUnlock()
+	if !alive {
+		return memory
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, vmMemoryInfoTimeout)
+	defer cancel()
+	if balloonMB, availableMB, err := v.balloonInfo(ctx); err == nil {
+		memory.SetBalloonSizeMB(balloonMB)
+		memory.SetAvailableMB(availableMB)
+	}
+	if residentMB, ok := v.residentMemoryMB(); ok {
+		memory.SetResidentMB(residentMB)
+	}
+	return memory
+}
+
+// residentMemoryMB returns the memory of the host used by all VMs in MB.
+func (s *Server) residentMemoryMB() int32 {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	var total int32
+	for _, vm := range vms {
+		if residentMB, ok := vm.residentMemoryMB(); ok {
+			total += residentMB
+		}
+	}
+	return total
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func TestDesiredBalloonSizeMB(t *testing.T) {
+	balloonConfig := config.BalloonConfig{IdleReclaimPercent: 50, PausedReclaimPercent: 75}
+	tests := []struct {
+		name         string
+		memoryMB     int32
+		targetMB     int32
+		config       config.BalloonConfig
+		idle, paused bool
+		want         int32
+	}{
+		{name: "active", memoryMB: 1024, config: balloonConfig, want: 0},
+		{name: "idle", memoryMB: 1024, config: balloonConfig, idle: true, want: 512},
+		{name: "paused", memoryMB: 1024, config: balloonConfig, paused: true, want: 768},
+		{name: "paused and idle", memoryMB: 1024, config: balloonConfig, idle: true, paused: true, want: 768},
+		{name: "target above reclaim", memoryMB: 1024, targetMB: 768, config: balloonConfig, idle: true, want: 768},
+		{name: "target below reclaim", memoryMB: 1024, targetMB: 256, config: balloonConfig, idle: true, want: 512},
+		{name: "reclaim disabled", memoryMB: 1024, idle: true, paused: true, want: 0},
+		{
+			name:     "guest keeps its minimum",
+			memoryMB: 1024,
+			targetMB: 1024,
+			config:   balloonConfig,
+			want:     1024 - minBalloonGuestMemoryMB,
+		},
+		{
+			name:     "percent above 100",
+			memoryMB: 1024,
+			config:   config.BalloonConfig{PausedReclaimPercent: 150},
+			paused:   true,
+			want:     1024 - minBalloonGuestMemoryMB,
+		},
+		{
+			name:     "memory below minimum",
+			memoryMB: 64,
+			targetMB: 32,
+			config:   balloonConfig,
+			paused:   true,
+			want:     0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{config: config.ServerConfig{Balloon: test.config}}
+			v := &vm{resources: vmResources{memorySizeMB: test.memoryMB}, balloonTargetMB: test.targetMB}
+			if got := s.desiredBalloonSizeMBLocked(v, test.idle, test.paused); got != test.want {
+				t.Errorf("desiredBalloonSizeMBLocked() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetResidentMemoryMB(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("no /proc")
+	}
+	// The test binary is at least a few MB big.
+	residentMB, err := getResidentMemoryMB(os.Getpid())
+	if err != nil {
+		t.Fatalf("getResidentMemoryMB() failed: %v", err)
+	}
+	if residentMB <= 0 {
+		t.Errorf("getResidentMemoryMB() = %d, want more than 0", residentMB)
+	}
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// How often VMs are checked for a checkpoint being due.
+	snapshotSchedulerInterval = 15 * time.Second
+	// Shortest interval between the checkpoints of a VM, snapshotting pauses the VM.
+	minSnapshotScheduleInterval = time.Minute
+	// Prefix of the IDs of the snapshots taken by a snapshot schedule.
+	checkpointSnapshotIdPrefix = "checkpoint-"
+	checkpointTimeFormat       = "20060102-150405"
+	// Prefix of the IDs of the snapshots a VM is brought back from if rolling it back fails.
+	rollbackSnapshotIdPrefix = "rollback-"
+)
+
+// snapshotSchedule is how often a VM is checkpointed and which checkpoints are kept. A checkpoint is
+// kept if any of the rules keeps it, the latest checkpoint always is.
+type snapshotSchedule struct {
+	IntervalSeconds int32 `json:"intervalSeconds"`
+	// Number of most recent checkpoints kept.
+	KeepLast int32 `json:"keepLast,omitempty"`
+	// Number of hours, resp. days, for which the latest checkpoint of the hour, resp. day, is kept.
+	KeepHourly int32 `json:"keepHourly,omitempty"`
+	KeepDaily  int32 `json:"keepDaily,omitempty"`
+}
+
+func (s *snapshotSchedule) interval() time.Duration {
+	return time.Duration(s.IntervalSeconds) * time.Second
+}
+
+func (s *snapshotSchedule) toAPI() *serverapi.SnapshotSchedule {
+	return &serverapi.SnapshotSchedule{
+		IntervalSeconds: s.IntervalSeconds,
+		KeepLast:        serverapi.PtrInt32(s.KeepLast),
+		KeepHourly:      serverapi.PtrInt32(s.KeepHourly),
+		KeepDaily:       serverapi.PtrInt32(s.KeepDaily),
+	}
+}
+
+// checkpoint is a snapshot taken by the snapshot schedule of a VM.
+type checkpoint struct {
+	SnapshotId string    `json:"snapshotId"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// parseSnapshotSchedule returns the requested snapshot schedule or nil if it disables checkpoints.
+func parseSnapshotSchedule(req *serverapi.SnapshotSchedule) (*snapshotSchedule, error) {
+	schedule := &snapshotSchedule{
+		IntervalSeconds: req.IntervalSeconds,
+		KeepLast:        req.GetKeepLast(),
+		KeepHourly:      req.GetKeepHourly(),
+		KeepDaily:       req.GetKeepDaily(),
+	}
+	if schedule.KeepLast < 0 || schedule.KeepHourly < 0 || schedule.KeepDaily < 0 {
+		return nil, status.Error(codes.InvalidArgument, "number of checkpoints to keep must be non-negative")
+	}
+	if schedule.IntervalSeconds == 0 {
+		return nil, nil
+	}
+	if schedule.interval() < minSnapshotScheduleInterval {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"intervalSeconds must be 0 or at least %d: %d",
+			int32(minSnapshotScheduleInterval.Seconds()),
+			schedule.IntervalSeconds,
+		)
+	}
+	return schedule, nil
+}
+
+// setSnapshotSchedule replaces the snapshot schedule of the VM, the next checkpoint is taken one
+// interval from now. A nil `schedule` stops checkpointing the VM. Fails if the VM has disks
+// snapshots don't capture.
+func (v *vm) setSnapshotSchedule(schedule *snapshotSchedule) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if schedule != nil {
+		if err := v.checkNoDisksLocked(); err != nil {
+			return err
+		}
+	}
+	v.snapshotSchedule = schedule
+	v.nextCheckpointAt = time.Time{}
+	if schedule != nil {
+		v.nextCheckpointAt = time.Now().Add(schedule.interval())
+	}
+	return nil
+}
+
+// restoreSnapshotSchedule sets the snapshot schedule and checkpoints of a VM that replaces another
+// one, e.g. after a crash or a server restart. A checkpoint is due one interval after the latest one.
+func (v *vm) restoreSnapshotSchedule(schedule *snapshotSchedule, checkpoints []checkpoint) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.snapshotSchedule = schedule
+	v.checkpoints = slices.Clone(checkpoints)
+	v.nextCheckpointAt = time.Time{}
+	if v.snapshotSchedule == nil {
+		return
+	}
+	lastCheckpointAt := time.Now()
+	if len(v.checkpoints) > 0 {
+		lastCheckpointAt = v.checkpoints[len(v.checkpoints)-1].CreatedAt
+	}
+	v.nextCheckpointAt = lastCheckpointAt.Add(v.snapshotSchedule.interval())
+}
+
+// checkpointsToAPI returns the snapshot schedule and checkpoints of the VM as reported by the API.
+func (v *vm) checkpointsToAPI() *serverapi.VMCheckpoints {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	resp := &serverapi.VMCheckpoints{
+		Checkpoints: make([]serverapi.Checkpoint, 0, len(v.checkpoints)),
+	}
+	if v.snapshotSchedule != nil {
+		resp.Schedule = v.snapshotSchedule.toAPI()
+		resp.NextCheckpointAt = serverapi.PtrTime(v.nextCheckpointAt)
+	}
+	for _, c := range v.checkpoints {
+		resp.Checkpoints = append(resp.Checkpoints, serverapi.Checkpoint{
+			SnapshotId: serverapi.PtrString(c.SnapshotId),
+			CreatedAt:  serverapi.PtrTime(c.CreatedAt),
+		})
+	}
+	return resp
+}
+
+// hasCheckpoint returns whether `snapshotId` is one of the retained checkpoints of the VM.
+func (v *vm) hasCheckpoint(snapshotId string) bool {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return slices.ContainsFunc(v.checkpoints, func(c checkpoint) bool {
+		return c.SnapshotId == snapshotId
+	})
+}
+
+// expiredCheckpoints returns the checkpoints, ordered oldest first, that `schedule` doesn't keep.
+func expiredCheckpoints(checkpoints []checkpoint, schedule *snapshotSchedule) []checkpoint {
+	if len(checkpoints) == 0 {
+		return nil
+	}
+
+	keep := make([]bool, len(checkpoints))
+	keep[len(checkpoints)-1] = true
+	for i := len(checkpoints) - 1; i >= 0 && i >= len(checkpoints)-int(schedule.KeepLast); i-- {
+		keep[i] = true
+	}
+	// Keeps the latest checkpoint of each of the `count` latest periods that have one.
+	keepPerPeriod := func(count int32, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for i := len(checkpoints) - 1; i >= 0 && len(seen) < int(count); i-- {
+			key := period(checkpoints[i].CreatedAt.UTC())
+			if !seen[key] {
+				seen[key] = true
+				keep[i] = true
+			}
+		}
+	}
+	keepPerPeriod(schedule.KeepHourly, func(t time.Time) string { return t.Format("2006010215") })
+	keepPerPeriod(schedule.KeepDaily, func(t time.Time) string { return t.Format("20060102") })
+
+	var expired []checkpoint
+	for i, c := range checkpoints {
+		if !keep[i] {
+			expired = append(expired, c)
+		}
+	}
+	return expired
+}
+
+// pruneCheckpoints deletes the checkpoints of the VM that its snapshot schedule doesn't keep.
+// Checkpoints still used, e.g. to restore a VM if it crashes, are kept until they aren't anymore.
+func (s *Server) pruneCheckpoints(ctx context.Context, vm *vm) {
+	vm.lock.RLock()
+	vmName := vm.name
+	var expired []checkpoint
+	if vm.snapshotSchedule != nil {
+		expired = expiredCheckpoints(vm.checkpoints, vm.snapshotSchedule)
+	}
+	vm.lock.RUnlock()
+
+	logger := log.WithField("vmName", vmName)
+	deleted := make(map[string]bool)
+	for _, c := range expired {
+		vmNames, warmPools := s.snapshotUsers(c.SnapshotId)
+		if len(vmNames) > 0 || len(warmPools) > 0 {
+			logger.WithField("snapshotId", c.SnapshotId).Debug("keeping expired checkpoint in use")
+			continue
+		}
+		if err := s.removeSnapshot(ctx, c.SnapshotId); err != nil {
+			logger.WithError(err).Warnf("failed to delete checkpoint: %s", c.SnapshotId)
+			continue
+		}
+		deleted[c.SnapshotId] = true
+		logger.WithField("snapshotId", c.SnapshotId).Info("deleted expired checkpoint")
+	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	vm.lock.Lock()
+	vm.checkpoints = slices.DeleteFunc(vm.checkpoints, func(c checkpoint) bool {
+		return deleted[c.SnapshotId]
+	})
+	vm.lock.Unlock()
+}
+
+// runSnapshotScheduler periodically checkpoints the VMs whose snapshot schedule is due. It never
+// returns.
+func (s *Server) runSnapshotScheduler() {
+	ticker := time.NewTicker(snapshotSchedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.checkpointDueVMs(context.Background())
+	}
+}
+
+func (s *Server) checkpointDueVMs(ctx context.Context) {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	for _, vm := range vms {
+		now := time.Now()
+		vm.lock.Lock()
+		due := vm.snapshotSchedule != nil &&
+			vm.status == vmStatusRunning &&
+			vm.warmPool == "" &&
+			!vm.destroying &&
+			!now.Before(vm.nextCheckpointAt)
+		if due {
+			// A failed checkpoint is retried one interval later rather than at every tick.
+			vm.nextCheckpointAt = now.Add(vm.snapshotSchedule.interval())
+		}
+		vmName := vm.name
+		vm.lock.Unlock()
+		if !due {
+			continue
+		}
+
+		if err := s.checkpointVM(ctx, vm, vmName, now); err != nil {
+			log.WithField("vmName", vmName).WithError(err).Error("failed to checkpoint VM")
+		}
+	}
+}
+
+// checkpointVM snapshots the VM as a checkpoint taken at `now` and deletes the checkpoints its
+// snapshot schedule no longer keeps.
+func (s *Server) checkpointVM(ctx context.Context, vm *vm, vmName string, now time.Time) error {
+	snapshotId := checkpointSnapshotIdPrefix + vmName + "-" + now.UTC().Format(checkpointTimeFormat)
+	if _, err := s.SnapshotVM(ctx, vmName, snapshotId); err != nil {
+		return err
+	}
+
+	vm.lock.Lock()
+	vm.checkpoints = append(vm.checkpoints, checkpoint{SnapshotId: snapshotId, CreatedAt: now})
+	vm.lock.Unlock()
+	log.WithFields(log.Fields{"vmName": vmName, "snapshotId": snapshotId}).Info("checkpointed VM")
+
+	s.pruneCheckpoints(ctx, vm)
+	s.persistVMRegistry()
+	return nil
+}
+
+// SetSnapshotSchedule replaces the snapshot schedule of a VM. Checkpoints the new schedule doesn't
+// keep are deleted, disabling the schedule keeps them all.
+func (s *Server) SetSnapshotSchedule(
+	ctx context.Context,
+	vmName string,
+	req *serverapi.SnapshotSchedule,
+) (*serverapi.VMCheckpoints, error) {
+	schedule, err := parseSnapshotSchedule(req)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	log.WithFields(log.Fields{"vmName": vmName, "schedule": schedule}).Info("setting snapshot schedule")
+
+	if err := vm.setSnapshotSchedule(schedule); err != nil {
+		return nil, err
+	}
+	s.pruneCheckpoints(ctx, vm)
+	s.persistVMRegistry()
+	return vm.checkpointsToAPI(), nil
+}
+
+// ListCheckpoints returns the snapshot schedule and retained checkpoints of a VM.
+func (s *Server) ListCheckpoints(ctx context.Context, vmName string) (*serverapi.VMCheckpoints, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	return vm.checkpointsToAPI(), nil
+}
+
+// RollbackVM replaces a VM by one restored from one of its checkpoints under the same name and IP.
+// Everything the snapshot doesn't capture, e.g. the lifetime, crash restart policy and snapshot
+// schedule of the VM, is kept. The VM is snapshotted first and restored as it was if the checkpoint
+// can't be restored, unless it crashed and there's nothing left to bring back.
+func (s *Server) RollbackVM(ctx context.Context, vmName string, snapshotId string) (*serverapi.StartVMResponse, error) {
+	logger := log.WithFields(log.Fields{"vmName": vmName, "snapshotId": snapshotId})
+	logger.Info("received request to roll back VM")
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if !vm.hasCheckpoint(snapshotId) {
+		return nil, status.Errorf(codes.NotFound, "checkpoint of vm %s not found: %s", vmName, snapshotId)
+	}
+	// Fetched before the VM is destroyed so that a missing snapshot leaves the VM untouched.
+	if _, err := s.fetchSnapshot(ctx, snapshotId); err != nil {
+		return nil, err
+	}
+
+	// Only kept locally, it's deleted once the VM was rolled back.
+	var rescueSnapshotId string
+	if vm.checkNotCrashed() == nil {
+		rescueSnapshotId = fmt.Sprintf("%s%s-%d", rollbackSnapshotIdPrefix, vmName, time.Now().UnixNano())
+		reportProgress(ctx, "snapshotting VM")
+		if _, err := s.snapshotVMToDir(ctx, vmName, rescueSnapshotId); err != nil {
+			return nil, fmt.Errorf("failed to snapshot VM before rolling it back: %w", err)
+		}
+	}
+	keepRescueSnapshot := false
+	defer func() {
+		if rescueSnapshotId == "" || keepRescueSnapshot {
+			return
+		}
+		if err := os.RemoveAll(s.getSnapshotPath(rescueSnapshotId)); err != nil {
+			logger.WithError(err).Warnf("failed to delete snapshot: %s", rescueSnapshotId)
+		}
+	}()
+
+	record := vm.toRecord()
+	if err := s.destroyVM(ctx, vmName); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to destroy vm: %s: %v", vmName, err)
+	}
+
+	reportProgress(ctx, "restoring checkpoint")
+	vm, err := s.restoreVM(ctx, vmName, record.Tenant, record.Labels, snapshotId, false)
+	if err != nil {
+		if rescueSnapshotId == "" {
+			return nil, fmt.Errorf("failed to restore VM from checkpoint: %w", err)
+		}
+		logger.WithError(err).Error("failed to restore checkpoint, restoring VM as it was")
+		// Brought back even if the request was cancelled.
+		rescued, rescueErr := s.restoreVM(context.WithoutCancel(ctx), vmName, record.Tenant, record.Labels, rescueSnapshotId, false)
+		if rescueErr != nil {
+			keepRescueSnapshot = true
+			logger.WithError(rescueErr).Errorf("failed to restore VM as it was, it's kept in snapshot: %s", rescueSnapshotId)
+			return nil, fmt.Errorf(
+				"failed to restore VM from checkpoint: %w, failed to restore it as it was from snapshot %s: %v",
+				err,
+				rescueSnapshotId,
+				rescueErr,
+			)
+		}
+		rescued.applyRecord(record)
+		s.persistVMRegistry()
+		return nil, fmt.Errorf("failed to restore VM from checkpoint, restored it as it was: %w", err)
+	}
+	vm.applyRecord(record)
+	vm.lock.Lock()
+	vm.lastSnapshotId = snapshotId
+	vm.lock.Unlock()
+
+	reportProgress(ctx, "waiting for VM to be ready")
+	if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
+		logger.WithError(err).Warnf("command server not ready")
+	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeRestored, vm, map[string]string{"snapshotId": snapshotId})
+	logger.Info("rolled back VM")
+
+	return &serverapi.StartVMResponse{
+		VmName:             serverapi.PtrString(vmName),
+		Ip:                 serverapi.PtrString(vm.ip.String()),
+		Status:             serverapi.PtrString(vm.status.String()),
+		TapDeviceName:      serverapi.PtrString(vm.tapDevice.Name),
+		PortForwards:       convertPortForward(vm.portForwards),
+		Vcpus:              serverapi.PtrInt32(vm.resources.vcpus),
+		MemorySizeMB:       serverapi.PtrInt32(vm.resources.memorySizeMB),
+		StatefulDiskSizeMB: serverapi.PtrInt32(vm.resources.statefulDiskSizeMB),
+		Lifetime:           vm.lifetime.toAPI(),
+		Labels:             labelsToAPI(vm.labels),
+	}, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+)
+
+func TestExpiredCheckpoints(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkpoints := []checkpoint{
+		{SnapshotId: "c0", CreatedAt: day.Add(10 * time.Hour)},
+		{SnapshotId: "c1", CreatedAt: day.Add(10*time.Hour + 30*time.Minute)},
+		{SnapshotId: "c2", CreatedAt: day.Add(11*time.Hour + 15*time.Minute)},
+		{SnapshotId: "c3", CreatedAt: day.Add(24*time.Hour + 9*time.Hour)},
+		{SnapshotId: "c4", CreatedAt: day.Add(24*time.Hour + 9*time.Hour + 20*time.Minute)},
+		// Day 2, 10:05 UTC, in another time zone.
+		{SnapshotId: "c5", CreatedAt: day.Add(24*time.Hour + 10*time.Hour + 5*time.Minute).In(time.FixedZone("UTC-11", -11*3600))},
+	}
+
+	tests := []struct {
+		schedule snapshotSchedule
+		want     []string
+	}{
+		{schedule: snapshotSchedule{}, want: []string{"c0", "c1", "c2", "c3", "c4"}},
+		{schedule: snapshotSchedule{KeepLast: 2}, want: []string{"c0", "c1", "c2", "c3"}},
+		{schedule: snapshotSchedule{KeepLast: 10}, want: nil},
+		{schedule: snapshotSchedule{KeepHourly: 2}, want: []string{"c0", "c1", "c2", "c3"}},
+		{schedule: snapshotSchedule{KeepHourly: 3}, want: []string{"c0", "c1", "c3"}},
+		{schedule: snapshotSchedule{KeepHourly: 10}, want: []string{"c0", "c3"}},
+		{schedule: snapshotSchedule{KeepDaily: 2}, want: []string{"c0", "c1", "c3", "c4"}},
+		{schedule: snapshotSchedule{KeepLast: 3, KeepDaily: 2}, want: []string{"c0", "c1"}},
+		{schedule: snapshotSchedule{KeepHourly: 1, KeepDaily: 1}, want: []string{"c0", "c1", "c2", "c3", "c4"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, c := range expiredCheckpoints(checkpoints, &test.schedule) {
+			got = append(got, c.SnapshotId)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("expiredCheckpoints(%+v) = %v, want %v", test.schedule, got, test.want)
+		}
+	}
+}
+
+func TestExpiredCheckpointsEmpty(t *testing.T) {
+	if got := expiredCheckpoints(nil, &snapshotSchedule{}); got != nil {
+		t.Errorf("expiredCheckpoints(nil) = %v, want nil", got)
+	}
+
+	checkpoints := []checkpoint{{SnapshotId: "c0", CreatedAt: time.Now()}}
+	if got := expiredCheckpoints(checkpoints, &snapshotSchedule{}); got != nil {
+		t.Errorf("expiredCheckpoints(%v) = %v, want the latest one kept", checkpoints, got)
+	}
+}
+
+func TestExpiredCheckpointsManyDays(t *testing.T) {
+	// One checkpoint every hour for a week.
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var checkpoints []checkpoint
+	for i := 0; i < 7*24; i++ {
+		checkpoints = append(checkpoints, checkpoint{
+			SnapshotId: fmt.Sprintf("c%d", i),
+			CreatedAt:  start.Add(time.Duration(i) * time.Hour),
+		})
+	}
+
+	schedule := &snapshotSchedule{KeepLast: 3, KeepHourly: 6, KeepDaily: 3}
+	expired := expiredCheckpoints(checkpoints, schedule)
+	// The last 6 hours, which include the last 3 checkpoints, and the last checkpoint of each of
+	// the 2 days before the last one.
+	if want := len(checkpoints) - 6 - 2; len(expired) != want {
+		t.Fatalf("expiredCheckpoints() expired %d checkpoints, want %d", len(expired), want)
+	}
+	for _, id := range []string{"c143", "c119"} {
+		if slices.ContainsFunc(expired, func(c checkpoint) bool { return c.SnapshotId == id }) {
+			t.Errorf("expiredCheckpoints() expired the last checkpoint of a day: %s", id)
+		}
+	}
+}
+
+func TestSetSnapshotScheduleWithDisks(t *testing.T) {
+	schedule := &snapshotSchedule{IntervalSeconds: 3600}
+	tests := []struct {
+		name     string
+		vm       *vm
+		schedule *snapshotSchedule
+		wantErr  bool
+	}{
+		{name: "no disks", vm: &vm{name: "vm1"}, schedule: schedule},
+		{name: "hot-plugged disk", vm: &vm{name: "vm1", disks: []*vmDisk{{id: "scratch"}}}, schedule: schedule, wantErr: true},
+		{name: "root volume", vm: &vm{name: "vm1", rootVolume: "data"}, schedule: schedule, wantErr: true},
+		{name: "disabled with disks", vm: &vm{name: "vm1", disks: []*vmDisk{{id: "scratch"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.vm.setSnapshotSchedule(test.schedule)
+			if test.wantErr {
+				checkCode(t, err, codes.FailedPrecondition)
+				if test.vm.snapshotSchedule != nil {
+					t.Errorf("snapshot schedule was set")
+				}
+			} else if err != nil {
+				t.Errorf("setSnapshotSchedule() failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestStartVMWithVolumesAndSnapshotSchedule(t *testing.T) {
+	s, _ := newTestWarmPoolServer(t)
+	req := serverapi.NewStartVMRequest()
+	req.SetVmName("vm1")
+	req.SetVolumes([]serverapi.VolumeMount{{Name: "data"}})
+	req.SetSnapshotSchedule(*serverapi.NewSnapshotSchedule(3600))
+	_, err := s.StartVM(context.Background(), req)
+	checkCode(t, err, codes.InvalidArgument)
+
+	req = serverapi.NewStartVMRequest()
+	req.SetVmName("vm1")
+	req.SetRootVolume("data")
+	s.SetPreserveVMs(true)
+	_, err = s.StartVM(context.Background(), req)
+	checkCode(t, err, codes.FailedPrecondition)
+}
+
+func TestAttachDiskWhilePreservingVMs(t *testing.T) {
+	s, _ := newTestWarmPoolServer(t)
+	s.SetPreserveVMs(true)
+	req := serverapi.NewAttachDiskRequest("scratch")
+	req.SetSizeMB(16)
+	_, err := s.AttachDisk(context.Background(), warmPoolVMNamePrefix+"0", req)
+	checkCode(t, err, codes.FailedPrecondition)
+}
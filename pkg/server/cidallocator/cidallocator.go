@@ -49,6 +49,15 @@ func (a *CIDAllocator) AllocateCID() (uint32, error) {
 	return cid, nil
 }
 
+// Usage returns the number of allocated CIDs and the number of CIDs in the range
+func (a *CIDAllocator) Usage() (int, int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	size := int(a.highCID - a.lowCID + 1)
+	return size - len(a.available), size
+}
+
 // FreeCID returns a CID to the pool of available CIDs
 func (a *CIDAllocator) FreeCID(cid uint32) error {
 	a.mutex.Lock()
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Prefix of the IDs of the snapshots taken to clone a VM.
+	cloneSnapshotIdPrefix = "clone-"
+	// Directory in the VM's state directory holding the snapshot rewritten for its new network.
+	freshNetworkSnapshotDirName = "restore-snapshot"
+	// Port of the vsock server in the guest, which runs commands sent to it.
+	guestVsockServerPort = 4032
+	// How long reconfiguring the network of the guest may take.
+	reconfigureGuestNetworkTimeout = 10 * time.Second
+)
+
+var guestIPCmdlineRegexp = regexp.MustCompile(`guest_ip="[^"]*"`)
+
+// guestMACForIP returns the locally administered MAC address of the guest with `ip`, which is
+// unique as long as the IP is.
+func guestMACForIP(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	return net.HardwareAddr{0x02, 0x00, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
+
+// linkOrCopyFile hard links `sourcePath` to `destPath` and falls back to copying it, e.g. across
+// file systems.
+func linkOrCopyFile(sourcePath string, destPath string) error {
+	if err := os.Link(sourcePath, destPath); err == nil {
+		return nil
+	}
+	return copyFile(sourcePath, destPath)
+}
+
+// prepareFreshNetworkSnapshot creates a copy of the snapshot at `snapshotPath` in the VM's state
+// directory whose config uses the VM's tap device, IP, CID, vsock socket, serial socket, stateful
+// disk and `mac` instead of the ones of the snapshotted VM. Returns the path of the copy.
+func (v *vm) prepareFreshNetworkSnapshot(snapshotPath string, mac net.HardwareAddr) (string, error) {
+	restorePath := path.Join(v.stateDirPath, freshNetworkSnapshotDirName)
+	if err := os.MkdirAll(restorePath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(snapshotPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+	for _, entry := range entries {
+		// The stateful disk was copied to the VM's state directory already.
+		if entry.IsDir() || entry.Name() == "config.json" || entry.Name() == statefulDiskFilename {
+			continue
+		}
+		if err := linkOrCopyFile(path.Join(snapshotPath, entry.Name()), path.Join(restorePath, entry.Name())); err != nil {
+			return "", fmt.Errorf("failed to copy %s: %w", entry.Name(), err)
+		}
+	}
+
+	data, err := os.ReadFile(path.Join(snapshotPath, "config.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read config file: %w", err)
+	}
+	// The config is rewritten generically to keep the fields this server doesn't know about.
+	var config map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return "", fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	nets, _ := config["net"].([]any)
+	if len(nets) == 0 {
+		return "", fmt.Errorf("no network configuration found")
+	}
+	if netConfig, ok := nets[0].(map[string]any); ok {
+		netConfig["tap"] = v.tapDevice.Name
+		netConfig["mac"] = mac.String()
+		// The new tap device has a MAC address of its own.
+		delete(netConfig, "host_mac")
+	}
+
+	if vsock, ok := config["vsock"].(map[string]any); ok {
+		vsock["cid"] = v.cid
+		vsock["socket"] = v.vsockPath
+	}
+
+	if serial, ok := config["serial"].(map[string]any); ok && serial["mode"] == serialPortMode {
+		serial["socket"] = getSerialSocketPath(v.stateDirPath)
+	}
+
+	disks, _ := config["disks"].([]any)
+	for _, disk := range disks {
+		diskConfig, ok := disk.(map[string]any)
+		if !ok {
+			continue
+		}
+		if diskPath, _ := diskConfig["path"].(string); path.Base(diskPath) == statefulDiskFilename {
+			diskConfig["path"] = path.Join(v.stateDirPath, statefulDiskFilename)
+		}
+	}
+
+	// Later snapshots of the VM report its new IP.
+	if payload, ok := config["payload"].(map[string]any); ok {
+		if cmdline, ok := payload["cmdline"].(string); ok {
+			payload["cmdline"] = guestIPCmdlineRegexp.ReplaceAllString(cmdline, fmt.Sprintf("guest_ip=%q", v.ip.String()))
+		}
+	}
+
+	data, err = json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := os.WriteFile(path.Join(restorePath, "config.json"), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write config file: %w", err)
+	}
+	return restorePath, nil
+}
+
+// reconfigureGuestNetwork moves `eth0` of the restored guest, which still has the IP and MAC
+// address of the snapshotted VM, to the VM's IP and `mac`. The guest's command server can't be
+// reached until then, so the command is sent over vsock.
+func (v *vm) reconfigureGuestNetwork(ctx context.Context, gatewayCIDR string, mac net.HardwareAddr) error {
+	gatewayIP, _, err := net.ParseCIDR(gatewayCIDR)
+	if err != nil {
+		return fmt.Errorf("failed to parse gateway CIDR: %w", err)
+	}
+
+	cmd := fmt.Sprintf(
+		"ip link set eth0 down && ip link set eth0 address %s && ip addr flush dev eth0 && "+
+			"ip addr add %s dev eth0 && ip link set eth0 up && ip route replace default via %s dev eth0",
+		mac.String(),
+		v.ip.String(),
+		gatewayIP.String(),
+	)
+	ctx, cancel := context.WithTimeout(ctx, reconfigureGuestNetworkTimeout)
+	defer cancel()
+	return runVsockCommand(ctx, v.vsockPath, guestVsockServerPort, cmd)
+}
+
+// runVsockCommand runs `cmd` through the vsock server listening on `port` in the guest, reached via
+// the VMM's vsock socket at `vsockPath`.
+func runVsockCommand(ctx context.Context, vsockPath string, port int, cmd string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", vsockPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to vsock socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	reader := bufio.NewReader(conn)
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		return fmt.Errorf("failed to send CONNECT command: %w", err)
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	if !strings.HasPrefix(response, "OK") {
+		return fmt.Errorf("unexpected response to CONNECT: %s", strings.TrimSpace(response))
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	// The server answers with the command's output or an error followed by the output.
+	output, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read command output: %w", err)
+	}
+	if strings.HasPrefix(output, "Error:") {
+		rest, _ := reader.ReadString('\n')
+		return fmt.Errorf("command failed: %s %s", strings.TrimSpace(output), strings.TrimSpace(rest))
+	}
+	return nil
+}
+
+// CloneVM snapshots a running VM and restores the snapshot as a new VM with its own tap device, IP,
+// CID and port forwards. The snapshot is deleted afterwards.
+func (s *Server) CloneVM(ctx context.Context, vmName string, req *serverapi.CloneVMRequest) (*serverapi.StartVMResponse, error) {
+	cloneName := req.GetVmName()
+	logger := log.WithFields(log.Fields{"vmName": vmName, "cloneName": cloneName})
+	logger.Info("received request to clone VM")
+
+	if cloneName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName of the clone is required")
+	}
+	if isWarmPoolVMName(cloneName) {
+		return nil, status.Errorf(codes.InvalidArgument, "vmName can't start with: %s", warmPoolVMNamePrefix)
+	}
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	source := s.getVMAtomic(vmName)
+	if source == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if s.getVMAtomic(cloneName) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "vm already exists: %s", cloneName)
+	}
+
+	// The clone counts against the quota of whoever clones the VM.
+	tenant := s.admission.tenantOf(callerFromContext(ctx))
+	source.lock.RLock()
+	bootConfig := source.bootConfig
+	lastSnapshotId := source.lastSnapshotId
+	source.lock.RUnlock()
+
+	snapshotId := fmt.Sprintf("%s%s-%d", cloneSnapshotIdPrefix, vmName, time.Now().UnixNano())
+	if _, err := s.SnapshotVM(ctx, vmName, snapshotId); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := s.removeSnapshot(context.WithoutCancel(ctx), snapshotId); err != nil {
+			logger.WithError(err).Warnf("failed to delete snapshot: %s", snapshotId)
+		}
+	}()
+	// The snapshot is gone once the clone is restored, the VM can't be restored from it after a crash.
+	source.lock.Lock()
+	if source.lastSnapshotId == snapshotId {
+		source.lastSnapshotId = lastSnapshotId
+	}
+	source.lock.Unlock()
+
+	logger.Info("restoring clone")
+	clone, err := s.restoreVM(ctx, cloneName, tenant, req.GetLabels(), snapshotId, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore clone: %w", err)
+	}
+
+	// The clone can be rebooted like the VM it was cloned from, but not restored from the snapshot.
+	clone.lock.Lock()
+	clone.bootConfig = bootConfig
+	clone.lastSnapshotId = ""
+	clone.lock.Unlock()
+
+	reportProgress(ctx, "waiting for VM to be ready")
+	if err := waitForCmdServerReady(ctx, clone.ip.IP.String()); err != nil {
+		logger.WithError(err).Warnf("command server not ready")
+	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeCloned, clone, map[string]string{"source": vmName})
+	logger.Info("cloned VM")
+
+	return &serverapi.StartVMResponse{
+		VmName:             serverapi.PtrString(cloneName),
+		Ip:                 serverapi.PtrString(clone.ip.String()),
+		Status:             serverapi.PtrString(clone.status.String()),
+		TapDeviceName:      serverapi.PtrString(clone.tapDevice.Name),
+		PortForwards:       convertPortForward(clone.portForwards),
+		Vcpus:              serverapi.PtrInt32(clone.resources.vcpus),
+		MemorySizeMB:       serverapi.PtrInt32(clone.resources.memorySizeMB),
+		StatefulDiskSizeMB: serverapi.PtrInt32(clone.resources.statefulDiskSizeMB),
+		Lifetime:           clone.lifetime.toAPI(),
+		Labels:             labelsToAPI(clone.labels),
+	}, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/server/fountain"
+)
+
+func TestGuestMACForIP(t *testing.T) {
+	mac := guestMACForIP(net.ParseIP("10.20.1.7"))
+	if got, want := mac.String(), "02:00:0a:14:01:07"; got != want {
+		t.Errorf("guestMACForIP() = %s, want %s", got, want)
+	}
+}
+
+func TestPrepareFreshNetworkSnapshot(t *testing.T) {
+	snapshotPath := t.TempDir()
+	snapshotConfig := `{
+		"net": [{"tap": "tap-old", "mac": "02:00:0a:14:01:02", "host_mac": "aa:bb:cc:dd:ee:ff", "num_queues": 2}],
+		"vsock": {"cid": 3, "socket": "/state/old/vsock.sock"},
+		"serial": {"mode": "Socket", "socket": "/state/old/serial.sock"},
+		"disks": [
+			{"path": "/images/rootfs.img", "readonly": true},
+			{"path": "/state/old/stateful.img"}
+		],
+		"payload": {"kernel": "/images/vmlinux", "cmdline": "console=ttyS0 guest_ip=\"10.20.1.2/24\" quiet"},
+		"memory": {"size": 1073741824}
+	}`
+	files := map[string]string{
+		"config.json":        snapshotConfig,
+		"state.json":         "{}",
+		"memory-ranges":      "memory",
+		statefulDiskFilename: "disk",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(snapshotPath, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	_, ipNet, _ := net.ParseCIDR("10.20.1.9/24")
+	ipNet.IP = net.ParseIP("10.20.1.9")
+	stateDirPath := t.TempDir()
+	v := &vm{
+		stateDirPath: stateDirPath,
+		tapDevice:    &fountain.TapDevice{Name: "tap-new"},
+		ip:           ipNet,
+		cid:          42,
+		vsockPath:    filepath.Join(stateDirPath, "vsock.sock"),
+	}
+	mac := guestMACForIP(ipNet.IP)
+
+	restorePath, err := v.prepareFreshNetworkSnapshot(snapshotPath, mac)
+	if err != nil {
+		t.Fatalf("prepareFreshNetworkSnapshot() failed: %v", err)
+	}
+
+	for _, name := range []string{"state.json", "memory-ranges"} {
+		if _, err := os.Stat(filepath.Join(restorePath, name)); err != nil {
+			t.Errorf("%s wasn't copied: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(restorePath, statefulDiskFilename)); !os.IsNotExist(err) {
+		t.Errorf("stateful disk was copied: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(restorePath, "config.json"))
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	var config struct {
+		Net   []map[string]any `json:"net"`
+		Vsock struct {
+			Cid    uint32 `json:"cid"`
+			Socket string `json:"socket"`
+		} `json:"vsock"`
+		Serial struct {
+			Socket string `json:"socket"`
+		} `json:"serial"`
+		Disks []struct {
+			Path string `json:"path"`
+		} `json:"disks"`
+		Payload struct {
+			Cmdline string `json:"cmdline"`
+		} `json:"payload"`
+		Memory struct {
+			Size int64 `json:"size"`
+		} `json:"memory"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	netConfig := config.Net[0]
+	if netConfig["tap"] != "tap-new" || netConfig["mac"] != mac.String() {
+		t.Errorf("net = %v, want tap-new with %s", netConfig, mac)
+	}
+	if _, ok := netConfig["host_mac"]; ok {
+		t.Errorf("host_mac of the snapshotted VM was kept")
+	}
+	if netConfig["num_queues"] != float64(2) {
+		t.Errorf("unknown net fields weren't kept: %v", netConfig)
+	}
+	if config.Vsock.Cid != v.cid || config.Vsock.Socket != v.vsockPath {
+		t.Errorf("vsock = %+v, want CID %d at %s", config.Vsock, v.cid, v.vsockPath)
+	}
+	if want := getSerialSocketPath(stateDirPath); config.Serial.Socket != want {
+		t.Errorf("serial socket = %s, want %s", config.Serial.Socket, want)
+	}
+	if config.Disks[0].Path != "/images/rootfs.img" {
+		t.Errorf("rootfs = %s, want it unchanged", config.Disks[0].Path)
+	}
+	if want := filepath.Join(stateDirPath, statefulDiskFilename); config.Disks[1].Path != want {
+		t.Errorf("stateful disk = %s, want %s", config.Disks[1].Path, want)
+	}
+	if want := `console=ttyS0 guest_ip="10.20.1.9/24" quiet`; config.Payload.Cmdline != want {
+		t.Errorf("cmdline = %s, want %s", config.Payload.Cmdline, want)
+	}
+	// Numbers are kept as they are rather than turned into floats.
+	if config.Memory.Size != 1073741824 {
+		t.Errorf("memory size = %d, want 1073741824", config.Memory.Size)
+	}
+}
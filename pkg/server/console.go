@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Socket in the VM's state directory the VMM exposes the VM's serial port on.
+	serialSocketFilename = "serial.sock"
+	serialConnectTimeout = 2 * time.Second
+	serialReadSize       = 4096
+	// Chunks of output buffered for an attached console. A console falling further behind is
+	// detached rather than holding up the guest's output for everyone else.
+	consoleOutputBufferSize = 256
+)
+
+func getSerialSocketPath(stateDirPath string) string {
+	return path.Join(stateDirPath, serialSocketFilename)
+}
+
+// serialConsole is the server's end of the serial port of a VM. It appends the guest's output to
+// the VM's log and hands it to the attached consoles, which can type into the guest.
+type serialConsole struct {
+	vmName string
+	conn   net.Conn
+	// The VM's log, shared with the VMM and hence only appended to.
+	logFile *os.File
+
+	lock     sync.Mutex
+	consoles map[*Console]struct{}
+	// Set once the VMM closed the serial port, consoles can't be attached anymore then.
+	closed bool
+}
+
+// connectSerialConsole connects to the serial port of the VM `vmName` exposed at `socketPath` and
+// starts copying the guest's output to the log at `logPath`.
+func connectSerialConsole(ctx context.Context, vmName string, socketPath string, logPath string) (*serialConsole, error) {
+	dialer := net.Dialer{Timeout: serialConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to serial socket: %w", err)
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	serial := &serialConsole{
+		vmName:   vmName,
+		conn:     conn,
+		logFile:  logFile,
+		consoles: make(map[*Console]struct{}),
+	}
+	go serial.run()
+	return serial, nil
+}
+
+// run copies the guest's output until the VMM closes the serial port, i.e. the VM is shut down or
+// its VMM exits.
+func (sc *serialConsole) run() {
+	logger := log.WithField("vmName", sc.vmName)
+	defer sc.close()
+
+	buf := make([]byte, serialReadSize)
+	logFailed := false
+	for {
+		n, err := sc.conn.Read(buf)
+		if n > 0 {
+			output := bytes.Clone(buf[:n])
+			if _, err := sc.logFile.Write(output); err != nil && !logFailed {
+				logger.WithError(err).Warn("failed to write serial console output to log")
+				logFailed = true
+			}
+			sc.broadcast(output)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.WithError(err).Warn("failed to read from serial console")
+			}
+			return
+		}
+	}
+}
+
+func (sc *serialConsole) broadcast(output []byte) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	for console := range sc.consoles {
+		select {
+		case console.output <- output:
+		default:
+			log.WithField("vmName", sc.vmName).Warn("detaching console falling behind the serial console output")
+			delete(sc.consoles, console)
+			close(console.output)
+		}
+	}
+}
+
+func (sc *serialConsole) close() {
+	sc.lock.Lock()
+	sc.closed = true
+	for console := range sc.consoles {
+		close(console.output)
+	}
+	clear(sc.consoles)
+	sc.lock.Unlock()
+
+	sc.conn.Close()
+	sc.logFile.Close()
+}
+
+func (sc *serialConsole) attach() (*Console, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if sc.closed {
+		return nil, status.Errorf(codes.FailedPrecondition, "serial console of vm is closed: %s", sc.vmName)
+	}
+	console := &Console{
+		serial: sc,
+		output: make(chan []byte, consoleOutputBufferSize),
+	}
+	sc.consoles[console] = struct{}{}
+	return console, nil
+}
+
+// Console is a console attached to the serial port of a VM.
+type Console struct {
+	serial *serialConsole
+	output chan []byte
+}
+
+// Output returns the guest's output from when the console was attached on. It's closed once the
+// console is detached, the VM is shut down or the console fell too far behind.
+func (c *Console) Output() <-chan []byte {
+	return c.output
+}
+
+// Write types `p` into the guest.
+func (c *Console) Write(p []byte) (int, error) {
+	return c.serial.conn.Write(p)
+}
+
+// Close detaches the console.
+func (c *Console) Close() error {
+	c.serial.lock.Lock()
+	defer c.serial.lock.Unlock()
+
+	if _, ok := c.serial.consoles[c]; ok {
+		delete(c.serial.consoles, c)
+		close(c.output)
+	}
+	return nil
+}
+
+// connectSerialLocked connects the server to the serial port of the VM once the VMM created it, i.e.
+// after the VM was booted or restored. The VM is left without a serial console if that fails, e.g.
+// when it was restored from a snapshot of a VM whose serial port was the VMM's TTY. Expects
+// `v.lock` to be held.
+func (v *vm) connectSerialLocked(ctx context.Context) {
+	logger := log.WithField("vmName", v.name)
+	v.serial = nil
+
+	info, resp, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		logger.WithError(err).Warn("failed to get VM info to connect to serial console")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Warnf("failed to get VM info to connect to serial console. bad status: %v", resp)
+		return
+	}
+	serialConfig := info.Config.Serial
+	if serialConfig == nil || serialConfig.GetMode() != serialPortMode || serialConfig.GetSocket() == "" {
+		logger.Info("VM has no serial socket, serial console unavailable")
+		return
+	}
+
+	serial, err := connectSerialConsole(ctx, v.name, serialConfig.GetSocket(), getVMLogPath(v.stateDirPath))
+	if err != nil {
+		logger.WithError(err).Warn("failed to connect to serial console")
+		return
+	}
+	v.serial = serial
+}
+
+// AttachConsole attaches a console to the serial port of the VM `vmName`. The console gets the
+// guest's output from now on and what's written to it is typed into the guest, e.g. into the shell
+// the guest's init drops to when it fails.
+func (s *Server) AttachConsole(ctx context.Context, vmName string) (*Console, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Info("received request to attach console")
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	serial := vm.serial
+	vm.lock.RUnlock()
+	if serial == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm has no serial console: %s", vmName)
+	}
+	return serial.attach()
+}
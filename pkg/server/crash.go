@@ -0,0 +1,382 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// What to do when the cloud-hypervisor process of a VM exits unexpectedly.
+const (
+	// Leave the VM in the crashed state until it's destroyed.
+	crashRestartPolicyNever = "never"
+	// Boot the VM again from its kernel and rootfs, keeping its stateful disk.
+	crashRestartPolicyReboot = "reboot"
+	// Restore the VM from its latest snapshot, or reboot it if it has none.
+	crashRestartPolicyRestore = "restore"
+)
+
+const (
+	// Number of bytes at the end of the VM's log file kept when it crashes.
+	crashLogTailSize = 4096
+	// How often the VMM of a VM that isn't our child, i.e. one adopted from a previous server
+	// instance, is checked for being alive.
+	adoptedVMPollInterval = time.Second
+	// Crashed VMs aren't restarted anymore after this many restarts to avoid crash loops.
+	maxCrashRestarts = 5
+)
+
+func isValidCrashRestartPolicy(policy string) bool {
+	switch policy {
+	case crashRestartPolicyNever, crashRestartPolicyReboot, crashRestartPolicyRestore:
+		return true
+	default:
+		return false
+	}
+}
+
+// vmCrash describes the last unexpected exit of the VMM of a VM.
+type vmCrash struct {
+	crashedAt  time.Time
+	exitStatus string
+	logTail    string
+}
+
+// vmBootConfig is what a VM was created with, needed to boot it again after a crash. The kernel is
+// empty for VMs restored from a snapshot.
+type vmBootConfig struct {
+	kernelPath    string
+	initramfsPath string
+	rootfsPath    string
+	entryPoint    entryPoint
+}
+
+// waitForVMMExit blocks until `process` exits and returns how it exited, if known.
+func waitForVMMExit(process *os.Process) string {
+	state, err := process.Wait()
+	if err == nil {
+		return state.String()
+	}
+
+	// VMs adopted from a previous server instance aren't our children and can't be waited on.
+	for {
+		if err := syscall.Kill(process.Pid, 0); errors.Is(err, syscall.ESRCH) {
+			return ""
+		}
+		time.Sleep(adoptedVMPollInterval)
+	}
+}
+
+// readLogTail returns up to the last `size` bytes of the file at `logPath`, starting at a line
+// boundary.
+func readLogTail(logPath string, size int64) (string, error) {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	offset := max(info.Size()-size, 0)
+	// The byte before the tail tells whether the tail starts a line.
+	readOffset := max(offset-1, 0)
+	data := make([]byte, info.Size()-readOffset)
+	if _, err := file.ReadAt(data, readOffset); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	tail := string(data)
+	if offset > 0 {
+		if _, rest, found := strings.Cut(tail, "\n"); found {
+			tail = rest
+		} else {
+			tail = tail[1:]
+		}
+	}
+	return tail, nil
+}
+
+// watchVM waits for the VMM of `vm` to exit and handles the exit as a crash unless the VM was being
+// destroyed.
+func (s *Server) watchVM(vm *vm) {
+	exitStatus := waitForVMMExit(vm.process)
+	close(vm.exited)
+
+	// Read before locking the VM, the state directory doesn't change. It's gone if the VM was
+	// destroyed meanwhile.
+	logTail, logErr := readLogTail(getVMLogPath(vm.stateDirPath), crashLogTailSize)
+
+	vm.lock.Lock()
+	if vm.destroying {
+		vm.lock.Unlock()
+		return
+	}
+	vmName := vm.name
+	logger := log.WithFields(log.Fields{"vmName": vmName, "exitStatus": exitStatus})
+	logger.Error("VMM exited unexpectedly")
+	if logErr != nil {
+		logger.WithError(logErr).Warn("failed to read VM log")
+	}
+	vm.status = vmStatusCrashed
+	vm.crash = &vmCrash{
+		crashedAt:  time.Now(),
+		exitStatus: exitStatus,
+		logTail:    logTail,
+	}
+	warmPool := vm.warmPool
+	restartPolicy := vm.crashRestartPolicy
+	restarts := vm.restarts
+	vm.lock.Unlock()
+
+	s.releaseCrashedVMNetwork(vm)
+	s.persistVMRegistry()
+
+	details := map[string]string{}
+	if exitStatus != "" {
+		details["exitStatus"] = exitStatus
+	}
+	s.publishEvent(EventTypeCrashed, vm, details)
+
+	// Warm pools are refilled with fresh VMs instead.
+	if warmPool != "" {
+		if err := s.destroyVM(context.Background(), vmName); err != nil {
+			logger.WithError(err).Error("failed to destroy crashed VM of warm pool")
+		}
+		return
+	}
+
+	if restartPolicy == "" || restartPolicy == crashRestartPolicyNever {
+		return
+	}
+	if restarts >= maxCrashRestarts {
+		logger.Errorf("not restarting VM that crashed %d times", restarts+1)
+		return
+	}
+	if err := s.restartCrashedVM(context.Background(), vm); err != nil {
+		logger.WithError(err).Error("failed to restart crashed VM")
+	}
+}
+
+// releaseCrashedVMNetwork frees the tap device, IP, CID and host ports of a VM whose VMM is gone so
+// that other VMs can use them.
+func (s *Server) releaseCrashedVMNetwork(vm *vm) {
+	logger := log.WithField("vmName", vm.name)
+
+	if err := cleanupAllIPTablesRulesForIP(vm.ip.IP.String()); err != nil {
+		logger.WithError(err).Warn("failed to delete iptables rules of crashed VM")
+	}
+	if err := s.fountain.DestroyTapDevice(vm.tapDevice); err != nil {
+		logger.WithError(err).Warn("failed to destroy tap device of crashed VM")
+	}
+	if err := s.ipAllocator.FreeIP(vm.ip.IP); err != nil {
+		logger.WithError(err).Warn("failed to free IP of crashed VM")
+	}
+	if err := s.cidAllocator.FreeCID(vm.cid); err != nil {
+		logger.WithError(err).Warn("failed to free CID of crashed VM")
+	}
+	s.freeHostPorts(vm.portForwards, logger)
+}
+
+// restartCrashedVM replaces a crashed VM by a new one with the same name, either booted from the
+// same kernel and rootfs with the crashed VM's stateful disk or restored from its latest snapshot.
+// Volumes attached to the crashed VM are attached to the new one again.
+func (s *Server) restartCrashedVM(ctx context.Context, crashed *vm) error {
+	crashed.lock.RLock()
+	vmName := crashed.name
+	tenant := crashed.tenant
+	labels := crashed.labels
+	resources := crashed.resources
+	bootConfig := crashed.bootConfig
+	restartPolicy := crashed.crashRestartPolicy
+	lastSnapshotId := crashed.lastSnapshotId
+	statefulDiskPath := crashed.statefulDiskPath
+	rootVolume := crashed.rootVolume
+	var volumeMounts []serverapi.VolumeMount
+	for _, disk := range crashed.disks {
+		if disk.volume != "" {
+			volumeMounts = append(volumeMounts, serverapi.VolumeMount{
+				Name:     disk.volume,
+				Readonly: serverapi.PtrBool(disk.readonly),
+			})
+		}
+	}
+	crash := crashed.crash
+	restarts := crashed.restarts
+	schedule := crashed.snapshotSchedule
+	checkpoints := crashed.checkpoints
+	balloonTargetMB := crashed.balloonTargetMB
+	crashed.lock.RUnlock()
+
+	crashed.lifetime.lock.Lock()
+	ttl := crashed.lifetime.ttl
+	idleTimeout := crashed.lifetime.idleTimeout
+	deadline := crashed.lifetime.deadline
+	crashed.lifetime.lock.Unlock()
+
+	logger := log.WithFields(log.Fields{"vmName": vmName, "restartPolicy": restartPolicy})
+	// VMs restored from a snapshot taken elsewhere don't know what to boot.
+	canReboot := bootConfig.kernelPath != ""
+	restore := lastSnapshotId != "" && (restartPolicy == crashRestartPolicyRestore || !canReboot)
+	// The crashed VM is only destroyed once it's known that it can be replaced. The snapshot may
+	// have been deleted or evicted from the snapshot store since.
+	if restore {
+		if _, err := s.fetchSnapshot(ctx, lastSnapshotId); err != nil {
+			if !canReboot {
+				return fmt.Errorf("snapshot %s can't be restored, leaving VM crashed: %w", lastSnapshotId, err)
+			}
+			logger.WithError(err).Warnf("snapshot %s can't be restored, rebooting instead", lastSnapshotId)
+			restore = false
+		}
+	}
+	if !restore && !canReboot {
+		return fmt.Errorf("VM restored from an unknown snapshot can't be rebooted")
+	}
+	logger.Info("restarting crashed VM")
+
+	// Keep the stateful disk around while the crashed VM is destroyed, also when restoring in case
+	// that fails and the VM is rebooted instead. Root volumes outlive the VM anyway.
+	var preservedDiskPath string
+	if canReboot && statefulDiskPath != "" && rootVolume == "" {
+		preservedDiskPath = path.Join(s.config.StateDir, vmName+"-crashed-"+statefulDiskFilename)
+		if err := os.Rename(statefulDiskPath, preservedDiskPath); err != nil {
+			logger.WithError(err).Warn("failed to preserve stateful disk, starting with an empty one")
+			preservedDiskPath = ""
+		}
+	}
+	defer func() {
+		if preservedDiskPath != "" {
+			os.Remove(preservedDiskPath)
+		}
+	}()
+
+	if err := s.destroyVM(ctx, vmName); err != nil {
+		// The crashed VM stays, with its stateful disk.
+		if preservedDiskPath != "" && os.Rename(preservedDiskPath, statefulDiskPath) == nil {
+			preservedDiskPath = ""
+		}
+		return fmt.Errorf("failed to destroy crashed VM: %w", err)
+	}
+
+	var vm *vm
+	var err error
+	if restore {
+		vm, err = s.restoreVM(ctx, vmName, tenant, labels, lastSnapshotId, true)
+		if err != nil {
+			if !canReboot {
+				return fmt.Errorf("failed to restore VM from snapshot %s: %w", lastSnapshotId, err)
+			}
+			logger.WithError(err).Warnf("failed to restore VM from snapshot %s, rebooting instead", lastSnapshotId)
+			restore = false
+		}
+	}
+	if !restore {
+		vm, err = s.createVM(
+			ctx,
+			vmName,
+			tenant,
+			labels,
+			bootConfig.kernelPath,
+			bootConfig.initramfsPath,
+			bootConfig.rootfsPath,
+			resources,
+			bootConfig.entryPoint,
+			rootVolume,
+			false,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create VM: %w", err)
+		}
+
+		if preservedDiskPath != "" {
+			if err := os.Rename(preservedDiskPath, vm.statefulDiskPath); err != nil {
+				logger.WithError(err).Warn("failed to restore stateful disk, starting with an empty one")
+			} else {
+				preservedDiskPath = ""
+			}
+		}
+
+		if err := vm.boot(ctx); err != nil {
+			return fmt.Errorf("failed to boot VM: %w", err)
+		}
+	}
+
+	vm.lock.Lock()
+	vm.crashRestartPolicy = restartPolicy
+	vm.crash = crash
+	vm.restarts = restarts + 1
+	vm.balloonTargetMB = balloonTargetMB
+	vm.lock.Unlock()
+	vm.lifetime.restore(ttl, idleTimeout, deadline)
+	vm.restoreSnapshotSchedule(schedule, checkpoints)
+
+	if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
+		logger.WithError(err).Warn("command server of restarted VM not ready")
+	}
+	if err := s.attachVolumes(ctx, vm, volumeMounts); err != nil {
+		logger.WithError(err).Warn("failed to attach volumes to restarted VM")
+	}
+	s.persistVMRegistry()
+	if restore {
+		s.publishEvent(EventTypeRestored, vm, map[string]string{"snapshotId": lastSnapshotId})
+	} else {
+		s.publishEvent(EventTypeBooted, vm, nil)
+	}
+	logger.Info("restarted crashed VM")
+	return nil
+}
+
+// crashToAPI returns the last crash of the VM as reported by the API or nil if it never crashed.
+func (v *vm) crashToAPI() *serverapi.VMCrash {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if v.crash == nil {
+		return nil
+	}
+	crash := &serverapi.VMCrash{
+		CrashedAt: serverapi.PtrTime(v.crash.crashedAt),
+		LogTail:   serverapi.PtrString(v.crash.logTail),
+		Restarts:  serverapi.PtrInt32(v.restarts),
+	}
+	if v.crash.exitStatus != "" {
+		crash.SetExitStatus(v.crash.exitStatus)
+	}
+	return crash
+}
+
+// setCrashRestartPolicy sets what to do when the VMM of the VM exits unexpectedly. An empty `policy`
+// keeps the current one.
+func (v *vm) setCrashRestartPolicy(policy string) {
+	if policy == "" {
+		return
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.crashRestartPolicy = policy
+}
+
+// checkNotCrashed returns an error if the VM crashed and can only be destroyed.
+func (v *vm) checkNotCrashed() error {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if v.status == vmStatusCrashed {
+		return status.Errorf(codes.FailedPrecondition, "vm crashed: %s", v.name)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"google.golang.org/grpc/codes"
+)
+
+func TestReadLogTail(t *testing.T) {
+	tests := []struct {
+		content string
+		size    int64
+		want    string
+	}{
+		{content: "", size: 10, want: ""},
+		{content: "first\nsecond\n", size: 100, want: "first\nsecond\n"},
+		{content: "first\nsecond\n", size: 13, want: "first\nsecond\n"},
+		// The partial first line is dropped.
+		{content: "first\nsecond\n", size: 10, want: "second\n"},
+		{content: "first\nsecond\n", size: 7, want: "second\n"},
+		{content: "first\nsecond\n", size: 5, want: ""},
+		{content: "first\nsecond", size: 8, want: "second"},
+		// Without a line boundary the tail is kept as is.
+		{content: "one long line", size: 4, want: "line"},
+	}
+	for _, test := range tests {
+		logPath := filepath.Join(t.TempDir(), "log")
+		if err := os.WriteFile(logPath, []byte(test.content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", logPath, err)
+		}
+		got, err := readLogTail(logPath, test.size)
+		if err != nil {
+			t.Fatalf("readLogTail(%q, %d) failed: %v", test.content, test.size, err)
+		}
+		if got != test.want {
+			t.Errorf("readLogTail(%q, %d) = %q, want %q", test.content, test.size, got, test.want)
+		}
+	}
+}
+
+func TestReadLogTailMissing(t *testing.T) {
+	_, err := readLogTail(filepath.Join(t.TempDir(), "missing"), 10)
+	if !os.IsNotExist(err) {
+		t.Errorf("readLogTail() of a missing log = %v, want not exist", err)
+	}
+}
+
+func TestReadLogTailLarge(t *testing.T) {
+	content := strings.Repeat("0123456789abcde\n", 1000)
+	logPath := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(logPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", logPath, err)
+	}
+	got, err := readLogTail(logPath, 100)
+	if err != nil {
+		t.Fatalf("readLogTail() failed: %v", err)
+	}
+	// The last 100 bytes hold 6 complete lines of 16 bytes.
+	if want := strings.Repeat("0123456789abcde\n", 6); got != want {
+		t.Errorf("readLogTail() = %q, want %q", got, want)
+	}
+}
+
+// newTestSnapshotServer returns a server with a local snapshot store in a temporary state
+// directory and the VMs `vms`.
+func newTestSnapshotServer(t *testing.T, vms ...*vm) *Server {
+	t.Helper()
+	serverConfig := config.ServerConfig{StateDir: t.TempDir()}
+	store, err := newSnapshotStore(serverConfig)
+	if err != nil {
+		t.Fatalf("newSnapshotStore() failed: %v", err)
+	}
+	wp, err := newWarmPools(serverConfig)
+	if err != nil {
+		t.Fatalf("newWarmPools() failed: %v", err)
+	}
+	s := &Server{
+		vms:           make(map[string]*vm),
+		warmPools:     wp,
+		snapshotStore: store,
+		config:        serverConfig,
+	}
+	for _, vm := range vms {
+		s.vms[vm.name] = vm
+	}
+	return s
+}
+
+func TestRestartCrashedVMWithoutSnapshot(t *testing.T) {
+	// Restored from a snapshot that was deleted since, without a kernel to reboot.
+	crashed := &vm{
+		name:               "vm1",
+		status:             vmStatusCrashed,
+		crashRestartPolicy: crashRestartPolicyRestore,
+		lastSnapshotId:     "deleted",
+	}
+	s := newTestSnapshotServer(t, crashed)
+
+	if err := s.restartCrashedVM(context.Background(), crashed); err == nil {
+		t.Fatalf("restartCrashedVM() succeeded without a snapshot to restore")
+	}
+	if s.getVMAtomic("vm1") != crashed || crashed.status != vmStatusCrashed {
+		t.Errorf("crashed VM was destroyed without being replaced")
+	}
+}
+
+func TestDeleteSnapshotForgetsIt(t *testing.T) {
+	now := time.Now()
+	vm1 := &vm{
+		name:           "vm1",
+		lastSnapshotId: "snap",
+		checkpoints: []checkpoint{
+			{SnapshotId: "older", CreatedAt: now.Add(-time.Hour)},
+			{SnapshotId: "snap", CreatedAt: now},
+		},
+	}
+	vm2 := &vm{name: "vm2", lastSnapshotId: "other"}
+	s := newTestSnapshotServer(t, vm1, vm2)
+	if err := os.MkdirAll(s.getSnapshotPath("snap"), 0755); err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+
+	checkCode(t, s.DeleteSnapshot(context.Background(), "snap", false), codes.FailedPrecondition)
+	if err := s.DeleteSnapshot(context.Background(), "snap", true); err != nil {
+		t.Fatalf("DeleteSnapshot() with force failed: %v", err)
+	}
+	if vm1.lastSnapshotId != "" {
+		t.Errorf("VM still restores from deleted snapshot %q", vm1.lastSnapshotId)
+	}
+	if len(vm1.checkpoints) != 1 || vm1.checkpoints[0].SnapshotId != "older" {
+		t.Errorf("checkpoints = %v, want only the older one", vm1.checkpoints)
+	}
+	if vm2.lastSnapshotId != "other" {
+		t.Errorf("snapshot of another VM was forgotten")
+	}
+
+	records, err := loadVMRegistry(s.config.StateDir)
+	if err != nil {
+		t.Fatalf("loadVMRegistry() failed: %v", err)
+	}
+	for _, record := range records {
+		if record.Name == "vm1" && record.LastSnapshotId != "" {
+			t.Errorf("registry still records deleted snapshot %q", record.LastSnapshotId)
+		}
+	}
+}
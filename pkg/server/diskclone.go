@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// cloneDiskFile makes `destPath` a copy of the disk image `sourcePath` whose cost scales with the
+// data written to the image rather than its size. The file is reflinked where the file system
+// supports it, e.g. btrfs and XFS, and otherwise only its data extents are copied, keeping holes.
+func cloneDiskFile(sourcePath string, destPath string) error {
+	srcFile, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer destFile.Close()
+
+	logger := log.WithFields(log.Fields{"source": sourcePath, "destination": destPath})
+	err = unix.IoctlFileClone(int(destFile.Fd()), int(srcFile.Fd()))
+	if err == nil {
+		logger.Debug("reflinked disk")
+		return nil
+	}
+	logger.WithError(err).Debug("reflink not supported, copying data extents")
+
+	if err := destFile.Truncate(info.Size()); err != nil {
+		return fmt.Errorf("failed to size destination file: %w", err)
+	}
+	if err := copyDataExtents(srcFile, destFile, info.Size()); err != nil {
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync destination file: %w", err)
+	}
+	return nil
+}
+
+// copyDataExtents copies the regions of `src` holding data to the same offsets in `dest`, which is
+// expected to be `size` bytes of holes already. Everything is copied if the file system can't
+// report holes.
+func copyDataExtents(src *os.File, dest *os.File, size int64) error {
+	fd := int(src.Fd())
+	var offset int64
+	for offset < size {
+		dataStart, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No data past `offset`.
+			return nil
+		}
+		if errors.Is(err, unix.EINVAL) && offset == 0 {
+			return copyRange(src, dest, 0, size)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find data in source file: %w", err)
+		}
+
+		dataEnd, err := unix.Seek(fd, dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return fmt.Errorf("failed to find hole in source file: %w", err)
+		}
+		if err := copyRange(src, dest, dataStart, dataEnd-dataStart); err != nil {
+			return err
+		}
+		offset = dataEnd
+	}
+	return nil
+}
+
+func copyRange(src *os.File, dest *os.File, offset int64, length int64) error {
+	_, err := io.Copy(io.NewOffsetWriter(dest, offset), io.NewSectionReader(src, offset, length))
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+const megabyte = 1024 * 1024
+
+// writeSparseFile creates a file of `size` bytes at `path` holding `data` at the given offsets and
+// holes elsewhere.
+func writeSparseFile(t *testing.T, path string, size int64, data map[int64][]byte) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		t.Fatalf("failed to size %s: %v", path, err)
+	}
+	for offset, b := range data {
+		if _, err := file.WriteAt(b, offset); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+}
+
+func allocatedBytes(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %v", path, err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestCopyDataExtents(t *testing.T) {
+	const size = 64 * megabyte
+	data := map[int64][]byte{
+		0:                 bytes.Repeat([]byte{1}, 4096),
+		8 * megabyte:      bytes.Repeat([]byte{2}, 3*4096),
+		size - 4096:       bytes.Repeat([]byte{3}, 4096),
+		32*megabyte + 100: []byte("not block aligned"),
+	}
+
+	tests := []struct {
+		name string
+		data map[int64][]byte
+	}{
+		{name: "extents", data: data},
+		{name: "empty", data: nil},
+		{name: "hole at the end", data: map[int64][]byte{megabyte: {4}}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		srcPath := filepath.Join(dir, "src.img")
+		destPath := filepath.Join(dir, "dest.img")
+		writeSparseFile(t, srcPath, size, test.data)
+
+		src, err := os.Open(srcPath)
+		if err != nil {
+			t.Fatalf("%s: failed to open source: %v", test.name, err)
+		}
+		dest, err := os.Create(destPath)
+		if err != nil {
+			t.Fatalf("%s: failed to create destination: %v", test.name, err)
+		}
+		if err := dest.Truncate(size); err != nil {
+			t.Fatalf("%s: failed to size destination: %v", test.name, err)
+		}
+		err = copyDataExtents(src, dest, size)
+		src.Close()
+		dest.Close()
+		if err != nil {
+			t.Fatalf("%s: copyDataExtents() failed: %v", test.name, err)
+		}
+
+		want, err := os.ReadFile(srcPath)
+		if err != nil {
+			t.Fatalf("%s: failed to read source: %v", test.name, err)
+		}
+		got, err := os.ReadFile(destPath)
+		if err != nil {
+			t.Fatalf("%s: failed to read destination: %v", test.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: destination differs from source", test.name)
+		}
+		// Holes stay holes, unless the file system doesn't support them.
+		if srcAllocated := allocatedBytes(t, srcPath); srcAllocated < size {
+			if destAllocated := allocatedBytes(t, destPath); destAllocated > srcAllocated {
+				t.Errorf("%s: destination allocates %d bytes, source only %d", test.name, destAllocated, srcAllocated)
+			}
+		}
+	}
+}
+
+func TestCloneDiskFile(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.img")
+	destPath := filepath.Join(dir, "dest.img")
+	writeSparseFile(t, srcPath, 16*megabyte, map[int64][]byte{4 * megabyte: []byte("data")})
+	// The destination is replaced.
+	if err := os.WriteFile(destPath, bytes.Repeat([]byte{5}, 32*megabyte), 0644); err != nil {
+		t.Fatalf("failed to write destination: %v", err)
+	}
+
+	if err := cloneDiskFile(srcPath, destPath); err != nil {
+		t.Fatalf("cloneDiskFile() failed: %v", err)
+	}
+	want, err := os.ReadFile(srcPath)
+	if err != nil {
+		t.Fatalf("failed to read source: %v", err)
+	}
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("failed to read destination: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("clone differs from source")
+	}
+
+	if err := cloneDiskFile(filepath.Join(dir, "missing.img"), destPath); err == nil {
+		t.Errorf("cloneDiskFile() of a missing source succeeded")
+	}
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abshkbh/arrakis/out/gen/chvapi"
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Directory in the VM's state directory holding the fresh disks hot-plugged into it.
+	disksDirName = "disks"
+	// Prefix of the VMM device IDs of hot-plugged disks.
+	diskDeviceIdPrefix = "data-"
+	// Mounting waits for the disk to show up in the guest first.
+	diskMountTimeout = 30 * time.Second
+)
+
+// vmDisk is a disk hot-plugged into a running VM.
+type vmDisk struct {
+	id   string
+	path string
+	// Image the disk was attached from, relative to the disk images directory.
+	image string
+	// Volume attached as the disk.
+	volume   string
+	sizeMB   int32
+	readonly bool
+}
+
+// isFresh returns true for disks created when they were attached, which are deleted when detached.
+func (d *vmDisk) isFresh() bool {
+	return d.image == "" && d.volume == ""
+}
+
+func (d *vmDisk) toAPI() serverapi.VMDisk {
+	disk := serverapi.VMDisk{
+		Id:         serverapi.PtrString(d.id),
+		SizeMB:     serverapi.PtrInt32(d.sizeMB),
+		Readonly:   serverapi.PtrBool(d.readonly),
+		MountPoint: serverapi.PtrString(cmdserver.DiskMountPoint(d.id)),
+	}
+	if d.image != "" {
+		disk.SetImage(d.image)
+	}
+	if d.volume != "" {
+		disk.SetVolume(d.volume)
+	}
+	return disk
+}
+
+// disksToAPI returns the disks hot-plugged into the VM as reported by the API.
+func (v *vm) disksToAPI() []serverapi.VMDisk {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	disks := make([]serverapi.VMDisk, 0, len(v.disks))
+	for _, disk := range v.disks {
+		disks = append(disks, disk.toAPI())
+	}
+	return disks
+}
+
+// findDiskLocked returns the index of the disk `id` in `v.disks` or -1. Expects `v.lock` to be held.
+func (v *vm) findDiskLocked(id string) int {
+	for i, disk := range v.disks {
+		if disk.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// resolveDiskImage returns the path of `image` in the disk images directory.
+func (s *Server) resolveDiskImage(image string) (string, error) {
+	if s.config.DiskImagesDir == "" {
+		return "", status.Error(codes.FailedPrecondition, "no disk images directory configured")
+	}
+	cleaned := filepath.Clean(image)
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid disk image: %q", image)
+	}
+
+	imagePath := filepath.Join(s.config.DiskImagesDir, cleaned)
+	info, err := os.Stat(imagePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", status.Errorf(codes.NotFound, "disk image not found: %s", image)
+	}
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to stat disk image: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", status.Errorf(codes.InvalidArgument, "disk image isn't a file: %s", image)
+	}
+	return imagePath, nil
+}
+
+// addDiskLocked hot-plugs `disk` into the VMM. Expects `v.lock` to be held.
+func (v *vm) addDiskLocked(ctx context.Context, disk *vmDisk) error {
+	diskConfig := chvapi.NewDiskConfig(disk.path)
+	diskConfig.SetReadonly(disk.readonly)
+	diskConfig.SetId(diskDeviceIdPrefix + disk.id)
+	// The guest finds the disk by its serial.
+	diskConfig.SetSerial(disk.id)
+
+	_, resp, err := v.apiClient.DefaultAPI.VmAddDiskPut(ctx).DiskConfig(*diskConfig).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to add disk: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to add disk. bad status: %v", resp)
+	}
+	return nil
+}
+
+// removeDiskLocked unplugs the disk `id` from the VMM. Expects `v.lock` to be held.
+func (v *vm) removeDiskLocked(ctx context.Context, id string) error {
+	removeDevice := chvapi.NewVmRemoveDevice()
+	removeDevice.SetId(diskDeviceIdPrefix + id)
+
+	resp, err := v.apiClient.DefaultAPI.VmRemoveDevicePut(ctx).VmRemoveDevice(*removeDevice).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to remove disk: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to remove disk. bad status: %v", resp)
+	}
+	return nil
+}
+
+// mountDisk mounts the hot-plugged `disk` at its mount point inside the guest.
+func (v *vm) mountDisk(ctx context.Context, disk *vmDisk) error {
+	body, err := json.Marshal(cmdserver.DiskMountRequest{
+		Id:       disk.id,
+		Readonly: disk.readonly,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := fmt.Sprintf("http://%s:4031/disks", v.ip.IP.String())
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: diskMountTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to mount disk in the guest: %s", readErrorBody(resp))
+	}
+	return nil
+}
+
+// unmountDisk unmounts the hot-plugged disk `id` inside the guest.
+func (v *vm) unmountDisk(ctx context.Context, id string) error {
+	url := fmt.Sprintf("http://%s:4031/disks/%s", v.ip.IP.String(), id)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	client := &http.Client{Timeout: diskMountTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return status.Errorf(codes.FailedPrecondition, "disk is still in use in the guest: %s", readErrorBody(resp))
+	default:
+		return fmt.Errorf("failed to unmount disk in the guest: %s", readErrorBody(resp))
+	}
+}
+
+// readErrorBody returns the plain text error sent by the guest's cmdserver.
+func readErrorBody(resp *http.Response) string {
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	if msg := strings.TrimSpace(buf.String()); msg != "" {
+		return msg
+	}
+	return resp.Status
+}
+
+// AttachDisk hot-plugs a disk into a running VM and mounts it in the guest. The disk is either a
+// fresh, empty one of `sizeMB`, an existing image from the disk images directory or a volume.
+func (s *Server) AttachDisk(ctx context.Context, vmName string, req *serverapi.AttachDiskRequest) (*serverapi.VMDisk, error) {
+	logger := log.WithFields(log.Fields{"vmName": vmName, "diskId": req.GetId()})
+	logger.Info("received request to attach disk")
+
+	if !cmdserver.IsValidDiskId(req.GetId()) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"invalid disk id %q: up to 20 lowercase alphanumerics and '-'",
+			req.GetId(),
+		)
+	}
+	sources := 0
+	for _, isSet := range []bool{req.GetSizeMB() > 0, req.GetImage() != "", req.GetVolume() != ""} {
+		if isSet {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, status.Error(codes.InvalidArgument, "exactly one of sizeMB, image and volume is required")
+	}
+	if req.GetSizeMB() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "sizeMB must not be negative")
+	}
+	if req.GetSizeMB() > 0 && req.GetReadonly() {
+		return nil, status.Error(codes.InvalidArgument, "a fresh disk can't be read-only")
+	}
+
+	// Snapshots don't capture the contents of hot-plugged disks.
+	if s.preserveVMs {
+		return nil, status.Error(codes.FailedPrecondition, "disks can't be attached while VMs are preserved on shutdown")
+	}
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	disk := &vmDisk{
+		id:       req.GetId(),
+		image:    req.GetImage(),
+		volume:   req.GetVolume(),
+		sizeMB:   req.GetSizeMB(),
+		readonly: req.GetReadonly(),
+	}
+
+	cleanup := cleanup.Make(func() {
+		logger.Info("clean up done")
+	})
+	defer func() {
+		cleanup.Clean()
+	}()
+
+	switch {
+	case disk.image != "":
+		imagePath, err := s.resolveDiskImage(disk.image)
+		if err != nil {
+			return nil, err
+		}
+		disk.path = imagePath
+	case disk.volume != "":
+		volumePath, err := s.volumes.attach(disk.volume, vmName, volumeAttachModeDisk, disk.readonly)
+		if err != nil {
+			return nil, err
+		}
+		cleanup.Add(func() {
+			s.volumes.detach(disk.volume, vmName)
+		})
+		disk.path = volumePath
+	}
+	if disk.path != "" {
+		info, err := os.Stat(disk.path)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to stat disk: %v", err)
+		}
+		disk.sizeMB = int32(info.Size() / (1024 * 1024))
+	}
+
+	// Formatting a fresh disk takes a while, so it's done without holding the VM's lock. The disk
+	// is created under a temporary name and only renamed once the id is known to be free.
+	if disk.isFresh() {
+		disksDir := path.Join(vm.stateDirPath, disksDirName)
+		if err := os.MkdirAll(disksDir, 0755); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create disks directory: %v", err)
+		}
+		f, err := os.CreateTemp(disksDir, disk.id+"-*.img.tmp")
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create disk: %v", err)
+		}
+		f.Close()
+		disk.path = f.Name()
+		cleanup.Add(func() {
+			if err := os.Remove(disk.path); err != nil {
+				logger.WithError(err).Errorf("failed to remove disk: %s", disk.path)
+			}
+		})
+		if err := createStatefulDisk(disk.path, disk.sizeMB); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create disk: %v", err)
+		}
+	}
+
+	vm.lock.Lock()
+	if vm.status != vmStatusRunning {
+		vm.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm isn't running: %s", vmName)
+	}
+	if vm.snapshotSchedule != nil {
+		vm.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "disks can't be attached to vm %s with a snapshot schedule", vmName)
+	}
+	if vm.findDiskLocked(disk.id) >= 0 {
+		vm.lock.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "vm already has a disk with id: %s", disk.id)
+	}
+
+	if disk.isFresh() {
+		diskPath := path.Join(vm.stateDirPath, disksDirName, disk.id+".img")
+		if err := os.Rename(disk.path, diskPath); err != nil {
+			vm.lock.Unlock()
+			return nil, status.Errorf(codes.Internal, "failed to rename disk: %v", err)
+		}
+		disk.path = diskPath
+	}
+
+	if err := vm.addDiskLocked(ctx, disk); err != nil {
+		vm.lock.Unlock()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	vm.disks = append(vm.disks, disk)
+	cleanup.Add(func() {
+		vm.lock.Lock()
+		defer vm.lock.Unlock()
+		if i := vm.findDiskLocked(disk.id); i >= 0 {
+			vm.disks = append(vm.disks[:i], vm.disks[i+1:]...)
+		}
+		if err := vm.removeDiskLocked(context.WithoutCancel(ctx), disk.id); err != nil {
+			logger.WithError(err).Error("failed to remove disk from VM")
+		}
+	})
+	vm.lock.Unlock()
+
+	if err := vm.mountDisk(ctx, disk); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	cleanup.Release()
+	logger.Infof("attached disk at %s", cmdserver.DiskMountPoint(disk.id))
+	s.persistVMRegistry()
+	apiDisk := disk.toAPI()
+	return &apiDisk, nil
+}
+
+// DetachDisk unmounts a hot-plugged disk in the guest and unplugs it from the VM. Fresh disks are
+// deleted, images and volumes are left as they are.
+func (s *Server) DetachDisk(ctx context.Context, vmName string, id string) error {
+	logger := log.WithFields(log.Fields{"vmName": vmName, "diskId": id})
+	logger.Info("received request to detach disk")
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	running := vm.status == vmStatusRunning
+	found := vm.findDiskLocked(id) >= 0
+	vm.lock.RUnlock()
+	if !found {
+		return status.Errorf(codes.NotFound, "disk not found: %s", id)
+	}
+	if !running {
+		return status.Errorf(codes.FailedPrecondition, "vm isn't running: %s", vmName)
+	}
+
+	if err := vm.unmountDisk(ctx, id); err != nil {
+		return err
+	}
+
+	vm.lock.Lock()
+	i := vm.findDiskLocked(id)
+	if i < 0 {
+		vm.lock.Unlock()
+		return status.Errorf(codes.NotFound, "disk not found: %s", id)
+	}
+	disk := vm.disks[i]
+	if err := vm.removeDiskLocked(ctx, id); err != nil {
+		vm.lock.Unlock()
+		return status.Error(codes.Internal, err.Error())
+	}
+	vm.disks = append(vm.disks[:i], vm.disks[i+1:]...)
+	vm.lock.Unlock()
+
+	if disk.volume != "" {
+		s.volumes.detach(disk.volume, vmName)
+	}
+	if disk.isFresh() {
+		if err := os.Remove(disk.path); err != nil {
+			logger.WithError(err).Warnf("failed to remove disk: %s", disk.path)
+		}
+	}
+	logger.Info("detached disk")
+	s.persistVMRegistry()
+	return nil
+}
+
+// ListDisks returns the disks hot-plugged into a VM.
+func (s *Server) ListDisks(ctx context.Context, vmName string) (*serverapi.ListDisksResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	return &serverapi.ListDisksResponse{
+		Disks: vm.disksToAPI(),
+	}, nil
+}
+
+// checkNoDisks returns an error if disks are hot-plugged into the VM or its stateful disk is a
+// volume. Snapshots only capture the paths of such disks, not their contents.
+func (v *vm) checkNoDisks() error {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.checkNoDisksLocked()
+}
+
+// checkNoDisksLocked is `checkNoDisks` with the VM's lock held.
+func (v *vm) checkNoDisksLocked() error {
+	if len(v.disks) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "detach the hot-plugged disks of vm %s first", v.name)
+	}
+	if v.rootVolume != "" {
+		return status.Errorf(codes.FailedPrecondition, "vm %s with root volume %s can't be snapshotted", v.name, v.rootVolume)
+	}
+	return nil
+}
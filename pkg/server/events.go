@@ -0,0 +1,138 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+)
+
+// Types of VM lifecycle events.
+const (
+	EventTypeCreated         = "created"
+	EventTypeBooted          = "booted"
+	EventTypeStopped         = "stopped"
+	EventTypePaused          = "paused"
+	EventTypeResumed         = "resumed"
+	EventTypeSnapshotted     = "snapshotted"
+	EventTypeRestored        = "restored"
+	EventTypeCloned          = "cloned"
+	EventTypeDestroyed       = "destroyed"
+	EventTypeCrashed         = "crashed"
+	EventTypeResized         = "resized"
+	EventTypeCommandFinished = "command-finished"
+)
+
+const (
+	// Number of events buffered per subscriber. Events are dropped for subscribers that fall further
+	// behind.
+	eventSubscriberBufferSize = 256
+)
+
+// EventFilter selects the events delivered to a subscriber. Empty fields match everything.
+type EventFilter struct {
+	VMNames  []string
+	Types    []string
+	Selector LabelSelector
+}
+
+func (f EventFilter) matches(event serverapi.VMEvent) bool {
+	if len(f.VMNames) > 0 && !slices.Contains(f.VMNames, event.GetVmName()) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, event.GetType()) {
+		return false
+	}
+	if !f.Selector.Matches(event.GetLabels()) {
+		return false
+	}
+	return true
+}
+
+type eventSubscriber struct {
+	filter EventFilter
+	events chan serverapi.VMEvent
+}
+
+// eventBroker fans out VM lifecycle events to subscribers.
+type eventBroker struct {
+	lock        sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+func (b *eventBroker) publish(event serverapi.VMEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for subscriber := range b.subscribers {
+		if !subscriber.filter.matches(event) {
+			continue
+		}
+
+		select {
+		case subscriber.events <- event:
+		default:
+			log.WithFields(log.Fields{
+				"vmName": event.GetVmName(),
+				"type":   event.GetType(),
+			}).Warn("dropping event for slow subscriber")
+		}
+	}
+}
+
+// publishEvent publishes an event of `eventType` for `vm`. Events of VMs in warm pools aren't
+// published as these VMs aren't handed out yet.
+func (s *Server) publishEvent(eventType string, vm *vm, details map[string]string) {
+	vm.lock.RLock()
+	vmName := vm.name
+	labels := labelsToAPI(vm.labels)
+	vm.lock.RUnlock()
+
+	if isWarmPoolVMName(vmName) {
+		return
+	}
+
+	event := serverapi.VMEvent{
+		Type:      serverapi.PtrString(eventType),
+		VmName:    serverapi.PtrString(vmName),
+		Timestamp: serverapi.PtrTime(time.Now()),
+		Labels:    labels,
+	}
+	if len(details) > 0 {
+		event.SetDetails(details)
+	}
+	s.events.publish(event)
+}
+
+// SubscribeEvents returns a channel of the VM lifecycle events matching `filter` and a function to
+// unsubscribe, after which the channel is closed.
+func (s *Server) SubscribeEvents(filter EventFilter) (<-chan serverapi.VMEvent, func()) {
+	subscriber := &eventSubscriber{
+		filter: filter,
+		events: make(chan serverapi.VMEvent, eventSubscriberBufferSize),
+	}
+
+	s.events.lock.Lock()
+	s.events.subscribers[subscriber] = struct{}{}
+	s.events.lock.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			s.events.lock.Lock()
+			delete(s.events.subscribers, subscriber)
+			s.events.lock.Unlock()
+			close(subscriber.events)
+		})
+	}
+	return subscriber.events, unsubscribe
+}
@@ -79,6 +79,15 @@ func (f *Fountain) freeTapID(id int32) error {
 	return nil
 }
 
+// TapIDUsage returns the number of allocated tap IDs and the number of IDs in the range.
+func (f *Fountain) TapIDUsage() (int, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	size := int(f.highID - f.lowID + 1)
+	return size - len(f.available), size
+}
+
 // claimID attempts to claim a specific tap ID from the pool
 // It returns an error if the ID is not available or outside the valid range
 func (f *Fountain) claimID(id int32) error {
@@ -193,3 +202,22 @@ func (f *Fountain) DestroyTapDevice(device *TapDevice) error {
 
 	return nil
 }
+
+// AdoptTapDevice claims the ID of an already existing tap device, e.g. one left behind by a previous
+// server instance, and returns a TapDevice for it without re-creating the device.
+func (f *Fountain) AdoptTapDevice(id int32) (*TapDevice, error) {
+	deviceName := fmt.Sprintf("tap%d", id)
+	if output, err := exec.Command("ip", "link", "show", deviceName).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("tap device %v not found: %s %w", deviceName, output, err)
+	}
+
+	if err := f.claimID(id); err != nil {
+		return nil, err
+	}
+
+	log.WithField("deviceName", deviceName).Info("adopted tap device")
+	return &TapDevice{
+		Name: deviceName,
+		ID:   id,
+	}, nil
+}
@@ -9,7 +9,9 @@ import (
 type IPAllocator struct {
 	subnet    *net.IPNet
 	available []net.IP
-	mutex     sync.Mutex
+	// Number of IPs in the pool of the allocator, allocated or not.
+	size  int
+	mutex sync.Mutex
 }
 
 func incrementIP(ip net.IP) net.IP {
@@ -47,6 +49,7 @@ func NewIPAllocator(subnetCIDR string) (*IPAllocator, error) {
 	for ip := incrementIP(ip); subnet.Contains(ip); ip = incrementIP(ip) {
 		allocator.available = append(allocator.available, copyIP(ip))
 	}
+	allocator.size = len(allocator.available)
 
 	return allocator, nil
 }
@@ -80,6 +83,14 @@ func (a *IPAllocator) FreeIP(ip net.IP) error {
 	return nil
 }
 
+// Usage returns the number of allocated IPs and the number of IPs handed out by the allocator.
+func (a *IPAllocator) Usage() (int, int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return max(a.size-len(a.available), 0), a.size
+}
+
 // ClaimIP attempts to claim a specific IP address from the pool.
 // Returns error if the IP is already allocated or not in the subnet.
 func (a *IPAllocator) ClaimIP(ip net.IP) error {
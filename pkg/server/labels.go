@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Name of the file in a snapshot directory holding the labels of the snapshotted VM.
+	labelsFilename = "labels.json"
+	maxLabelLength = 63
+)
+
+// Label keys and values consist of alphanumerics, '-', '_', '.' and '/', starting and ending with
+// an alphanumeric. Values may also be empty.
+var labelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+
+func validateLabelKey(key string) error {
+	if len(key) > maxLabelLength || !labelRegexp.MatchString(key) {
+		return fmt.Errorf("invalid label key: %q", key)
+	}
+	return nil
+}
+
+func validateLabelValue(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > maxLabelLength || !labelRegexp.MatchString(value) {
+		return fmt.Errorf("invalid label value: %q", value)
+	}
+	return nil
+}
+
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+		if err := validateLabelValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type labelOperator int
+
+const (
+	labelOperatorEquals labelOperator = iota
+	labelOperatorNotEquals
+	labelOperatorExists
+	labelOperatorNotExists
+)
+
+type labelRequirement struct {
+	key      string
+	operator labelOperator
+	value    string
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case labelOperatorEquals:
+		return ok && value == r.value
+	case labelOperatorNotEquals:
+		return !ok || value != r.value
+	case labelOperatorExists:
+		return ok
+	case labelOperatorNotExists:
+		return !ok
+	default:
+		return false
+	}
+}
+
+// LabelSelector selects VMs by their labels. All requirements must match, an empty selector
+// matches every VM.
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a comma separated list of requirements, each one of `key=value`,
+// `key==value`, `key!=value`, `key` (the label is set) or `!key` (the label isn't set).
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var requirements LabelSelector
+	if strings.TrimSpace(selector) == "" {
+		return requirements, nil
+	}
+
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		var requirement labelRequirement
+		if key, found := strings.CutPrefix(term, "!"); found {
+			requirement = labelRequirement{key: key, operator: labelOperatorNotExists}
+		} else if key, value, found := strings.Cut(term, "!="); found {
+			requirement = labelRequirement{key: key, operator: labelOperatorNotEquals, value: value}
+		} else if key, value, found := strings.Cut(term, "=="); found {
+			requirement = labelRequirement{key: key, operator: labelOperatorEquals, value: value}
+		} else if key, value, found := strings.Cut(term, "="); found {
+			requirement = labelRequirement{key: key, operator: labelOperatorEquals, value: value}
+		} else {
+			requirement = labelRequirement{key: term, operator: labelOperatorExists}
+		}
+
+		requirement.key = strings.TrimSpace(requirement.key)
+		requirement.value = strings.TrimSpace(requirement.value)
+		if err := validateLabelKey(requirement.key); err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %w", selector, err)
+		}
+		if err := validateLabelValue(requirement.value); err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %w", selector, err)
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// Matches returns whether `labels` satisfy all requirements of the selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// nameAndLabels returns the name and labels of the VM, both of which change when it's handed out
+// from a warm pool. The labels are replaced rather than modified, so they can be read unlocked.
+func (v *vm) nameAndLabels() (string, map[string]string) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.name, v.labels
+}
+
+// writeSnapshotLabels stores `labels` in the snapshot directory `snapshotPath`.
+func writeSnapshotLabels(snapshotPath string, labels map[string]string) error {
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return fmt.Errorf("failed to marshal labels: %w", err)
+	}
+	return os.WriteFile(path.Join(snapshotPath, labelsFilename), data, 0644)
+}
+
+// readSnapshotLabels returns the labels stored in the snapshot directory `snapshotPath`. Snapshots
+// taken before labels existed have none.
+func readSnapshotLabels(snapshotPath string) (map[string]string, error) {
+	data, err := os.ReadFile(path.Join(snapshotPath, labelsFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read labels: %w", err)
+	}
+
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("failed to parse labels: %w", err)
+	}
+	return labels, nil
+}
+
+// mergeLabels returns `base` overridden by `overrides`.
+func mergeLabels(base map[string]string, overrides map[string]string) map[string]string {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[string]string, len(overrides))
+	}
+	maps.Copy(merged, overrides)
+	return merged
+}
+
+// labelsToAPI returns `labels` as reported by the API or nil if there are none.
+func labelsToAPI(labels map[string]string) *map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	labels = maps.Clone(labels)
+	return &labels
+}
+
+func (r labelRequirement) String() string {
+	switch r.operator {
+	case labelOperatorEquals:
+		return r.key + "=" + r.value
+	case labelOperatorNotEquals:
+		return r.key + "!=" + r.value
+	case labelOperatorNotExists:
+		return "!" + r.key
+	default:
+		return r.key
+	}
+}
+
+func (s LabelSelector) String() string {
+	requirements := make([]string, 0, len(s))
+	for _, requirement := range s {
+		requirements = append(requirements, requirement.String())
+	}
+	return strings.Join(requirements, ",")
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		{selector: "", want: ""},
+		{selector: "  ", want: ""},
+		{selector: "env=prod", want: "env=prod"},
+		{selector: "env==prod", want: "env=prod"},
+		{selector: "env!=prod", want: "env!=prod"},
+		{selector: "env", want: "env"},
+		{selector: "!env", want: "!env"},
+		{selector: "env=", want: "env="},
+		{selector: " env = prod , team ,!debug ", want: "env=prod,team,!debug"},
+		{selector: "example.com/owner=a_b", want: "example.com/owner=a_b"},
+		{selector: "=prod", wantErr: true},
+		{selector: "env=prod,", wantErr: true},
+		{selector: "-env", wantErr: true},
+		{selector: "env=prod-", wantErr: true},
+		{selector: "env=a b", wantErr: true},
+		{selector: "!", wantErr: true},
+	}
+	for _, test := range tests {
+		selector, err := ParseLabelSelector(test.selector)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseLabelSelector(%q) = %q, want error", test.selector, selector)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLabelSelector(%q) failed: %v", test.selector, err)
+			continue
+		}
+		if got := selector.String(); got != test.want {
+			t.Errorf("ParseLabelSelector(%q) = %q, want %q", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "infra", "empty": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{selector: "", want: true},
+		{selector: "env=prod", want: true},
+		{selector: "env=dev", want: false},
+		{selector: "env!=dev", want: true},
+		{selector: "env!=prod", want: false},
+		{selector: "owner!=me", want: true},
+		{selector: "team", want: true},
+		{selector: "owner", want: false},
+		{selector: "!owner", want: true},
+		{selector: "!team", want: false},
+		{selector: "empty=", want: true},
+		{selector: "owner=", want: false},
+		{selector: "env=prod,team=infra", want: true},
+		{selector: "env=prod,team=web", want: false},
+	}
+	for _, test := range tests {
+		selector, err := ParseLabelSelector(test.selector)
+		if err != nil {
+			t.Fatalf("ParseLabelSelector(%q) failed: %v", test.selector, err)
+		}
+		if got := selector.Matches(labels); got != test.want {
+			t.Errorf("%q.Matches(%v) = %v, want %v", test.selector, labels, got, test.want)
+		}
+	}
+	selector, err := ParseLabelSelector("!env")
+	if err != nil {
+		t.Fatalf("ParseLabelSelector failed: %v", err)
+	}
+	if !selector.Matches(nil) {
+		t.Errorf("%q doesn't match nil labels", selector)
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	base := map[string]string{"env": "prod", "team": "infra"}
+	merged := mergeLabels(base, map[string]string{"env": "dev", "owner": "me"})
+	want := map[string]string{"env": "dev", "team": "infra", "owner": "me"}
+	if len(merged) != len(want) {
+		t.Fatalf("mergeLabels() = %v, want %v", merged, want)
+	}
+	for key, value := range want {
+		if merged[key] != value {
+			t.Errorf("mergeLabels()[%q] = %q, want %q", key, merged[key], value)
+		}
+	}
+	if base["env"] != "prod" {
+		t.Errorf("mergeLabels() modified its base: %v", base)
+	}
+	if merged := mergeLabels(nil, nil); merged != nil {
+		t.Errorf("mergeLabels(nil, nil) = %v, want nil", merged)
+	}
+}
+
+func TestListAllVMsWhileClaimingWarmPoolVM(t *testing.T) {
+	s, key := newTestWarmPoolServer(t)
+	selector, err := ParseLabelSelector("team=infra")
+	if err != nil {
+		t.Fatalf("ParseLabelSelector failed: %v", err)
+	}
+
+	// Run with -race, handing out the VM renames and labels it.
+	claimed := make(chan *vm)
+	go func() {
+		claimed <- s.claimWarmPoolVM("vm1", defaultTenant, map[string]string{"team": "infra"}, key)
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := s.ListAllVMs(context.Background(), selector); err != nil {
+			t.Fatalf("ListAllVMs() failed: %v", err)
+		}
+	}
+	if <-claimed == nil {
+		t.Fatalf("claimWarmPoolVM() didn't hand out the VM")
+	}
+
+	resp, err := s.ListAllVMs(context.Background(), selector)
+	if err != nil {
+		t.Fatalf("ListAllVMs() failed: %v", err)
+	}
+	if len(resp.Vms) != 1 || resp.Vms[0].GetVmName() != "vm1" {
+		t.Errorf("ListAllVMs(%q) = %+v, want vm1", selector, resp.Vms)
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// How often VMs are checked for an expired time-to-live or idle timeout.
+	reaperInterval = 15 * time.Second
+	// Comment of the firewall rules counting the traffic forwarded to a VM, followed by its IP.
+	portForwardActivityCommentPrefix = "arrakis-activity:"
+)
+
+// vmLifetime tracks when a VM is to be destroyed automatically. A zero `ttl` or `idleTimeout`
+// disables the corresponding limit.
+type vmLifetime struct {
+	lock         sync.Mutex
+	ttl          time.Duration
+	idleTimeout  time.Duration
+	deadline     time.Time
+	lastActivity time.Time
+	// Number of bytes forwarded to the VM through its port forwards when last checked. A change
+	// means that there was traffic to a forwarded port.
+	portForwardBytes uint64
+}
+
+// set (re)starts the lifetime of the VM from now.
+func (l *vmLifetime) set(ttl time.Duration, idleTimeout time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.ttl = ttl
+	l.idleTimeout = idleTimeout
+	l.deadline = time.Time{}
+	if ttl > 0 {
+		l.deadline = now.Add(ttl)
+	}
+	l.lastActivity = now
+}
+
+// restore sets the lifetime of a VM adopted from the registry. The idle timer restarts from now as
+// activity while the server was down can't be known.
+func (l *vmLifetime) restore(ttl time.Duration, idleTimeout time.Duration, deadline time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.ttl = ttl
+	l.idleTimeout = idleTimeout
+	l.deadline = deadline
+	l.lastActivity = time.Now()
+}
+
+// markActive resets the idle timer of the VM.
+func (l *vmLifetime) markActive() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lastActivity = time.Now()
+}
+
+// extend resets the idle timer and moves the deadline to `ttl` from now. If `ttl` is zero the
+// time-to-live the VM was started with is used.
+func (l *vmLifetime) extend(ttl time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.lastActivity = now
+	if ttl == 0 {
+		ttl = l.ttl
+	} else {
+		l.ttl = ttl
+	}
+	if ttl > 0 {
+		l.deadline = now.Add(ttl)
+	}
+}
+
+// lastActiveAt returns when the VM was last active.
+func (l *vmLifetime) lastActiveAt() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lastActivity
+}
+
+// updatePortForwardBytes records the number of bytes forwarded to the VM and marks it active if it
+// changed since the last call.
+func (l *vmLifetime) updatePortForwardBytes(bytes uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if bytes != l.portForwardBytes {
+		l.portForwardBytes = bytes
+		l.lastActivity = time.Now()
+	}
+}
+
+// expiresAtLocked returns the time at which the VM expires and false if it never does. Expects
+// `l.lock` to be held.
+func (l *vmLifetime) expiresAtLocked() (time.Time, bool) {
+	var expiresAt time.Time
+	if l.ttl > 0 {
+		expiresAt = l.deadline
+	}
+	if l.idleTimeout > 0 {
+		idleDeadline := l.lastActivity.Add(l.idleTimeout)
+		if expiresAt.IsZero() || idleDeadline.Before(expiresAt) {
+			expiresAt = idleDeadline
+		}
+	}
+	return expiresAt, !expiresAt.IsZero()
+}
+
+func (l *vmLifetime) expiresAt() (time.Time, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.expiresAtLocked()
+}
+
+// toAPI returns the lifetime as reported by the API or nil if the VM never expires.
+func (l *vmLifetime) toAPI() *serverapi.VMLifetime {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	expiresAt, ok := l.expiresAtLocked()
+	if !ok {
+		return nil
+	}
+
+	remaining := time.Until(expiresAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &serverapi.VMLifetime{
+		TtlSeconds:         serverapi.PtrInt32(int32(l.ttl.Seconds())),
+		IdleTimeoutSeconds: serverapi.PtrInt32(int32(l.idleTimeout.Seconds())),
+		ExpiresAt:          serverapi.PtrTime(expiresAt),
+		RemainingSeconds:   serverapi.PtrInt32(int32(remaining.Seconds())),
+	}
+}
+
+// parseVMLifetime returns the time-to-live and the idle timeout requested for a VM.
+func parseVMLifetime(req *serverapi.StartVMRequest) (time.Duration, time.Duration, error) {
+	ttlSeconds := req.GetTtlSeconds()
+	if ttlSeconds < 0 {
+		return 0, 0, status.Errorf(codes.InvalidArgument, "ttlSeconds must be non-negative: %d", ttlSeconds)
+	}
+
+	idleTimeoutSeconds := req.GetIdleTimeoutSeconds()
+	if idleTimeoutSeconds < 0 {
+		return 0, 0, status.Errorf(
+			codes.InvalidArgument,
+			"idleTimeoutSeconds must be non-negative: %d",
+			idleTimeoutSeconds,
+		)
+	}
+	return time.Duration(ttlSeconds) * time.Second, time.Duration(idleTimeoutSeconds) * time.Second, nil
+}
+
+// addPortForwardActivityRule adds a firewall rule counting the packets of the connections forwarded
+// to the VM with `vmIP` through its port forwards. Unlike the port forwarding rules in the nat
+// table, which only see the first packet of a connection, it sees every packet sent to the VM, so
+// that long-lived connections, e.g. SSH sessions, keep the VM active. The rule doesn't accept or
+// drop anything.
+func addPortForwardActivityRule(vmIP string) error {
+	cmd := exec.Command(
+		"iptables",
+		"-t",
+		"filter",
+		"-I",
+		"FORWARD",
+		"-d",
+		vmIP,
+		"-m",
+		"conntrack",
+		"--ctstate",
+		"DNAT",
+		"-m",
+		"comment",
+		"--comment",
+		portForwardActivityCommentPrefix+vmIP,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add port forward activity rule for %s: %s: %w", vmIP, output, err)
+	}
+	return nil
+}
+
+// matchesPortForwardActivityRule returns whether `rule` counts the traffic forwarded to the IP `ip`,
+// or to any IP starting with the octets `ip` if it's a prefix.
+func matchesPortForwardActivityRule(rule string, ip string) bool {
+	for _, field := range strings.Fields(rule) {
+		ruleIP, found := strings.CutPrefix(strings.Trim(field, `"`), portForwardActivityCommentPrefix)
+		if found && (ruleIP == ip || strings.HasPrefix(ruleIP, ip+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// deletePortForwardActivityRules deletes the rules added by `addPortForwardActivityRule` for `ip`,
+// which may be a prefix of IPs as accepted by `matchesPortForwardActivityRule`.
+func deletePortForwardActivityRules(ip string) error {
+	output, err := exec.Command("iptables", "-t", "filter", "-S", "FORWARD").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list iptables rules: %w", err)
+	}
+
+	var finalErr error
+	for _, rule := range strings.Split(string(output), "\n") {
+		args, found := strings.CutPrefix(rule, "-A ")
+		if !found || !matchesPortForwardActivityRule(rule, ip) {
+			continue
+		}
+		log.Infof("deleting rule: %s", rule)
+		deleteArgs := append([]string{"-t", "filter", "-D"}, strings.Fields(strings.ReplaceAll(args, `"`, ""))...)
+		if err := exec.Command("iptables", deleteArgs...).Run(); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to delete rule %q: %w", rule, err))
+		}
+	}
+	return finalErr
+}
+
+// getPortForwardByteCounts returns the number of bytes forwarded to VMs through their port
+// forwards, keyed by the IP of the VM.
+func getPortForwardByteCounts() (map[string]uint64, error) {
+	output, err := exec.Command("iptables", "-t", "filter", "-L", "FORWARD", "-n", "-v", "-x").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iptables rules: %w", err)
+	}
+	return parsePortForwardByteCounts(string(output)), nil
+}
+
+// parsePortForwardByteCounts parses the byte counts of the port forward activity rules out of the
+// verbose listing of their chain.
+func parsePortForwardByteCounts(listing string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		// The packet and byte counts come first, the target is left out for rules without one.
+		if len(fields) < 2 {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		for _, field := range fields[2:] {
+			if ip, found := strings.CutPrefix(field, portForwardActivityCommentPrefix); found {
+				counts[ip] += bytes
+			}
+		}
+	}
+	return counts
+}
+
+// runReaper periodically destroys VMs whose time-to-live or idle timeout has expired. It never
+// returns.
+func (s *Server) runReaper() {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.reapExpiredVMs(context.Background())
+	}
+}
+
+func (s *Server) reapExpiredVMs(ctx context.Context) {
+	portForwardBytes, err := getPortForwardByteCounts()
+	if err != nil {
+		log.WithError(err).Warn("failed to get port forward byte counts")
+	}
+
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	now := time.Now()
+	for _, vm := range vms {
+		// VMs handed out from a warm pool are renamed.
+		vm.lock.RLock()
+		vmName := vm.name
+		vmIP := vm.ip
+		vm.lock.RUnlock()
+
+		if portForwardBytes != nil && vmIP != nil {
+			vm.lifetime.updatePortForwardBytes(portForwardBytes[vmIP.IP.String()])
+		}
+
+		expiresAt, ok := vm.lifetime.expiresAt()
+		if !ok || now.Before(expiresAt) {
+			continue
+		}
+
+		logger := log.WithField("vmName", vmName)
+		logger.WithField("expiresAt", expiresAt).Info("VM expired, destroying it")
+		start := time.Now()
+		err := s.destroyVM(ctx, vmName)
+		if err != nil {
+			logger.WithError(err).Error("failed to destroy expired VM")
+		}
+		s.Audit(ctx, AuditActionExpire, vmName, start, nil, err)
+	}
+}
+
+// KeepAliveVM resets the idle timer of a VM and extends its time-to-live by `ttl` from now. If
+// `ttl` is zero the time-to-live the VM was started with is used.
+func (s *Server) KeepAliveVM(ctx context.Context, vmName string, ttl time.Duration) (*serverapi.VMLifetime, error) {
+	if ttl < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be non-negative: %v", ttl)
+	}
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lifetime.extend(ttl)
+	s.persistVMRegistry()
+
+	lifetime := vm.lifetime.toAPI()
+	if lifetime == nil {
+		lifetime = &serverapi.VMLifetime{}
+	}
+	return lifetime, nil
+}
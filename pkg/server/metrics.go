@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/metrics"
+)
+
+const (
+	// How long getting the counters of all VMs from their VMMs may take. They're asked in parallel,
+	// a hung VMM leaves its VM without counters rather than holding up the scrape.
+	vmCountersTimeout = 2 * time.Second
+	// Clock ticks per second of the CPU times in /proc, fixed at 100 on Linux.
+	procClockTicks = 100
+)
+
+// vmCounterMetrics are the per-device counters of cloud-hypervisor exported for each VM.
+var vmCounterMetrics = []struct {
+	counter string
+	name    string
+	help    string
+}{
+	{"read_bytes", "arrakis_vm_block_read_bytes_total", "Bytes read by the VM from a block device."},
+	{"write_bytes", "arrakis_vm_block_write_bytes_total", "Bytes written by the VM to a block device."},
+	{"read_ops", "arrakis_vm_block_read_ops_total", "Reads of the VM from a block device."},
+	{"write_ops", "arrakis_vm_block_write_ops_total", "Writes of the VM to a block device."},
+	{"rx_bytes", "arrakis_vm_net_receive_bytes_total", "Bytes received by the VM on a network device."},
+	{"tx_bytes", "arrakis_vm_net_transmit_bytes_total", "Bytes sent by the VM on a network device."},
+	{"rx_frames", "arrakis_vm_net_receive_frames_total", "Frames received by the VM on a network device."},
+	{"tx_frames", "arrakis_vm_net_transmit_frames_total", "Frames sent by the VM on a network device."},
+}
+
+// serverMetrics are the metrics the server records as it goes, all others are collected when the
+// metrics are written.
+type serverMetrics struct {
+	startVMDuration  *metrics.Histogram
+	snapshotDuration *metrics.Histogram
+	restoreDuration  *metrics.Histogram
+	commandDuration  *metrics.Histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		startVMDuration: metrics.NewHistogram(
+			"arrakis_start_vm_duration_seconds",
+			"Time taken to start VMs until they're ready, including VMs started from warm pools and snapshots.",
+			metrics.DurationBuckets,
+		),
+		snapshotDuration: metrics.NewHistogram(
+			"arrakis_snapshot_duration_seconds",
+			"Time taken to snapshot VMs, including scheduled checkpoints.",
+			metrics.DurationBuckets,
+		),
+		restoreDuration: metrics.NewHistogram(
+			"arrakis_restore_duration_seconds",
+			"Time taken to restore VMs from snapshots, including fetching the snapshots.",
+			metrics.DurationBuckets,
+		),
+		commandDuration: metrics.NewHistogram(
+			"arrakis_command_duration_seconds",
+			"Time taken by blocking commands run in VMs.",
+			metrics.DurationBuckets,
+		),
+	}
+}
+
+// vmStats are the statistics of a VM exported as metrics.
+type vmStats struct {
+	name string
+	// CPU time used by the VMM, nil if unknown.
+	cpuSeconds *float64
+	// Counters of the VM's devices by device ID, as reported by its VMM.
+	counters map[string]map[string]int64
+}
+
+// getCPUSeconds returns the CPU time used by the process `pid` in seconds.
+func getCPUSeconds(pid int) (float64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, the fields are counted from its end.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("failed to parse stat")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// utime and stime, the 14th and 15th fields.
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("failed to parse stat")
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse utime: %w", err)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse stime: %w", err)
+	}
+	return float64(utime+stime) / procClockTicks, nil
+}
+
+// stats returns the statistics of the VM. What only the VMM knows is left out if it can't be
+// asked before `ctx` is done, e.g. because the VM crashed.
+func (v *vm) stats(ctx context.Context) vmStats {
+	v.lock.RLock()
+	stats := vmStats{name: v.name}
+	process := v.process
+	alive := (v.status == vmStatusRunning || v.status == vmStatusPaused) && !v.destroying
+	v.lock.RUnlock()
+
+	if process != nil {
+		if cpuSeconds, err := getCPUSeconds(process.Pid); err == nil {
+			stats.cpuSeconds = &cpuSeconds
+		}
+	}
+	if !alive {
+		return stats
+	}
+
+	counters, resp, err := v.apiClient.DefaultAPI.VmCountersGet(ctx).Execute()
+	if err == nil && resp.StatusCode == http.StatusOK && counters != nil {
+		stats.counters = *counters
+	}
+	return stats
+}
+
+// WriteMetrics writes the metrics of the server and its VMs to `w` in the Prometheus text format.
+func (s *Server) WriteMetrics(ctx context.Context, w io.Writer) error {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	vmsByStatus := make(map[vmStatus]int)
+	for _, vm := range vms {
+		vm.lock.RLock()
+		vmsByStatus[vm.status]++
+		vm.lock.RUnlock()
+	}
+
+	countersCtx, cancel := context.WithTimeout(ctx, vmCountersTimeout)
+	defer cancel()
+	stats := make([]vmStats, len(vms))
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats[i] = vm.stats(countersCtx)
+		}()
+	}
+	wg.Wait()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].name < stats[j].name
+	})
+
+	mw := metrics.NewWriter(w)
+	mw.Describe("arrakis_vms", metrics.TypeGauge, "VMs on the host by status, including VMs in warm pools.")
+	for _, status := range []vmStatus{vmStatusCreated, vmStatusRunning, vmStatusStopped, vmStatusPaused, vmStatusCrashed} {
+		mw.Sample("arrakis_vms", map[string]string{"status": status.String()}, float64(vmsByStatus[status]))
+	}
+
+	allocators := []struct {
+		name  string
+		usage func() (int, int)
+	}{
+		{"ip", s.ipAllocator.Usage},
+		{"port", s.portAllocator.Usage},
+		{"cid", s.cidAllocator.Usage},
+		{"tap", s.fountain.TapIDUsage},
+	}
+	allocated := make([]int, len(allocators))
+	sizes := make([]int, len(allocators))
+	for i, allocator := range allocators {
+		allocated[i], sizes[i] = allocator.usage()
+	}
+	mw.Describe("arrakis_allocator_allocated", metrics.TypeGauge, "Allocated IPs, host ports, vsock CIDs and tap device IDs.")
+	for i, allocator := range allocators {
+		mw.Sample("arrakis_allocator_allocated", map[string]string{"allocator": allocator.name}, float64(allocated[i]))
+	}
+	mw.Describe("arrakis_allocator_size", metrics.TypeGauge, "IPs, host ports, vsock CIDs and tap device IDs that can be allocated in total.")
+	for i, allocator := range allocators {
+		mw.Sample("arrakis_allocator_size", map[string]string{"allocator": allocator.name}, float64(sizes[i]))
+	}
+
+	s.metrics.startVMDuration.Write(mw)
+	s.metrics.snapshotDuration.Write(mw)
+	s.metrics.restoreDuration.Write(mw)
+	s.metrics.commandDuration.Write(mw)
+
+	mw.Describe("arrakis_vm_cpu_seconds_total", metrics.TypeCounter, "CPU time used by the VMM of the VM.")
+	for _, vm := range stats {
+		if vm.cpuSeconds != nil {
+			mw.Sample("arrakis_vm_cpu_seconds_total", map[string]string{"vm": vm.name}, *vm.cpuSeconds)
+		}
+	}
+	for _, metric := range vmCounterMetrics {
+		mw.Describe(metric.name, metrics.TypeCounter, metric.help)
+		for _, vm := range stats {
+			devices := make([]string, 0, len(vm.counters))
+			for device := range vm.counters {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				if value, ok := vm.counters[device][metric.counter]; ok {
+					mw.Sample(metric.name, map[string]string{"vm": vm.name, "device": device}, float64(value))
+				}
+			}
+		}
+	}
+	return mw.Err()
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Types of asynchronous operations.
+const (
+	operationTypeStart    = "start"
+	operationTypeRestore  = "restore"
+	operationTypeSnapshot = "snapshot"
+)
+
+// States of asynchronous operations.
+const (
+	operationStateRunning   = "running"
+	operationStateSucceeded = "succeeded"
+	operationStateFailed    = "failed"
+	operationStateCancelled = "cancelled"
+)
+
+const (
+	// How long finished operations can still be queried.
+	operationRetention = time.Hour
+)
+
+// operation is a long-running request executed in the background.
+type operation struct {
+	lock       sync.Mutex
+	id         string
+	opType     string
+	vmName     string
+	state      string
+	progress   string
+	err        error
+	createdAt  time.Time
+	finishedAt time.Time
+	// Set once a start, respectively snapshot, operation succeeded.
+	startResult    *serverapi.StartVMResponse
+	snapshotResult *serverapi.VMSnapshotResponse
+	cancel         context.CancelFunc
+}
+
+func (op *operation) setProgress(progress string) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.progress = progress
+}
+
+func (op *operation) finish(state string, err error) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.state = state
+	op.err = err
+	op.progress = ""
+	op.finishedAt = time.Now()
+}
+
+func (op *operation) isFinished() bool {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.state != operationStateRunning
+}
+
+func (op *operation) toAPI() serverapi.Operation {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	apiOp := serverapi.Operation{
+		Id:             serverapi.PtrString(op.id),
+		Type:           serverapi.PtrString(op.opType),
+		VmName:         serverapi.PtrString(op.vmName),
+		State:          serverapi.PtrString(op.state),
+		CreatedAt:      serverapi.PtrTime(op.createdAt),
+		StartResult:    op.startResult,
+		SnapshotResult: op.snapshotResult,
+	}
+	if op.progress != "" {
+		apiOp.SetProgress(op.progress)
+	}
+	if op.err != nil {
+		apiOp.SetError(op.err.Error())
+	}
+	if !op.finishedAt.IsZero() {
+		apiOp.SetFinishedAt(op.finishedAt)
+	}
+	return apiOp
+}
+
+// operations tracks running operations and recently finished ones.
+type operations struct {
+	lock sync.Mutex
+	ops  map[string]*operation
+}
+
+func newOperations() *operations {
+	return &operations{
+		ops: make(map[string]*operation),
+	}
+}
+
+func newOperationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "op-" + hex.EncodeToString(b)
+}
+
+// add registers a new running operation on `vmName`. Only one operation may run per VM at a time.
+func (o *operations) add(opType string, vmName string, cancel context.CancelFunc) (*operation, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := time.Now()
+	for id, op := range o.ops {
+		op.lock.Lock()
+		expired := !op.finishedAt.IsZero() && now.Sub(op.finishedAt) > operationRetention
+		running := op.state == operationStateRunning
+		op.lock.Unlock()
+
+		if expired {
+			delete(o.ops, id)
+			continue
+		}
+		if running && op.vmName == vmName {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"operation %s is already in progress for vm: %s",
+				op.id,
+				vmName,
+			)
+		}
+	}
+
+	op := &operation{
+		id:        newOperationID(),
+		opType:    opType,
+		vmName:    vmName,
+		state:     operationStateRunning,
+		createdAt: now,
+		cancel:    cancel,
+	}
+	o.ops[op.id] = op
+	return op, nil
+}
+
+func (o *operations) get(id string) *operation {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.ops[id]
+}
+
+type operationContextKey struct{}
+
+// reportProgress records the current step of the operation running with `ctx`, if any.
+func reportProgress(ctx context.Context, progress string) {
+	if op, ok := ctx.Value(operationContextKey{}).(*operation); ok {
+		op.setProgress(progress)
+	}
+}
+
+// runOperation executes `run` in the background as an operation of `opType` on `vmName` requested
+// with `requestCtx`. `run` gets a context that is cancelled when the operation is cancelled, which
+// makes the request roll back via its usual error paths. The outcome is recorded in the audit log.
+func (s *Server) runOperation(
+	requestCtx context.Context,
+	opType string,
+	vmName string,
+	run func(ctx context.Context, op *operation) error,
+) (*serverapi.Operation, error) {
+	// The operation outlives the request but is still taken on behalf of its caller.
+	ctx, cancel := context.WithCancel(WithCaller(context.Background(), callerFromContext(requestCtx)))
+	op, err := s.operations.add(opType, vmName, cancel)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, operationContextKey{}, op)
+
+	logger := log.WithFields(log.Fields{
+		"operationId": op.id,
+		"type":        opType,
+		"vmName":      vmName,
+	})
+	logger.Info("operation started")
+
+	go func() {
+		defer cancel()
+
+		start := time.Now()
+		err := run(ctx, op)
+		s.Audit(ctx, auditActionOperationPrefix+opType, vmName, start, map[string]string{"operationId": op.id}, err)
+		switch {
+		case err == nil:
+			// A cancellation that came in too late to abort the operation is ignored.
+			logger.Info("operation succeeded")
+			op.finish(operationStateSucceeded, nil)
+		case ctx.Err() != nil:
+			logger.WithError(err).Info("operation cancelled")
+			op.finish(operationStateCancelled, err)
+		default:
+			logger.WithError(err).Error("operation failed")
+			op.finish(operationStateFailed, err)
+		}
+	}()
+
+	apiOp := op.toAPI()
+	return &apiOp, nil
+}
+
+// StartVMAsync starts or restores a VM like `StartVM` but returns an operation tracking it right
+// away. If the operation is cancelled a VM it created is destroyed again.
+func (s *Server) StartVMAsync(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.Operation, error) {
+	vmName := req.GetVmName()
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+
+	opType := operationTypeStart
+	if req.GetSnapshotId() != "" {
+		opType = operationTypeRestore
+	}
+
+	return s.runOperation(ctx, opType, vmName, func(ctx context.Context, op *operation) error {
+		existed := s.getVMAtomic(vmName) != nil
+		resp, err := s.StartVM(ctx, req)
+		if ctx.Err() != nil && !existed && s.getVMAtomic(vmName) != nil {
+			// Some steps, e.g. waiting for the guest to become ready, don't fail on cancellation.
+			// Don't leave a VM behind that the caller doesn't want anymore.
+			if err := s.destroyVM(context.Background(), vmName); err != nil {
+				log.WithField("vmName", vmName).WithError(err).Error("failed to destroy VM of cancelled operation")
+			}
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		op.lock.Lock()
+		op.startResult = resp
+		op.lock.Unlock()
+		return nil
+	})
+}
+
+// SnapshotVMAsync snapshots a VM like `SnapshotVM` but returns an operation tracking it right away.
+func (s *Server) SnapshotVMAsync(ctx context.Context, vmName string, snapshotId string) (*serverapi.Operation, error) {
+	if s.getVMAtomic(vmName) == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	return s.runOperation(ctx, operationTypeSnapshot, vmName, func(ctx context.Context, op *operation) error {
+		resp, err := s.SnapshotVM(ctx, vmName, snapshotId)
+		if err != nil {
+			return err
+		}
+
+		op.lock.Lock()
+		op.snapshotResult = resp
+		op.lock.Unlock()
+		return nil
+	})
+}
+
+// GetOperation returns the state of an operation.
+func (s *Server) GetOperation(ctx context.Context, id string) (*serverapi.Operation, error) {
+	op := s.operations.get(id)
+	if op == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("operation not found: %s", id))
+	}
+	apiOp := op.toAPI()
+	return &apiOp, nil
+}
+
+// ListOperations returns running operations and recently finished ones, oldest first.
+func (s *Server) ListOperations(ctx context.Context) (*serverapi.ListOperationsResponse, error) {
+	s.operations.lock.Lock()
+	ops := make([]*operation, 0, len(s.operations.ops))
+	for _, op := range s.operations.ops {
+		ops = append(ops, op)
+	}
+	s.operations.lock.Unlock()
+
+	apiOps := make([]serverapi.Operation, 0, len(ops))
+	for _, op := range ops {
+		apiOps = append(apiOps, op.toAPI())
+	}
+	sort.Slice(apiOps, func(i, j int) bool {
+		return apiOps[i].GetCreatedAt().Before(apiOps[j].GetCreatedAt())
+	})
+	return &serverapi.ListOperationsResponse{
+		Operations: apiOps,
+	}, nil
+}
+
+// CancelOperation aborts a running operation. The operation is marked as cancelled once its
+// rollback is done.
+func (s *Server) CancelOperation(ctx context.Context, id string) (*serverapi.Operation, error) {
+	op := s.operations.get(id)
+	if op == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("operation not found: %s", id))
+	}
+	if op.isFinished() {
+		return nil, status.Errorf(codes.FailedPrecondition, "operation already finished: %s", id)
+	}
+
+	log.WithField("operationId", id).Info("cancelling operation")
+	op.cancel()
+	apiOp := op.toAPI()
+	return &apiOp, nil
+}
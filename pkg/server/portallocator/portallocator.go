@@ -49,6 +49,15 @@ func (a *PortAllocator) AllocatePort() (int32, error) {
 	return port, nil
 }
 
+// Usage returns the number of allocated ports and the number of ports in the range
+func (a *PortAllocator) Usage() (int, int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	size := int(a.highPort - a.lowPort + 1)
+	return size - len(a.available), size
+}
+
 // FreePort returns a port to the pool of available ports
 func (a *PortAllocator) FreePort(port int32) error {
 	a.mutex.Lock()
@@ -68,3 +77,17 @@ func (a *PortAllocator) FreePort(port int32) error {
 	a.available = append(a.available, port)
 	return nil
 }
+
+// ClaimPort claims a specific port from the pool of available ports
+func (a *PortAllocator) ClaimPort(port int32) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i, p := range a.available {
+		if p == port {
+			a.available = append(a.available[:i], a.available[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("port %d is not available", port)
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Lists the VMs snapshotted by `PreserveVMs` to be restored by the next server instance.
+	preservedVMsFilename = "preserved-vms.json"
+	// Prefix of the IDs of the snapshots taken by `PreserveVMs`.
+	preserveSnapshotIdPrefix = "preserve-"
+)
+
+// preservedVM is a VM snapshotted on shutdown along with what's needed to restore it as it was.
+type preservedVM struct {
+	vmRecord
+	PreserveSnapshotId string `json:"preserveSnapshotId"`
+}
+
+func getPreservedVMsPath(stateDir string) string {
+	return path.Join(stateDir, preservedVMsFilename)
+}
+
+func loadPreservedVMs(stateDir string) ([]preservedVM, error) {
+	data, err := os.ReadFile(getPreservedVMsPath(stateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preserved VMs: %w", err)
+	}
+
+	var preserved []preservedVM
+	if err := json.Unmarshal(data, &preserved); err != nil {
+		return nil, fmt.Errorf("failed to parse preserved VMs: %w", err)
+	}
+	return preserved, nil
+}
+
+func savePreservedVMs(stateDir string, preserved []preservedVM) error {
+	data, err := json.MarshalIndent(preserved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal preserved VMs: %w", err)
+	}
+
+	preservedPath := getPreservedVMsPath(stateDir)
+	tmpPath := preservedPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write preserved VMs: %w", err)
+	}
+	if err := os.Rename(tmpPath, preservedPath); err != nil {
+		return fmt.Errorf("failed to rename preserved VMs file: %w", err)
+	}
+	return nil
+}
+
+// SetPreserveVMs sets whether `PreserveVMs` is called on shutdown. VMs can't be preserved with
+// volumes or hot-plugged disks, so they are refused meanwhile. Must be called before serving.
+func (s *Server) SetPreserveVMs(preserve bool) {
+	s.preserveVMs = preserve
+}
+
+// preserveVM snapshots `vm` so that it can be restored by the next server instance.
+func (s *Server) preserveVM(ctx context.Context, vm *vm) (preservedVM, error) {
+	record := vm.toRecord()
+
+	// Snapshotting pauses the VM itself, which fails if it's paused already. It's paused again once
+	// restored.
+	if parseVMStatus(record.Status) == vmStatusPaused {
+		if err := vm.resume(ctx); err != nil {
+			return preservedVM{}, fmt.Errorf("failed to resume paused VM: %w", err)
+		}
+	}
+
+	snapshotId := fmt.Sprintf("%s%s-%d", preserveSnapshotIdPrefix, record.Name, time.Now().Unix())
+	if _, err := s.SnapshotVM(ctx, record.Name, snapshotId); err != nil {
+		return preservedVM{}, err
+	}
+	return preservedVM{
+		vmRecord:           record,
+		PreserveSnapshotId: snapshotId,
+	}, nil
+}
+
+// PreserveVMs snapshots all running and paused VMs, destroys them and records them to be restored
+// under their original names by the next server instance. Stopped VMs are left as they are for the
+// next server instance to re-attach to, so are VMs failing to be preserved, which makes it return
+// an error. VMs in warm pools are destroyed.
+func (s *Server) PreserveVMs(ctx context.Context) error {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	var lock sync.Mutex
+	var preserved []preservedVM
+	var preserveErr error
+	var wg sync.WaitGroup
+	for _, vm := range vms {
+		vm.lock.RLock()
+		vmName := vm.name
+		vmStatus := vm.status
+		warmPool := vm.warmPool
+		vm.lock.RUnlock()
+
+		logger := log.WithField("vmName", vmName)
+		if warmPool != "" {
+			if err := s.destroyVM(ctx, vmName); err != nil {
+				logger.WithError(err).Warn("failed to destroy VM of warm pool")
+			}
+			continue
+		}
+		if vmStatus != vmStatusRunning && vmStatus != vmStatusPaused {
+			logger.WithField("status", vmStatus.String()).Warn("can't preserve VM, leaving it as is")
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			logger.Info("preserving VM")
+			p, err := s.preserveVM(ctx, vm)
+			if err != nil {
+				logger.WithError(err).Error("failed to preserve VM, leaving it running")
+				lock.Lock()
+				preserveErr = errors.Join(preserveErr, fmt.Errorf("failed to preserve vm %s: %w", vmName, err))
+				lock.Unlock()
+				return
+			}
+
+			if err := s.destroyVM(ctx, vmName); err != nil {
+				// The next server instance re-attaches to the VM, don't also restore it.
+				logger.WithError(err).Error("failed to destroy preserved VM")
+				lock.Lock()
+				preserveErr = errors.Join(preserveErr, fmt.Errorf("failed to destroy preserved vm %s: %w", vmName, err))
+				lock.Unlock()
+				return
+			}
+
+			lock.Lock()
+			preserved = append(preserved, p)
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if err := savePreservedVMs(s.config.StateDir, preserved); err != nil {
+		return err
+	}
+	log.Infof("preserved %d VMs", len(preserved))
+	return preserveErr
+}
+
+// restorePreservedVMs restores the VMs preserved by the previous server instance. The snapshots of
+// the VMs restored successfully are deleted, the others are kept and stay listed in the preserved
+// VMs file to be restored by the next server instance or manually.
+func (s *Server) restorePreservedVMs(ctx context.Context) error {
+	preserved, err := loadPreservedVMs(s.config.StateDir)
+	if err != nil {
+		return err
+	}
+
+	var failed []preservedVM
+	for _, p := range preserved {
+		logger := log.WithFields(log.Fields{
+			"vmName":     p.Name,
+			"snapshotId": p.PreserveSnapshotId,
+		})
+		if err := s.restorePreservedVM(ctx, p); err != nil {
+			logger.WithError(err).Error("failed to restore preserved VM")
+			failed = append(failed, p)
+			continue
+		}
+
+		if err := s.removeSnapshot(ctx, p.PreserveSnapshotId); err != nil {
+			logger.WithError(err).Warn("failed to delete snapshot of preserved VM")
+		}
+		logger.Info("restored preserved VM")
+	}
+
+	if len(failed) > 0 {
+		return savePreservedVMs(s.config.StateDir, failed)
+	}
+	if err := os.Remove(getPreservedVMsPath(s.config.StateDir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove preserved VMs file: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) restorePreservedVM(ctx context.Context, p preservedVM) error {
+	vm, err := s.restoreVM(ctx, p.Name, p.Tenant, p.Labels, p.PreserveSnapshotId, false)
+	if err != nil {
+		return err
+	}
+
+	// Restore what the snapshot doesn't capture.
+	vm.applyRecord(p.vmRecord)
+
+	if parseVMStatus(p.Status) == vmStatusPaused {
+		if err := vm.pause(ctx); err != nil {
+			log.WithField("vmName", p.Name).WithError(err).Warn("failed to pause restored VM")
+		}
+	} else if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
+		log.WithField("vmName", p.Name).WithError(err).Warn("command server of restored VM not ready")
+	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeRestored, vm, map[string]string{"snapshotId": p.PreserveSnapshotId})
+	return nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRestorePreservedVMsKeepsFailed(t *testing.T) {
+	s := newTestSnapshotServer(t)
+	// Neither snapshot exists, so neither VM can be restored.
+	preserved := []preservedVM{
+		{vmRecord: vmRecord{Name: "vm1"}, PreserveSnapshotId: "preserve-vm1"},
+		{vmRecord: vmRecord{Name: "vm2"}, PreserveSnapshotId: "preserve-vm2"},
+	}
+	if err := savePreservedVMs(s.config.StateDir, preserved); err != nil {
+		t.Fatalf("savePreservedVMs() failed: %v", err)
+	}
+
+	if err := s.restorePreservedVMs(context.Background()); err != nil {
+		t.Fatalf("restorePreservedVMs() failed: %v", err)
+	}
+	got, err := loadPreservedVMs(s.config.StateDir)
+	if err != nil {
+		t.Fatalf("loadPreservedVMs() failed: %v", err)
+	}
+	if len(got) != len(preserved) {
+		t.Fatalf("got %d preserved VMs, want %d", len(got), len(preserved))
+	}
+	for i := range got {
+		if got[i].Name != preserved[i].Name || got[i].PreserveSnapshotId != preserved[i].PreserveSnapshotId {
+			t.Errorf("preserved VM %d = %+v, want %+v", i, got[i], preserved[i])
+		}
+	}
+}
+
+func TestRestorePreservedVMsRemovesFile(t *testing.T) {
+	s := newTestSnapshotServer(t)
+	if err := savePreservedVMs(s.config.StateDir, nil); err != nil {
+		t.Fatalf("savePreservedVMs() failed: %v", err)
+	}
+
+	if err := s.restorePreservedVMs(context.Background()); err != nil {
+		t.Fatalf("restorePreservedVMs() failed: %v", err)
+	}
+	if _, err := os.Stat(getPreservedVMsPath(s.config.StateDir)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("preserved VMs file wasn't removed: %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/server/fountain"
+	"gvisor.dev/gvisor/pkg/cleanup"
+)
+
+const (
+	registryFilename = "registry.json"
+	// How long to wait for a cloud-hypervisor API server of a VM found in the registry to respond
+	// before deeming it dead.
+	adoptVMPingTimeout = 2 * time.Second
+	// How long to wait for the cloud-hypervisor process of a VM that can't be adopted to exit once
+	// killed.
+	killVMProcessTimeout = 5 * time.Second
+)
+
+type portForwardRecord struct {
+	HostPort    int32  `json:"hostPort"`
+	GuestPort   int32  `json:"guestPort"`
+	Description string `json:"description"`
+}
+
+// vmRecord is the on-disk representation of a `vm` in the registry. It holds everything needed to
+// re-attach to a VM whose cloud-hypervisor process outlived the server that created it.
+type vmRecord struct {
+	Name               string              `json:"name"`
+	Pid                int                 `json:"pid"`
+	StateDirPath       string              `json:"stateDirPath"`
+	APISocketPath      string              `json:"apiSocketPath"`
+	IP                 string              `json:"ip"`
+	TapDeviceName      string              `json:"tapDeviceName"`
+	TapDeviceID        int32               `json:"tapDeviceId"`
+	CID                uint32              `json:"cid"`
+	VsockPath          string              `json:"vsockPath"`
+	StatefulDiskPath   string              `json:"statefulDiskPath"`
+	PortForwards       []portForwardRecord `json:"portForwards"`
+	Status             string              `json:"status"`
+	Vcpus              int32               `json:"vcpus"`
+	MemorySizeMB       int32               `json:"memorySizeMB"`
+	StatefulDiskSizeMB int32               `json:"statefulDiskSizeMB"`
+	TTLSeconds         int32               `json:"ttlSeconds"`
+	IdleTimeoutSeconds int32               `json:"idleTimeoutSeconds"`
+	Deadline           time.Time           `json:"deadline"`
+	WarmPool           string              `json:"warmPool,omitempty"`
+	Tenant             string              `json:"tenant,omitempty"`
+	Labels             map[string]string   `json:"labels,omitempty"`
+	CrashRestartPolicy string              `json:"crashRestartPolicy,omitempty"`
+	Restarts           int32               `json:"restarts,omitempty"`
+	LastSnapshotId     string              `json:"lastSnapshotId,omitempty"`
+	Kernel             string              `json:"kernel,omitempty"`
+	Initramfs          string              `json:"initramfs,omitempty"`
+	Rootfs             string              `json:"rootfs,omitempty"`
+	EntryPoint         string              `json:"entryPoint,omitempty"`
+	EntryPointRestart  string              `json:"entryPointRestart,omitempty"`
+	Disks              []diskRecord        `json:"disks,omitempty"`
+	RootVolume         string              `json:"rootVolume,omitempty"`
+	SnapshotSchedule   *snapshotSchedule   `json:"snapshotSchedule,omitempty"`
+	Checkpoints        []checkpoint        `json:"checkpoints,omitempty"`
+	BalloonTargetMB    int32               `json:"balloonTargetMB,omitempty"`
+}
+
+// diskRecord is the registry representation of a disk hot-plugged into a VM.
+type diskRecord struct {
+	Id       string `json:"id"`
+	Path     string `json:"path"`
+	Image    string `json:"image,omitempty"`
+	Volume   string `json:"volume,omitempty"`
+	SizeMB   int32  `json:"sizeMB"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+func getRegistryPath(stateDir string) string {
+	return path.Join(stateDir, registryFilename)
+}
+
+func parseVMStatus(status string) vmStatus {
+	switch status {
+	case vmStatusCreated.String():
+		return vmStatusCreated
+	case vmStatusRunning.String():
+		return vmStatusRunning
+	case vmStatusStopped.String():
+		return vmStatusStopped
+	case vmStatusPaused.String():
+		return vmStatusPaused
+	default:
+		return vmStatusRunning
+	}
+}
+
+// toRecord converts the VM to its registry representation.
+func (v *vm) toRecord() vmRecord {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	record := vmRecord{
+		Name:               v.name,
+		StateDirPath:       v.stateDirPath,
+		APISocketPath:      v.apiSocketPath,
+		CID:                v.cid,
+		VsockPath:          v.vsockPath,
+		StatefulDiskPath:   v.statefulDiskPath,
+		Status:             v.status.String(),
+		Vcpus:              v.resources.vcpus,
+		MemorySizeMB:       v.resources.memorySizeMB,
+		StatefulDiskSizeMB: v.resources.statefulDiskSizeMB,
+		WarmPool:           v.warmPool,
+		Tenant:             v.tenant,
+		Labels:             v.labels,
+		CrashRestartPolicy: v.crashRestartPolicy,
+		Restarts:           v.restarts,
+		LastSnapshotId:     v.lastSnapshotId,
+		Kernel:             v.bootConfig.kernelPath,
+		Initramfs:          v.bootConfig.initramfsPath,
+		Rootfs:             v.bootConfig.rootfsPath,
+		EntryPoint:         v.bootConfig.entryPoint.cmd,
+		EntryPointRestart:  v.bootConfig.entryPoint.restartPolicy,
+		RootVolume:         v.rootVolume,
+		SnapshotSchedule:   v.snapshotSchedule,
+		Checkpoints:        slices.Clone(v.checkpoints),
+		BalloonTargetMB:    v.balloonTargetMB,
+	}
+	v.lifetime.lock.Lock()
+	record.TTLSeconds = int32(v.lifetime.ttl.Seconds())
+	record.IdleTimeoutSeconds = int32(v.lifetime.idleTimeout.Seconds())
+	record.Deadline = v.lifetime.deadline
+	v.lifetime.lock.Unlock()
+
+	if v.process != nil {
+		record.Pid = v.process.Pid
+	}
+	if v.ip != nil {
+		record.IP = v.ip.String()
+	}
+	if v.tapDevice != nil {
+		record.TapDeviceName = v.tapDevice.Name
+		record.TapDeviceID = v.tapDevice.ID
+	}
+	for _, disk := range v.disks {
+		record.Disks = append(record.Disks, diskRecord{
+			Id:       disk.id,
+			Path:     disk.path,
+			Image:    disk.image,
+			Volume:   disk.volume,
+			SizeMB:   disk.sizeMB,
+			Readonly: disk.readonly,
+		})
+	}
+	for _, pf := range v.portForwards {
+		record.PortForwards = append(record.PortForwards, portForwardRecord{
+			HostPort:    pf.hostPort,
+			GuestPort:   pf.guestPort,
+			Description: pf.description,
+		})
+	}
+	return record
+}
+
+// saveVMRegistry persists all VMs known to the server. The file is written to a temporary path and
+// renamed so that a crash mid-write never leaves a truncated registry behind.
+func (s *Server) saveVMRegistry() error {
+	s.registryLock.Lock()
+	defer s.registryLock.Unlock()
+
+	s.lock.RLock()
+	records := make([]vmRecord, 0, len(s.vms))
+	for _, vm := range s.vms {
+		records = append(records, vm.toRecord())
+	}
+	s.lock.RUnlock()
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal vm registry: %w", err)
+	}
+
+	registryPath := getRegistryPath(s.config.StateDir)
+	tmpPath := registryPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write vm registry: %w", err)
+	}
+	if err := os.Rename(tmpPath, registryPath); err != nil {
+		return fmt.Errorf("failed to rename vm registry: %w", err)
+	}
+	return nil
+}
+
+// persistVMRegistry is a best effort wrapper around `saveVMRegistry` for callers that have already
+// changed VM state and can't roll it back.
+func (s *Server) persistVMRegistry() {
+	if err := s.saveVMRegistry(); err != nil {
+		log.WithError(err).Error("failed to persist vm registry")
+	}
+}
+
+// loadVMRegistry returns the VMs recorded by a previous server instance. A missing registry is not an
+// error.
+func loadVMRegistry(stateDir string) ([]vmRecord, error) {
+	data, err := os.ReadFile(getRegistryPath(stateDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read vm registry: %w", err)
+	}
+
+	var records []vmRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vm registry: %w", err)
+	}
+	return records, nil
+}
+
+// isVMProcessAlive returns true if the cloud-hypervisor process of the recorded VM is still running
+// and its API server is responsive.
+func isVMProcessAlive(record vmRecord) bool {
+	if record.Pid <= 0 {
+		return false
+	}
+
+	if err := syscall.Kill(record.Pid, 0); err != nil {
+		return false
+	}
+
+	// Guard against the PID having been recycled by an unrelated process.
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", record.Pid))
+	if err != nil || !strings.Contains(string(cmdline), record.APISocketPath) {
+		return false
+	}
+
+	apiClient := createApiClient(record.APISocketPath)
+	return waitForServer(context.Background(), apiClient, adoptVMPingTimeout) == nil
+}
+
+// partitionVMRecords splits the recorded VMs into the ones whose VMM is still alive and the ones
+// that are gone.
+func partitionVMRecords(records []vmRecord) ([]vmRecord, []vmRecord) {
+	var live, dead []vmRecord
+	for _, record := range records {
+		if isVMProcessAlive(record) {
+			live = append(live, record)
+		} else {
+			dead = append(dead, record)
+		}
+	}
+	return live, dead
+}
+
+// cleanupDeadVMRecord removes the host resources left behind by a recorded VM whose VMM is no
+// longer running.
+func cleanupDeadVMRecord(record vmRecord) {
+	logger := log.WithField("vmName", record.Name)
+	logger.Info("cleaning up dead VM from registry")
+
+	if record.TapDeviceName != "" {
+		if err := exec.Command("ip", "link", "delete", record.TapDeviceName).Run(); err != nil {
+			logger.WithError(err).Warnf("failed to delete tap device: %s", record.TapDeviceName)
+		}
+	}
+
+	if record.IP != "" {
+		if ip, _, err := net.ParseCIDR(record.IP); err == nil {
+			if err := cleanupAllIPTablesRulesForIP(ip.String()); err != nil {
+				logger.WithError(err).Warn("failed to delete iptables rules")
+			}
+		}
+	}
+
+	if record.StateDirPath != "" {
+		if err := os.RemoveAll(record.StateDirPath); err != nil {
+			logger.WithError(err).Warnf("failed to remove vm state dir: %s", record.StateDirPath)
+		}
+	}
+}
+
+// killVMProcess kills the cloud-hypervisor process of a recorded VM, which isn't a child of the
+// server, and waits for it to exit.
+func killVMProcess(record vmRecord) error {
+	if err := syscall.Kill(record.Pid, syscall.SIGKILL); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return fmt.Errorf("failed to kill VM process: %w", err)
+	}
+	return waitForProcessExit(record.Pid, killVMProcessTimeout)
+}
+
+// adoptVM re-attaches to a VM that was created by a previous server instance and is still running.
+// All of its resources are claimed from the allocators so that they aren't handed out again. A VM
+// that can't be adopted is killed and its host resources are removed rather than leaving it running
+// untracked.
+func (s *Server) adoptVM(ctx context.Context, record vmRecord) (*vm, error) {
+	logger := log.WithFields(log.Fields{"vmName": record.Name, "pid": record.Pid})
+
+	var tapDevice *fountain.TapDevice
+	cleanup := cleanup.Make(func() {
+		logger.Warn("killing VM that can't be adopted")
+		if err := killVMProcess(record); err != nil {
+			logger.WithError(err).Error("failed to kill VM that can't be adopted")
+		}
+		deadRecord := record
+		if tapDevice != nil {
+			// Destroyed through the fountain to free its ID too.
+			if err := s.fountain.DestroyTapDevice(tapDevice); err != nil {
+				logger.WithError(err).Warnf("failed to delete tap device: %s", tapDevice.Name)
+			}
+			deadRecord.TapDeviceName = ""
+		}
+		cleanupDeadVMRecord(deadRecord)
+	})
+	defer func() {
+		// Won't do anything if no error since we call `Release` it at the end.
+		cleanup.Clean()
+	}()
+
+	process, err := os.FindProcess(record.Pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find VM process: %w", err)
+	}
+
+	var guestIP *net.IPNet
+	if record.IP != "" {
+		ip, ipNet, err := net.ParseCIDR(record.IP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse VM IP %q: %w", record.IP, err)
+		}
+		ipNet.IP = ip
+		guestIP = ipNet
+		if err := s.ipAllocator.ClaimIP(guestIP.IP); err != nil {
+			return nil, fmt.Errorf("failed to claim IP: %w", err)
+		}
+		cleanup.Add(func() {
+			if err := s.ipAllocator.FreeIP(guestIP.IP); err != nil {
+				logger.WithError(err).Warnf("failed to free IP: %s", guestIP.String())
+			}
+		})
+	}
+
+	if record.TapDeviceName != "" {
+		tapDevice, err = s.fountain.AdoptTapDevice(record.TapDeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to adopt tap device: %w", err)
+		}
+	}
+
+	if record.CID != 0 {
+		if err := s.cidAllocator.ClaimCID(record.CID); err != nil {
+			return nil, fmt.Errorf("failed to claim CID: %w", err)
+		}
+		cleanup.Add(func() {
+			if err := s.cidAllocator.FreeCID(record.CID); err != nil {
+				logger.WithError(err).Warnf("failed to free CID: %d", record.CID)
+			}
+		})
+	}
+
+	portForwards := make([]portForward, 0, len(record.PortForwards))
+	for _, pf := range record.PortForwards {
+		if err := s.portAllocator.ClaimPort(pf.HostPort); err != nil {
+			return nil, fmt.Errorf("failed to claim host port %d: %w", pf.HostPort, err)
+		}
+		cleanup.Add(func() {
+			if err := s.portAllocator.FreePort(pf.HostPort); err != nil {
+				logger.WithError(err).Warnf("failed to free host port: %d", pf.HostPort)
+			}
+		})
+		portForwards = append(portForwards, portForward{
+			hostPort:    pf.HostPort,
+			guestPort:   pf.GuestPort,
+			description: pf.Description,
+		})
+	}
+
+	apiClient := createApiClient(record.APISocketPath)
+	status := parseVMStatus(record.Status)
+	// The VMM is the source of truth for the state of the VM, the record may be stale if the server
+	// died in the middle of a state change.
+	if info, _, err := apiClient.DefaultAPI.VmInfoGet(ctx).Execute(); err == nil {
+		switch info.GetState() {
+		case "Created":
+			status = vmStatusCreated
+		case "Running":
+			status = vmStatusRunning
+		case "Paused":
+			status = vmStatusPaused
+		case "Shutdown":
+			status = vmStatusStopped
+		}
+	} else {
+		logger.WithError(err).Warn("failed to get VM info, using recorded status")
+	}
+
+	vm := &vm{
+		name:               record.Name,
+		stateDirPath:       record.StateDirPath,
+		apiSocketPath:      record.APISocketPath,
+		apiClient:          apiClient,
+		process:            process,
+		ip:                 guestIP,
+		tapDevice:          tapDevice,
+		status:             status,
+		portForwards:       portForwards,
+		vsockPath:          record.VsockPath,
+		cid:                record.CID,
+		statefulDiskPath:   record.StatefulDiskPath,
+		warmPool:           record.WarmPool,
+		tenant:             record.Tenant,
+		labels:             record.Labels,
+		exited:             make(chan struct{}),
+		crashRestartPolicy: record.CrashRestartPolicy,
+		restarts:           record.Restarts,
+		lastSnapshotId:     record.LastSnapshotId,
+		rootVolume:         record.RootVolume,
+		balloonTargetMB:    record.BalloonTargetMB,
+		bootConfig: vmBootConfig{
+			kernelPath:    record.Kernel,
+			initramfsPath: record.Initramfs,
+			rootfsPath:    record.Rootfs,
+			entryPoint: entryPoint{
+				cmd:           record.EntryPoint,
+				restartPolicy: record.EntryPointRestart,
+			},
+		},
+		resources: vmResources{
+			vcpus:              record.Vcpus,
+			memorySizeMB:       record.MemorySizeMB,
+			statefulDiskSizeMB: record.StatefulDiskSizeMB,
+		},
+	}
+
+	for _, disk := range record.Disks {
+		vm.disks = append(vm.disks, &vmDisk{
+			id:       disk.Id,
+			path:     disk.Path,
+			image:    disk.Image,
+			volume:   disk.Volume,
+			sizeMB:   disk.SizeMB,
+			readonly: disk.Readonly,
+		})
+	}
+
+	s.admission.commit(vm.tenant, vm.resources)
+	vm.lifetime.restore(
+		time.Duration(record.TTLSeconds)*time.Second,
+		time.Duration(record.IdleTimeoutSeconds)*time.Second,
+		record.Deadline,
+	)
+	vm.restoreSnapshotSchedule(record.SnapshotSchedule, record.Checkpoints)
+	// The serial port was released when the previous server exited.
+	if status == vmStatusRunning || status == vmStatusPaused {
+		vm.lock.Lock()
+		vm.connectSerialLocked(ctx)
+		vm.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	s.vms[vm.name] = vm
+	s.lock.Unlock()
+	cleanup.Release()
+	go s.watchVM(vm)
+
+	logger.WithField("status", status.String()).Info("adopted VM")
+	return vm, nil
+}
+
+// applyRecord restores what a snapshot doesn't capture of the VM `record` was taken of onto `v`,
+// which was restored from a snapshot of it.
+func (v *vm) applyRecord(record vmRecord) {
+	v.lock.Lock()
+	v.crashRestartPolicy = record.CrashRestartPolicy
+	v.restarts = record.Restarts
+	v.lastSnapshotId = record.LastSnapshotId
+	v.balloonTargetMB = record.BalloonTargetMB
+	v.bootConfig = vmBootConfig{
+		kernelPath:    record.Kernel,
+		initramfsPath: record.Initramfs,
+		rootfsPath:    record.Rootfs,
+		entryPoint: entryPoint{
+			cmd:           record.EntryPoint,
+			restartPolicy: record.EntryPointRestart,
+		},
+	}
+	v.lock.Unlock()
+	v.lifetime.restore(
+		time.Duration(record.TTLSeconds)*time.Second,
+		time.Duration(record.IdleTimeoutSeconds)*time.Second,
+		record.Deadline,
+	)
+	v.restoreSnapshotSchedule(record.SnapshotSchedule, record.Checkpoints)
+}
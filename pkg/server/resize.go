@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/chvapi"
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Memory is hot-plugged in multiples of this size.
+	memoryHotplugAlignmentMB = 128
+	// Onlines hot-plugged vCPUs and memory in guests that don't do so on their own.
+	onlineHotpluggedResourcesCmd = `for f in /sys/devices/system/cpu/cpu*/online /sys/devices/system/memory/memory*/online; do [ "$(cat "$f")" = 1 ] || echo 1 > "$f"; done; true`
+)
+
+// hotplugLimits returns the maximum number of vCPUs and the size of the hot-pluggable memory region
+// in MB a VM booted with `resources` is created with.
+func (s *Server) hotplugLimits(resources vmResources) (int32, int32) {
+	maxVcpus := s.config.Resize.MaxVCPUs
+	if maxVcpus <= 0 {
+		maxVcpus = int32(runtime.NumCPU())
+	}
+	maxVcpus = max(maxVcpus, resources.vcpus)
+
+	hotplugSizeMB := s.config.Resize.MemoryHotplugMB
+	hotplugSizeMB -= hotplugSizeMB % memoryHotplugAlignmentMB
+	return maxVcpus, max(hotplugSizeMB, 0)
+}
+
+// resize changes the resources committed to a VM of `tenant` from `from` to `to`. Unlike `admit`
+// it doesn't wait for capacity to be freed.
+func (a *admissionController) resize(tenant string, from vmResources, to vmResources) error {
+	delta := to.sub(from)
+	grown := vmResources{
+		vcpus:              max(delta.vcpus, 0),
+		memorySizeMB:       max(delta.memorySizeMB, 0),
+		statefulDiskSizeMB: max(delta.statefulDiskSizeMB, 0),
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if resource := a.committed.add(grown).exceeds(a.limits); resource != "" {
+		return status.Errorf(codes.ResourceExhausted, "not enough capacity on the host: %s", resource)
+	}
+	if quota, ok := a.quotas[tenant]; ok && tenant != "" {
+		var usage vmResources
+		if u, ok := a.tenants[tenant]; ok {
+			usage = u.resources
+		}
+		if resource := usage.add(grown).exceeds(quota.resources); resource != "" {
+			return status.Errorf(codes.ResourceExhausted, "quota of tenant %s exceeded: %s", tenant, resource)
+		}
+	}
+
+	a.applyResizeLocked(tenant, delta)
+	return nil
+}
+
+// revertResize undoes `resize` from `from` to `to` after resizing the VM failed. It can't be
+// rejected, the resources were committed to the VM before.
+func (a *admissionController) revertResize(tenant string, from vmResources, to vmResources) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.applyResizeLocked(tenant, from.sub(to))
+}
+
+// applyResizeLocked adds `delta` to the resources committed to a VM of `tenant`. Expects `a.lock` to
+// be held.
+func (a *admissionController) applyResizeLocked(tenant string, delta vmResources) {
+	a.committed = a.committed.add(delta)
+	if usage, ok := a.tenants[tenant]; ok {
+		usage.resources = usage.resources.add(delta)
+	}
+	if delta.vcpus < 0 || delta.memorySizeMB < 0 {
+		close(a.released)
+		a.released = make(chan struct{})
+	}
+}
+
+// resizeLocked hot-plugs vCPUs and memory into the running VM. Expects `v.lock` to be held.
+func (v *vm) resizeLocked(ctx context.Context, vcpus int32, memorySizeMB int32) error {
+	resize := chvapi.NewVmResize()
+	if vcpus != v.resources.vcpus {
+		resize.SetDesiredVcpus(vcpus)
+	}
+	if memorySizeMB != v.resources.memorySizeMB {
+		resize.SetDesiredRam(int64(memorySizeMB) * 1024 * 1024)
+	}
+
+	resp, err := v.apiClient.DefaultAPI.VmResizePut(ctx).VmResize(*resize).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to resize VM: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to resize VM. bad status: %v", resp)
+	}
+	return nil
+}
+
+// ResizeVM changes the number of vCPUs and the memory size of a running VM. vCPUs can be added and
+// removed up to the maximum the VM was booted with, memory can only be added as long as its
+// hot-pluggable region has room left. Zero values keep the current size.
+func (s *Server) ResizeVM(
+	ctx context.Context,
+	vmName string,
+	vcpus int32,
+	memorySizeMB int32,
+) (*serverapi.ListVMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to resize VM to %d vCPUs and %d MB memory", vcpus, memorySizeMB)
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if vcpus < 0 || memorySizeMB < 0 {
+		return nil, status.Error(codes.InvalidArgument, "vcpus and memorySizeMB must not be negative")
+	}
+
+	vm.lock.Lock()
+	if vm.status != vmStatusRunning {
+		vm.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm isn't running: %s", vmName)
+	}
+	from := vm.resources
+	to := from
+	if vcpus > 0 {
+		to.vcpus = vcpus
+	}
+	if memorySizeMB > 0 {
+		to.memorySizeMB = memorySizeMB
+	}
+	if to == from {
+		vm.lock.Unlock()
+		return s.ListVM(ctx, vmName)
+	}
+
+	if err := vm.checkResizeLocked(ctx, from, to); err != nil {
+		vm.lock.Unlock()
+		return nil, err
+	}
+	if err := s.admission.resize(vm.tenant, from, to); err != nil {
+		vm.lock.Unlock()
+		return nil, err
+	}
+	if err := vm.resizeLocked(ctx, to.vcpus, to.memorySizeMB); err != nil {
+		s.admission.revertResize(vm.tenant, from, to)
+		vm.lock.Unlock()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	vm.resources = to
+	vm.lock.Unlock()
+	logger.Infof("resized VM to %d vCPUs and %d MB memory", to.vcpus, to.memorySizeMB)
+
+	if to.vcpus > from.vcpus || to.memorySizeMB > from.memorySizeMB {
+		client := &http.Client{Timeout: 30 * time.Second}
+		url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+		if _, err := vm.handleRun(ctx, client, url, onlineHotpluggedResourcesCmd, true); err != nil {
+			logger.WithError(err).Warn("failed to online hot-plugged resources in the guest")
+		}
+	}
+
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeResized, vm, map[string]string{
+		"vcpus":        fmt.Sprint(to.vcpus),
+		"memorySizeMB": fmt.Sprint(to.memorySizeMB),
+	})
+	return s.ListVM(ctx, vmName)
+}
+
+// checkResizeLocked returns an error if the VM can't be resized from `from` to `to` given what it
+// was booted with. Expects `v.lock` to be held.
+func (v *vm) checkResizeLocked(ctx context.Context, from vmResources, to vmResources) error {
+	info, resp, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get VM info: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return status.Errorf(codes.Internal, "failed to get VM info. bad status: %v", resp)
+	}
+
+	var maxVcpus int32
+	if info.Config.Cpus != nil {
+		maxVcpus = info.Config.Cpus.MaxVcpus
+	}
+	if to.vcpus > maxVcpus {
+		return status.Errorf(codes.InvalidArgument, "vm can have at most %d vCPUs", maxVcpus)
+	}
+
+	if to.memorySizeMB == from.memorySizeMB {
+		return nil
+	}
+	if to.memorySizeMB < from.memorySizeMB {
+		return status.Error(codes.InvalidArgument, "memory of a running vm can't be shrunk")
+	}
+	if (to.memorySizeMB-from.memorySizeMB)%memoryHotplugAlignmentMB != 0 {
+		return status.Errorf(codes.InvalidArgument, "memory can only be added in multiples of %d MB", memoryHotplugAlignmentMB)
+	}
+	// The VMM rejects growing beyond the hot-pluggable region itself, its size isn't reported
+	// reliably once memory was hot-plugged.
+	if info.Config.Memory == nil || info.Config.Memory.GetHotplugSize() == 0 {
+		return status.Error(codes.InvalidArgument, "vm was booted without hot-pluggable memory")
+	}
+	return nil
+}
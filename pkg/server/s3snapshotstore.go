@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	// Files larger than this are uploaded in parts of `s3PartSize`, single uploads are limited to
+	// 5 GiB.
+	s3MultipartThreshold = 512 * 1024 * 1024
+	s3PartSize           = 128 * 1024 * 1024
+	// Payloads aren't hashed, uploads would have to be read twice otherwise.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// Uploaded last, a snapshot in the bucket is complete once its VMM config is there.
+	s3SnapshotCompleteFilename = "config.json"
+)
+
+// s3SnapshotStore keeps snapshots in a bucket of an S3 compatible object store, one object per
+// file of the snapshot directory under "<prefix><snapshot id>/".
+type s3SnapshotStore struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	prefix          string
+	accessKeyId     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+// s3Error is an error response of the object store.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("object store returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("object store returned status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func newS3SnapshotStore(s3Config config.S3Config) (*s3SnapshotStore, error) {
+	if s3Config.Endpoint == "" || s3Config.Bucket == "" {
+		return nil, fmt.Errorf("s3 snapshot store needs an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(s3Config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", s3Config.Endpoint)
+	}
+
+	st := &s3SnapshotStore{
+		endpoint:        endpoint,
+		region:          s3Config.Region,
+		bucket:          s3Config.Bucket,
+		prefix:          s3Config.Prefix,
+		accessKeyId:     s3Config.AccessKeyId,
+		secretAccessKey: s3Config.SecretAccessKey,
+		client:          &http.Client{},
+	}
+	if st.region == "" {
+		st.region = s3DefaultRegion
+	}
+	if st.accessKeyId == "" {
+		st.accessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if st.secretAccessKey == "" {
+		st.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if st.accessKeyId == "" || st.secretAccessKey == "" {
+		return nil, fmt.Errorf("s3 snapshot store needs credentials")
+	}
+	return st, nil
+}
+
+func (st *s3SnapshotStore) snapshotPrefix(snapshotId string) string {
+	return st.prefix + snapshotId + "/"
+}
+
+// s3Escape URI encodes `s` the way signature version 4 expects, leaving '/' alone unless
+// `encodeSlash`.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS signature version 4 to `req`.
+func (st *s3SnapshotStore) sign(req *http.Request) {
+	st.signAt(req, time.Now())
+}
+
+// signAt signs `req` as if sent at `now`.
+func (st *s3SnapshotStore) signAt(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + s3UnsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + st.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+st.secretAccessKey), date)
+	key = hmacSha256(key, st.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		st.accessKeyId,
+		scope,
+		signedHeaders,
+		hex.EncodeToString(hmacSha256(key, stringToSign)),
+	))
+}
+
+// objectURL returns the path-style URL of the object `key`, or the bucket if empty, escaped as
+// signature version 4 expects.
+func (st *s3SnapshotStore) objectURL(key string, query url.Values) *url.URL {
+	objectPath := path.Join(st.endpoint.Path, "/", st.bucket)
+	if key != "" {
+		objectPath += "/" + key
+	}
+	u := *st.endpoint
+	u.Path = objectPath
+	u.RawPath = s3Escape(objectPath, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request for the object `key`, or the bucket if empty. Returns an `s3Error` for
+// unsuccessful responses.
+func (st *s3SnapshotStore) do(
+	ctx context.Context,
+	method string,
+	key string,
+	query url.Values,
+	body io.Reader,
+	contentLength int64,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, st.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+		if contentLength == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	st.sign(req)
+
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		s3Err := &s3Error{}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(data, s3Err)
+		s3Err.StatusCode = resp.StatusCode
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// listKeys returns the keys of all objects starting with `prefix`.
+func (st *s3SnapshotStore) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	continuationToken := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := st.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object list: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (st *s3SnapshotStore) uploadFile(ctx context.Context, key string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() <= s3MultipartThreshold {
+		resp, err := st.do(ctx, http.MethodPut, key, nil, file, info.Size())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return st.uploadFileInParts(ctx, key, file, info.Size())
+}
+
+func (st *s3SnapshotStore) uploadFileInParts(ctx context.Context, key string, file *os.File, size int64) error {
+	resp, err := st.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to parse multipart upload: %w", err)
+	}
+	uploadQuery := url.Values{"uploadId": {initiated.UploadId}}
+
+	var complete s3CompleteMultipartUpload
+	err = func() error {
+		for offset := int64(0); offset < size; offset += s3PartSize {
+			partNumber := len(complete.Parts) + 1
+			length := min(s3PartSize, size-offset)
+			partQuery := url.Values{
+				"partNumber": {strconv.Itoa(partNumber)},
+				"uploadId":   {initiated.UploadId},
+			}
+			resp, err := st.do(ctx, http.MethodPut, key, partQuery, io.NewSectionReader(file, offset, length), length)
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, s3CompletedPart{
+				PartNumber: partNumber,
+				ETag:       resp.Header.Get("ETag"),
+			})
+		}
+
+		data, err := xml.Marshal(complete)
+		if err != nil {
+			return fmt.Errorf("failed to marshal parts: %w", err)
+		}
+		resp, err := st.do(ctx, http.MethodPost, key, uploadQuery, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+		defer resp.Body.Close()
+		// Completing can fail after the response status was sent.
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+		if bytes.Contains(data, []byte("<Error>")) {
+			s3Err := &s3Error{StatusCode: resp.StatusCode}
+			xml.Unmarshal(data, s3Err)
+			return fmt.Errorf("failed to complete multipart upload: %w", s3Err)
+		}
+		return nil
+	}()
+	if err != nil {
+		// The parts uploaded so far are billed until aborted.
+		if resp, abortErr := st.do(context.WithoutCancel(ctx), http.MethodDelete, key, uploadQuery, nil, 0); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// downloadFile writes the object `key` to `filePath`, keeping zeroed regions sparse.
+func (st *s3SnapshotStore) downloadFile(ctx context.Context, key string, filePath string) error {
+	resp, err := st.do(ctx, http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := &sparseFileWriter{file: file}
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		return err
+	}
+	if err := file.Truncate(writer.offset); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (st *s3SnapshotStore) Put(ctx context.Context, snapshotId string, dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+	// The snapshot must not look complete until all of its files are uploaded.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name() != s3SnapshotCompleteFilename && entries[j].Name() == s3SnapshotCompleteFilename
+	})
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		key := st.snapshotPrefix(snapshotId) + entry.Name()
+		if err := st.uploadFile(ctx, key, path.Join(dirPath, entry.Name())); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (st *s3SnapshotStore) Get(ctx context.Context, snapshotId string, dirPath string) error {
+	prefix := st.snapshotPrefix(snapshotId)
+	keys, err := st.listKeys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if err := st.downloadFile(ctx, key, path.Join(dirPath, name)); err != nil {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (st *s3SnapshotStore) Exists(ctx context.Context, snapshotId string) (bool, error) {
+	resp, err := st.do(ctx, http.MethodHead, st.snapshotPrefix(snapshotId)+s3SnapshotCompleteFilename, nil, nil, 0)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (st *s3SnapshotStore) List(ctx context.Context) ([]string, error) {
+	keys, err := st.listKeys(ctx, st.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var snapshotIds []string
+	for _, key := range keys {
+		snapshotId, found := strings.CutSuffix(strings.TrimPrefix(key, st.prefix), "/"+s3SnapshotCompleteFilename)
+		if found && snapshotId != "" && !strings.Contains(snapshotId, "/") {
+			snapshotIds = append(snapshotIds, snapshotId)
+		}
+	}
+	return snapshotIds, nil
+}
+
+func (st *s3SnapshotStore) Delete(ctx context.Context, snapshotId string) error {
+	prefix := st.snapshotPrefix(snapshotId)
+	keys, err := st.listKeys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	// The snapshot stops looking complete first, in case deleting the rest fails.
+	completeKey := prefix + s3SnapshotCompleteFilename
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i] == completeKey && keys[j] != completeKey
+	})
+	for _, key := range keys {
+		resp, err := st.do(ctx, http.MethodDelete, key, nil, nil, 0)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
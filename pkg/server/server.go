@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,6 +45,7 @@ const (
 	vmStatusRunning
 	vmStatusStopped
 	vmStatusPaused
+	vmStatusCrashed
 )
 
 func (status vmStatus) String() string {
@@ -56,14 +58,16 @@ func (status vmStatus) String() string {
 		return "STOPPED"
 	case vmStatusPaused:
 		return "PAUSED"
+	case vmStatusCrashed:
+		return "CRASHED"
 	default:
 		return "UNKNOWN"
 	}
 }
 
 const (
-	// Case sensitive.
-	serialPortMode = "Tty"
+	// Case sensitive. The server owns the serial port's socket, see `serialConsole`.
+	serialPortMode = "Socket"
 	// Case sensitive.
 	consolePortMode = "Off"
 
@@ -83,9 +87,15 @@ const (
 	minGuestMemoryMB          = 1024
 	maxGuestMemoryMB          = 32768
 	defaultGuestMemPercentage = 50
+	// Lower bounds for explicitly requested VM sizes.
+	minRequestedGuestMemoryMB = 256
+	minStatefulDiskSizeMB     = 64
 
 	cmdServerReadyTimeout    = 1 * time.Minute
 	cmdServerReadyRetryDelay = 10 * time.Millisecond
+
+	// Longest kernel command line accepted by x86_64 kernels, excluding the terminating NUL.
+	maxKernelCmdLineLength = 2047
 )
 
 type portForward struct {
@@ -124,6 +134,52 @@ type vm struct {
 	vsockPath        string
 	cid              uint32
 	statefulDiskPath string
+	resources        vmResources
+	lifetime         vmLifetime
+	// Name of the warm pool the VM is waiting in to be handed out. Empty for all other VMs.
+	warmPool string
+	// Tenant whose quota the VM counts against. Empty while the VM is in a warm pool.
+	tenant string
+	// Arbitrary key/value labels. Set when the VM is handed out and not changed afterwards.
+	labels map[string]string
+	// Closed once the VMM process has exited.
+	exited chan struct{}
+	// Set while the VM is being destroyed, its VMM exiting isn't a crash then.
+	destroying bool
+	// What to do when the VMM exits unexpectedly, one of the `crashRestartPolicy*` constants.
+	crashRestartPolicy string
+	bootConfig         vmBootConfig
+	// Last crash of the VM and how often it was restarted after crashing.
+	crash    *vmCrash
+	restarts int32
+	// Snapshot the VM was last restored from or snapshotted to.
+	lastSnapshotId string
+	// Disks hot-plugged into the VM in addition to its rootfs and stateful disk.
+	disks []*vmDisk
+	// Volume used as the stateful disk instead of one in the VM's state directory, if any.
+	rootVolume string
+	// Snapshot schedule of the VM, nil if it isn't checkpointed, and its retained checkpoints,
+	// oldest first.
+	snapshotSchedule *snapshotSchedule
+	checkpoints      []checkpoint
+	nextCheckpointAt time.Time
+	// Memory to reclaim from the guest through its balloon as set by hand, in MB.
+	balloonTargetMB int32
+	// Server's end of the VM's serial port, nil if it has none.
+	serial *serialConsole
+}
+
+// entryPoint is the process started and supervised inside the guest once it has booted.
+type entryPoint struct {
+	cmd           string
+	restartPolicy string
+}
+
+// vmResources describes the size of a VM.
+type vmResources struct {
+	vcpus              int32
+	memorySizeMB       int32
+	statefulDiskSizeMB int32
 }
 
 // calculateVCPUCount returns an appropriate number of vCPUs based on host's CPU count.
@@ -154,26 +210,13 @@ func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
 		)
 	}
 
-	var totalMemoryKB int64
 	data, err := os.ReadFile("/proc/meminfo")
 	if err != nil {
 		log.Warn("Could not determine host memory size, using default of 4096 MB")
 		return minGuestMemoryMB, nil
 	}
 
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "MemTotal:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				memKB, err := strconv.ParseInt(fields[1], 10, 64)
-				if err == nil {
-					totalMemoryKB = memKB
-					break
-				}
-			}
-		}
-	}
+	totalMemoryKB := parseHostMemoryKB(data)
 	if totalMemoryKB <= 0 {
 		return 0, fmt.Errorf("could not determine host memory size")
 	}
@@ -194,12 +237,147 @@ func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
 	return int32(suggestedMemoryKB / 1024), nil
 }
 
-func getKernelCmdLine(gatewayIP string, guestIP string) string {
-	return fmt.Sprintf(
+// parseHostMemoryKB returns the total host memory in KB from the contents of /proc/meminfo, or 0 if
+// it can't be found.
+func parseHostMemoryKB(meminfo []byte) int64 {
+	lines := strings.Split(string(meminfo), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "MemTotal:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				memKB, err := strconv.ParseInt(fields[1], 10, 64)
+				if err == nil {
+					return memKB
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// getHostMemoryMB returns the total memory of the host in MB.
+func getHostMemoryMB() (int64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read /proc/meminfo: %w", err)
+	}
+
+	totalMemoryKB := parseHostMemoryKB(data)
+	if totalMemoryKB <= 0 {
+		return 0, fmt.Errorf("could not determine host memory size")
+	}
+	return totalMemoryKB / 1024, nil
+}
+
+// getFreeDiskSpaceMB returns the space available to unprivileged users on the filesystem containing
+// `dir` in MB.
+func getFreeDiskSpaceMB(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat filesystem of %s: %w", dir, err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize) / (1024 * 1024), nil
+}
+
+// resolveVMResources returns the resources for a new VM. Explicitly requested values are validated
+// against the capacity of the host, unset ones are derived from the host and the server config.
+func (s *Server) resolveVMResources(req *serverapi.StartVMRequest) (vmResources, error) {
+	var resources vmResources
+
+	hostCPUs := int32(runtime.NumCPU())
+	if req.HasVcpus() {
+		resources.vcpus = req.GetVcpus()
+		if resources.vcpus < 1 || resources.vcpus > hostCPUs {
+			return vmResources{}, status.Errorf(
+				codes.InvalidArgument,
+				"invalid vcpus: %d, must be between 1 and the host's CPU count: %d",
+				resources.vcpus,
+				hostCPUs,
+			)
+		}
+	} else {
+		resources.vcpus = calculateVCPUCount()
+	}
+
+	if req.HasMemorySizeMB() {
+		resources.memorySizeMB = req.GetMemorySizeMB()
+		hostMemoryMB, err := getHostMemoryMB()
+		if err != nil {
+			return vmResources{}, fmt.Errorf("failed to get host memory size: %w", err)
+		}
+		if resources.memorySizeMB < minRequestedGuestMemoryMB || int64(resources.memorySizeMB) > hostMemoryMB {
+			return vmResources{}, status.Errorf(
+				codes.InvalidArgument,
+				"invalid memorySizeMB: %d, must be between %d and the host's memory: %d",
+				resources.memorySizeMB,
+				minRequestedGuestMemoryMB,
+				hostMemoryMB,
+			)
+		}
+	} else {
+		memorySizeMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage)
+		if err != nil {
+			return vmResources{}, fmt.Errorf("failed to calculate guest memory size: %w", err)
+		}
+		resources.memorySizeMB = memorySizeMB
+	}
+
+	if req.HasStatefulDiskSizeMB() {
+		resources.statefulDiskSizeMB = req.GetStatefulDiskSizeMB()
+		freeDiskSpaceMB, err := getFreeDiskSpaceMB(s.config.StateDir)
+		if err != nil {
+			return vmResources{}, fmt.Errorf("failed to get free disk space: %w", err)
+		}
+		if resources.statefulDiskSizeMB < minStatefulDiskSizeMB || int64(resources.statefulDiskSizeMB) > freeDiskSpaceMB {
+			return vmResources{}, status.Errorf(
+				codes.InvalidArgument,
+				"invalid statefulDiskSizeMB: %d, must be between %d and the free disk space: %d",
+				resources.statefulDiskSizeMB,
+				minStatefulDiskSizeMB,
+				freeDiskSpaceMB,
+			)
+		}
+	} else {
+		resources.statefulDiskSizeMB = s.config.StatefulSizeInMB
+	}
+	return resources, nil
+}
+
+// checkKernelCmdLineLength returns an error if the kernel command line of a VM with `entryPoint`
+// can be longer than the kernel accepts, which would make the guest fail to boot.
+func checkKernelCmdLineLength(gatewayIP string, entryPoint entryPoint) error {
+	// The guest IP isn't allocated yet, the longest one is assumed.
+	cmdline := getKernelCmdLine(gatewayIP, "255.255.255.255/32", entryPoint)
+	if len(cmdline) > maxKernelCmdLineLength {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"entry point too long: the kernel command line would be %d bytes, at most %d are allowed",
+			len(cmdline),
+			maxKernelCmdLineLength,
+		)
+	}
+	return nil
+}
+
+func getKernelCmdLine(gatewayIP string, guestIP string, entryPoint entryPoint) string {
+	cmdline := fmt.Sprintf(
 		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\"",
 		gatewayIP,
 		guestIP,
 	)
+	if entryPoint.cmd == "" {
+		return cmdline
+	}
+	// The entry point is encoded as it can contain quotes and spaces which the kernel command line
+	// can't represent.
+	return fmt.Sprintf(
+		"%s %s=\"%s\" %s=\"%s\"",
+		cmdline,
+		cmdserver.EntryPointCmdlineKey,
+		base64.RawURLEncoding.EncodeToString([]byte(entryPoint.cmd)),
+		cmdserver.EntryPointRestartPolicyCmdlineKey,
+		entryPoint.restartPolicy,
+	)
 }
 
 // bridgeExists checks if a bridge with the given name exists.
@@ -331,9 +509,24 @@ func (s *Server) setupPortForwardsToVM(vmIP string, guestPorts []config.PortForw
 			portForwards = append(portForwards, pf)
 		}
 	}
+	if len(portForwards) > 0 {
+		if err := addPortForwardActivityRule(vmIP); err != nil {
+			return nil, err
+		}
+	}
 	return portForwards, nil
 }
 
+// freeHostPorts returns the host ports of `portForwards` to the port allocator once their forwarding
+// rules are deleted.
+func (s *Server) freeHostPorts(portForwards []portForward, logger *log.Entry) {
+	for _, pf := range portForwards {
+		if err := s.portAllocator.FreePort(pf.hostPort); err != nil {
+			logger.WithError(err).Warnf("failed to free host port: %d", pf.hostPort)
+		}
+	}
+}
+
 func cleanupAllIPTablesRulesForIP(ip string) error {
 	log.Infof("deleting all iptables rules for IP: %s", ip)
 	// First, list all rules in the NAT table PREROUTING chain.
@@ -385,10 +578,11 @@ func cleanupAllIPTablesRulesForIP(ip string) error {
 			)
 		}
 	}
-	return finalErr
+	return errors.Join(finalErr, deletePortForwardActivityRules(ip))
 }
 
-func cleanupTapDevices() error {
+// cleanupTapDevices deletes all tap devices on the host except the ones in `keep`.
+func cleanupTapDevices(keep map[string]bool) error {
 	// List all network interfaces.
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -397,7 +591,7 @@ func cleanupTapDevices() error {
 
 	for _, iface := range interfaces {
 		// Check if interface name starts with "tap".
-		if strings.HasPrefix(iface.Name, "tap") {
+		if strings.HasPrefix(iface.Name, "tap") && !keep[iface.Name] {
 			if err := exec.Command("ip", "link", "delete", iface.Name).Run(); err != nil {
 				log.Warnf("failed to delete tap device %s: %v", iface.Name, err)
 			}
@@ -576,6 +770,10 @@ func reapProcess(process *os.Process, logger *log.Entry, timeout time.Duration)
 	go func() {
 		log.Info("waiting for VM process to exit")
 		_, err := process.Wait()
+		// VMs adopted from a previous server instance aren't our children and can't be waited on.
+		if errors.Is(err, syscall.ECHILD) {
+			err = waitForProcessExit(process.Pid, timeout)
+		}
 		done <- err
 	}()
 
@@ -596,6 +794,18 @@ func reapProcess(process *os.Process, logger *log.Entry, timeout time.Duration)
 	return fmt.Errorf("VM process was force killed after timeout")
 }
 
+// waitForProcessExit polls until the process with the given PID exits or the timeout expires.
+func waitForProcessExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for process %d to exit", pid)
+}
+
 // convertPortForward converts the port forwards from the config to the API format.
 func convertPortForward(pfs []portForward) []serverapi.PortForward {
 	result := make([]serverapi.PortForward, 0, len(pfs))
@@ -620,9 +830,25 @@ type PayloadConfig struct {
 	Initramfs *string `json:"initramfs"`
 }
 
+type CpusConfig struct {
+	BootVcpus int32 `json:"boot_vcpus"`
+}
+
+type MemoryConfig struct {
+	Size int64 `json:"size"`
+}
+
+type DiskConfig struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
 type VMConfig struct {
 	Net     *[]NetworkConfig `json:"net"`
 	Payload PayloadConfig    `json:"payload"`
+	Cpus    *CpusConfig      `json:"cpus"`
+	Memory  *MemoryConfig    `json:"memory"`
+	Disks   *[]DiskConfig    `json:"disks"`
 }
 
 func extractGuestIPFromCmdline(cmdline string) (*net.IPNet, error) {
@@ -669,6 +895,35 @@ func parseNetworkDataFromSnapshotConfig(configPath string) (string, *net.IPNet,
 	return (*config.Net)[0].Tap, guestIP, nil
 }
 
+// parseResourcesFromSnapshot returns the resources of the VM captured in the snapshot at
+// `snapshotPath`.
+func parseResourcesFromSnapshot(snapshotPath string) (vmResources, error) {
+	data, err := os.ReadFile(path.Join(snapshotPath, "config.json"))
+	if err != nil {
+		return vmResources{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config VMConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return vmResources{}, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	var resources vmResources
+	if config.Cpus != nil {
+		resources.vcpus = config.Cpus.BootVcpus
+	}
+	if config.Memory != nil {
+		resources.memorySizeMB = int32(config.Memory.Size / (1024 * 1024))
+	}
+
+	info, err := os.Stat(path.Join(snapshotPath, statefulDiskFilename))
+	if err != nil {
+		return vmResources{}, fmt.Errorf("failed to stat stateful disk: %w", err)
+	}
+	resources.statefulDiskSizeMB = int32(info.Size() / (1024 * 1024))
+	return resources, nil
+}
+
 // getIPPrefix returns the IP prefix from the given CIDR taking into account the mask.
 func getIPPrefix(cidr string) (string, error) {
 	// Parse CIDR
@@ -716,34 +971,57 @@ func createStatefulDisk(path string, sizeInMB int32) error {
 }
 
 func NewServer(config config.ServerConfig) (*Server, error) {
-	// Cleanup any existing resources.
-	if err := cleanupTapDevices(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup tap devices: %w", err)
+	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
 	}
 
-	if err := cleanupBridge(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup bridge: %w", err)
+	// VMs created by a previous server instance may have outlived it. Re-attach to the ones that
+	// are still running and clean up after the rest.
+	records, err := loadVMRegistry(config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load vm registry: %w", err)
+	}
+	liveRecords, deadRecords := partitionVMRecords(records)
+	for _, record := range deadRecords {
+		cleanupDeadVMRecord(record)
 	}
 
-	ipPrefix, err := getIPPrefix(config.BridgeSubnet)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get IP prefix: %w", err)
+	liveTapDevices := make(map[string]bool, len(liveRecords))
+	for _, record := range liveRecords {
+		liveTapDevices[record.TapDeviceName] = true
 	}
 
-	log.Infof("Cleaning up iptables rules for IP prefix: %s", ipPrefix)
-	if err := cleanupAllIPTablesRulesForIP(ipPrefix); err != nil {
-		return nil, fmt.Errorf("failed to cleanup iptables rules: %w", err)
+	// Cleanup any existing resources.
+	if err := cleanupTapDevices(liveTapDevices); err != nil {
+		return nil, fmt.Errorf("failed to cleanup tap devices: %w", err)
 	}
 
-	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
+	// The bridge and the port forwarding rules are still in use by the live VMs.
+	if len(liveRecords) == 0 {
+		if err := cleanupBridge(); err != nil {
+			return nil, fmt.Errorf("failed to cleanup bridge: %w", err)
+		}
+
+		ipPrefix, err := getIPPrefix(config.BridgeSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get IP prefix: %w", err)
+		}
+
+		log.Infof("Cleaning up iptables rules for IP prefix: %s", ipPrefix)
+		if err := cleanupAllIPTablesRulesForIP(ipPrefix); err != nil {
+			return nil, fmt.Errorf("failed to cleanup iptables rules: %w", err)
+		}
 	}
 
-	// Will be used to store snapshots.
+	// Will be used to store snapshots, or cache them if they're stored elsewhere.
 	snapshotsDir := path.Join(config.StateDir, "snapshots")
 	if err := os.MkdirAll(snapshotsDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create snapshots directory: %w", err)
 	}
+	snapshotStore, err := newSnapshotStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot store: %w", err)
+	}
 
 	ipBackupFile := fmt.Sprintf("/tmp/iptables-backup-%s.rules", time.Now().Format(time.UnixDate))
 	if err := setupBridgeAndFirewall(
@@ -773,15 +1051,60 @@ func NewServer(config config.ServerConfig) (*Server, error) {
 		return nil, fmt.Errorf("failed to create CID allocator: %w", err)
 	}
 
+	warmPools, err := newWarmPools(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create warm pools: %w", err)
+	}
+
+	volumes, err := newVolumeStore(config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume store: %w", err)
+	}
+
+	auditLog, err := newAuditLog(config.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
 	log.Infof("Server config: %+v", config)
-	return &Server{
+	s := &Server{
 		vms:           make(map[string]*vm),
 		fountain:      fountain.NewFountain(config.BridgeName),
 		ipAllocator:   ipAllocator,
 		portAllocator: portAllocator,
 		cidAllocator:  cidAllocator,
+		warmPools:     warmPools,
+		volumes:       volumes,
+		snapshotStore: snapshotStore,
+		admission:     newAdmissionController(config.Admission),
+		events:        newEventBroker(),
+		operations:    newOperations(),
+		metrics:       newServerMetrics(),
+		auditLog:      auditLog,
 		config:        config,
-	}, nil
+	}
+
+	for _, record := range liveRecords {
+		vm, err := s.adoptVM(context.Background(), record)
+		if err != nil {
+			// The VM was killed, it's dropped from the registry.
+			log.WithError(err).Errorf("failed to adopt VM: %s", record.Name)
+			continue
+		}
+		s.claimVolumes(vm)
+	}
+	if err := s.saveVMRegistry(); err != nil {
+		return nil, fmt.Errorf("failed to save vm registry: %w", err)
+	}
+	if err := s.restorePreservedVMs(context.Background()); err != nil {
+		log.WithError(err).Error("failed to restore preserved VMs")
+	}
+
+	s.startWarmPools()
+	go s.runReaper()
+	go s.runSnapshotScheduler()
+	go s.runBalloonAdjuster()
+	return s, nil
 }
 
 func (s *Server) getVMAtomic(vmName string) *vm {
@@ -798,9 +1121,14 @@ func (s *Server) getVMAtomic(vmName string) *vm {
 func (s *Server) createVM(
 	ctx context.Context,
 	vmName string,
+	tenant string,
+	labels map[string]string,
 	kernelPath string,
 	initramfsPath string,
 	rootfsPath string,
+	resources vmResources,
+	entryPoint entryPoint,
+	rootVolume string,
 	forRestore bool,
 ) (*vm, error) {
 	cleanup := cleanup.Make(func() {
@@ -818,6 +1146,15 @@ func (s *Server) createVM(
 		cleanup.Clean()
 	}()
 
+	reportProgress(ctx, "waiting for capacity")
+	if err := s.admission.admit(ctx, tenant, resources); err != nil {
+		return nil, fmt.Errorf("failed to admit VM: %w", err)
+	}
+	reportProgress(ctx, "creating VM")
+	cleanup.Add(func() {
+		s.admission.release(tenant, resources)
+	})
+
 	vmStateDir := getVmStateDirPath(s.config.StateDir, vmName)
 	err := os.MkdirAll(vmStateDir, 0755)
 	if err != nil {
@@ -834,12 +1171,17 @@ func (s *Server) createVM(
 	apiSocketPath := getVmSocketPath(vmStateDir, vmName)
 	apiClient := createApiClient(apiSocketPath)
 
-	// This will be cleaned up by the clean up function above nuking the directory.
-	logFilePath := path.Join(vmStateDir, "log")
-	logFile, err := os.Create(logFilePath)
+	// This will be cleaned up by the clean up function above nuking the directory, after being kept
+	// to debug why the VM failed to be created.
+	logFilePath := getVMLogPath(vmStateDir)
+	// The guest's serial console output is appended to the log by the server.
+	logFile, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log file: %w", err)
 	}
+	cleanup.Add(func() {
+		s.retainVMLog(vmName, logFilePath)
+	})
 
 	cmd := exec.Command(s.config.ChvBinPath, "--api-socket", apiSocketPath)
 	cmd.Stdout = logFile
@@ -930,38 +1272,60 @@ func (s *Server) createVM(
 			}
 		})
 
-		statefulDiskPath = path.Join(vmStateDir, statefulDiskFilename)
-		err = createStatefulDisk(statefulDiskPath, s.config.StatefulSizeInMB)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create stateful disk: %w", err)
-		}
-		cleanup.Add(func() {
-			if err := os.Remove(statefulDiskPath); err != nil {
-				log.WithError(err).Errorf("failed to remove stateful disk: %s", statefulDiskPath)
+		if rootVolume != "" {
+			statefulDiskPath, err = s.volumes.attach(rootVolume, vmName, volumeAttachModeRoot, false)
+			if err != nil {
+				return nil, err
 			}
-		})
+			cleanup.Add(func() {
+				s.volumes.detach(rootVolume, vmName)
+			})
+		} else {
+			statefulDiskPath = path.Join(vmStateDir, statefulDiskFilename)
+			err = createStatefulDisk(statefulDiskPath, resources.statefulDiskSizeMB)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create stateful disk: %w", err)
+			}
+			cleanup.Add(func() {
+				if err := os.Remove(statefulDiskPath); err != nil {
+					log.WithError(err).Errorf("failed to remove stateful disk: %s", statefulDiskPath)
+				}
+			})
+		}
 
-		vcpus := calculateVCPUCount()
+		vcpus := resources.vcpus
 		// Match virtio-blk queues to vCPUs.
 		numBlockDeviceQueues := vcpus
-		memorySizeMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage)
-		if err != nil {
-			return nil, fmt.Errorf("failed to calculate guest memory size: %w", err)
+		memorySizeMB := resources.memorySizeMB
+		// Leave room to grow the VM while it's running.
+		maxVcpus, hotplugSizeMB := s.hotplugLimits(resources)
+		memoryConfig := chvapi.NewMemoryConfig(int64(memorySizeMB) * 1024 * 1024)
+		if hotplugSizeMB > 0 {
+			memoryConfig.SetHotplugSize(int64(hotplugSizeMB) * 1024 * 1024)
 		}
-		log.Infof("Calculated vCPUs: %d, memory size: %d MB", vcpus, memorySizeMB)
+		log.Infof(
+			"vCPUs: %d (max %d), memory size: %d MB (hotplug %d MB)",
+			vcpus,
+			maxVcpus,
+			memorySizeMB,
+			hotplugSizeMB,
+		)
+		serialConfig := chvapi.NewConsoleConfig(serialPortMode)
+		serialConfig.SetSocket(getSerialSocketPath(vmStateDir))
 		vmConfig := chvapi.VmConfig{
 			Payload: chvapi.PayloadConfig{
 				Kernel:    String(kernelPath),
-				Cmdline:   String(getKernelCmdLine(s.config.BridgeIP, guestIP.String())),
+				Cmdline:   String(getKernelCmdLine(s.config.BridgeIP, guestIP.String(), entryPoint)),
 				Initramfs: String(initramfsPath),
 			},
 			Disks: []chvapi.DiskConfig{
 				{Path: rootfsPath, Readonly: Bool(true), NumQueues: &numBlockDeviceQueues},
 				{Path: statefulDiskPath, NumQueues: &numBlockDeviceQueues},
 			},
-			Cpus:    &chvapi.CpusConfig{BootVcpus: vcpus, MaxVcpus: vcpus},
-			Memory:  &chvapi.MemoryConfig{Size: int64(memorySizeMB) * 1024 * 1024},
-			Serial:  chvapi.NewConsoleConfig(serialPortMode),
+			Cpus:    &chvapi.CpusConfig{BootVcpus: vcpus, MaxVcpus: maxVcpus},
+			Memory:  memoryConfig,
+			Balloon: newBalloonConfig(),
+			Serial:  serialConfig,
 			Console: chvapi.NewConsoleConfig(consolePortMode),
 			Net: []chvapi.NetConfig{
 				{Tap: String(tapDevice.Name), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)},
@@ -1015,12 +1379,31 @@ func (s *Server) createVM(
 		vsockPath:        vsockPath,
 		cid:              cid,
 		statefulDiskPath: statefulDiskPath,
+		resources:        resources,
+		tenant:           tenant,
+		labels:           labels,
+		exited:           make(chan struct{}),
+		rootVolume:       rootVolume,
+	}
+	if !forRestore {
+		vm.bootConfig = vmBootConfig{
+			kernelPath:    kernelPath,
+			initramfsPath: initramfsPath,
+			rootfsPath:    rootfsPath,
+			entryPoint:    entryPoint,
+		}
 	}
 	log.Infof("Successfully created VM: %s", vmName)
 
 	s.lock.Lock()
 	s.vms[vmName] = vm
 	s.lock.Unlock()
+	go s.watchVM(vm)
+	s.persistVMRegistry()
+	// Restored VMs get a restored event once they are running.
+	if !forRestore {
+		s.publishEvent(EventTypeCreated, vm, nil)
+	}
 
 	cleanup.Release()
 	return vm, nil
@@ -1032,6 +1415,13 @@ func (v *vm) boot(
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
+	// A socket left behind by a previous boot of the VM would keep the VMM from creating its serial
+	// port.
+	serialSocketPath := getSerialSocketPath(v.stateDirPath)
+	if err := os.Remove(serialSocketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale serial socket: %w", err)
+	}
+
 	resp, err := v.apiClient.DefaultAPI.BootVM(ctx).Execute()
 	if err != nil {
 		return fmt.Errorf("failed to boot VM resp.Body: %v: %w", resp.Body, err)
@@ -1042,6 +1432,7 @@ func (v *vm) boot(
 
 	log.Infof("Successfully booted VM: %s", v.name)
 	v.status = vmStatusRunning
+	v.connectSerialLocked(ctx)
 	return nil
 }
 
@@ -1088,6 +1479,7 @@ func (v *vm) restore(
 	if resp.StatusCode != 204 {
 		return fmt.Errorf("failed to restore from snapshot. bad status: %v", resp)
 	}
+	v.connectSerialLocked(ctx)
 	return nil
 }
 
@@ -1119,6 +1511,8 @@ func (v *vm) destroy(
 		return status.Error(codes.Internal, fmt.Sprintf("failed to stop VM. bad status: %v", resp))
 	}
 
+	// The VMM exiting from here on isn't a crash.
+	v.destroying = true
 	shutdownVMMReq := v.apiClient.DefaultAPI.ShutdownVMM(ctx)
 	resp, err = shutdownVMMReq.Execute()
 	if err != nil {
@@ -1129,10 +1523,15 @@ func (v *vm) destroy(
 		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM. bad status: %v", resp))
 	}
 
-	// At this point `v.process` is guaranteed to be non-nil.
-	err = reapProcess(v.process, logger, reapVmTimeout)
-	if err != nil {
-		logger.Warnf("failed to reap VM process: %v", err)
+	// At this point `v.process` is guaranteed to be non-nil. It's waited on by `watchVM`.
+	select {
+	case <-v.exited:
+		logger.Info("VM process exited")
+	case <-time.After(reapVmTimeout):
+		logger.Warn("timeout waiting for VM process to exit, killing it")
+		if err := v.process.Kill(); err != nil {
+			logger.Warnf("failed to kill VM process: %v", err)
+		}
 	}
 
 	// This should be done at the very end in case we need to communicate with the VM during cleanup.
@@ -1176,36 +1575,128 @@ type Server struct {
 	ipAllocator   *ipallocator.IPAllocator
 	portAllocator *portallocator.PortAllocator
 	cidAllocator  *cidallocator.CIDAllocator
-	config        config.ServerConfig
+	warmPools     *warmPools
+	volumes       *volumeStore
+	snapshotStore SnapshotStore
+	admission     *admissionController
+	events        *eventBroker
+	operations    *operations
+	metrics       *serverMetrics
+	// Audit log of API calls and guest commands, nil if disabled.
+	auditLog *auditLog
+	config   config.ServerConfig
+	// Serializes writes of the on-disk VM registry.
+	registryLock sync.Mutex
+	// Serializes fetches of snapshots from `snapshotStore`.
+	snapshotFetchLock sync.Mutex
+	// Whether VMs are preserved on shutdown, which volumes and hot-plugged disks prevent.
+	preserveVMs bool
 }
 
 func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	start := time.Now()
 	vmName := req.GetVmName()
 	if vmName == "" {
 		return nil, fmt.Errorf("vmName is required")
 	}
+	if isWarmPoolVMName(vmName) {
+		return nil, status.Errorf(codes.InvalidArgument, "vmName can't start with: %s", warmPoolVMNamePrefix)
+	}
 	logger := log.WithField("vmName", vmName)
 
-	if snapshotId := req.GetSnapshotId(); snapshotId != "" {
-		logger.WithField("snapshotId", snapshotId).Infof("Restoring VM")
-		vm, err := s.restoreVM(ctx, vmName, snapshotId)
+	tenant := s.admission.tenantOf(callerFromContext(ctx))
+
+	ttl, idleTimeout, err := parseVMLifetime(req)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := req.GetLabels()
+	if err := validateLabels(labels); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	crashRestartPolicy := req.GetCrashRestartPolicy()
+	if crashRestartPolicy != "" && !isValidCrashRestartPolicy(crashRestartPolicy) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid crash restart policy: %s", crashRestartPolicy)
+	}
+	var schedule *snapshotSchedule
+	if req.HasSnapshotSchedule() {
+		requestedSchedule := req.GetSnapshotSchedule()
+		schedule, err = parseSnapshotSchedule(&requestedSchedule)
 		if err != nil {
-			return nil, fmt.Errorf("failed to restore VM from snapshot: %w", err)
+			return nil, err
+		}
+	}
+	// An existing VM being booted again keeps its lifetime unless a new one is requested.
+	setLifetime := req.HasTtlSeconds() || req.HasIdleTimeoutSeconds()
+
+	rootVolume := req.GetRootVolume()
+	if rootVolume != "" && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "rootVolume can't be used when restoring from a snapshot")
+	}
+	// Snapshots don't capture the contents of volumes.
+	if rootVolume != "" || len(req.GetVolumes()) > 0 {
+		if schedule != nil {
+			return nil, status.Error(codes.InvalidArgument, "VMs with volumes can't have a snapshot schedule")
+		}
+		if s.preserveVMs {
+			return nil, status.Error(codes.FailedPrecondition, "VMs with volumes can't be preserved on shutdown")
 		}
+	}
 
-		// Only mark the VM as ready when we can do things inside the sandbox via the API.
-		logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-		if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
-			logger.WithError(err).Warnf("command server not ready")
+	if snapshotId := req.GetSnapshotId(); snapshotId != "" {
+		// VMs in pools of snapshots are restored with a fresh network, they can't be handed out to
+		// requests expecting the IP of the snapshotted VM.
+		var vm *vm
+		if req.GetFreshNetwork() {
+			vm = s.claimWarmPoolVM(vmName, tenant, labels, warmPoolKey{snapshotId: snapshotId})
+		}
+		if vm == nil {
+			logger.WithField("snapshotId", snapshotId).Infof("Restoring VM")
+			vm, err = s.restoreVM(ctx, vmName, tenant, labels, snapshotId, req.GetFreshNetwork())
+			if err != nil {
+				return nil, fmt.Errorf("failed to restore VM from snapshot: %w", err)
+			}
+
+			// Only mark the VM as ready when we can do things inside the sandbox via the API.
+			logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
+			reportProgress(ctx, "waiting for VM to be ready")
+			if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
+				logger.WithError(err).Warnf("command server not ready")
+			}
+		}
+		if err := s.attachVolumes(ctx, vm, req.GetVolumes()); err != nil {
+			if err := s.destroyVM(context.WithoutCancel(ctx), vmName); err != nil {
+				logger.WithError(err).Error("failed to destroy VM after failing to attach volumes")
+			}
+			return nil, err
 		}
 		logger.Infof("VM ready")
+		if setLifetime {
+			vm.lifetime.set(ttl, idleTimeout)
+		}
+		vm.setCrashRestartPolicy(crashRestartPolicy)
+		if req.HasSnapshotSchedule() {
+			if err := vm.setSnapshotSchedule(schedule); err != nil {
+				logger.WithError(err).Error("failed to set snapshot schedule")
+			}
+		}
+		s.persistVMRegistry()
+		s.publishEvent(EventTypeRestored, vm, map[string]string{"snapshotId": snapshotId})
+		s.metrics.startVMDuration.ObserveSince(start)
 
 		return &serverapi.StartVMResponse{
-			VmName:        serverapi.PtrString(vmName),
-			Ip:            serverapi.PtrString(vm.ip.String()),
-			Status:        serverapi.PtrString(vm.status.String()),
-			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-			PortForwards:  convertPortForward(vm.portForwards),
+			VmName:             serverapi.PtrString(vmName),
+			Ip:                 serverapi.PtrString(vm.ip.String()),
+			Status:             serverapi.PtrString(vm.status.String()),
+			TapDeviceName:      serverapi.PtrString(vm.tapDevice.Name),
+			PortForwards:       convertPortForward(vm.portForwards),
+			Vcpus:              serverapi.PtrInt32(vm.resources.vcpus),
+			MemorySizeMB:       serverapi.PtrInt32(vm.resources.memorySizeMB),
+			StatefulDiskSizeMB: serverapi.PtrInt32(vm.resources.statefulDiskSizeMB),
+			Lifetime:           vm.lifetime.toAPI(),
+			Labels:             labelsToAPI(vm.labels),
 		}, nil
 	}
 
@@ -1227,12 +1718,31 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 		initramfsPath = s.config.InitramfsPath
 	}
 
+	warmPoolKey := warmPoolKey{
+		kernelPath:    kernelPath,
+		initramfsPath: initramfsPath,
+		rootfsPath:    rootfsPath,
+	}
+
 	vm := s.getVMAtomic(vmName)
 	if vm != nil {
+		if rootVolume != "" || len(req.GetVolumes()) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "volumes can only be attached to new VMs, vm exists: %s", vmName)
+		}
+		if schedule != nil {
+			if err := vm.checkNoDisks(); err != nil {
+				return nil, err
+			}
+		}
+		if err := vm.checkNotCrashed(); err != nil {
+			return nil, err
+		}
 		err := vm.boot(ctx)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to boot existing VM: %v", err)
 		}
+	} else if vm = s.startVMFromWarmPool(vmName, tenant, labels, req, warmPoolKey); vm != nil {
+		logger.Info("Using VM from warm pool")
 	} else {
 		cleanup := cleanup.Make(func() {
 			logger.Info("start VM clean up done")
@@ -1242,8 +1752,40 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 			cleanup.Clean()
 		}()
 
-		var err error
-		vm, err = s.createVM(ctx, vmName, kernelPath, initramfsPath, rootfsPath, false)
+		resources, err := s.resolveVMResources(req)
+		if err != nil {
+			logger.Errorf("invalid VM resources: %v", err)
+			return nil, err
+		}
+
+		restartPolicy := cmdserver.RestartPolicyNever
+		if req.HasEntryPointRestartPolicy() {
+			restartPolicy = req.GetEntryPointRestartPolicy()
+			if !cmdserver.IsValidRestartPolicy(restartPolicy) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid entry point restart policy: %s", restartPolicy)
+			}
+		}
+		entryPoint := entryPoint{
+			cmd:           req.GetEntryPoint(),
+			restartPolicy: restartPolicy,
+		}
+		if err := checkKernelCmdLineLength(s.config.BridgeIP, entryPoint); err != nil {
+			return nil, err
+		}
+
+		vm, err = s.createVM(
+			ctx,
+			vmName,
+			tenant,
+			labels,
+			kernelPath,
+			initramfsPath,
+			rootfsPath,
+			resources,
+			entryPoint,
+			rootVolume,
+			false,
+		)
 		if err != nil {
 			logger.Errorf("failed to create VM: %v", err)
 			return nil, err
@@ -1251,7 +1793,7 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 
 		cleanup.Add(func() {
 			logger.Info("shutting down VM")
-			resp, err := vm.apiClient.DefaultAPI.ShutdownVM(ctx).Execute()
+			resp, err := vm.apiClient.DefaultAPI.ShutdownVM(context.WithoutCancel(ctx)).Execute()
 			if err != nil {
 				logger.WithError(err).Errorf("failed to shutdown VM: %v", err)
 			}
@@ -1261,6 +1803,7 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 			}
 		})
 
+		reportProgress(ctx, "booting VM")
 		err = vm.boot(ctx)
 		if err != nil {
 			logger.Errorf("failed to boot VM: %v", err)
@@ -1271,18 +1814,44 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 
 	// Only mark the VM as ready when we can do things inside the sandbox via the API.
 	logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-	err := waitForCmdServerReady(ctx, vm.ip.IP.String())
+	reportProgress(ctx, "waiting for VM to be ready")
+	err = waitForCmdServerReady(ctx, vm.ip.IP.String())
 	if err != nil {
 		logger.WithError(err).Warnf("command server not ready")
 	}
+	// Existing VMs were refused volumes above, so they're only attached to new VMs.
+	if err := s.attachVolumes(ctx, vm, req.GetVolumes()); err != nil {
+		if err := s.destroyVM(context.WithoutCancel(ctx), vmName); err != nil {
+			logger.WithError(err).Error("failed to destroy VM after failing to attach volumes")
+		}
+		return nil, err
+	}
 	logger.Infof("VM ready")
+	if setLifetime {
+		vm.lifetime.set(ttl, idleTimeout)
+	}
+	vm.setCrashRestartPolicy(crashRestartPolicy)
+	// Disks were checked above, they can only have been attached since.
+	if req.HasSnapshotSchedule() {
+		if err := vm.setSnapshotSchedule(schedule); err != nil {
+			logger.WithError(err).Error("failed to set snapshot schedule")
+		}
+	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeBooted, vm, nil)
+	s.metrics.startVMDuration.ObserveSince(start)
 
 	return &serverapi.StartVMResponse{
-		VmName:        serverapi.PtrString(vmName),
-		Ip:            serverapi.PtrString(vm.ip.String()),
-		Status:        serverapi.PtrString(vm.status.String()),
-		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-		PortForwards:  convertPortForward(vm.portForwards),
+		VmName:             serverapi.PtrString(vmName),
+		Ip:                 serverapi.PtrString(vm.ip.String()),
+		Status:             serverapi.PtrString(vm.status.String()),
+		TapDeviceName:      serverapi.PtrString(vm.tapDevice.Name),
+		PortForwards:       convertPortForward(vm.portForwards),
+		Vcpus:              serverapi.PtrInt32(vm.resources.vcpus),
+		MemorySizeMB:       serverapi.PtrInt32(vm.resources.memorySizeMB),
+		StatefulDiskSizeMB: serverapi.PtrInt32(vm.resources.statefulDiskSizeMB),
+		Lifetime:           vm.lifetime.toAPI(),
+		Labels:             labelsToAPI(vm.labels),
 	}, nil
 }
 
@@ -1308,6 +1877,8 @@ func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*servera
 
 	vm.status = vmStatusStopped
 	logger.Infof("VM stopped")
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeStopped, vm, nil)
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
@@ -1321,29 +1892,44 @@ func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 		return fmt.Errorf("vm %s not found", vmName)
 	}
 
-	err := vm.destroy(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to destroy vm: %s: %w", vmName, err)
-	}
+	// Kept before the VM is destroyed, output written meanwhile ends up in the kept log if linked.
+	s.retainVMLog(vmName, getVMLogPath(vm.stateDirPath))
+	if vm.checkNotCrashed() != nil {
+		// The VMM is gone and the network of the VM was released when it crashed.
+		if err := os.RemoveAll(vm.stateDirPath); err != nil {
+			logger.WithError(err).Warnf("failed to delete directory: %s", vm.stateDirPath)
+		}
+	} else {
+		err := vm.destroy(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to destroy vm: %s: %w", vmName, err)
+		}
 
-	err = s.fountain.DestroyTapDevice(vm.tapDevice)
-	if err != nil {
-		return fmt.Errorf("failed to destroy the tap device for vm: %s: %w", vmName, err)
-	}
+		err = s.fountain.DestroyTapDevice(vm.tapDevice)
+		if err != nil {
+			return fmt.Errorf("failed to destroy the tap device for vm: %s: %w", vmName, err)
+		}
 
-	err = s.ipAllocator.FreeIP(vm.ip.IP)
-	if err != nil {
-		return fmt.Errorf("failed to free IP: %s: %w", vm.ip.String(), err)
-	}
+		err = s.ipAllocator.FreeIP(vm.ip.IP)
+		if err != nil {
+			return fmt.Errorf("failed to free IP: %s: %w", vm.ip.String(), err)
+		}
 
-	err = s.cidAllocator.FreeCID(vm.cid)
-	if err != nil {
-		log.WithError(err).Errorf("failed to free CID: %d", vm.cid)
+		err = s.cidAllocator.FreeCID(vm.cid)
+		if err != nil {
+			log.WithError(err).Errorf("failed to free CID: %d", vm.cid)
+		}
+		s.freeHostPorts(vm.portForwards, logger)
 	}
 
 	s.lock.Lock()
 	delete(s.vms, vmName)
 	s.lock.Unlock()
+	s.warmPools.remove(vm)
+	s.admission.release(vm.tenant, vm.resources)
+	s.volumes.detachVM(vmName)
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeDestroyed, vm, nil)
 	return nil
 }
 
@@ -1359,25 +1945,36 @@ func (s *Server) DestroyVM(ctx context.Context, req *serverapi.VMRequest) (*serv
 	}, nil
 }
 
-func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsResponse, error) {
-	log.Infof("received request to destroy all VMs")
+// DestroyAllVMs destroys all VMs whose labels match `selector`. VMs in warm pools are only destroyed
+// along with everything else when `selector` is empty.
+func (s *Server) DestroyAllVMs(ctx context.Context, selector LabelSelector) (*serverapi.DestroyAllVMsResponse, error) {
+	log.WithField("selector", selector).Infof("received request to destroy all VMs")
 
 	// `destroyVM` grabs locks inside it. Hence easiest to just capture VM names before. If state is
 	// changed concurrently before destroying then we will return an error as expected. However,
 	// state will never be corrupted.
 	s.lock.RLock()
 	vmNames := make([]string, 0, len(s.vms))
-	for name := range s.vms {
+	for name, vm := range s.vms {
+		if len(selector) > 0 {
+			_, labels := vm.nameAndLabels()
+			if isWarmPoolVMName(name) || !selector.Matches(labels) {
+				continue
+			}
+		}
 		vmNames = append(vmNames, name)
 	}
 	s.lock.RUnlock()
 
 	var finalErr error
+	destroyedVMNames := make([]string, 0, len(vmNames))
 	for _, vmName := range vmNames {
 		// Each invocation grabs the same lock on `s`. No point spawning a goroutine for each VM.
 		err := s.destroyVM(ctx, vmName)
 		if err != nil {
 			log.Warnf("failed to destroy and clean up vm: %s", vmName)
+		} else {
+			destroyedVMNames = append(destroyedVMNames, vmName)
 		}
 		finalErr = errors.Join(finalErr, err)
 	}
@@ -1386,12 +1983,15 @@ func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsRes
 		return nil, status.Errorf(codes.Internal, "failed to destroy all VMs: %v", finalErr)
 	}
 
+	sort.Strings(destroyedVMNames)
 	return &serverapi.DestroyAllVMsResponse{
 		Success: serverapi.PtrBool(true),
+		VmNames: destroyedVMNames,
 	}, nil
 }
 
-func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse, error) {
+// ListAllVMs lists all VMs whose labels match `selector`.
+func (s *Server) ListAllVMs(ctx context.Context, selector LabelSelector) (*serverapi.ListAllVMsResponse, error) {
 	resp := &serverapi.ListAllVMsResponse{}
 	var vms []serverapi.ListAllVMsResponseVmsInner
 
@@ -1399,17 +1999,32 @@ func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse,
 	defer s.lock.RUnlock()
 
 	for _, vm := range s.vms {
+		vmName, labels := vm.nameAndLabels()
+		// VMs in warm pools aren't handed out yet.
+		if isWarmPoolVMName(vmName) {
+			continue
+		}
+		if !selector.Matches(labels) {
+			continue
+		}
+
 		var ipString string
 		if vm.ip != nil {
 			ipString = vm.ip.String()
 		}
 
 		vmInfo := serverapi.ListAllVMsResponseVmsInner{
-			VmName:        serverapi.PtrString(vm.name),
-			Ip:            serverapi.PtrString(ipString),
-			Status:        serverapi.PtrString(vm.status.String()),
-			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-			PortForwards:  convertPortForward(vm.portForwards),
+			VmName:             serverapi.PtrString(vmName),
+			Ip:                 serverapi.PtrString(ipString),
+			Status:             serverapi.PtrString(vm.status.String()),
+			TapDeviceName:      serverapi.PtrString(vm.tapDevice.Name),
+			PortForwards:       convertPortForward(vm.portForwards),
+			Vcpus:              serverapi.PtrInt32(vm.resources.vcpus),
+			MemorySizeMB:       serverapi.PtrInt32(vm.resources.memorySizeMB),
+			StatefulDiskSizeMB: serverapi.PtrInt32(vm.resources.statefulDiskSizeMB),
+			Lifetime:           vm.lifetime.toAPI(),
+			Labels:             labelsToAPI(labels),
+			Crash:              vm.crashToAPI(),
 		}
 		vms = append(vms, vmInfo)
 	}
@@ -1427,13 +2042,22 @@ func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMRe
 	if vm.ip != nil {
 		ipString = vm.ip.String()
 	}
+	name, labels := vm.nameAndLabels()
 
 	return &serverapi.ListVMResponse{
-		VmName:        serverapi.PtrString(vm.name),
-		Ip:            serverapi.PtrString(ipString),
-		Status:        serverapi.PtrString(vm.status.String()),
-		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-		PortForwards:  convertPortForward(vm.portForwards),
+		VmName:             serverapi.PtrString(name),
+		Ip:                 serverapi.PtrString(ipString),
+		Status:             serverapi.PtrString(vm.status.String()),
+		TapDeviceName:      serverapi.PtrString(vm.tapDevice.Name),
+		PortForwards:       convertPortForward(vm.portForwards),
+		Vcpus:              serverapi.PtrInt32(vm.resources.vcpus),
+		MemorySizeMB:       serverapi.PtrInt32(vm.resources.memorySizeMB),
+		StatefulDiskSizeMB: serverapi.PtrInt32(vm.resources.statefulDiskSizeMB),
+		Lifetime:           vm.lifetime.toAPI(),
+		Labels:             labelsToAPI(labels),
+		Crash:              vm.crashToAPI(),
+		Disks:              vm.disksToAPI(),
+		Memory:             s.memoryToAPI(ctx, vm),
 	}, nil
 }
 
@@ -1441,15 +2065,54 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to snapshot VM with ID: %s", snapshotId)
 
+	vm, err := s.snapshotVMToDir(ctx, vmName, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stored once the VM runs again so that the upload doesn't prolong the pause. The local copy is
+	// kept as a cache.
+	reportProgress(ctx, "storing snapshot")
+	if err := s.snapshotStore.Put(ctx, snapshotId, s.getSnapshotPath(snapshotId)); err != nil {
+		logger.WithError(err).Error("failed to store snapshot")
+		if err := os.RemoveAll(s.getSnapshotPath(snapshotId)); err != nil {
+			logger.WithError(err).Error("failed to clean up snapshot directory")
+		}
+		return nil, fmt.Errorf("failed to store snapshot: %w", err)
+	}
+
+	vm.lock.Lock()
+	vm.lastSnapshotId = snapshotId
+	vm.lock.Unlock()
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeSnapshotted, vm, map[string]string{"snapshotId": snapshotId})
+	return &serverapi.VMSnapshotResponse{
+		SnapshotId: serverapi.PtrString(snapshotId),
+	}, nil
+}
+
+// snapshotVMToDir snapshots the VM `vmName` into its directory in the local snapshots directory,
+// pausing it meanwhile.
+func (s *Server) snapshotVMToDir(ctx context.Context, vmName string, snapshotId string) (*vm, error) {
+	start := time.Now()
+	logger := log.WithField("vmName", vmName)
+
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
+	if err := vm.checkNoDisks(); err != nil {
+		return nil, err
+	}
 
 	snapshotsDir := path.Join(s.config.StateDir, "snapshots")
 	outputDir := path.Join(snapshotsDir, snapshotId)
-	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
-		logger.WithField("snapshotId", snapshotId).Error("snapshot directory already exists")
+	exists, err := s.snapshotExists(ctx, snapshotId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up snapshot: %w", err)
+	}
+	if exists {
+		logger.WithField("snapshotId", snapshotId).Error("snapshot already exists")
 		return nil, fmt.Errorf("snapshot with ID %s already exists", snapshotId)
 	}
 
@@ -1468,6 +2131,7 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 	}()
 
 	// Pause the VM first as this is a prerequisite for taking a snapshot as per the CHV API spec.
+	reportProgress(ctx, "pausing VM")
 	pauseReq := vm.apiClient.DefaultAPI.PauseVM(ctx)
 	resp, err := pauseReq.Execute()
 	if err != nil {
@@ -1479,9 +2143,9 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 	logger.Info("VM paused successfully")
 	vm.status = vmStatusPaused
 
-	// Ensure we resume the VM even if snapshot fails.
+	// Ensure we resume the VM even if snapshot fails, including when `ctx` was cancelled.
 	defer func() {
-		resumeReq := vm.apiClient.DefaultAPI.ResumeVM(ctx)
+		resumeReq := vm.apiClient.DefaultAPI.ResumeVM(context.WithoutCancel(ctx))
 		resp, err := resumeReq.Execute()
 		if err != nil {
 			logger.Errorf("failed to resume VM: %v", err)
@@ -1495,13 +2159,15 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		vm.status = vmStatusRunning
 	}()
 
-	// Copy the stateful disk to the snapshot directory; since VMM snapshot doesn't save this.
+	// Copy the stateful disk to the snapshot directory; since VMM snapshot doesn't save this. The VM
+	// is paused meanwhile, so the copy is a reflink or skips the holes of the sparse disk.
 	statefulDiskDest := path.Join(outputDir, statefulDiskFilename)
 	logger.WithFields(log.Fields{
 		"source":      vm.statefulDiskPath,
 		"destination": statefulDiskDest,
 	}).Info("copying stateful disk to snapshot directory")
-	err = copyFile(vm.statefulDiskPath, statefulDiskDest)
+	reportProgress(ctx, "copying stateful disk")
+	err = cloneDiskFile(vm.statefulDiskPath, statefulDiskDest)
 	if err != nil {
 		logger.WithError(err).Error("failed to copy stateful disk")
 		return nil, fmt.Errorf("failed to copy stateful disk to snapshot directory: %w", err)
@@ -1520,12 +2186,25 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		return nil, fmt.Errorf("failed to write CID to file: %w", err)
 	}
 
+	// Store the labels of the VM so that VMs restored from the snapshot get them too.
+	_, labels := vm.nameAndLabels()
+	if err := writeSnapshotLabels(outputDir, labels); err != nil {
+		logger.WithError(err).Error("failed to write labels to file")
+		return nil, fmt.Errorf("failed to write labels to file: %w", err)
+	}
+
+	if err := writeSnapshotMetadata(outputDir, snapshotMetadata{VmName: vmName, CreatedAt: time.Now()}); err != nil {
+		logger.WithError(err).Error("failed to write snapshot metadata")
+		return nil, fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+
 	// The API expects a "file://" URL.
 	outputUrl := fmt.Sprintf("file://%s", outputDir)
 	snapshotConfig := chvapi.VmSnapshotConfig{
 		DestinationUrl: &outputUrl,
 	}
 	logger.WithField("destination", outputDir).Info("initiating VM snapshot")
+	reportProgress(ctx, "snapshotting VM")
 
 	snapshotReq := vm.apiClient.DefaultAPI.VmSnapshotPut(ctx)
 	snapshotReq = snapshotReq.VmSnapshotConfig(snapshotConfig)
@@ -1547,28 +2226,38 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		"destination": outputDir,
 		"statusCode":  resp.StatusCode,
 	}).Info("VM snapshot created successfully")
-	return &serverapi.VMSnapshotResponse{
-		SnapshotId: serverapi.PtrString(snapshotId),
-	}, nil
+	s.metrics.snapshotDuration.ObserveSince(start)
+	return vm, nil
 }
 
+// restoreVM creates a VM from the snapshot `snapshotId`. With `freshNetwork` the VM gets a new tap
+// device, IP and CID instead of the ones of the snapshotted VM.
 func (s *Server) restoreVM(
 	ctx context.Context,
 	vmName string,
+	tenant string,
+	labels map[string]string,
 	snapshotId string,
+	freshNetwork bool,
 ) (*vm, error) {
-	// Construct the snapshot path from the snapshot ID
-	snapshotPath := path.Join(s.config.StateDir, "snapshots", snapshotId)
-
-	// Check if the snapshot directory exists
-	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("snapshot with ID %s does not exist", snapshotId)
+	start := time.Now()
+	// Fetch the snapshot from the snapshot store unless it's cached.
+	snapshotPath, err := s.fetchSnapshot(ctx, snapshotId)
+	if err != nil {
+		return nil, err
 	}
 	logger := log.WithFields(log.Fields{
 		"vmName":       vmName,
 		"snapshotPath": snapshotPath,
 	})
 	logger.Info("received request to restore VM from snapshot")
+	// Until the VM is created its network is released here, then by destroying the VM.
+	networkCleanup := cleanup.Make(func() {
+		logger.Info("released network of VM")
+	})
+	defer func() {
+		networkCleanup.Clean()
+	}()
 	cleanup := cleanup.Make(func() {
 		logger.Info("restore VM clean up done")
 	})
@@ -1577,42 +2266,90 @@ func (s *Server) restoreVM(
 		cleanup.Clean()
 	}()
 
-	oldtapdeviceName, guestIP, err := parseNetworkDataFromSnapshotConfig(snapshotPath + "/config.json")
+	oldtapdeviceName, snapshotIP, err := parseNetworkDataFromSnapshotConfig(snapshotPath + "/config.json")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tap device from config: %w", err)
 	}
-	oldTapDeviceID, err := parseTapDeviceId(oldtapdeviceName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse tap device ID: %w", err)
-	}
 	logger.WithFields(log.Fields{
 		"oldTapDevice": oldtapdeviceName,
-		"guestIP":      guestIP.IP.String(),
+		"guestIP":      snapshotIP.IP.String(),
 	}).Info("parse network data from snapshot config")
 
-	err = s.ipAllocator.ClaimIP(guestIP.IP)
+	var tapDevice *fountain.TapDevice
+	var guestIP *net.IPNet
+	if freshNetwork {
+		guestIP, err = s.ipAllocator.AllocateIP()
+		if err != nil {
+			return nil, fmt.Errorf("error allocating guest ip: %w", err)
+		}
+		networkCleanup.Add(func() {
+			s.ipAllocator.FreeIP(guestIP.IP)
+		})
+
+		tapDevice, err = s.fountain.CreateTapDevice(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tap device: %w", err)
+		}
+	} else {
+		oldTapDeviceID, err := parseTapDeviceId(oldtapdeviceName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tap device ID: %w", err)
+		}
+
+		guestIP = snapshotIP
+		err = s.ipAllocator.ClaimIP(guestIP.IP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim IP: %w", err)
+		}
+		networkCleanup.Add(func() {
+			s.ipAllocator.FreeIP(guestIP.IP)
+		})
+
+		tapDevice, err = s.fountain.CreateTapDevice(&oldTapDeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tap device: %w", err)
+		}
+	}
+	networkCleanup.Add(func() {
+		if err := s.fountain.DestroyTapDevice(tapDevice); err != nil {
+			logger.WithError(err).Errorf("failed to delete tap device: %s", tapDevice.Name)
+		}
+	})
+
+	resources, err := parseResourcesFromSnapshot(snapshotPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to claim IP: %w", err)
+		return nil, fmt.Errorf("failed to get resources from snapshot: %w", err)
 	}
 
-	oldTapDevice, err := s.fountain.CreateTapDevice(&oldTapDeviceID)
+	snapshotLabels, err := readSnapshotLabels(snapshotPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create tap device: %w", err)
+		return nil, fmt.Errorf("failed to get labels from snapshot: %w", err)
 	}
-	cleanup.Add(func() {
-		logger.Errorf("TODO: destroy tap device: %s", oldTapDevice.Name)
-	})
 
-	vm, err := s.createVM(ctx, vmName, "", "", "", true)
+	vm, err := s.createVM(
+		ctx,
+		vmName,
+		tenant,
+		mergeLabels(snapshotLabels, labels),
+		"",
+		"",
+		"",
+		resources,
+		entryPoint{},
+		"",
+		true,
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create VM for restore: %w", err)
 	}
 	// From this point on we need to clean up the VM if the restore fails.
+	networkCleanup.Release()
 	cleanup.Add(func() {
-		err := s.destroyVM(ctx, vmName)
+		// The restore may have failed because `ctx` was cancelled, the VM must be destroyed anyway.
+		err := s.destroyVM(context.WithoutCancel(ctx), vmName)
 		logger.WithError(err).Errorf("failed to destroy VM during restore cleanup")
 	})
-	vm.tapDevice = oldTapDevice
+	vm.tapDevice = tapDevice
 	vm.ip = guestIP
 
 	// Copy the stateful disk from the snapshot to the VM state directory.
@@ -1622,12 +2359,14 @@ func (s *Server) restoreVM(
 		"source":      sourcePath,
 		"destination": destPath,
 	}).Info("copying stateful disk from snapshot")
-	err = copyFile(sourcePath, destPath)
+	err = cloneDiskFile(sourcePath, destPath)
 	if err != nil {
 		logger.WithError(err).Error("failed to copy stateful disk from snapshot")
 		return nil, fmt.Errorf("failed to copy stateful disk from snapshot: %w", err)
 	}
 	logger.Info("successfully copied stateful disk from snapshot")
+	// The VM can be snapshotted and rebooted after a crash with its disk from now on.
+	vm.statefulDiskPath = destPath
 
 	portForwards, err := s.setupPortForwardsToVM(guestIP.IP.String(), s.config.PortForwards)
 	if err != nil {
@@ -1640,29 +2379,51 @@ func (s *Server) restoreVM(
 	})
 	vm.portForwards = portForwards
 
-	cidFilePath := path.Join(snapshotPath, cidFilename)
-	cidBytes, err := os.ReadFile(cidFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CID file from snapshot: %w", err)
-	}
-	cidStr := strings.TrimSpace(string(cidBytes))
-	cid, err := strconv.ParseUint(cidStr, 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse CID from file: %w", err)
-	}
-	err = s.cidAllocator.ClaimCID(uint32(cid))
-	if err != nil {
-		return nil, fmt.Errorf("failed to claim CID from allocator: %w", err)
+	if freshNetwork {
+		cid, err := s.cidAllocator.AllocateCID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate CID: %w", err)
+		}
+		vm.cid = cid
+		logger.WithField("cid", vm.cid).Info("allocated CID")
+	} else {
+		cidFilePath := path.Join(snapshotPath, cidFilename)
+		cidBytes, err := os.ReadFile(cidFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CID file from snapshot: %w", err)
+		}
+		cidStr := strings.TrimSpace(string(cidBytes))
+		cid, err := strconv.ParseUint(cidStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CID from file: %w", err)
+		}
+		err = s.cidAllocator.ClaimCID(uint32(cid))
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim CID from allocator: %w", err)
+		}
+		vm.cid = uint32(cid)
+		logger.WithField("cid", vm.cid).Info("claimed CID from snapshot")
 	}
-	vm.cid = uint32(cid)
-	logger.WithField("cid", vm.cid).Info("claimed CID from snapshot")
 	cleanup.Add(func() {
 		if err := s.cidAllocator.FreeCID(vm.cid); err != nil {
 			logger.WithError(err).Errorf("failed to free CID %d during restore cleanup", vm.cid)
 		}
 	})
 
-	err = vm.restore(ctx, snapshotPath)
+	restorePath := snapshotPath
+	var guestMAC net.HardwareAddr
+	if freshNetwork {
+		guestMAC = guestMACForIP(guestIP.IP)
+		vm.vsockPath = path.Join(vm.stateDirPath, "vsock.sock")
+		restorePath, err = vm.prepareFreshNetworkSnapshot(snapshotPath, guestMAC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rewrite snapshot config: %w", err)
+		}
+		defer os.RemoveAll(restorePath)
+	}
+
+	reportProgress(ctx, "restoring VM from snapshot")
+	err = vm.restore(ctx, restorePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to restore VM: %w", err)
 	}
@@ -1673,7 +2434,18 @@ func (s *Server) restoreVM(
 		return nil, fmt.Errorf("failed to resume VM: %w", err)
 	}
 
+	if freshNetwork {
+		reportProgress(ctx, "reconfiguring guest network")
+		if err := vm.reconfigureGuestNetwork(ctx, s.config.BridgeIP, guestMAC); err != nil {
+			return nil, fmt.Errorf("failed to reconfigure guest network: %w", err)
+		}
+	}
+	vm.lock.Lock()
+	vm.lastSnapshotId = snapshotId
+	vm.lock.Unlock()
+
 	cleanup.Release()
+	s.metrics.restoreDuration.ObserveSince(start)
 	return vm, nil
 }
 
@@ -1687,10 +2459,15 @@ func (s *Server) PauseVM(ctx context.Context, req *serverapi.VMRequest) (*server
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
+	if err := s.inflateBalloonForPause(ctx, vm); err != nil && status.Code(err) != codes.FailedPrecondition {
+		logger.WithError(err).Warn("failed to reclaim memory of VM before pausing it")
+	}
 	err := vm.pause(ctx)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to pause VM: %v", err))
 	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypePaused, vm, nil)
 
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
@@ -1713,31 +2490,92 @@ func (s *Server) ResumeVM(ctx context.Context, req *serverapi.VMRequest) (*serve
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to resume VM: %v", err))
 	}
+	if _, _, err := s.adjustBalloon(ctx, vm, false); err != nil && status.Code(err) != codes.FailedPrecondition {
+		logger.WithError(err).Warn("failed to give memory back to resumed VM")
+	}
+	s.persistVMRegistry()
+	s.publishEvent(EventTypeResumed, vm, nil)
 
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
 }
 
+// commandExitStatusRegexp matches the error the guest reports for a command exiting unsuccessfully.
+var commandExitStatusRegexp = regexp.MustCompile(`^exit status (\d+)$`)
+
+// VMCommand runs `cmd` in the VM and records it in the audit log, along with its exit status if
+// it's blocking.
 func (s *Server) VMCommand(ctx context.Context, vmName string, cmd string, blocking bool) (*serverapi.VmCommandResponse, error) {
+	start := time.Now()
+	resp, err := s.vmCommand(ctx, vmName, cmd, blocking)
+
+	details := map[string]string{
+		"cmd":      cmd,
+		"blocking": strconv.FormatBool(blocking),
+	}
+	if err == nil && blocking {
+		cmdErr := resp.GetError()
+		if cmdErr == "" {
+			details["exitStatus"] = "0"
+		} else if match := commandExitStatusRegexp.FindStringSubmatch(cmdErr); match != nil {
+			details["exitStatus"] = match[1]
+		} else {
+			details["commandError"] = cmdErr
+		}
+	}
+	s.Audit(ctx, AuditActionCommand, vmName, start, details, err)
+	return resp, err
+}
+
+func (s *Server) vmCommand(ctx context.Context, vmName string, cmd string, blocking bool) (*serverapi.VmCommandResponse, error) {
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
+	vm.lifetime.markActive()
+
 	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
 	client := &http.Client{
 		Timeout: 30 * time.Second,
 	}
 
-	return vm.handleRun(ctx, client, url, cmd, blocking)
+	start := time.Now()
+	resp, err := vm.handleRun(ctx, client, url, cmd, blocking)
+	// A non-blocking command is still running when this returns.
+	if blocking {
+		s.metrics.commandDuration.ObserveSince(start)
+		details := map[string]string{"cmd": cmd}
+		if err != nil {
+			details["error"] = err.Error()
+		} else if resp.GetError() != "" {
+			details["error"] = resp.GetError()
+		}
+		s.publishEvent(EventTypeCommandFinished, vm, details)
+	}
+	return resp, err
 }
 
+// VMFileUpload writes `files` to the VM and records their paths in the audit log.
 func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []serverapi.VmFileUploadRequestFilesInner) (*serverapi.VmFileUploadResponse, error) {
+	start := time.Now()
+	resp, err := s.vmFileUpload(ctx, vmName, files)
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.GetPath())
+	}
+	s.Audit(ctx, AuditActionFileUpload, vmName, start, map[string]string{"paths": strings.Join(paths, ",")}, err)
+	return resp, err
+}
+
+func (s *Server) vmFileUpload(ctx context.Context, vmName string, files []serverapi.VmFileUploadRequestFilesInner) (*serverapi.VmFileUploadResponse, error) {
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
+	vm.lifetime.markActive()
 
 	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
 	client := &http.Client{
@@ -1820,11 +2658,62 @@ func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string,
 	}, nil
 }
 
+// VMEntryPointStatus returns the status of the entry point process supervised inside the VM.
+func (s *Server) VMEntryPointStatus(ctx context.Context, vmName string) (*serverapi.EntryPointStatus, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/entrypoint", nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var entryPointStatus cmdserver.EntryPointStatus
+	if err := json.NewDecoder(resp.Body).Decode(&entryPointStatus); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	return &serverapi.EntryPointStatus{
+		Cmd:           serverapi.PtrString(entryPointStatus.Cmd),
+		RestartPolicy: serverapi.PtrString(entryPointStatus.RestartPolicy),
+		State:         serverapi.PtrString(entryPointStatus.State),
+		Pid:           serverapi.PtrInt32(int32(entryPointStatus.Pid)),
+		ExitCode:      serverapi.PtrInt32(int32(entryPointStatus.ExitCode)),
+		RestartCount:  serverapi.PtrInt32(int32(entryPointStatus.RestartCount)),
+	}, nil
+}
+
+// VMFileDownload reads the comma separated `paths` from the VM and records them in the audit log.
 func (s *Server) VMFileDownload(ctx context.Context, vmName string, paths string) (*serverapi.VmFileDownloadResponse, error) {
+	start := time.Now()
+	resp, err := s.vmFileDownload(ctx, vmName, paths)
+	s.Audit(ctx, AuditActionFileDownload, vmName, start, map[string]string{"paths": paths}, err)
+	return resp, err
+}
+
+func (s *Server) vmFileDownload(ctx context.Context, vmName string, paths string) (*serverapi.VmFileDownloadResponse, error) {
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
+	vm.lifetime.markActive()
 
 	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
 	client := &http.Client{
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// First entry of a snapshot archive, describing the rest.
+	snapshotManifestFilename = "manifest.json"
+	// Bumped whenever the archive layout changes incompatibly.
+	snapshotManifestVersion = 1
+	// Prefix of the directories snapshots are imported into before they're complete.
+	snapshotImportDirPrefix = ".import-"
+)
+
+// snapshotArchiveFile is a file of a snapshot directory in an archive.
+type snapshotArchiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// snapshotDependency is a file outside the snapshot that VMs restored from it need, at the same
+// path on every host.
+type snapshotDependency struct {
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+}
+
+// snapshotManifest describes a snapshot archive.
+type snapshotManifest struct {
+	Version   int                   `json:"version"`
+	Id        string                `json:"id"`
+	VmName    string                `json:"vmName,omitempty"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Kernel    *snapshotDependency   `json:"kernel,omitempty"`
+	Initramfs *snapshotDependency   `json:"initramfs,omitempty"`
+	Rootfs    *snapshotDependency   `json:"rootfs,omitempty"`
+	Files     []snapshotArchiveFile `json:"files"`
+}
+
+// SnapshotArchive is a snapshot ready to be written as a gzipped tar archive.
+type SnapshotArchive struct {
+	snapshotPath string
+	manifest     snapshotManifest
+}
+
+// fileSha256 returns the hex encoded SHA-256 of the file at `filePath`.
+func fileSha256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newSnapshotDependency(filePath string) (*snapshotDependency, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+	sum, err := fileSha256(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return &snapshotDependency{
+		Path:   filePath,
+		Sha256: sum,
+	}, nil
+}
+
+// checkSnapshotDependency returns an error if the file `dependency` isn't on this host as it was on
+// the host the snapshot was exported from. Only regular files are hashed, devices like /dev/zero
+// would never be read to the end. The hash found isn't reported, so that importing archives can't
+// be used to learn the hash of arbitrary files.
+func checkSnapshotDependency(kind string, dependency *snapshotDependency) error {
+	if dependency == nil {
+		return nil
+	}
+	info, err := os.Lstat(dependency.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return status.Errorf(codes.FailedPrecondition, "%s not found on this host: %s", kind, dependency.Path)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to stat %s: %v", kind, err)
+	}
+	if !info.Mode().IsRegular() {
+		return status.Errorf(codes.FailedPrecondition, "%s isn't a regular file: %s", kind, dependency.Path)
+	}
+	sum, err := fileSha256(dependency.Path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to hash %s: %v", kind, err)
+	}
+	if sum != dependency.Sha256 {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"%s %s differs from the one the snapshot was taken with",
+			kind,
+			dependency.Path,
+		)
+	}
+	return nil
+}
+
+// checkSnapshotConfig returns an error if the VMM config at `configPath` of an imported snapshot
+// boots anything but the dependencies checked against `manifest`, or uses disks other than the
+// rootfs and the stateful disk of a VM in `stateDir`, which restoring copies the snapshot's stateful
+// disk to.
+func checkSnapshotConfig(configPath string, manifest *snapshotManifest, stateDir string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read VMM config: %v", err)
+	}
+	var config VMConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid VMM config: %v", err)
+	}
+
+	dependencyPath := func(dependency *snapshotDependency) string {
+		if dependency == nil {
+			return ""
+		}
+		return dependency.Path
+	}
+	stringValue := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+	if config.Payload.Firmware != nil {
+		return status.Error(codes.InvalidArgument, "VMM config boots a firmware")
+	}
+	if stringValue(config.Payload.Kernel) != dependencyPath(manifest.Kernel) {
+		return status.Error(codes.InvalidArgument, "kernel of the VMM config doesn't match the manifest")
+	}
+	if stringValue(config.Payload.Initramfs) != dependencyPath(manifest.Initramfs) {
+		return status.Error(codes.InvalidArgument, "initramfs of the VMM config doesn't match the manifest")
+	}
+	if config.Disks == nil {
+		return nil
+	}
+	for _, disk := range *config.Disks {
+		if disk.Readonly {
+			if disk.Path == "" || disk.Path != dependencyPath(manifest.Rootfs) {
+				return status.Errorf(codes.InvalidArgument, "rootfs of the VMM config doesn't match the manifest: %s", disk.Path)
+			}
+			continue
+		}
+		diskPath := path.Clean(disk.Path)
+		if path.Base(diskPath) != statefulDiskFilename || path.Dir(path.Dir(diskPath)) != path.Clean(stateDir) {
+			return status.Errorf(codes.InvalidArgument, "unexpected disk in VMM config: %s", disk.Path)
+		}
+	}
+	return nil
+}
+
+// sparseFileWriter writes sequentially to a file, skipping zeroed chunks so that they become holes.
+// The file must be truncated to its full size afterwards.
+type sparseFileWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *sparseFileWriter) Write(p []byte) (int, error) {
+	if len(bytes.Trim(p, "\x00")) > 0 {
+		if _, err := w.file.WriteAt(p, w.offset); err != nil {
+			return 0, err
+		}
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// ExportSnapshot describes the snapshot `snapshotId` and the kernel and rootfs it expects, to be
+// written as an archive by `SnapshotArchive.Write`.
+func (s *Server) ExportSnapshot(ctx context.Context, snapshotId string) (*SnapshotArchive, error) {
+	logger := log.WithField("snapshotId", snapshotId)
+	logger.Info("received request to export snapshot")
+
+	if err := checkSnapshotId(snapshotId); err != nil {
+		return nil, err
+	}
+	snapshotPath, err := s.fetchSnapshot(ctx, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := s.inspectSnapshot(snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.GetKernel() == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot is incomplete: %s", snapshotId)
+	}
+
+	manifest := snapshotManifest{
+		Version:   snapshotManifestVersion,
+		Id:        snapshotId,
+		VmName:    snapshot.GetVmName(),
+		CreatedAt: snapshot.GetCreatedAt(),
+	}
+	reportProgress(ctx, "hashing kernel and rootfs")
+	if manifest.Kernel, err = newSnapshotDependency(snapshot.GetKernel()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if manifest.Initramfs, err = newSnapshotDependency(snapshot.GetInitramfs()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if manifest.Rootfs, err = newSnapshotDependency(snapshot.GetRootfs()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	entries, err := os.ReadDir(snapshotPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read snapshot directory: %v", err)
+	}
+	reportProgress(ctx, "hashing snapshot files")
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to stat %s: %v", entry.Name(), err)
+		}
+		sum, err := fileSha256(path.Join(snapshotPath, entry.Name()))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to hash %s: %v", entry.Name(), err)
+		}
+		manifest.Files = append(manifest.Files, snapshotArchiveFile{
+			Name:   entry.Name(),
+			Size:   info.Size(),
+			Sha256: sum,
+		})
+	}
+
+	return &SnapshotArchive{
+		snapshotPath: snapshotPath,
+		manifest:     manifest,
+	}, nil
+}
+
+// Write writes the manifest followed by the snapshot files to `w` as a gzipped tar archive.
+func (a *SnapshotArchive) Write(ctx context.Context, w io.Writer) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	manifest, err := json.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    snapshotManifestFilename,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write manifest header: %w", err)
+	}
+	if _, err := tarWriter.Write(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	for _, file := range a.manifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tarWriter, path.Join(a.snapshotPath, file.Name), file.Size); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Name, err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return gzipWriter.Close()
+}
+
+func writeArchiveFile(tarWriter *tar.Writer, filePath string, size int64) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    path.Base(filePath),
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	// The file must not have changed size since it was hashed, the archive is corrupt otherwise.
+	_, err = io.CopyN(tarWriter, file, size)
+	return err
+}
+
+// ImportSnapshot registers the snapshot in the archive read from `r` as `snapshotId`, or the ID it
+// was exported with if empty. Fails before unpacking anything if the kernel or rootfs the snapshot
+// expects aren't on this host.
+func (s *Server) ImportSnapshot(ctx context.Context, r io.Reader, snapshotId string) (*serverapi.Snapshot, error) {
+	logger := log.WithField("snapshotId", snapshotId)
+	logger.Info("received request to import snapshot")
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid archive: %v", err)
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	manifest, err := readSnapshotManifest(tarReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshotId == "" {
+		snapshotId = manifest.Id
+	}
+	if err := checkSnapshotId(snapshotId); err != nil {
+		return nil, err
+	}
+	logger = logger.WithField("snapshotId", snapshotId)
+	snapshotPath := s.getSnapshotPath(snapshotId)
+	exists, err := s.snapshotExists(ctx, snapshotId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up snapshot: %v", err)
+	}
+	if exists {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot already exists: %s", snapshotId)
+	}
+
+	expected, err := manifest.expectedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	reportProgress(ctx, "checking kernel and rootfs")
+	if err := checkSnapshotDependency("kernel", manifest.Kernel); err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotDependency("initramfs", manifest.Initramfs); err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotDependency("rootfs", manifest.Rootfs); err != nil {
+		return nil, err
+	}
+
+	reportProgress(ctx, "unpacking snapshot")
+	err = createSnapshotDir(snapshotPath, snapshotImportDirPrefix, func(importPath string) error {
+		return unpackSnapshotArchive(tarReader, importPath, manifest, expected, s.config.StateDir)
+	})
+	if err != nil {
+		// Refused while unpacking.
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		if _, statErr := os.Stat(snapshotPath); statErr == nil {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot already exists: %s", snapshotId)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to register snapshot: %v", err)
+	}
+
+	reportProgress(ctx, "storing snapshot")
+	if err := s.snapshotStore.Put(ctx, snapshotId, snapshotPath); err != nil {
+		os.RemoveAll(snapshotPath)
+		return nil, status.Errorf(codes.Internal, "failed to store snapshot: %v", err)
+	}
+	logger.Info("imported snapshot")
+	return s.inspectSnapshot(snapshotId)
+}
+
+// unpackSnapshotArchive unpacks the rest of the archive read by `tarReader` into `importPath`,
+// checking it against `manifest` and its files `expected`.
+func unpackSnapshotArchive(
+	tarReader *tar.Reader,
+	importPath string,
+	manifest *snapshotManifest,
+	expected map[string]snapshotArchiveFile,
+	stateDir string,
+) error {
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid archive: %v", err)
+		}
+		file, ok := expected[header.Name]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "unexpected file in archive: %q", header.Name)
+		}
+		delete(expected, header.Name)
+		if header.Typeflag != tar.TypeReg || header.Size != file.Size {
+			return status.Errorf(codes.InvalidArgument, "%s doesn't match the manifest", header.Name)
+		}
+		if err := unpackArchiveFile(tarReader, path.Join(importPath, file.Name), file); err != nil {
+			return err
+		}
+	}
+	if len(expected) > 0 {
+		missing := make([]string, 0, len(expected))
+		for name := range expected {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return status.Errorf(codes.InvalidArgument, "archive is missing: %s", strings.Join(missing, ", "))
+	}
+	// Only the manifest's dependencies were checked, the VMM config restores must agree with them.
+	return checkSnapshotConfig(path.Join(importPath, "config.json"), manifest, stateDir)
+}
+
+// readSnapshotManifest reads the manifest, which must be the first entry of the archive.
+func readSnapshotManifest(tarReader *tar.Reader) (*snapshotManifest, error) {
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid archive: %v", err)
+	}
+	if header.Name != snapshotManifestFilename {
+		return nil, status.Errorf(codes.InvalidArgument, "archive doesn't start with %s", snapshotManifestFilename)
+	}
+	var manifest snapshotManifest
+	if err := json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid manifest: %v", err)
+	}
+	if manifest.Version != snapshotManifestVersion {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported manifest version: %d", manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// expectedFiles returns the files of the manifest by name. Fails if a name could escape the
+// snapshot directory, is listed twice or the VMM config is missing.
+func (m *snapshotManifest) expectedFiles() (map[string]snapshotArchiveFile, error) {
+	expected := make(map[string]snapshotArchiveFile, len(m.Files))
+	for _, file := range m.Files {
+		if err := checkSnapshotId(file.Name); err != nil || file.Name == snapshotManifestFilename {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid file name in manifest: %q", file.Name)
+		}
+		if _, ok := expected[file.Name]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "duplicate file in manifest: %s", file.Name)
+		}
+		expected[file.Name] = file
+	}
+	if _, ok := expected["config.json"]; !ok {
+		return nil, status.Error(codes.InvalidArgument, "archive has no VMM config")
+	}
+	return expected, nil
+}
+
+// unpackArchiveFile writes the current file of `tarReader` to `filePath`, keeping zeroed regions
+// sparse, and checks it against the manifest.
+func unpackArchiveFile(tarReader *tar.Reader, filePath string, file snapshotArchiveFile) error {
+	out, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to create %s: %v", file.Name, err)
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(&sparseFileWriter{file: out}, io.TeeReader(tarReader, hash)); err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to unpack %s: %v", file.Name, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.Sha256 {
+		return status.Errorf(codes.InvalidArgument, "checksum mismatch for %s: %s, expected %s", file.Name, sum, file.Sha256)
+	}
+	if err := out.Truncate(file.Size); err != nil {
+		return status.Errorf(codes.Internal, "failed to size %s: %v", file.Name, err)
+	}
+	if err := out.Sync(); err != nil {
+		return status.Errorf(codes.Internal, "failed to sync %s: %v", file.Name, err)
+	}
+	return nil
+}
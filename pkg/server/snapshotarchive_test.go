@@ -0,0 +1,291 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+// tarWithManifest returns a tar reader of an archive starting with an entry `name` holding
+// `manifest`.
+func tarWithManifest(t *testing.T, name string, manifest []byte) *tar.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if _, err := tarWriter.Write(manifest); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	return tar.NewReader(&buf)
+}
+
+func TestReadSnapshotManifest(t *testing.T) {
+	valid, err := json.Marshal(snapshotManifest{Version: snapshotManifestVersion, Id: "snap"})
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	unsupported, err := json.Marshal(snapshotManifest{Version: snapshotManifestVersion + 1, Id: "snap"})
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+
+	manifest, err := readSnapshotManifest(tarWithManifest(t, snapshotManifestFilename, valid))
+	if err != nil {
+		t.Fatalf("readSnapshotManifest() failed: %v", err)
+	}
+	if manifest.Id != "snap" {
+		t.Errorf("readSnapshotManifest() = %+v, want id snap", manifest)
+	}
+
+	tests := []struct {
+		name     string
+		entry    string
+		manifest []byte
+	}{
+		{name: "not first", entry: "config.json", manifest: valid},
+		{name: "invalid json", entry: snapshotManifestFilename, manifest: []byte("{")},
+		{name: "unsupported version", entry: snapshotManifestFilename, manifest: unsupported},
+	}
+	for _, test := range tests {
+		_, err := readSnapshotManifest(tarWithManifest(t, test.entry, test.manifest))
+		checkCode(t, err, codes.InvalidArgument)
+	}
+	_, err = readSnapshotManifest(tar.NewReader(bytes.NewReader(nil)))
+	checkCode(t, err, codes.InvalidArgument)
+}
+
+func TestSnapshotManifestExpectedFiles(t *testing.T) {
+	config := snapshotArchiveFile{Name: "config.json"}
+	tests := []struct {
+		name    string
+		files   []snapshotArchiveFile
+		wantErr bool
+	}{
+		{name: "valid", files: []snapshotArchiveFile{config, {Name: "memory-ranges"}, {Name: "state.json"}}},
+		{name: "no config", files: []snapshotArchiveFile{{Name: "state.json"}}, wantErr: true},
+		{name: "duplicate", files: []snapshotArchiveFile{config, config}, wantErr: true},
+		{name: "path", files: []snapshotArchiveFile{config, {Name: "../escape"}}, wantErr: true},
+		{name: "subdirectory", files: []snapshotArchiveFile{config, {Name: "dir/file"}}, wantErr: true},
+		{name: "hidden", files: []snapshotArchiveFile{config, {Name: ".hidden"}}, wantErr: true},
+		{name: "empty name", files: []snapshotArchiveFile{config, {Name: ""}}, wantErr: true},
+		{name: "manifest", files: []snapshotArchiveFile{config, {Name: snapshotManifestFilename}}, wantErr: true},
+	}
+	for _, test := range tests {
+		manifest := snapshotManifest{Files: test.files}
+		expected, err := manifest.expectedFiles()
+		if test.wantErr {
+			checkCode(t, err, codes.InvalidArgument)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expectedFiles() failed: %v", test.name, err)
+			continue
+		}
+		if len(expected) != len(test.files) {
+			t.Errorf("%s: expectedFiles() = %v, want %d files", test.name, expected, len(test.files))
+		}
+	}
+}
+
+func TestSnapshotArchiveRoundTrip(t *testing.T) {
+	snapshotPath := t.TempDir()
+	files := map[string][]byte{
+		"config.json": []byte(`{"cpus":{}}`),
+		// Mostly zeroes, unpacked sparse.
+		"memory-ranges": append(make([]byte, 3*megabyte), []byte("data")...),
+	}
+	archive := &SnapshotArchive{
+		snapshotPath: snapshotPath,
+		manifest:     snapshotManifest{Version: snapshotManifestVersion, Id: "snap"},
+	}
+	for name, data := range files {
+		filePath := filepath.Join(snapshotPath, name)
+		if err := os.WriteFile(filePath, data, 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		sum, err := fileSha256(filePath)
+		if err != nil {
+			t.Fatalf("failed to hash %s: %v", name, err)
+		}
+		archive.manifest.Files = append(archive.manifest.Files, snapshotArchiveFile{
+			Name:   name,
+			Size:   int64(len(data)),
+			Sha256: sum,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Write(context.Background(), &buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	gzipReader, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("invalid gzip stream: %v", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	manifest, err := readSnapshotManifest(tarReader)
+	if err != nil {
+		t.Fatalf("readSnapshotManifest() failed: %v", err)
+	}
+	expected, err := manifest.expectedFiles()
+	if err != nil {
+		t.Fatalf("expectedFiles() failed: %v", err)
+	}
+
+	importPath := t.TempDir()
+	for range files {
+		header, err := tarReader.Next()
+		if err != nil {
+			t.Fatalf("failed to read archive: %v", err)
+		}
+		file, ok := expected[header.Name]
+		if !ok {
+			t.Fatalf("unexpected file in archive: %s", header.Name)
+		}
+		if err := unpackArchiveFile(tarReader, filepath.Join(importPath, file.Name), file); err != nil {
+			t.Fatalf("unpackArchiveFile(%s) failed: %v", file.Name, err)
+		}
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(importPath, name))
+		if err != nil {
+			t.Fatalf("failed to read unpacked %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("unpacked %s differs from the original", name)
+		}
+	}
+}
+
+func TestUnpackArchiveFileChecksumMismatch(t *testing.T) {
+	tarReader := tarWithManifest(t, "config.json", []byte("tampered"))
+	if _, err := tarReader.Next(); err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	file := snapshotArchiveFile{Name: "config.json", Size: 8, Sha256: "0000"}
+	err := unpackArchiveFile(tarReader, filepath.Join(t.TempDir(), file.Name), file)
+	checkCode(t, err, codes.InvalidArgument)
+}
+
+func TestCheckSnapshotDependency(t *testing.T) {
+	kernelPath := filepath.Join(t.TempDir(), "vmlinux")
+	if err := os.WriteFile(kernelPath, []byte("kernel"), 0644); err != nil {
+		t.Fatalf("failed to write kernel: %v", err)
+	}
+	dependency, err := newSnapshotDependency(kernelPath)
+	if err != nil {
+		t.Fatalf("newSnapshotDependency() failed: %v", err)
+	}
+
+	if err := checkSnapshotDependency("kernel", dependency); err != nil {
+		t.Errorf("checkSnapshotDependency() of the same file failed: %v", err)
+	}
+	if err := checkSnapshotDependency("kernel", nil); err != nil {
+		t.Errorf("checkSnapshotDependency() without dependency failed: %v", err)
+	}
+	if err := os.WriteFile(kernelPath, []byte("other kernel"), 0644); err != nil {
+		t.Fatalf("failed to write kernel: %v", err)
+	}
+	err = checkSnapshotDependency("kernel", dependency)
+	checkCode(t, err, codes.FailedPrecondition)
+	if sum, _ := fileSha256(kernelPath); strings.Contains(err.Error(), sum) {
+		t.Errorf("checkSnapshotDependency() reported the hash of the file: %v", err)
+	}
+	os.Remove(kernelPath)
+	checkCode(t, checkSnapshotDependency("kernel", dependency), codes.FailedPrecondition)
+
+	// Not hashed, even if they could be.
+	if err := os.Symlink(os.DevNull, kernelPath); err != nil {
+		t.Fatalf("failed to link kernel: %v", err)
+	}
+	checkCode(t, checkSnapshotDependency("kernel", dependency), codes.FailedPrecondition)
+	checkCode(t, checkSnapshotDependency("kernel", &snapshotDependency{Path: os.DevNull}), codes.FailedPrecondition)
+}
+
+func TestCheckSnapshotConfig(t *testing.T) {
+	stateDir := "/var/lib/arrakis"
+	manifest := &snapshotManifest{
+		Kernel: &snapshotDependency{Path: "/images/vmlinux"},
+		Rootfs: &snapshotDependency{Path: "/images/rootfs.img"},
+	}
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			config: `{"payload":{"kernel":"/images/vmlinux"},"disks":[` +
+				`{"path":"/images/rootfs.img","readonly":true},` +
+				`{"path":"/var/lib/arrakis/vm1/stateful.img"}]}`,
+		},
+		{
+			name:    "other kernel",
+			config:  `{"payload":{"kernel":"/etc/shadow"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "no kernel",
+			config:  `{"payload":{}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unexpected initramfs",
+			config:  `{"payload":{"kernel":"/images/vmlinux","initramfs":"/etc/shadow"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "firmware",
+			config:  `{"payload":{"kernel":"/images/vmlinux","firmware":"/etc/shadow"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "other rootfs",
+			config:  `{"payload":{"kernel":"/images/vmlinux"},"disks":[{"path":"/dev/sda","readonly":true}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "writable host disk",
+			config:  `{"payload":{"kernel":"/images/vmlinux"},"disks":[{"path":"/dev/sda"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "stateful disk outside the state dir",
+			config:  `{"payload":{"kernel":"/images/vmlinux"},"disks":[{"path":"/home/user/stateful.img"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "stateful disk escaping the state dir",
+			config:  `{"payload":{"kernel":"/images/vmlinux"},"disks":[{"path":"/var/lib/arrakis/../../etc/stateful.img"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(configPath, []byte(test.config), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			err := checkSnapshotConfig(configPath, manifest, stateDir)
+			if test.wantErr {
+				checkCode(t, err, codes.InvalidArgument)
+			} else if err != nil {
+				t.Errorf("checkSnapshotConfig() failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Directory in the state directory holding the snapshots.
+	snapshotsDirName = "snapshots"
+	// File in a snapshot directory describing where the snapshot comes from.
+	snapshotMetadataFilename = "metadata.json"
+)
+
+// snapshotMetadata describes where a snapshot comes from.
+type snapshotMetadata struct {
+	VmName    string    `json:"vmName"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func writeSnapshotMetadata(snapshotPath string, metadata snapshotMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot metadata: %w", err)
+	}
+	return os.WriteFile(path.Join(snapshotPath, snapshotMetadataFilename), data, 0644)
+}
+
+// readSnapshotMetadata returns the metadata stored in the snapshot directory `snapshotPath`.
+// Snapshots taken before metadata existed report the modification time of their directory.
+func readSnapshotMetadata(snapshotPath string) (snapshotMetadata, error) {
+	data, err := os.ReadFile(path.Join(snapshotPath, snapshotMetadataFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		info, err := os.Stat(snapshotPath)
+		if err != nil {
+			return snapshotMetadata{}, fmt.Errorf("failed to stat snapshot: %w", err)
+		}
+		return snapshotMetadata{CreatedAt: info.ModTime()}, nil
+	}
+	if err != nil {
+		return snapshotMetadata{}, fmt.Errorf("failed to read snapshot metadata: %w", err)
+	}
+
+	var metadata snapshotMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return snapshotMetadata{}, fmt.Errorf("failed to parse snapshot metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// diskUsage returns the space the files under `dirPath` take up on disk. Sparse files, e.g. the
+// stateful disk, only count the blocks allocated to them.
+func diskUsage(dirPath string) (int64, error) {
+	var usage int64
+	err := filepath.WalkDir(dirPath, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage += stat.Blocks * 512
+		} else {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
+
+func (s *Server) getSnapshotPath(snapshotId string) string {
+	return path.Join(s.config.StateDir, snapshotsDirName, snapshotId)
+}
+
+// checkSnapshotId returns an error if `snapshotId` can't name a snapshot directory. Hidden
+// directories hold snapshots being imported.
+func checkSnapshotId(snapshotId string) error {
+	if snapshotId == "" || strings.HasPrefix(snapshotId, ".") || strings.ContainsRune(snapshotId, '/') {
+		return status.Errorf(codes.InvalidArgument, "invalid snapshot id: %q", snapshotId)
+	}
+	return nil
+}
+
+// snapshotUsers returns the VMs that are restored from the snapshot `snapshotId` if they crash and
+// the warm pools restoring VMs from it.
+func (s *Server) snapshotUsers(snapshotId string) ([]string, []string) {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	var vmNames []string
+	for _, vm := range vms {
+		vm.lock.RLock()
+		if vm.lastSnapshotId == snapshotId && vm.warmPool == "" {
+			vmNames = append(vmNames, vm.name)
+		}
+		vm.lock.RUnlock()
+	}
+	sort.Strings(vmNames)
+
+	var warmPools []string
+	s.warmPools.lock.Lock()
+	for _, pool := range s.warmPools.pools {
+		if pool.key.snapshotId == snapshotId {
+			warmPools = append(warmPools, pool.name)
+		}
+	}
+	s.warmPools.lock.Unlock()
+	return vmNames, warmPools
+}
+
+// inspectSnapshot returns the snapshot `snapshotId` as reported by the API.
+func (s *Server) inspectSnapshot(snapshotId string) (*serverapi.Snapshot, error) {
+	snapshotPath := s.getSnapshotPath(snapshotId)
+	info, err := os.Stat(snapshotPath)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil, status.Errorf(codes.NotFound, "snapshot not found: %s", snapshotId)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat snapshot: %v", err)
+	}
+
+	metadata, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	labels, err := readSnapshotLabels(snapshotPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	usage, err := diskUsage(snapshotPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get disk usage of snapshot: %v", err)
+	}
+
+	snapshot := &serverapi.Snapshot{
+		Id:             serverapi.PtrString(snapshotId),
+		Cached:         serverapi.PtrBool(true),
+		CreatedAt:      serverapi.PtrTime(metadata.CreatedAt),
+		DiskUsageBytes: serverapi.PtrInt64(usage),
+		Labels:         labelsToAPI(labels),
+	}
+	if metadata.VmName != "" {
+		snapshot.SetVmName(metadata.VmName)
+	}
+	snapshot.UsedBy, snapshot.WarmPools = s.snapshotUsers(snapshotId)
+
+	// The VMM's config of the snapshotted VM has what VMs restored from it need. It's missing if the
+	// snapshot failed half way.
+	data, err := os.ReadFile(path.Join(snapshotPath, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read snapshot config: %v", err)
+	}
+	var config VMConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to parse snapshot config: %v", err)
+	}
+	if config.Cpus != nil {
+		snapshot.SetVcpus(config.Cpus.BootVcpus)
+	}
+	if config.Memory != nil {
+		snapshot.SetMemorySizeMB(int32(config.Memory.Size / (1024 * 1024)))
+	}
+	if config.Payload.Kernel != nil {
+		snapshot.SetKernel(*config.Payload.Kernel)
+	}
+	if config.Payload.Initramfs != nil {
+		snapshot.SetInitramfs(*config.Payload.Initramfs)
+	}
+	if config.Disks != nil {
+		for _, disk := range *config.Disks {
+			if disk.Readonly {
+				snapshot.SetRootfs(disk.Path)
+				break
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// ListSnapshots returns all snapshots sorted by creation time. Only the ID of the stored snapshots
+// that aren't cached locally is known, they come last.
+func (s *Server) ListSnapshots(ctx context.Context) (*serverapi.ListSnapshotsResponse, error) {
+	entries, err := os.ReadDir(path.Join(s.config.StateDir, snapshotsDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.Internal, "failed to read snapshots dir: %v", err)
+	}
+	storedIds, err := s.snapshotStore.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list stored snapshots: %v", err)
+	}
+
+	snapshots := make([]serverapi.Snapshot, 0, len(entries))
+	cached := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		snapshot, err := s.inspectSnapshot(entry.Name())
+		if err != nil {
+			// The snapshot may have been deleted concurrently.
+			log.WithField("snapshotId", entry.Name()).WithError(err).Warn("failed to inspect snapshot")
+			continue
+		}
+		snapshots = append(snapshots, *snapshot)
+		cached[entry.Name()] = true
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].GetCreatedAt().Before(snapshots[j].GetCreatedAt())
+	})
+
+	sort.Strings(storedIds)
+	for _, snapshotId := range storedIds {
+		if !cached[snapshotId] {
+			snapshots = append(snapshots, serverapi.Snapshot{
+				Id:     serverapi.PtrString(snapshotId),
+				Cached: serverapi.PtrBool(false),
+			})
+		}
+	}
+	return &serverapi.ListSnapshotsResponse{
+		Snapshots: snapshots,
+	}, nil
+}
+
+// GetSnapshot returns a snapshot and the VMs and warm pools using it, fetching it from the snapshot
+// store if it isn't cached.
+func (s *Server) GetSnapshot(ctx context.Context, snapshotId string) (*serverapi.Snapshot, error) {
+	if err := checkSnapshotId(snapshotId); err != nil {
+		return nil, err
+	}
+	if _, err := s.fetchSnapshot(ctx, snapshotId); err != nil {
+		return nil, err
+	}
+	return s.inspectSnapshot(snapshotId)
+}
+
+// DeleteSnapshot deletes a snapshot. Snapshots used by VMs or warm pools are only deleted with
+// `force`, VMs using it then can't be restored from it if they crash.
+func (s *Server) DeleteSnapshot(ctx context.Context, snapshotId string, force bool) error {
+	logger := log.WithField("snapshotId", snapshotId)
+	logger.Info("received request to delete snapshot")
+
+	if err := checkSnapshotId(snapshotId); err != nil {
+		return err
+	}
+	exists, err := s.snapshotExists(ctx, snapshotId)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to look up snapshot: %v", err)
+	}
+	if !exists {
+		return status.Errorf(codes.NotFound, "snapshot not found: %s", snapshotId)
+	}
+
+	vmNames, warmPools := s.snapshotUsers(snapshotId)
+	if !force {
+		if len(vmNames) > 0 {
+			return status.Errorf(codes.FailedPrecondition, "snapshot is used by vms: %s", strings.Join(vmNames, ", "))
+		}
+		if len(warmPools) > 0 {
+			return status.Errorf(codes.FailedPrecondition, "snapshot is used by warm pools: %s", strings.Join(warmPools, ", "))
+		}
+	}
+
+	if err := s.removeSnapshot(ctx, snapshotId); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete snapshot: %v", err)
+	}
+	s.forgetSnapshot(snapshotId)
+	logger.Info("deleted snapshot")
+	return nil
+}
+
+// forgetSnapshot drops the deleted snapshot `snapshotId` from the VMs referencing it, so that
+// crashed VMs aren't restored from it and it isn't listed as a checkpoint anymore.
+func (s *Server) forgetSnapshot(snapshotId string) {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	changed := false
+	for _, vm := range vms {
+		vm.lock.Lock()
+		if vm.lastSnapshotId == snapshotId {
+			vm.lastSnapshotId = ""
+			changed = true
+		}
+		checkpoints := slices.DeleteFunc(vm.checkpoints, func(c checkpoint) bool {
+			return c.SnapshotId == snapshotId
+		})
+		if len(checkpoints) != len(vm.checkpoints) {
+			vm.checkpoints = checkpoints
+			changed = true
+		}
+		vm.lock.Unlock()
+	}
+	if changed {
+		s.persistVMRegistry()
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	snapshotStoreTypeLocal = "local"
+	snapshotStoreTypeS3    = "s3"
+	// Prefix of the directories snapshots are copied into before they're complete.
+	snapshotFetchDirPrefix = ".fetch-"
+	snapshotPutDirPrefix   = ".put-"
+)
+
+// SnapshotStore keeps snapshots durably. Snapshots are taken into, and restored from, their
+// directory in the local snapshots directory, which caches the store.
+type SnapshotStore interface {
+	// Put stores the files of the snapshot directory `dirPath` as the snapshot `snapshotId`.
+	Put(ctx context.Context, snapshotId string, dirPath string) error
+	// Get writes the files of the snapshot `snapshotId` into the empty directory `dirPath`.
+	Get(ctx context.Context, snapshotId string, dirPath string) error
+	// Exists returns whether the snapshot `snapshotId` is stored.
+	Exists(ctx context.Context, snapshotId string) (bool, error)
+	// List returns the IDs of the stored snapshots.
+	List(ctx context.Context) ([]string, error)
+	// Delete deletes the snapshot `snapshotId`. Deleting a snapshot that isn't stored succeeds.
+	Delete(ctx context.Context, snapshotId string) error
+}
+
+func newSnapshotStore(serverConfig config.ServerConfig) (SnapshotStore, error) {
+	storeConfig := serverConfig.SnapshotStore
+	switch storeConfig.Type {
+	case "", snapshotStoreTypeLocal:
+		dir := storeConfig.Dir
+		if dir == "" {
+			dir = path.Join(serverConfig.StateDir, snapshotsDirName)
+		}
+		return newLocalSnapshotStore(dir)
+	case snapshotStoreTypeS3:
+		return newS3SnapshotStore(storeConfig.S3)
+	default:
+		return nil, fmt.Errorf("unknown snapshot store type: %s", storeConfig.Type)
+	}
+}
+
+// localSnapshotStore keeps snapshots in a directory of the host, e.g. on a network file system.
+// With the default directory the store and the local snapshots directory are the same.
+type localSnapshotStore struct {
+	dir string
+}
+
+func newLocalSnapshotStore(dir string) (*localSnapshotStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve snapshot store dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot store dir: %w", err)
+	}
+	return &localSnapshotStore{dir: dir}, nil
+}
+
+func (ls *localSnapshotStore) snapshotPath(snapshotId string) string {
+	return path.Join(ls.dir, snapshotId)
+}
+
+// isSnapshotPath returns whether `dirPath` is where the store keeps `snapshotId`, in which case
+// there is nothing to copy.
+func (ls *localSnapshotStore) isSnapshotPath(snapshotId string, dirPath string) bool {
+	absPath, err := filepath.Abs(dirPath)
+	return err == nil && absPath == ls.snapshotPath(snapshotId)
+}
+
+func (ls *localSnapshotStore) Put(ctx context.Context, snapshotId string, dirPath string) error {
+	if ls.isSnapshotPath(snapshotId, dirPath) {
+		return nil
+	}
+
+	return createSnapshotDir(ls.snapshotPath(snapshotId), snapshotPutDirPrefix, func(putPath string) error {
+		return copySnapshotFiles(ctx, dirPath, putPath)
+	})
+}
+
+func (ls *localSnapshotStore) Get(ctx context.Context, snapshotId string, dirPath string) error {
+	if ls.isSnapshotPath(snapshotId, dirPath) {
+		return nil
+	}
+	return copySnapshotFiles(ctx, ls.snapshotPath(snapshotId), dirPath)
+}
+
+func (ls *localSnapshotStore) Exists(ctx context.Context, snapshotId string) (bool, error) {
+	info, err := os.Stat(ls.snapshotPath(snapshotId))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (ls *localSnapshotStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshotIds := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			snapshotIds = append(snapshotIds, entry.Name())
+		}
+	}
+	return snapshotIds, nil
+}
+
+func (ls *localSnapshotStore) Delete(ctx context.Context, snapshotId string) error {
+	return os.RemoveAll(ls.snapshotPath(snapshotId))
+}
+
+// createSnapshotDir creates the snapshot directory `snapshotPath` with the files `fill` writes into
+// the directory it's passed. They're written into a temporary directory named with `prefix` next to
+// `snapshotPath`, so that renaming it is atomic and the snapshot is never seen incomplete, as
+// directories starting with "." aren't listed as snapshots. Errors of `fill` are returned as is.
+func createSnapshotDir(snapshotPath string, prefix string, fill func(dirPath string) error) error {
+	if err := os.MkdirAll(path.Dir(snapshotPath), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshots directory: %w", err)
+	}
+	tmpPath, err := os.MkdirTemp(path.Dir(snapshotPath), prefix)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	if err := fill(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return fmt.Errorf("failed to rename snapshot directory: %w", err)
+	}
+	return nil
+}
+
+// copySnapshotFiles copies the files of the snapshot directory `sourcePath` to the directory
+// `destPath`, reflinking them where possible.
+func copySnapshotFiles(ctx context.Context, sourcePath string, destPath string) error {
+	entries, err := os.ReadDir(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := cloneDiskFile(path.Join(sourcePath, entry.Name()), path.Join(destPath, entry.Name())); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// isSnapshotCached returns whether the snapshot `snapshotId` is in the local snapshots directory.
+func (s *Server) isSnapshotCached(snapshotId string) bool {
+	info, err := os.Stat(s.getSnapshotPath(snapshotId))
+	return err == nil && info.IsDir()
+}
+
+// snapshotExists returns whether the snapshot `snapshotId` is stored or in the local snapshots
+// directory.
+func (s *Server) snapshotExists(ctx context.Context, snapshotId string) (bool, error) {
+	if s.isSnapshotCached(snapshotId) {
+		return true, nil
+	}
+	return s.snapshotStore.Exists(ctx, snapshotId)
+}
+
+// fetchSnapshot makes sure the snapshot `snapshotId` is in the local snapshots directory, fetching
+// it from the snapshot store if needed, and returns its path.
+func (s *Server) fetchSnapshot(ctx context.Context, snapshotId string) (string, error) {
+	snapshotPath := s.getSnapshotPath(snapshotId)
+	if s.isSnapshotCached(snapshotId) {
+		return snapshotPath, nil
+	}
+
+	// Serialized so that VMs restored from the same snapshot at once, e.g. by a warm pool, fetch it
+	// once.
+	s.snapshotFetchLock.Lock()
+	defer s.snapshotFetchLock.Unlock()
+	if s.isSnapshotCached(snapshotId) {
+		return snapshotPath, nil
+	}
+
+	exists, err := s.snapshotStore.Exists(ctx, snapshotId)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to look up snapshot: %v", err)
+	}
+	if !exists {
+		return "", status.Errorf(codes.NotFound, "snapshot not found: %s", snapshotId)
+	}
+
+	reportProgress(ctx, "fetching snapshot")
+	err = createSnapshotDir(snapshotPath, snapshotFetchDirPrefix, func(fetchPath string) error {
+		return s.snapshotStore.Get(ctx, snapshotId, fetchPath)
+	})
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to fetch snapshot: %v", err)
+	}
+	return snapshotPath, nil
+}
+
+// removeSnapshot deletes the snapshot `snapshotId` from the snapshot store and the local snapshots
+// directory.
+func (s *Server) removeSnapshot(ctx context.Context, snapshotId string) error {
+	if err := s.snapshotStore.Delete(ctx, snapshotId); err != nil {
+		return fmt.Errorf("failed to delete snapshot from store: %w", err)
+	}
+	if err := os.RemoveAll(s.getSnapshotPath(snapshotId)); err != nil {
+		return fmt.Errorf("failed to delete cached snapshot: %w", err)
+	}
+	return nil
+}
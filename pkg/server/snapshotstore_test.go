@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateSnapshotDir(t *testing.T) {
+	snapshotsDir := filepath.Join(t.TempDir(), snapshotsDirName)
+	snapshotPath := filepath.Join(snapshotsDir, "snap")
+	fill := func(dirPath string) error {
+		return os.WriteFile(filepath.Join(dirPath, "config.json"), []byte("{}"), 0644)
+	}
+
+	fillErr := errors.New("fill failed")
+	err := createSnapshotDir(snapshotPath, snapshotFetchDirPrefix, func(dirPath string) error {
+		if err := fill(dirPath); err != nil {
+			return err
+		}
+		return fillErr
+	})
+	if err != fillErr {
+		t.Errorf("createSnapshotDir() = %v, want the error of fill", err)
+	}
+	entries, err := os.ReadDir(snapshotsDir)
+	if err != nil {
+		t.Fatalf("failed to read snapshots dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("failed snapshot left %d entries behind", len(entries))
+	}
+
+	if err := createSnapshotDir(snapshotPath, snapshotFetchDirPrefix, fill); err != nil {
+		t.Fatalf("createSnapshotDir() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(snapshotPath, "config.json")); err != nil {
+		t.Errorf("snapshot wasn't created: %v", err)
+	}
+
+	// An existing snapshot isn't replaced.
+	if err := createSnapshotDir(snapshotPath, snapshotFetchDirPrefix, fill); err == nil {
+		t.Errorf("createSnapshotDir() replaced an existing snapshot")
+	}
+	entries, err = os.ReadDir(snapshotsDir)
+	if err != nil {
+		t.Fatalf("failed to read snapshots dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d entries in snapshots dir, want only the snapshot", len(entries))
+	}
+}
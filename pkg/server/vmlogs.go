@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// File in the VM's state directory the VMM's output and the serial console are written to.
+	vmLogFilename = "log"
+	// How often a followed log is checked for new output.
+	vmLogPollInterval = 250 * time.Millisecond
+	// Size of the chunks a log is read backwards in to find its last lines.
+	vmLogTailChunkSize = 64 * 1024
+)
+
+func getVMLogPath(stateDirPath string) string {
+	return path.Join(stateDirPath, vmLogFilename)
+}
+
+func getRetainedVMLogPath(logsDir string, vmName string) string {
+	return path.Join(logsDir, vmName+".log")
+}
+
+// retainVMLog keeps the log of the VM `vmName` at `logPath` in the configured logs directory, if
+// any, so that it outlives the VM. The log is hard linked where possible so that output written
+// while the VM is destroyed still ends up in the kept log.
+func (s *Server) retainVMLog(vmName string, logPath string) {
+	logsDir := s.config.VMLogsDir
+	if logsDir == "" {
+		return
+	}
+
+	logger := log.WithField("vmName", vmName)
+	if err := os.MkdirAll(logsDir, 0755); err != nil {
+		logger.WithError(err).Warn("failed to create VM logs directory")
+		return
+	}
+	retainedPath := getRetainedVMLogPath(logsDir, vmName)
+	if err := os.Remove(retainedPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.WithError(err).Warnf("failed to remove previous log: %s", retainedPath)
+		return
+	}
+	if err := linkOrCopyFile(logPath, retainedPath); err != nil {
+		logger.WithError(err).Warn("failed to keep VM log")
+		return
+	}
+	logger.WithField("path", retainedPath).Info("kept VM log")
+}
+
+// VMLog is the log of a VM opened to be streamed.
+type VMLog struct {
+	file *os.File
+	// VM writing to the log, nil for the kept log of a destroyed VM.
+	vm     *vm
+	follow bool
+}
+
+// OpenVMLog opens the log of the VM `vmName`, holding the output of its VMM and its serial console,
+// positioned at its last `tail` lines or its start if `tail` is negative. With `follow` the log is
+// streamed until the VMM exits. The kept log of a destroyed VM is opened if there is one.
+func (s *Server) OpenVMLog(ctx context.Context, vmName string, tail int, follow bool) (*VMLog, error) {
+	var logPath string
+	vm := s.getVMAtomic(vmName)
+	if vm != nil {
+		vm.lock.RLock()
+		logPath = getVMLogPath(vm.stateDirPath)
+		vm.lock.RUnlock()
+	} else if s.config.VMLogsDir != "" {
+		logPath = getRetainedVMLogPath(s.config.VMLogsDir, vmName)
+	} else {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	file, err := os.Open(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "log of vm not found: %s", vmName)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to open log: %v", err)
+	}
+
+	if tail >= 0 {
+		offset, err := findLastLines(file, tail)
+		if err != nil {
+			file.Close()
+			return nil, status.Errorf(codes.Internal, "failed to read log: %v", err)
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, status.Errorf(codes.Internal, "failed to read log: %v", err)
+		}
+	}
+	return &VMLog{file: file, vm: vm, follow: follow && vm != nil}, nil
+}
+
+// findLastLines returns the offset of the last `n` lines of `file`. A final line without a newline
+// counts as a line.
+func findLastLines(file *os.File, n int) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := info.Size()
+	if n == 0 {
+		return end, nil
+	}
+	buf := make([]byte, vmLogTailChunkSize)
+	// The newline ending the last line doesn't start a line.
+	newlines := -1
+	for end > 0 {
+		start := max(end-vmLogTailChunkSize, 0)
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if end == info.Size() && chunk[len(chunk)-1] != '\n' {
+			newlines = 0
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				continue
+			}
+			newlines++
+			if newlines == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// Write copies the log to `w` and, if the log is followed, keeps copying output as it's written
+// until `ctx` is done or the VMM exits. `flush` is called whenever output was copied.
+func (l *VMLog) Write(ctx context.Context, w io.Writer, flush func()) error {
+	if err := l.copy(w, flush); err != nil || !l.follow {
+		return err
+	}
+
+	ticker := time.NewTicker(vmLogPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-l.vm.exited:
+			// Copy what the VMM wrote before exiting.
+			return l.copy(w, flush)
+		case <-ticker.C:
+		}
+		if err := l.copy(w, flush); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *VMLog) copy(w io.Writer, flush func()) error {
+	n, err := io.Copy(w, l.file)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		flush()
+	}
+	return nil
+}
+
+// Close closes the log.
+func (l *VMLog) Close() error {
+	return l.file.Close()
+}
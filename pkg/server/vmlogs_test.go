@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, content string) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestFindLastLines(t *testing.T) {
+	tests := []struct {
+		content string
+		n       int
+		want    string
+	}{
+		{content: "", n: 3, want: ""},
+		{content: "a\nb\nc\n", n: 0, want: ""},
+		{content: "a\nb\nc\n", n: 1, want: "c\n"},
+		{content: "a\nb\nc\n", n: 2, want: "b\nc\n"},
+		{content: "a\nb\nc\n", n: 3, want: "a\nb\nc\n"},
+		{content: "a\nb\nc\n", n: 10, want: "a\nb\nc\n"},
+		{content: "a\nb\nc", n: 1, want: "c"},
+		{content: "a\nb\nc", n: 2, want: "b\nc"},
+		{content: "a\n\n\nb\n", n: 3, want: "\n\nb\n"},
+		{content: "\n", n: 1, want: "\n"},
+	}
+	for _, test := range tests {
+		file := writeTestFile(t, test.content)
+		offset, err := findLastLines(file, test.n)
+		if err != nil {
+			t.Fatalf("findLastLines(%q, %d) failed: %v", test.content, test.n, err)
+		}
+		if got := test.content[offset:]; got != test.want {
+			t.Errorf("findLastLines(%q, %d) = %q, want %q", test.content, test.n, got, test.want)
+		}
+	}
+}
+
+func TestFindLastLinesAcrossChunks(t *testing.T) {
+	// Lines of 100 bytes, spanning several chunks.
+	var lines []string
+	for i := 0; i < 3*vmLogTailChunkSize/100; i++ {
+		lines = append(lines, fmt.Sprintf("%099d", i))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	file := writeTestFile(t, content)
+
+	for _, n := range []int{1, vmLogTailChunkSize / 100, vmLogTailChunkSize/100 + 1, len(lines) - 1, len(lines)} {
+		offset, err := findLastLines(file, n)
+		if err != nil {
+			t.Fatalf("findLastLines(%d) failed: %v", n, err)
+		}
+		if want := strings.Join(lines[len(lines)-n:], "\n") + "\n"; content[offset:] != want {
+			t.Errorf("findLastLines(%d) returned offset %d, want %d", n, offset, len(content)-len(want))
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Directory in the state directory holding the volumes.
+	volumesDirName = "volumes"
+	// Every volume is an ext4 image with its metadata next to it.
+	volumeImageSuffix    = ".img"
+	volumeMetadataSuffix = ".json"
+)
+
+// How a volume is attached to a VM.
+const (
+	// The volume is the VM's stateful disk, i.e. the writable upper layer of its root filesystem.
+	volumeAttachModeRoot = "root"
+	// The volume is an extra disk mounted at /mnt/disks/<name> in the guest.
+	volumeAttachModeDisk = "disk"
+)
+
+// volume is a disk whose lifecycle is independent of the VMs it's attached to.
+type volume struct {
+	Name      string    `json:"name"`
+	SizeMB    int32     `json:"sizeMB"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type volumeAttachment struct {
+	vmName   string
+	mode     string
+	readonly bool
+}
+
+// volumeStore manages the volumes and tracks which VMs they're attached to. A volume can be
+// attached read-write to a single VM or read-only to any number of VMs.
+type volumeStore struct {
+	lock        sync.Mutex
+	dir         string
+	volumes     map[string]*volume
+	attachments map[string][]volumeAttachment
+}
+
+func newVolumeStore(stateDir string) (*volumeStore, error) {
+	dir := path.Join(stateDir, volumesDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volumes dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volumes dir: %w", err)
+	}
+
+	vs := &volumeStore{
+		dir:         dir,
+		volumes:     make(map[string]*volume),
+		attachments: make(map[string][]volumeAttachment),
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), volumeMetadataSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read volume metadata: %w", err)
+		}
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("failed to parse volume metadata %s: %w", entry.Name(), err)
+		}
+		vs.volumes[v.Name] = &v
+	}
+	return vs, nil
+}
+
+func (vs *volumeStore) imagePath(name string) string {
+	return path.Join(vs.dir, name+volumeImageSuffix)
+}
+
+func (vs *volumeStore) metadataPath(name string) string {
+	return path.Join(vs.dir, name+volumeMetadataSuffix)
+}
+
+func (vs *volumeStore) create(name string, sizeMB int32) (*volume, error) {
+	// Volume names double as disk IDs when attached as extra disks.
+	if !cmdserver.IsValidDiskId(name) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"invalid volume name %q: up to 20 lowercase alphanumerics and '-'",
+			name,
+		)
+	}
+	if sizeMB <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "sizeMB must be positive")
+	}
+
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	if _, ok := vs.volumes[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "volume already exists: %s", name)
+	}
+
+	imagePath := vs.imagePath(name)
+	if err := createStatefulDisk(imagePath, sizeMB); err != nil {
+		os.Remove(imagePath)
+		return nil, status.Errorf(codes.Internal, "failed to create volume: %v", err)
+	}
+
+	v := &volume{
+		Name:      name,
+		SizeMB:    sizeMB,
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		os.Remove(imagePath)
+		return nil, status.Errorf(codes.Internal, "failed to marshal volume metadata: %v", err)
+	}
+	if err := os.WriteFile(vs.metadataPath(name), data, 0644); err != nil {
+		os.Remove(imagePath)
+		return nil, status.Errorf(codes.Internal, "failed to write volume metadata: %v", err)
+	}
+
+	vs.volumes[name] = v
+	return v, nil
+}
+
+func (vs *volumeStore) delete(name string) error {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	if _, ok := vs.volumes[name]; !ok {
+		return status.Errorf(codes.NotFound, "volume not found: %s", name)
+	}
+	if len(vs.attachments[name]) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "volume is attached to vm: %s", vs.attachments[name][0].vmName)
+	}
+
+	// The metadata goes first so that a half deleted volume doesn't show up again.
+	if err := os.Remove(vs.metadataPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return status.Errorf(codes.Internal, "failed to delete volume metadata: %v", err)
+	}
+	delete(vs.volumes, name)
+	if err := os.Remove(vs.imagePath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithField("volume", name).WithError(err).Warn("failed to delete volume image")
+	}
+	return nil
+}
+
+// attach records that `vmName` uses the volume `name` and returns its image path. Fails if the
+// volume is attached read-write elsewhere, or anywhere when attaching it read-write.
+func (vs *volumeStore) attach(name string, vmName string, mode string, readonly bool) (string, error) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	if _, ok := vs.volumes[name]; !ok {
+		return "", status.Errorf(codes.NotFound, "volume not found: %s", name)
+	}
+	for _, attachment := range vs.attachments[name] {
+		if attachment.vmName == vmName {
+			return "", status.Errorf(codes.AlreadyExists, "volume %s is already attached to vm: %s", name, vmName)
+		}
+		if !readonly || !attachment.readonly {
+			return "", status.Errorf(
+				codes.FailedPrecondition,
+				"volume %s is attached read-write to vm: %s",
+				name,
+				attachment.vmName,
+			)
+		}
+	}
+
+	vs.attachments[name] = append(vs.attachments[name], volumeAttachment{
+		vmName:   vmName,
+		mode:     mode,
+		readonly: readonly,
+	})
+	return vs.imagePath(name), nil
+}
+
+// detach undoes `attach`.
+func (vs *volumeStore) detach(name string, vmName string) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	attachments := vs.attachments[name]
+	for i, attachment := range attachments {
+		if attachment.vmName == vmName {
+			attachments = append(attachments[:i], attachments[i+1:]...)
+			break
+		}
+	}
+	if len(attachments) == 0 {
+		delete(vs.attachments, name)
+	} else {
+		vs.attachments[name] = attachments
+	}
+}
+
+// detachVM detaches all volumes from `vmName`.
+func (vs *volumeStore) detachVM(vmName string) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	for name, attachments := range vs.attachments {
+		kept := attachments[:0]
+		for _, attachment := range attachments {
+			if attachment.vmName != vmName {
+				kept = append(kept, attachment)
+			}
+		}
+		if len(kept) == 0 {
+			delete(vs.attachments, name)
+		} else {
+			vs.attachments[name] = kept
+		}
+	}
+}
+
+// toAPILocked returns the volume `v` as reported by the API. Expects `vs.lock` to be held.
+func (vs *volumeStore) toAPILocked(v *volume) serverapi.Volume {
+	attachments := make([]serverapi.VolumeAttachment, 0, len(vs.attachments[v.Name]))
+	for _, attachment := range vs.attachments[v.Name] {
+		attachments = append(attachments, serverapi.VolumeAttachment{
+			VmName:   serverapi.PtrString(attachment.vmName),
+			Mode:     serverapi.PtrString(attachment.mode),
+			Readonly: serverapi.PtrBool(attachment.readonly),
+		})
+	}
+	return serverapi.Volume{
+		Name:        serverapi.PtrString(v.Name),
+		SizeMB:      serverapi.PtrInt32(v.SizeMB),
+		CreatedAt:   serverapi.PtrTime(v.CreatedAt),
+		Attachments: attachments,
+	}
+}
+
+// claimVolumes re-records the volume attachments of `vm`, e.g. one adopted from a previous server
+// instance.
+func (s *Server) claimVolumes(vm *vm) {
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+
+	logger := log.WithField("vmName", vm.name)
+	if vm.rootVolume != "" {
+		if _, err := s.volumes.attach(vm.rootVolume, vm.name, volumeAttachModeRoot, false); err != nil {
+			logger.WithError(err).Warnf("failed to claim root volume: %s", vm.rootVolume)
+		}
+	}
+	for _, disk := range vm.disks {
+		if disk.volume == "" {
+			continue
+		}
+		if _, err := s.volumes.attach(disk.volume, vm.name, volumeAttachModeDisk, disk.readonly); err != nil {
+			logger.WithError(err).Warnf("failed to claim volume: %s", disk.volume)
+		}
+	}
+}
+
+// attachVolumes hot-plugs the volumes `mounts` into `vm` as extra disks.
+func (s *Server) attachVolumes(ctx context.Context, vm *vm, mounts []serverapi.VolumeMount) error {
+	for _, mount := range mounts {
+		_, err := s.AttachDisk(ctx, vm.name, &serverapi.AttachDiskRequest{
+			Id:       mount.GetName(),
+			Volume:   serverapi.PtrString(mount.GetName()),
+			Readonly: serverapi.PtrBool(mount.GetReadonly()),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to attach volume %s: %w", mount.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// CreateVolume creates an empty ext4 volume.
+func (s *Server) CreateVolume(ctx context.Context, req *serverapi.CreateVolumeRequest) (*serverapi.Volume, error) {
+	log.WithField("volume", req.GetName()).Infof("received request to create volume of %d MB", req.GetSizeMB())
+	v, err := s.volumes.create(req.GetName(), req.GetSizeMB())
+	if err != nil {
+		return nil, err
+	}
+
+	s.volumes.lock.Lock()
+	defer s.volumes.lock.Unlock()
+	apiVolume := s.volumes.toAPILocked(v)
+	return &apiVolume, nil
+}
+
+// GetVolume returns a volume and the VMs it's attached to.
+func (s *Server) GetVolume(ctx context.Context, name string) (*serverapi.Volume, error) {
+	s.volumes.lock.Lock()
+	defer s.volumes.lock.Unlock()
+
+	v, ok := s.volumes.volumes[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume not found: %s", name)
+	}
+	apiVolume := s.volumes.toAPILocked(v)
+	return &apiVolume, nil
+}
+
+// ListVolumes returns all volumes sorted by name.
+func (s *Server) ListVolumes(ctx context.Context) (*serverapi.ListVolumesResponse, error) {
+	s.volumes.lock.Lock()
+	defer s.volumes.lock.Unlock()
+
+	volumes := make([]serverapi.Volume, 0, len(s.volumes.volumes))
+	for _, v := range s.volumes.volumes {
+		volumes = append(volumes, s.volumes.toAPILocked(v))
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].GetName() < volumes[j].GetName()
+	})
+	return &serverapi.ListVolumesResponse{
+		Volumes: volumes,
+	}, nil
+}
+
+// DeleteVolume deletes a volume that isn't attached to any VM.
+func (s *Server) DeleteVolume(ctx context.Context, name string) error {
+	log.WithField("volume", name).Info("received request to delete volume")
+	return s.volumes.delete(name)
+}
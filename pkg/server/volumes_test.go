@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func newTestVolumeStore(t *testing.T, names ...string) *volumeStore {
+	t.Helper()
+	vs, err := newVolumeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newVolumeStore() failed: %v", err)
+	}
+	for _, name := range names {
+		vs.volumes[name] = &volume{Name: name, SizeMB: 16}
+	}
+	return vs
+}
+
+func TestVolumeStoreAttach(t *testing.T) {
+	type attach struct {
+		vmName   string
+		readonly bool
+		wantCode codes.Code
+	}
+	tests := []struct {
+		name     string
+		attaches []attach
+	}{
+		{
+			name: "read-write once",
+			attaches: []attach{
+				{vmName: "vm1", wantCode: codes.OK},
+				{vmName: "vm2", wantCode: codes.FailedPrecondition},
+				{vmName: "vm2", readonly: true, wantCode: codes.FailedPrecondition},
+			},
+		},
+		{
+			name: "read-only many times",
+			attaches: []attach{
+				{vmName: "vm1", readonly: true, wantCode: codes.OK},
+				{vmName: "vm2", readonly: true, wantCode: codes.OK},
+				{vmName: "vm3", wantCode: codes.FailedPrecondition},
+			},
+		},
+		{
+			name: "same VM twice",
+			attaches: []attach{
+				{vmName: "vm1", readonly: true, wantCode: codes.OK},
+				{vmName: "vm1", readonly: true, wantCode: codes.AlreadyExists},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vs := newTestVolumeStore(t, "data")
+			for i, attach := range test.attaches {
+				imagePath, err := vs.attach("data", attach.vmName, volumeAttachModeDisk, attach.readonly)
+				if attach.wantCode == codes.OK {
+					if err != nil {
+						t.Fatalf("attach %d failed: %v", i, err)
+					}
+					if imagePath != vs.imagePath("data") {
+						t.Errorf("attach %d returned %s, want %s", i, imagePath, vs.imagePath("data"))
+					}
+					continue
+				}
+				checkCode(t, err, attach.wantCode)
+			}
+		})
+	}
+}
+
+func TestVolumeStoreAttachMissing(t *testing.T) {
+	vs := newTestVolumeStore(t)
+	_, err := vs.attach("data", "vm1", volumeAttachModeRoot, false)
+	checkCode(t, err, codes.NotFound)
+}
+
+func TestVolumeStoreDetach(t *testing.T) {
+	vs := newTestVolumeStore(t, "data", "logs")
+	if _, err := vs.attach("data", "vm1", volumeAttachModeRoot, false); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := vs.attach("logs", "vm1", volumeAttachModeDisk, true); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := vs.attach("logs", "vm2", volumeAttachModeDisk, true); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	checkCode(t, vs.delete("data"), codes.FailedPrecondition)
+	vs.detach("data", "vm1")
+	if _, err := vs.attach("data", "vm2", volumeAttachModeDisk, false); err != nil {
+		t.Errorf("attach after detach failed: %v", err)
+	}
+
+	vs.detachVM("vm2")
+	if len(vs.attachments["data"]) != 0 {
+		t.Errorf("data is still attached: %v", vs.attachments["data"])
+	}
+	if got := vs.attachments["logs"]; len(got) != 1 || got[0].vmName != "vm1" {
+		t.Errorf("attachments of logs = %v, want only vm1", got)
+	}
+}
+
+func TestNewVolumeStoreLoadsVolumes(t *testing.T) {
+	stateDir := t.TempDir()
+	vs, err := newVolumeStore(stateDir)
+	if err != nil {
+		t.Fatalf("newVolumeStore() failed: %v", err)
+	}
+	want := volume{Name: "data", SizeMB: 64, CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("failed to marshal volume: %v", err)
+	}
+	if err := os.WriteFile(vs.metadataPath("data"), data, 0644); err != nil {
+		t.Fatalf("failed to write volume metadata: %v", err)
+	}
+	// Images without metadata are left over from volumes that were being deleted.
+	if err := os.WriteFile(filepath.Join(vs.dir, "gone"+volumeImageSuffix), nil, 0644); err != nil {
+		t.Fatalf("failed to write volume image: %v", err)
+	}
+
+	vs, err = newVolumeStore(stateDir)
+	if err != nil {
+		t.Fatalf("newVolumeStore() failed: %v", err)
+	}
+	if len(vs.volumes) != 1 {
+		t.Fatalf("got %d volumes, want 1", len(vs.volumes))
+	}
+	if got := vs.volumes["data"]; got == nil || !got.CreatedAt.Equal(want.CreatedAt) || got.SizeMB != want.SizeMB {
+		t.Errorf("volume = %+v, want %+v", got, want)
+	}
+}
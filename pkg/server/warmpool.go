@@ -0,0 +1,406 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	// Names of VMs in a warm pool start with this prefix. They are hidden from the VM listing and
+	// renamed when handed out.
+	warmPoolVMNamePrefix = "warmpool-"
+	// How long to wait before retrying to refill a pool after a VM failed to boot.
+	warmPoolRefillRetryInterval = 30 * time.Second
+)
+
+// warmPoolKey identifies what the VMs of a pool are booted from.
+type warmPoolKey struct {
+	kernelPath    string
+	initramfsPath string
+	rootfsPath    string
+	snapshotId    string
+}
+
+// warmPool holds VMs that are booted ahead of time so that `StartVM` can hand them out without
+// waiting for a boot.
+type warmPool struct {
+	name    string
+	key     warmPoolKey
+	size    int
+	ready   []*vm
+	booting int
+}
+
+type warmPools struct {
+	lock   sync.Mutex
+	pools  []*warmPool
+	refill chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newWarmPools returns the warm pools in `serverConfig`. The pools are empty until `startWarmPools`
+// is called.
+func newWarmPools(serverConfig config.ServerConfig) (*warmPools, error) {
+	wp := &warmPools{
+		refill: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	names := make(map[string]bool, len(serverConfig.WarmPools))
+	for _, poolConfig := range serverConfig.WarmPools {
+		if poolConfig.Name == "" {
+			return nil, fmt.Errorf("warm pool name is required")
+		}
+		if names[poolConfig.Name] {
+			return nil, fmt.Errorf("duplicate warm pool: %s", poolConfig.Name)
+		}
+		names[poolConfig.Name] = true
+
+		if poolConfig.Size < 0 {
+			return nil, fmt.Errorf("invalid size of warm pool %s: %d", poolConfig.Name, poolConfig.Size)
+		}
+
+		key := warmPoolKey{snapshotId: poolConfig.SnapshotId}
+		if key.snapshotId == "" {
+			key.kernelPath = poolConfig.KernelPath
+			if key.kernelPath == "" {
+				key.kernelPath = serverConfig.KernelPath
+			}
+			key.initramfsPath = poolConfig.InitramfsPath
+			if key.initramfsPath == "" {
+				key.initramfsPath = serverConfig.InitramfsPath
+			}
+			key.rootfsPath = poolConfig.RootfsPath
+			if key.rootfsPath == "" {
+				key.rootfsPath = serverConfig.RootfsPath
+			}
+		}
+
+		wp.pools = append(wp.pools, &warmPool{
+			name: poolConfig.Name,
+			key:  key,
+			size: int(poolConfig.Size),
+		})
+	}
+	return wp, nil
+}
+
+// findLocked returns the first pool matching `key` or nil. Expects `wp.lock` to be held.
+func (wp *warmPools) findLocked(key warmPoolKey) *warmPool {
+	for _, pool := range wp.pools {
+		if pool.key == key {
+			return pool
+		}
+	}
+	return nil
+}
+
+// triggerRefill wakes up the refiller without blocking.
+func (wp *warmPools) triggerRefill() {
+	select {
+	case wp.refill <- struct{}{}:
+	default:
+	}
+}
+
+// remove drops `vm` from the pool it's waiting in, if any.
+func (wp *warmPools) remove(vm *vm) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	for _, pool := range wp.pools {
+		for i, readyVM := range pool.ready {
+			if readyVM == vm {
+				pool.ready = append(pool.ready[:i], pool.ready[i+1:]...)
+				wp.triggerRefill()
+				return
+			}
+		}
+	}
+}
+
+func isWarmPoolVMName(vmName string) bool {
+	return strings.HasPrefix(vmName, warmPoolVMNamePrefix)
+}
+
+func newWarmPoolVMName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate VM name: %w", err)
+	}
+	return warmPoolVMNamePrefix + hex.EncodeToString(suffix), nil
+}
+
+// startWarmPools puts the warm pool VMs adopted from a previous server instance back into their
+// pools and starts refilling the pools in the background.
+func (s *Server) startWarmPools() {
+	var unclaimed []string
+	s.lock.RLock()
+	s.warmPools.lock.Lock()
+	for _, vm := range s.vms {
+		if !isWarmPoolVMName(vm.name) {
+			continue
+		}
+
+		var pool *warmPool
+		for _, p := range s.warmPools.pools {
+			if p.name == vm.warmPool {
+				pool = p
+				break
+			}
+		}
+		if pool == nil || len(pool.ready) >= pool.size || vm.status != vmStatusRunning {
+			unclaimed = append(unclaimed, vm.name)
+			continue
+		}
+		pool.ready = append(pool.ready, vm)
+	}
+	s.warmPools.lock.Unlock()
+	s.lock.RUnlock()
+
+	for _, vmName := range unclaimed {
+		log.WithField("vmName", vmName).Info("destroying VM not needed by any warm pool")
+		if err := s.destroyVM(context.Background(), vmName); err != nil {
+			log.WithError(err).Errorf("failed to destroy warm pool VM: %s", vmName)
+		}
+	}
+
+	go s.runWarmPoolRefiller()
+	s.warmPools.triggerRefill()
+}
+
+// StopWarmPools stops refilling the warm pools. It waits for a VM being booted for a pool, if any.
+// The VMs in the pools are left running.
+func (s *Server) StopWarmPools() {
+	close(s.warmPools.stop)
+	<-s.warmPools.done
+}
+
+func (s *Server) runWarmPoolRefiller() {
+	defer close(s.warmPools.done)
+
+	ticker := time.NewTicker(warmPoolRefillRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.warmPools.stop:
+			return
+		case <-s.warmPools.refill:
+		case <-ticker.C:
+		}
+		s.fillWarmPools()
+	}
+}
+
+// fillWarmPools boots VMs until every pool is full. A pool whose VM fails to boot is retried on the
+// next call.
+func (s *Server) fillWarmPools() {
+	wp := s.warmPools
+	for _, pool := range wp.pools {
+		for {
+			select {
+			case <-wp.stop:
+				return
+			default:
+			}
+
+			wp.lock.Lock()
+			if len(pool.ready)+pool.booting >= pool.size {
+				wp.lock.Unlock()
+				break
+			}
+			pool.booting++
+			wp.lock.Unlock()
+
+			vm, err := s.bootWarmPoolVM(context.Background(), pool)
+
+			wp.lock.Lock()
+			pool.booting--
+			if err == nil {
+				pool.ready = append(pool.ready, vm)
+			}
+			wp.lock.Unlock()
+
+			if err != nil {
+				log.WithError(err).Errorf("failed to boot VM for warm pool: %s", pool.name)
+				break
+			}
+			s.persistVMRegistry()
+		}
+	}
+}
+
+// bootWarmPoolVM boots a VM for `pool` and waits for it to be ready to be handed out.
+func (s *Server) bootWarmPoolVM(ctx context.Context, pool *warmPool) (*vm, error) {
+	vmName, err := newWarmPoolVMName()
+	if err != nil {
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{"vmName": vmName, "warmPool": pool.name})
+	logger.Info("booting VM for warm pool")
+
+	var vm *vm
+	if pool.key.snapshotId != "" {
+		vm, err = s.restoreVM(ctx, vmName, "", nil, pool.key.snapshotId, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore VM from snapshot: %w", err)
+		}
+	} else {
+		resources, err := s.resolveVMResources(&serverapi.StartVMRequest{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve VM resources: %w", err)
+		}
+
+		vm, err = s.createVM(
+			ctx,
+			vmName,
+			"",
+			nil,
+			pool.key.kernelPath,
+			pool.key.initramfsPath,
+			pool.key.rootfsPath,
+			resources,
+			entryPoint{},
+			"",
+			false,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create VM: %w", err)
+		}
+
+		if err := vm.boot(ctx); err != nil {
+			if err := s.destroyVM(ctx, vmName); err != nil {
+				logger.WithError(err).Error("failed to destroy VM that failed to boot")
+			}
+			return nil, fmt.Errorf("failed to boot VM: %w", err)
+		}
+	}
+
+	// Unlike `StartVM` a VM that isn't ready is never handed out.
+	if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
+		if err := s.destroyVM(ctx, vmName); err != nil {
+			logger.WithError(err).Error("failed to destroy VM that isn't ready")
+		}
+		return nil, fmt.Errorf("command server not ready: %w", err)
+	}
+
+	vm.lock.Lock()
+	vm.warmPool = pool.name
+	vm.lock.Unlock()
+
+	logger.Info("VM ready in warm pool")
+	return vm, nil
+}
+
+// claimWarmPoolVM hands out a VM from the pool matching `key` to `tenant` by renaming it to
+// `vmName` and adding `labels` to it. Returns nil if there is no such pool, it's empty, `vmName` is
+// taken or the VM exceeds the tenant's quota.
+func (s *Server) claimWarmPoolVM(vmName string, tenant string, labels map[string]string, key warmPoolKey) *vm {
+	wp := s.warmPools
+	wp.lock.Lock()
+	pool := wp.findLocked(key)
+	if pool == nil || len(pool.ready) == 0 {
+		wp.lock.Unlock()
+		return nil
+	}
+	vm := pool.ready[0]
+	pool.ready = pool.ready[1:]
+	wp.lock.Unlock()
+
+	putBack := func() {
+		wp.lock.Lock()
+		pool.ready = append(pool.ready, vm)
+		wp.lock.Unlock()
+	}
+
+	// The quota error, if any, is returned when the caller falls back to creating a VM.
+	if err := s.admission.chargeTenant(tenant, vm.resources); err != nil {
+		putBack()
+		return nil
+	}
+
+	s.lock.Lock()
+	if _, exists := s.vms[vmName]; exists {
+		s.lock.Unlock()
+		s.admission.unchargeTenant(tenant, vm.resources)
+		putBack()
+		return nil
+	}
+
+	oldName := vm.name
+	delete(s.vms, oldName)
+	vm.lock.Lock()
+	vm.name = vmName
+	vm.warmPool = ""
+	vm.tenant = tenant
+	// VMs restored from a snapshot already carry the snapshot's labels.
+	vm.labels = mergeLabels(vm.labels, labels)
+	vm.lock.Unlock()
+	s.vms[vmName] = vm
+	s.lock.Unlock()
+
+	wp.triggerRefill()
+	s.publishEvent(EventTypeCreated, vm, nil)
+	log.WithFields(log.Fields{
+		"vmName":     vmName,
+		"warmPool":   pool.name,
+		"warmPoolVM": oldName,
+	}).Info("handed out VM from warm pool")
+	return vm
+}
+
+// startVMFromWarmPool hands out a VM from a warm pool for a request to start a new VM. Returns nil
+// if the request can't be served from a warm pool.
+func (s *Server) startVMFromWarmPool(
+	vmName string,
+	tenant string,
+	labels map[string]string,
+	req *serverapi.StartVMRequest,
+	key warmPoolKey,
+) *vm {
+	// VMs in warm pools are booted with the default resources, without an entry point and with a
+	// stateful disk of their own. Volumes are attached by `StartVM` to VMs it creates.
+	if req.GetEntryPoint() != "" ||
+		req.HasVcpus() ||
+		req.HasMemorySizeMB() ||
+		req.HasStatefulDiskSizeMB() ||
+		req.GetRootVolume() != "" ||
+		len(req.GetVolumes()) > 0 {
+		return nil
+	}
+	return s.claimWarmPoolVM(vmName, tenant, labels, key)
+}
+
+// ListWarmPools returns the configured warm pools and how full they are.
+func (s *Server) ListWarmPools(ctx context.Context) (*serverapi.ListWarmPoolsResponse, error) {
+	wp := s.warmPools
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	pools := make([]serverapi.WarmPool, 0, len(wp.pools))
+	for _, pool := range wp.pools {
+		pools = append(pools, serverapi.WarmPool{
+			Name:       serverapi.PtrString(pool.name),
+			Kernel:     serverapi.PtrString(pool.key.kernelPath),
+			Initramfs:  serverapi.PtrString(pool.key.initramfsPath),
+			Rootfs:     serverapi.PtrString(pool.key.rootfsPath),
+			SnapshotId: serverapi.PtrString(pool.key.snapshotId),
+			Size:       serverapi.PtrInt32(int32(pool.size)),
+			Ready:      serverapi.PtrInt32(int32(len(pool.ready))),
+			Booting:    serverapi.PtrInt32(int32(pool.booting)),
+		})
+	}
+	return &serverapi.ListWarmPoolsResponse{Pools: pools}, nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/fountain"
+)
+
+// newTestWarmPoolServer returns a server with a warm pool of kernel "vmlinux" holding one ready VM.
+func newTestWarmPoolServer(t *testing.T) (*Server, warmPoolKey) {
+	t.Helper()
+	serverConfig := config.ServerConfig{
+		KernelPath: "vmlinux",
+		RootfsPath: "rootfs.img",
+		WarmPools:  []config.WarmPoolConfig{{Name: "default", Size: 1}},
+	}
+	wp, err := newWarmPools(serverConfig)
+	if err != nil {
+		t.Fatalf("newWarmPools() failed: %v", err)
+	}
+	key := wp.pools[0].key
+	wp.pools[0].ready = []*vm{{
+		name:      warmPoolVMNamePrefix + "0",
+		warmPool:  "default",
+		resources: vmResources{vcpus: 1, memorySizeMB: 512},
+		tapDevice: &fountain.TapDevice{Name: "tap0"},
+	}}
+
+	s := &Server{
+		vms:       map[string]*vm{warmPoolVMNamePrefix + "0": wp.pools[0].ready[0]},
+		warmPools: wp,
+		admission: newAdmissionController(config.AdmissionConfig{}),
+		events:    newEventBroker(),
+	}
+	return s, key
+}
+
+func TestStartVMFromWarmPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     serverapi.StartVMRequest
+		claimed bool
+	}{
+		{name: "default", req: serverapi.StartVMRequest{}, claimed: true},
+		{name: "entry point", req: serverapi.StartVMRequest{EntryPoint: serverapi.PtrString("sleep 1")}},
+		{name: "vcpus", req: serverapi.StartVMRequest{Vcpus: serverapi.PtrInt32(2)}},
+		{name: "memory", req: serverapi.StartVMRequest{MemorySizeMB: serverapi.PtrInt32(1024)}},
+		{name: "stateful disk", req: serverapi.StartVMRequest{StatefulDiskSizeMB: serverapi.PtrInt32(1024)}},
+		{name: "root volume", req: serverapi.StartVMRequest{RootVolume: serverapi.PtrString("data")}},
+		{name: "volumes", req: serverapi.StartVMRequest{Volumes: []serverapi.VolumeMount{{Name: "data"}}}},
+	}
+	for _, test := range tests {
+		s, key := newTestWarmPoolServer(t)
+		vm := s.startVMFromWarmPool("vm1", defaultTenant, nil, &test.req, key)
+		if claimed := vm != nil; claimed != test.claimed {
+			t.Errorf("%s: startVMFromWarmPool() claimed a VM: %v, want %v", test.name, claimed, test.claimed)
+		}
+		if vm == nil {
+			continue
+		}
+		if vm.name != "vm1" || vm.warmPool != "" || vm.tenant != defaultTenant {
+			t.Errorf("%s: claimed VM is %q in pool %q of tenant %q", test.name, vm.name, vm.warmPool, vm.tenant)
+		}
+		if s.getVMAtomic("vm1") != vm {
+			t.Errorf("%s: claimed VM isn't registered under its new name", test.name)
+		}
+	}
+}